@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"ssh-gate/models"
+)
+
+const (
+	// auditCheckpointDirEnv каталог, в который периодически выгружаются контрольные точки журнала аудита.
+	// Пустое значение отключает выгрузку
+	auditCheckpointDirEnv = "SSH_GATE_AUDIT_CHECKPOINT_DIR"
+	// auditCheckpointIntervalEnv интервал выгрузки контрольных точек (по умолчанию 1h)
+	auditCheckpointIntervalEnv = "SSH_GATE_AUDIT_CHECKPOINT_INTERVAL"
+
+	defaultAuditCheckpointInterval = time.Hour
+)
+
+// loadAuditCheckpointConfig читает каталог и интервал выгрузки контрольных точек из окружения
+func loadAuditCheckpointConfig() (string, time.Duration, error) {
+	dir := os.Getenv(auditCheckpointDirEnv)
+	value := os.Getenv(auditCheckpointIntervalEnv)
+	if dir == "" || value == "" {
+		return dir, defaultAuditCheckpointInterval, nil
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return "", 0, fmt.Errorf("неверное значение %s: %s", auditCheckpointIntervalEnv, value)
+	}
+
+	return dir, interval, nil
+}
+
+// runAuditCheckpoints периодически выгружает контрольные точки журнала аудита в каталог dir,
+// пока не будет отменен контекст. Если новых записей не было, контрольная точка не выгружается
+func runAuditCheckpoints(ctx context.Context, database *sql.DB, key []byte, dir string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		checkpoint, err := models.NewAuditCheckpoint(database, key)
+		if err != nil {
+			log.Printf("Ошибка создания контрольной точки журнала аудита: %v", err)
+			continue
+		}
+
+		path := filepath.Join(dir, "audit-checkpoint-"+strconv.FormatInt(checkpoint.EventID, 10)+".json")
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+
+		if err := writeAuditCheckpoint(path, checkpoint); err != nil {
+			log.Printf("Ошибка выгрузки контрольной точки журнала аудита: %v", err)
+			continue
+		}
+		log.Printf("Выгружена контрольная точка журнала аудита: %s", path)
+	}
+}
+
+// writeAuditCheckpoint сохраняет контрольную точку журнала аудита в файл
+func writeAuditCheckpoint(path string, checkpoint *models.AuditCheckpoint) error {
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return fmt.Errorf("ошибка сериализации контрольной точки: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("ошибка записи файла контрольной точки: %w", err)
+	}
+	return nil
+}
+
+// readAuditCheckpoint читает контрольную точку журнала аудита из файла
+func readAuditCheckpoint(path string) (*models.AuditCheckpoint, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения файла контрольной точки: %w", err)
+	}
+
+	var checkpoint models.AuditCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("ошибка разбора файла контрольной точки: %w", err)
+	}
+	return &checkpoint, nil
+}
+
+// errAuditChainBroken возвращается командой проверки, если цепочка журнала аудита нарушена
+var errAuditChainBroken = errors.New("цепочка журнала аудита нарушена")
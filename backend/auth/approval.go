@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"database/sql"
+	"time"
+
+	"ssh-gate/models"
+)
+
+// DefaultMaxRequestDuration наибольший срок доступа по запросу, если правила групп сервера его не ограничивают
+const DefaultMaxRequestDuration = 7 * 24 * time.Hour
+
+// ApprovalPolicy объединяет правила одобрения запросов доступа всех групп, в которые входит сервер
+type ApprovalPolicy struct {
+	ServerID int64
+	Rules    []models.ApprovalRule
+}
+
+// LoadApprovalPolicy загружает правила одобрения запросов доступа к серверу
+func LoadApprovalPolicy(db *sql.DB, serverID int64) (*ApprovalPolicy, error) {
+	rules, err := models.GetServerApprovalRules(db, serverID)
+	if err != nil {
+		return nil, err
+	}
+	return &ApprovalPolicy{ServerID: serverID, Rules: rules}, nil
+}
+
+// RequiredApprovals возвращает число одобрений, необходимое для выдачи доступа:
+// наибольшее из требований правил, но не меньше одного
+func (p *ApprovalPolicy) RequiredApprovals() int {
+	required := 1
+	for _, rule := range p.Rules {
+		required = max(required, rule.RequiredApprovals)
+	}
+	return required
+}
+
+// MaxDuration возвращает наибольший срок доступа по запросу: самое строгое ограничение
+// из правил или DefaultMaxRequestDuration, если правила срок не ограничивают
+func (p *ApprovalPolicy) MaxDuration() time.Duration {
+	var limit time.Duration
+	for _, rule := range p.Rules {
+		if d := time.Duration(rule.MaxDuration); d > 0 && (limit == 0 || d < limit) {
+			limit = d
+		}
+	}
+	if limit == 0 {
+		return DefaultMaxRequestDuration
+	}
+	return limit
+}
+
+// CanApprove проверяет, может ли оператор одобрять запросы доступа к серверу: у него есть разрешение
+// access:write или access:write:group и он указан в одном из правил по ID или роли. Разрешения
+// проверяются и при входе по API-токену, поэтому токен без этих областей запросы не одобряет.
+// Если правил нет, одобряют операторы, которым разрешено менять доступ к серверу
+func (p *ApprovalPolicy) CanApprove(db *sql.DB, admin *models.Admin) (bool, error) {
+	if admin == nil {
+		return false, nil
+	}
+	if !admin.HasPermission(PermAccessWrite) && !admin.HasPermission(PermAccessWriteGroup) {
+		return false, nil
+	}
+	if len(p.Rules) == 0 {
+		return CanWriteAccess(db, admin, p.ServerID)
+	}
+
+	for _, rule := range p.Rules {
+		if rule.ApproverRole != "" && rule.ApproverRole == admin.Role {
+			return true, nil
+		}
+		for _, id := range rule.ApproverIDs {
+			if id == admin.ID {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,271 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"ssh-gate/models"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// SessionCookie имя cookie с токеном сессии
+	SessionCookie = "ssh_gate_session"
+	// SessionTTL время жизни сессии
+	SessionTTL = 12 * time.Hour
+
+	// BootstrapUsername имя оператора, создаваемого при первом запуске
+	BootstrapUsername = "admin"
+	// BootstrapPasswordEnv задает пароль оператора, создаваемого при первом запуске
+	BootstrapPasswordEnv = "SSH_GATE_ADMIN_PASSWORD"
+	// TokenPrefix префикс API-токенов, позволяющий отличить их от других секретов
+	TokenPrefix = "sgt_"
+
+	// CookieSecureEnv позволяет отключить флаг Secure у cookie при работе по HTTP
+	CookieSecureEnv = "SSH_GATE_COOKIE_SECURE"
+)
+
+type (
+	contextKey      struct{}
+	tokenContextKey struct{}
+)
+
+// HashPassword возвращает bcrypt-хеш пароля
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("ошибка хеширования пароля: %w", err)
+	}
+	return string(hash), nil
+}
+
+// CheckPassword сверяет пароль с bcrypt-хешем
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// NewToken генерирует случайный токен
+func NewToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("ошибка генерации токена: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// NewAPIToken генерирует API-токен
+func NewAPIToken() (string, error) {
+	token, err := NewToken()
+	if err != nil {
+		return "", err
+	}
+	return TokenPrefix + token, nil
+}
+
+// HashToken возвращает SHA-256-хеш токена для хранения в базе данных
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// StartSession создает сессию оператора и устанавливает cookie
+func StartSession(w http.ResponseWriter, db *sql.DB, adminID int64) error {
+	token, err := NewToken()
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(SessionTTL)
+	if err := models.CreateSession(db, HashToken(token), adminID, expiresAt); err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   CookieSecure(),
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return nil
+}
+
+// EndSession удаляет сессию текущего запроса и сбрасывает cookie
+func EndSession(w http.ResponseWriter, r *http.Request, db *sql.DB) error {
+	if cookie, err := r.Cookie(SessionCookie); err == nil {
+		if err := models.DeleteSession(db, HashToken(cookie.Value)); err != nil {
+			return err
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   CookieSecure(),
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	return nil
+}
+
+// Middleware пропускает только запросы с действующей сессией оператора
+// или с API-токеном в заголовке Authorization: Bearer
+func Middleware(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+
+			var (
+				admin *models.Admin
+				err   error
+			)
+			if header := r.Header.Get("Authorization"); header != "" {
+				var token *models.APIToken
+				admin, token, err = authenticateToken(db, header)
+				if err != nil {
+					http.Error(w, "Требуется авторизация: "+err.Error(), http.StatusUnauthorized)
+					return
+				}
+				ctx = context.WithValue(ctx, tokenContextKey{}, token)
+			} else {
+				admin, err = authenticateSession(db, r)
+				if err != nil {
+					http.Error(w, "Требуется авторизация", http.StatusUnauthorized)
+					return
+				}
+			}
+
+			ctx = context.WithValue(ctx, contextKey{}, admin)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// authenticateSession находит оператора по cookie сессии
+func authenticateSession(db *sql.DB, r *http.Request) (*models.Admin, error) {
+	cookie, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	admin, err := models.GetSessionAdmin(db, HashToken(cookie.Value))
+	if err != nil {
+		return nil, err
+	}
+
+	admin.Permissions, err = models.GetRolePermissions(db, admin.Role)
+	if err != nil {
+		return nil, err
+	}
+
+	return admin, nil
+}
+
+// authenticateToken находит владельца API-токена. Разрешения запроса ограничены
+// пересечением областей действия токена и разрешений роли владельца
+func authenticateToken(db *sql.DB, header string) (*models.Admin, *models.APIToken, error) {
+	value, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || !strings.HasPrefix(value, TokenPrefix) {
+		return nil, nil, fmt.Errorf("неверный формат заголовка Authorization")
+	}
+
+	token, err := models.GetActiveAPIToken(db, HashToken(value))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	admin, err := models.GetAdminByID(db, token.AdminID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rolePermissions, err := models.GetRolePermissions(db, admin.Role)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	admin.Permissions = []string{}
+	for _, scope := range token.Scopes {
+		if slices.Contains(rolePermissions, scope) {
+			admin.Permissions = append(admin.Permissions, scope)
+		}
+	}
+
+	if err := models.TouchAPIToken(db, token.ID); err != nil {
+		log.Printf("Ошибка при обновлении времени использования API-токена: %v", err)
+	}
+
+	return admin, token, nil
+}
+
+// AdminFromContext возвращает оператора, выполняющего запрос
+func AdminFromContext(ctx context.Context) *models.Admin {
+	admin, _ := ctx.Value(contextKey{}).(*models.Admin)
+	return admin
+}
+
+// TokenFromContext возвращает API-токен, которым авторизован запрос, или nil для сессии
+func TokenFromContext(ctx context.Context) *models.APIToken {
+	token, _ := ctx.Value(tokenContextKey{}).(*models.APIToken)
+	return token
+}
+
+// EnsureBootstrapAdmin создает первого оператора, если в базе данных еще нет ни одного.
+// Пароль берется из окружения или генерируется и выводится в лог
+func EnsureBootstrapAdmin(db *sql.DB) error {
+	count, err := models.CountAdmins(db)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	password := os.Getenv(BootstrapPasswordEnv)
+	generated := password == ""
+	if generated {
+		if password, err = NewToken(); err != nil {
+			return err
+		}
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	if _, err := models.AddAdmin(db, models.Admin{Username: BootstrapUsername, PasswordHash: hash, Role: RoleAdmin}); err != nil {
+		return err
+	}
+
+	if generated {
+		log.Printf("Создан оператор %s с паролем %s, смените его после первого входа", BootstrapUsername, password)
+	} else {
+		log.Printf("Создан оператор %s с паролем из %s", BootstrapUsername, BootstrapPasswordEnv)
+	}
+
+	return nil
+}
+
+// CookieSecure определяет, нужно ли выставлять флаг Secure у cookie сессии
+func CookieSecure() bool {
+	return os.Getenv(CookieSecureEnv) != "false"
+}
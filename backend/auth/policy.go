@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"ssh-gate/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Разрешения операторов
+const (
+	PermUsersRead        = "users:read"
+	PermUsersWrite       = "users:write"
+	PermServersRead      = "servers:read"
+	PermServersWrite     = "servers:write"
+	PermAccessRead       = "access:read"
+	PermAccessWrite      = "access:write"       // Выдача и отзыв доступа к любому серверу
+	PermAccessWriteGroup = "access:write:group" // Выдача и отзыв доступа только к серверам своих групп
+	PermAccessRequest    = "access:request"     // Запрос временного доступа для связанного пользователя SSH
+	PermAdminsRead       = "admins:read"
+	PermAdminsWrite      = "admins:write"
+	PermAuditRead        = "audit:read" // Просмотр и выгрузка журнала аудита
+)
+
+// AllPermissions перечисляет все разрешения, в том числе допустимые области действия API-токенов
+var AllPermissions = []string{
+	PermUsersRead, PermUsersWrite,
+	PermServersRead, PermServersWrite,
+	PermAccessRead, PermAccessWrite, PermAccessWriteGroup, PermAccessRequest,
+	PermAdminsRead, PermAdminsWrite,
+	PermAuditRead,
+}
+
+// Встроенные роли
+const (
+	RoleAdmin    = "admin"
+	RoleLead     = "lead"
+	RoleAuditor  = "auditor"
+	RoleEngineer = "engineer"
+)
+
+// BuiltinRoles описывает встроенные роли и их разрешения
+var BuiltinRoles = []models.Role{
+	{
+		Name:        RoleAdmin,
+		Description: "Полный доступ",
+		Permissions: []string{
+			PermUsersRead, PermUsersWrite,
+			PermServersRead, PermServersWrite,
+			PermAccessRead, PermAccessWrite, PermAccessRequest,
+			PermAdminsRead, PermAdminsWrite,
+			PermAuditRead,
+		},
+	},
+	{
+		Name:        RoleLead,
+		Description: "Руководитель команды: выдает доступ к серверам своих групп",
+		Permissions: []string{
+			PermUsersRead,
+			PermServersRead,
+			PermAccessRead, PermAccessWriteGroup,
+		},
+	},
+	{
+		Name:        RoleAuditor,
+		Description: "Аудитор: только чтение",
+		Permissions: []string{
+			PermUsersRead,
+			PermServersRead,
+			PermAccessRead,
+			PermAdminsRead,
+			PermAuditRead,
+		},
+	},
+	{
+		Name:        RoleEngineer,
+		Description: "Инженер: запрашивает временный доступ к серверам для себя",
+		Permissions: []string{
+			PermServersRead,
+			PermAccessRequest,
+		},
+	},
+}
+
+// RoleNames возвращает имена всех ролей в порядке приоритета: сначала встроенные роли
+// в порядке BuiltinRoles, от самой широкой к самой узкой, затем остальные роли в порядке создания
+func RoleNames(db *sql.DB) ([]string, error) {
+	roles, err := models.GetAllRoles(db)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(roles))
+	for _, role := range BuiltinRoles {
+		names = append(names, role.Name)
+	}
+	for _, role := range roles {
+		if !slices.Contains(names, role.Name) {
+			names = append(names, role.Name)
+		}
+	}
+	return names, nil
+}
+
+// Forbidden отвечает ошибкой 403 с указанием недостающего разрешения
+func Forbidden(w http.ResponseWriter, permission string) {
+	http.Error(w, "Недостаточно прав: требуется разрешение "+permission, http.StatusForbidden)
+}
+
+// Require пропускает только операторов с указанным разрешением
+func Require(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			admin := AdminFromContext(r.Context())
+			if admin == nil || !admin.HasPermission(permission) {
+				Forbidden(w, permission)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CanWriteAccess проверяет, может ли оператор менять доступ к серверу:
+// с разрешением access:write — к любому серверу, с access:write:group — только к серверам своих групп
+func CanWriteAccess(db *sql.DB, admin *models.Admin, serverID int64) (bool, error) {
+	if admin == nil {
+		return false, nil
+	}
+	if admin.HasPermission(PermAccessWrite) {
+		return true, nil
+	}
+	if !admin.HasPermission(PermAccessWriteGroup) {
+		return false, nil
+	}
+	return models.IsServerInAdminGroups(db, admin.ID, serverID)
+}
+
+// RequireAccessWrite пропускает операторов, которым разрешено менять доступ к серверу
+// из параметра маршрута serverParam: с разрешением access:write — к любому серверу,
+// с разрешением access:write:group — только к серверам своих групп
+func RequireAccessWrite(db *sql.DB, serverParam string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			admin := AdminFromContext(r.Context())
+			if admin == nil || !(admin.HasPermission(PermAccessWrite) || admin.HasPermission(PermAccessWriteGroup)) {
+				Forbidden(w, PermAccessWrite)
+				return
+			}
+
+			serverID, err := strconv.ParseInt(chi.URLParam(r, serverParam), 10, 64)
+			if err != nil {
+				http.Error(w, "Неверный формат ID сервера", http.StatusBadRequest)
+				return
+			}
+
+			allowed, err := CanWriteAccess(db, admin, serverID)
+			if err != nil {
+				log.Printf("Ошибка при проверке групп оператора: %v", err)
+				http.Error(w, "Ошибка при проверке прав доступа", http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				Forbidden(w, PermAccessWrite+" (сервер не входит в ваши группы)")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
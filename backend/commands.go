@@ -0,0 +1,196 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"ssh-gate/db"
+	"ssh-gate/models"
+	"ssh-gate/secrets"
+)
+
+// databasePath путь к файлу базы данных
+const databasePath = "users.db"
+
+// runCommand выполняет служебную команду, переданную в аргументах запуска
+func runCommand(name string, args []string) error {
+	switch name {
+	case "rotate-master-key":
+		return rotateMasterKey(args)
+	case "audit-verify":
+		return verifyAudit(args)
+	case "audit-checkpoint":
+		return exportAuditCheckpoint(args)
+	default:
+		return fmt.Errorf("неизвестная команда: %s", name)
+	}
+}
+
+// rotateMasterKey перешифровывает учетные данные серверов и приватные ключи шлюза новым мастер-ключом.
+// Текущий ключ должен быть задан: если его нет, ротация прерывается, а не создает новый ключ.
+// Новый ключ читается из файла -new-key-file (или генерируется, если файла нет)
+// и после успешной ротации заменяет текущий файл мастер-ключа
+func rotateMasterKey(args []string) error {
+	flags := flag.NewFlagSet("rotate-master-key", flag.ExitOnError)
+	newKeyFile := flags.String("new-key-file", "", "файл с новым мастер-ключом (по умолчанию генерируется рядом с текущим)")
+	flags.Parse(args)
+
+	keyFile := secrets.MasterKeyFile()
+	currentKey, err := secrets.ReadMasterKey()
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("текущий мастер-ключ не найден: не задан %s и нет файла %s", secrets.MasterKeyEnv, keyFile)
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка загрузки текущего мастер-ключа: %w", err)
+	}
+	current, err := secrets.NewKeeper(currentKey)
+	if err != nil {
+		return fmt.Errorf("ошибка загрузки текущего мастер-ключа: %w", err)
+	}
+
+	fromEnv := os.Getenv(secrets.MasterKeyEnv) != ""
+	if fromEnv && *newKeyFile == "" {
+		return fmt.Errorf("мастер-ключ задан через %s, укажите файл нового ключа через -new-key-file", secrets.MasterKeyEnv)
+	}
+
+	// Новый ключ сначала сохраняется во временный файл, чтобы не потерять его при сбое
+	nextFile := *newKeyFile
+	if nextFile == "" {
+		nextFile = keyFile + ".new"
+	}
+	// Ключ генерируется, только если файла еще нет: поврежденный или недоступный файл
+	// не перезаписывается, чтобы не потерять подготовленный ключ
+	nextKey, err := secrets.ReadKeyFile(nextFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("ошибка чтения нового мастер-ключа: %w", err)
+	}
+	if err != nil {
+		if nextKey, err = secrets.GenerateKey(); err != nil {
+			return err
+		}
+		if err := secrets.WriteKeyFile(nextFile, nextKey); err != nil {
+			return err
+		}
+	}
+
+	next, err := secrets.NewKeeper(nextKey)
+	if err != nil {
+		return err
+	}
+
+	database, err := db.InitDB(databasePath, current)
+	if err != nil {
+		return fmt.Errorf("ошибка инициализации базы данных: %w", err)
+	}
+	defer database.Close()
+
+	rewrapped, err := models.RewrapServerSecrets(database, current, next)
+	if err != nil {
+		return fmt.Errorf("ошибка ротации мастер-ключа: %w", err)
+	}
+	log.Printf("Перешифровано записей: %d", rewrapped)
+
+	if fromEnv {
+		log.Printf("Замените значение %s содержимым файла %s", secrets.MasterKeyEnv, nextFile)
+		return nil
+	}
+
+	if err := os.Rename(nextFile, keyFile); err != nil {
+		return fmt.Errorf("ошибка замены файла мастер-ключа (новый ключ сохранен в %s): %w", nextFile, err)
+	}
+	log.Printf("Мастер-ключ в файле %s заменен", keyFile)
+
+	return nil
+}
+
+// verifyAudit проходит по цепочке журнала аудита и сообщает о первой нарушенной записи.
+// Ключ подписи берется из окружения, как при запуске шлюза. С флагом -checkpoint
+// дополнительно проверяется, что журнал содержит выгруженную ранее контрольную точку
+func verifyAudit(args []string) error {
+	flags := flag.NewFlagSet("audit-verify", flag.ExitOnError)
+	checkpointFile := flags.String("checkpoint", "", "файл контрольной точки для сверки")
+	flags.Parse(args)
+
+	key, err := secrets.LoadAuditKey()
+	if err != nil {
+		return err
+	}
+
+	var checkpoint *models.AuditCheckpoint
+	if *checkpointFile != "" {
+		if checkpoint, err = readAuditCheckpoint(*checkpointFile); err != nil {
+			return err
+		}
+	}
+
+	database, err := openDatabaseReadOnly()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	result, err := models.VerifyAuditChain(database, key, checkpoint)
+	if err != nil {
+		return err
+	}
+
+	if key == nil {
+		log.Printf("Ключ подписи журнала не задан (%s), подписи не проверяются", secrets.AuditKeyEnv)
+	}
+	if !result.Valid {
+		if result.BrokenID != 0 {
+			log.Printf("Проверено записей: %d. Цепочка нарушена на записи %d: %s", result.Checked, result.BrokenID, result.Reason)
+		} else {
+			log.Printf("Проверено записей: %d. %s", result.Checked, result.Reason)
+		}
+		return errAuditChainBroken
+	}
+
+	log.Printf("Цепочка журнала аудита цела: проверено записей %d, последняя запись %d, хеш %s", result.Checked, result.LastID, result.LastHash)
+	return nil
+}
+
+// exportAuditCheckpoint выгружает контрольную точку журнала аудита в файл -out или в стандартный вывод
+func exportAuditCheckpoint(args []string) error {
+	flags := flag.NewFlagSet("audit-checkpoint", flag.ExitOnError)
+	out := flags.String("out", "", "файл контрольной точки (по умолчанию стандартный вывод)")
+	flags.Parse(args)
+
+	key, err := secrets.LoadAuditKey()
+	if err != nil {
+		return err
+	}
+
+	database, err := openDatabaseReadOnly()
+	if err != nil {
+		return err
+	}
+	defer database.Close()
+
+	checkpoint, err := models.NewAuditCheckpoint(database, key)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		*out = "/dev/stdout"
+	}
+	return writeAuditCheckpoint(*out, checkpoint)
+}
+
+// openDatabaseReadOnly открывает базу данных только для чтения, не изменяя ее структуру
+func openDatabaseReadOnly() (*sql.DB, error) {
+	database, err := sql.Open("sqlite3", "file:"+databasePath+"?mode=ro")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка открытия соединения с базой данных: %w", err)
+	}
+	if err := database.Ping(); err != nil {
+		database.Close()
+		return nil, fmt.Errorf("ошибка подключения к базе данных: %w", err)
+	}
+	return database, nil
+}
@@ -5,13 +5,17 @@ import (
 	"fmt"
 	"log"
 
+	"ssh-gate/auth"
 	"ssh-gate/models"
+	"ssh-gate/secrets"
+	"ssh-gate/ssh"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// InitDB инициализирует соединение с базой данных и создает необходимые таблицы
-func InitDB(dataSourceName string) (*sql.DB, error) {
+// InitDB инициализирует соединение с базой данных, создает необходимые таблицы
+// и шифрует учетные данные, сохраненные ранее в открытом виде
+func InitDB(dataSourceName string, keeper *secrets.Keeper) (*sql.DB, error) {
 	db, err := sql.Open("sqlite3", dataSourceName)
 	if err != nil {
 		return nil, fmt.Errorf("ошибка открытия соединения с базой данных: %w", err)
@@ -27,12 +31,156 @@ func InitDB(dataSourceName string) (*sql.DB, error) {
 		return db, err
 	}
 
+	// Создаем таблицу ключей пользователей и переносим в нее ключи из таблицы пользователей
+	if err := models.CreateUserKeyTable(db); err != nil {
+		log.Printf("Ошибка при создании таблицы ключей пользователей: %v", err)
+		return db, err
+	}
+	migrated, err := migrateUserKeys(db)
+	if err != nil {
+		log.Printf("Ошибка при переносе ключей пользователей: %v", err)
+		return db, err
+	}
+	if migrated > 0 {
+		log.Printf("Перенесены ключи пользователей: %d", migrated)
+	}
+
 	// Создаем таблицу серверов и связующую таблицу
 	if err := models.CreateServerTable(db); err != nil {
 		log.Printf("Ошибка при создании таблицы серверов: %v", err)
 		return db, err
 	}
 
+	// Создаем таблицу собственных ключей шлюза
+	if err := models.CreateGateKeyTable(db); err != nil {
+		log.Printf("Ошибка при создании таблицы ключей шлюза: %v", err)
+		return db, err
+	}
+
+	// Создаем таблицы операторов и сессий
+	if err := models.CreateAdminTable(db); err != nil {
+		log.Printf("Ошибка при создании таблицы операторов: %v", err)
+		return db, err
+	}
+
+	// Создаем таблицы ролей и назначаем роли существующим операторам
+	if err := models.CreateRoleTable(db, auth.BuiltinRoles, auth.RoleAdmin); err != nil {
+		log.Printf("Ошибка при создании таблицы ролей: %v", err)
+		return db, err
+	}
+
+	// Создаем таблицы групп серверов
+	if err := models.CreateServerGroupTable(db); err != nil {
+		log.Printf("Ошибка при создании таблицы групп серверов: %v", err)
+		return db, err
+	}
+
+	// Создаем таблицы групп пользователей и их доступов к серверам
+	if err := models.CreateUserGroupTable(db); err != nil {
+		log.Printf("Ошибка при создании таблицы групп пользователей: %v", err)
+		return db, err
+	}
+
+	// Создаем таблицы меток серверов и политик доступа по меткам
+	if err := models.CreateServerLabelTable(db); err != nil {
+		log.Printf("Ошибка при создании таблицы меток серверов: %v", err)
+		return db, err
+	}
+	if err := models.CreateAccessPolicyTable(db); err != nil {
+		log.Printf("Ошибка при создании таблицы политик доступа: %v", err)
+		return db, err
+	}
+
+	// Создаем таблицу правил одобрения запросов доступа
+	if err := models.CreateApprovalRuleTable(db); err != nil {
+		log.Printf("Ошибка при создании таблицы правил одобрения: %v", err)
+		return db, err
+	}
+
+	// Создаем таблицу API-токенов
+	if err := models.CreateAPITokenTable(db); err != nil {
+		log.Printf("Ошибка при создании таблицы API-токенов: %v", err)
+		return db, err
+	}
+
+	// Создаем таблицу планов изменений доступа
+	if err := models.CreatePlanTable(db); err != nil {
+		log.Printf("Ошибка при создании таблицы планов: %v", err)
+		return db, err
+	}
+
+	// Создаем таблицы запросов доступа
+	if err := models.CreateAccessRequestTable(db); err != nil {
+		log.Printf("Ошибка при создании таблицы запросов доступа: %v", err)
+		return db, err
+	}
+
+	// Создаем таблицы очереди фоновых задач
+	if err := models.CreateJobTable(db); err != nil {
+		log.Printf("Ошибка при создании таблицы задач: %v", err)
+		return db, err
+	}
+
+	// Создаем таблицу журнала аудита
+	if err := models.CreateAuditTable(db); err != nil {
+		log.Printf("Ошибка при создании таблицы журнала аудита: %v", err)
+		return db, err
+	}
+
+	// Шифруем пароли серверов, сохраненные до включения шифрования
+	encrypted, err := models.EncryptServerSecrets(db, keeper)
+	if err != nil {
+		log.Printf("Ошибка при шифровании учетных данных серверов: %v", err)
+		return db, err
+	}
+	if encrypted > 0 {
+		log.Printf("Зашифрованы учетные данные серверов: %d", encrypted)
+	}
+
 	log.Println("База данных успешно инициализирована")
 	return db, nil
 }
+
+// migrateUserKeys добавляет в таблицу ключей публичные ключи пользователей, у которых еще нет ни одного ключа.
+// Некорректные ключи пропускаются
+func migrateUserKeys(db *sql.DB) (int, error) {
+	users, err := models.GetAllUsers(db)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, user := range users {
+		if user.PublicKey == "" {
+			continue
+		}
+
+		keys, err := models.GetUserKeys(db, user.ID)
+		if err != nil {
+			return migrated, err
+		}
+		if len(keys) > 0 {
+			continue
+		}
+
+		key, err := ssh.ParseAuthorizedKey(user.PublicKey)
+		if err != nil {
+			log.Printf("Ключ пользователя %s не перенесен: %v", user.Username, err)
+			continue
+		}
+
+		_, err = models.AddUserKey(db, models.UserKey{
+			UserID:      user.ID,
+			PublicKey:   key.String(),
+			Fingerprint: key.Fingerprint(),
+			Comment:     key.Comment,
+			Enabled:     true,
+		})
+		if err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+
+	return migrated, nil
+}
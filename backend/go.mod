@@ -3,12 +3,17 @@ module ssh-gate
 go 1.24.1
 
 require (
+	github.com/coreos/go-oidc/v3 v3.17.0
 	github.com/go-chi/chi/v5 v5.2.1
+	github.com/go-jose/go-jose/v4 v4.1.3
 	github.com/mattn/go-sqlite3 v1.14.24
+	github.com/pkg/sftp v1.13.7
+	github.com/rs/cors v1.11.1
 	golang.org/x/crypto v0.36.0
+	golang.org/x/oauth2 v0.28.0
 )
 
 require (
-	github.com/rs/cors v1.11.1 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	golang.org/x/sys v0.31.0 // indirect
 )
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"ssh-gate/models"
+	"ssh-gate/reconcile"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// AccessPolicyHandler содержит обработчики для API политик доступа по меткам серверов
+type AccessPolicyHandler struct {
+	DB         *sql.DB
+	Reconciler *reconcile.Engine
+}
+
+// NewAccessPolicyHandler создает новый экземпляр AccessPolicyHandler
+func NewAccessPolicyHandler(db *sql.DB, reconciler *reconcile.Engine) *AccessPolicyHandler {
+	return &AccessPolicyHandler{DB: db, Reconciler: reconciler}
+}
+
+// accessPolicyResponse описывает политику доступа и результат синхронизации затронутых серверов
+type accessPolicyResponse struct {
+	models.AccessPolicy
+	Servers []*reconcile.Drift `json:"servers"`
+}
+
+// CreateAccessPolicy обрабатывает запрос на создание политики доступа.
+// Ключи участников группы сразу выдаются на все подходящие серверы
+func (h *AccessPolicyHandler) CreateAccessPolicy(w http.ResponseWriter, r *http.Request) {
+	var policy models.AccessPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !h.validate(w, policy) {
+		return
+	}
+
+	id, err := models.AddAccessPolicy(h.DB, policy)
+	if err != nil {
+		http.Error(w, "Ошибка при добавлении политики доступа: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	created, err := models.GetAccessPolicyByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Ошибка при получении политики доступа: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	event := models.AuditEvent{Action: models.AuditPolicyCreate, Target: accessPolicyTarget(id), After: auditState(created)}
+	h.apply(w, r, http.StatusCreated, created, created.ServerIDs, event)
+}
+
+// GetAllAccessPolicies обрабатывает запрос на получение всех политик доступа
+func (h *AccessPolicyHandler) GetAllAccessPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := models.GetAllAccessPolicies(h.DB)
+	if err != nil {
+		http.Error(w, "Ошибка при получении политик доступа: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policies)
+}
+
+// GetAccessPolicy обрабатывает запрос на получение политики доступа по ID
+func (h *AccessPolicyHandler) GetAccessPolicy(w http.ResponseWriter, r *http.Request) {
+	policy, ok := h.policy(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(policy)
+}
+
+// UpdateAccessPolicy обрабатывает запрос на изменение политики доступа. Синхронизируются
+// серверы, которые подходили под прежний селектор, и серверы, подходящие под новый
+func (h *AccessPolicyHandler) UpdateAccessPolicy(w http.ResponseWriter, r *http.Request) {
+	existing, ok := h.policy(w, r)
+	if !ok {
+		return
+	}
+
+	var policy models.AccessPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !h.validate(w, policy) {
+		return
+	}
+
+	policy.ID = existing.ID
+	if err := models.UpdateAccessPolicy(h.DB, policy); err != nil {
+		http.Error(w, "Ошибка при обновлении политики доступа: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	updated, err := models.GetAccessPolicyByID(h.DB, existing.ID)
+	if err != nil {
+		http.Error(w, "Ошибка при получении политики доступа: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	event := models.AuditEvent{
+		Action: models.AuditPolicyUpdate,
+		Target: accessPolicyTarget(existing.ID),
+		Before: auditState(existing),
+		After:  auditState(updated),
+	}
+	h.apply(w, r, http.StatusOK, updated, mergeIDs(existing.ServerIDs, updated.ServerIDs), event)
+}
+
+// DeleteAccessPolicy обрабатывает запрос на удаление политики доступа.
+// Ключи, выданные только по этой политике, убираются с серверов
+func (h *AccessPolicyHandler) DeleteAccessPolicy(w http.ResponseWriter, r *http.Request) {
+	policy, ok := h.policy(w, r)
+	if !ok {
+		return
+	}
+
+	if err := models.DeleteAccessPolicy(h.DB, policy.ID); err != nil {
+		http.Error(w, "Ошибка при удалении политики доступа: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	event := models.AuditEvent{Action: models.AuditPolicyDelete, Target: accessPolicyTarget(policy.ID), Before: auditState(policy)}
+	h.apply(w, r, http.StatusOK, policy, policy.ServerIDs, event)
+}
+
+// apply приводит в соответствие с базой данных серверы, затронутые изменением политики,
+// записывает изменение в журнал аудита и отправляет ответ. Если сервер недоступен,
+// ошибка записывается в отчет сервера, а ключи будут обновлены при следующей сверке
+func (h *AccessPolicyHandler) apply(w http.ResponseWriter, r *http.Request, status int, policy *models.AccessPolicy, serverIDs []int64, event models.AuditEvent) {
+	drifts, err := h.Reconciler.ApplyServers(r.Context(), serverIDs)
+	if err != nil {
+		audit(h.DB, r, event, err)
+		http.Error(w, "Ошибка при обновлении серверов политики: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	event.Error = driftErrors(drifts...)
+	audit(h.DB, r, event, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(accessPolicyResponse{AccessPolicy: *policy, Servers: drifts})
+}
+
+// validate проверяет группу и селектор политики и отвечает ошибкой, если они заданы неверно
+func (h *AccessPolicyHandler) validate(w http.ResponseWriter, policy models.AccessPolicy) bool {
+	if _, err := models.GetUserGroupByID(h.DB, policy.GroupID); err != nil {
+		http.Error(w, "Группа пользователей не найдена: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	// Пустой селектор подошел бы ко всем серверам
+	if len(policy.Selector) == 0 {
+		http.Error(w, "Селектор политики обязателен, например {\"env\": \"staging\"}", http.StatusBadRequest)
+		return false
+	}
+
+	if err := models.ValidateLabels(policy.Selector); err != nil {
+		http.Error(w, "Неверный селектор политики: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// policy получает политику доступа по ID из URL и отвечает ошибкой, если ее нет
+func (h *AccessPolicyHandler) policy(w http.ResponseWriter, r *http.Request) (*models.AccessPolicy, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	policy, err := models.GetAccessPolicyByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Политика доступа не найдена: "+err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+
+	return policy, true
+}
+
+// mergeIDs объединяет два списка ID без повторов, сохраняя порядок
+func mergeIDs(a, b []int64) []int64 {
+	seen := make(map[int64]bool, len(a)+len(b))
+	result := make([]int64, 0, len(a)+len(b))
+	for _, id := range append(append([]int64{}, a...), b...) {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// accessPolicyTarget описывает политику доступа как объект действия в журнале аудита
+func accessPolicyTarget(id int64) string {
+	return "access_policy:" + strconv.FormatInt(id, 10)
+}
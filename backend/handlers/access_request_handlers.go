@@ -0,0 +1,499 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ssh-gate/auth"
+	"ssh-gate/models"
+	"ssh-gate/reconcile"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// AccessRequestHandler содержит обработчики для запросов временного доступа
+type AccessRequestHandler struct {
+	DB         *sql.DB
+	Reconciler *reconcile.Engine
+}
+
+// NewAccessRequestHandler создает новый экземпляр AccessRequestHandler
+func NewAccessRequestHandler(db *sql.DB, reconciler *reconcile.Engine) *AccessRequestHandler {
+	return &AccessRequestHandler{DB: db, Reconciler: reconciler}
+}
+
+// accessRequestInput описывает запрос на создание запроса доступа.
+// Если user_id не указан, доступ запрашивается для пользователя SSH, связанного с оператором
+type accessRequestInput struct {
+	UserID   int64           `json:"user_id"`
+	ServerID int64           `json:"server_id"`
+	Reason   string          `json:"reason"`
+	Duration models.Duration `json:"duration"`
+}
+
+// decisionInput описывает комментарий к решению по запросу доступа
+type decisionInput struct {
+	Comment string `json:"comment"`
+}
+
+// CreateAccessRequest обрабатывает запрос на создание запроса временного доступа к серверу.
+// Для себя запрос создают операторы с разрешением access:request, для других пользователей -
+// операторы, которым разрешено менять доступ к серверу
+func (h *AccessRequestHandler) CreateAccessRequest(w http.ResponseWriter, r *http.Request) {
+	admin := auth.AdminFromContext(r.Context())
+
+	var input accessRequestInput
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if input.UserID == 0 {
+		input.UserID = admin.UserID
+	}
+	if input.UserID == 0 {
+		http.Error(w, "Укажите user_id: оператор не связан с пользователем SSH", http.StatusBadRequest)
+		return
+	}
+
+	input.Reason = strings.TrimSpace(input.Reason)
+	if input.Reason == "" {
+		http.Error(w, "Причина запроса обязательна", http.StatusBadRequest)
+		return
+	}
+
+	duration := time.Duration(input.Duration)
+	if duration <= 0 {
+		http.Error(w, "Укажите срок доступа (duration), например \"2h\"", http.StatusBadRequest)
+		return
+	}
+
+	server, err := models.GetServerByID(h.DB, input.ServerID)
+	if err != nil {
+		http.Error(w, "Сервер не найден: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	user, err := models.GetUserByID(h.DB, input.UserID)
+	if err != nil {
+		http.Error(w, "Пользователь не найден: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Для себя достаточно разрешения access:request, для других нужно право менять доступ к серверу
+	if input.UserID != admin.UserID || !admin.HasPermission(auth.PermAccessRequest) {
+		allowed, err := auth.CanWriteAccess(h.DB, admin, server.ID)
+		if err != nil {
+			log.Printf("Ошибка при проверке групп оператора: %v", err)
+			http.Error(w, "Ошибка при проверке прав доступа", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			auth.Forbidden(w, auth.PermAccessRequest)
+			return
+		}
+	}
+
+	policy, err := auth.LoadApprovalPolicy(h.DB, server.ID)
+	if err != nil {
+		http.Error(w, "Ошибка при получении правил одобрения: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if duration > policy.MaxDuration() {
+		http.Error(w, "Срок доступа превышает допустимый для сервера: "+policy.MaxDuration().String(), http.StatusBadRequest)
+		return
+	}
+
+	// Проверяем, что у пользователя есть ключи для выдачи на сервер
+	keys, err := models.GetActiveUserKeys(h.DB, user.ID)
+	if err != nil {
+		http.Error(w, "Ошибка при получении ключей пользователя: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(keys) == 0 {
+		http.Error(w, "У пользователя нет активных ключей", http.StatusBadRequest)
+		return
+	}
+
+	grant, err := models.GetGrant(h.DB, user.ID, server.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Ошибка при получении привязки сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if grant != nil && grant.ExpiresAt == nil {
+		http.Error(w, "У пользователя уже есть бессрочный доступ к серверу", http.StatusConflict)
+		return
+	}
+
+	pending, err := models.HasPendingAccessRequest(h.DB, user.ID, server.ID)
+	if err != nil {
+		http.Error(w, "Ошибка при проверке запросов доступа: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if pending {
+		http.Error(w, "Запрос доступа пользователя к этому серверу уже ожидает одобрения", http.StatusConflict)
+		return
+	}
+
+	id, err := models.AddAccessRequest(h.DB, models.AccessRequest{
+		RequesterID:       admin.ID,
+		UserID:            user.ID,
+		ServerID:          server.ID,
+		Reason:            input.Reason,
+		Duration:          input.Duration,
+		RequiredApprovals: policy.RequiredApprovals(),
+	})
+	if err != nil {
+		http.Error(w, "Ошибка при создании запроса доступа: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.respond(w, r, http.StatusCreated, id, models.AuditEvent{Action: models.AuditRequestCreate})
+}
+
+// GetAccessRequests обрабатывает запрос на получение запросов доступа.
+// Параметры status, user_id и server_id ограничивают выборку. Операторы без разрешения
+// access:read видят свои запросы и ожидающие запросы, которые они могут одобрить
+func (h *AccessRequestHandler) GetAccessRequests(w http.ResponseWriter, r *http.Request) {
+	admin := auth.AdminFromContext(r.Context())
+
+	query := r.URL.Query()
+	filter := models.AccessRequestFilter{Status: query.Get("status")}
+	for name, target := range map[string]*int64{"user_id": &filter.UserID, "server_id": &filter.ServerID} {
+		if value := query.Get(name); value != "" {
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				http.Error(w, "Неверный формат параметра "+name, http.StatusBadRequest)
+				return
+			}
+			*target = id
+		}
+	}
+
+	requests, err := models.GetAccessRequests(h.DB, filter)
+	if err != nil {
+		http.Error(w, "Ошибка при получении запросов доступа: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	visible := make([]models.AccessRequest, 0, len(requests))
+	for _, request := range requests {
+		ok, err := h.canView(admin, &request)
+		if err != nil {
+			http.Error(w, "Ошибка при проверке прав доступа: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			visible = append(visible, request)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(visible)
+}
+
+// GetAccessRequest обрабатывает запрос на получение запроса доступа по ID
+func (h *AccessRequestHandler) GetAccessRequest(w http.ResponseWriter, r *http.Request) {
+	request, ok := h.request(w, r)
+	if !ok {
+		return
+	}
+
+	allowed, err := h.canView(auth.AdminFromContext(r.Context()), request)
+	if err != nil {
+		http.Error(w, "Ошибка при проверке прав доступа: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		auth.Forbidden(w, auth.PermAccessRead)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(request)
+}
+
+// ApproveAccessRequest обрабатывает одобрение запроса доступа. Когда набрано необходимое
+// число одобрений, пользователю выдается временный доступ к серверу
+func (h *AccessRequestHandler) ApproveAccessRequest(w http.ResponseWriter, r *http.Request) {
+	admin := auth.AdminFromContext(r.Context())
+
+	request, ok := h.request(w, r)
+	if !ok {
+		return
+	}
+
+	var input decisionInput
+	if !decodeDecision(w, r, &input) {
+		return
+	}
+
+	if !h.canDecide(w, admin, request) {
+		return
+	}
+
+	for _, approval := range request.Approvals {
+		if approval.AdminID == admin.ID {
+			http.Error(w, "Вы уже одобрили этот запрос", http.StatusConflict)
+			return
+		}
+	}
+
+	// Одобрение сохраняется, а последнее необходимое одобрение в той же транзакции закрепляет запрос
+	// за оператором, и только затем выдается доступ: одновременные отклонение или отмена запроса
+	// не оставят выданного доступа без одобрения
+	claimed, err := models.ClaimAccessRequest(h.DB, request.ID, admin.ID, input.Comment)
+	if err != nil {
+		http.Error(w, "Ошибка при одобрении запроса доступа: "+err.Error(), http.StatusConflict)
+		return
+	}
+	if !claimed {
+		h.respond(w, r, http.StatusOK, request.ID, models.AuditEvent{Action: models.AuditRequestApprove, Before: auditState(request)})
+		return
+	}
+
+	server, err := models.GetServerByID(h.DB, request.ServerID)
+	if err != nil {
+		h.release(request.ID, admin.ID)
+		http.Error(w, "Сервер не найден: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	expiresAt, undo, err := h.grant(r, server, request)
+	if err != nil {
+		h.release(request.ID, admin.ID)
+		http.Error(w, "Ошибка при добавлении ключа на сервер: "+err.Error(), sshErrorStatus(err))
+		return
+	}
+
+	if err := models.ApproveAccessRequest(h.DB, request.ID, expiresAt); err != nil {
+		undo()
+		h.release(request.ID, admin.ID)
+		http.Error(w, "Ошибка при одобрении запроса доступа: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.respond(w, r, http.StatusOK, request.ID, models.AuditEvent{Action: models.AuditRequestApprove, Before: auditState(request)})
+}
+
+// release возвращает закрепленный за оператором запрос в ожидание одобрения
+func (h *AccessRequestHandler) release(id, adminID int64) {
+	if err := models.ReleaseAccessRequest(h.DB, id, adminID); err != nil {
+		log.Printf("Ошибка возврата запроса доступа %d в ожидание: %v", id, err)
+	}
+}
+
+// grant выдает доступ по одобренному запросу, записывает выдачу в журнал аудита и возвращает
+// срок действия доступа и функцию, которая возвращает доступ в прежнее состояние. Уже выданный
+// доступ не сокращается: бессрочный доступ и более поздний срок сохраняются
+func (h *AccessRequestHandler) grant(r *http.Request, server models.Server, request *models.AccessRequest) (*time.Time, func(), error) {
+	now := time.Now().UTC()
+	expiresAt := now.Add(time.Duration(request.Duration))
+
+	existing, err := models.GetGrant(h.DB, request.UserID, server.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, err
+	}
+	if existing != nil && !existing.Expired(now) && (existing.ExpiresAt == nil || existing.ExpiresAt.After(expiresAt)) {
+		return existing.ExpiresAt, func() {}, nil
+	}
+
+	event := models.AuditEvent{
+		Action:   models.AuditAccessGrant,
+		UserID:   request.UserID,
+		ServerID: server.ID,
+		Target:   accessRequestTarget(request.ID),
+		Before:   auditState(existing),
+	}
+	if _, err := h.Reconciler.Grant(r.Context(), server, request.UserID, &expiresAt); err != nil {
+		audit(h.DB, r, event, err)
+		return nil, nil, err
+	}
+	granted := models.Grant{UserID: request.UserID, ServerID: server.ID, ExpiresAt: &expiresAt}
+	event.After = auditState(granted)
+	audit(h.DB, r, event, nil)
+
+	undo := func() {
+		event := models.AuditEvent{
+			Action:   models.AuditAccessRevoke,
+			UserID:   request.UserID,
+			ServerID: server.ID,
+			Target:   accessRequestTarget(request.ID),
+			Before:   auditState(granted),
+			After:    auditState(existing),
+		}
+		var err error
+		if existing == nil {
+			_, err = h.Reconciler.Revoke(r.Context(), server, request.UserID)
+		} else {
+			event.Action = models.AuditAccessGrant
+			_, err = h.Reconciler.Grant(r.Context(), server, request.UserID, existing.ExpiresAt)
+		}
+		if err != nil {
+			log.Printf("Ошибка отмены доступа по запросу %d: %v", request.ID, err)
+		}
+		audit(h.DB, r, event, err)
+	}
+
+	return &expiresAt, undo, nil
+}
+
+// DenyAccessRequest обрабатывает отклонение запроса доступа
+func (h *AccessRequestHandler) DenyAccessRequest(w http.ResponseWriter, r *http.Request) {
+	admin := auth.AdminFromContext(r.Context())
+
+	request, ok := h.request(w, r)
+	if !ok {
+		return
+	}
+
+	var input decisionInput
+	if !decodeDecision(w, r, &input) {
+		return
+	}
+
+	if !h.canDecide(w, admin, request) {
+		return
+	}
+
+	if err := models.DenyAccessRequest(h.DB, request.ID, admin.ID, input.Comment); err != nil {
+		http.Error(w, "Ошибка при отклонении запроса доступа: "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	h.respond(w, r, http.StatusOK, request.ID, models.AuditEvent{Action: models.AuditRequestDeny, Before: auditState(request)})
+}
+
+// CancelAccessRequest обрабатывает отмену ожидающего запроса доступа его автором
+func (h *AccessRequestHandler) CancelAccessRequest(w http.ResponseWriter, r *http.Request) {
+	admin := auth.AdminFromContext(r.Context())
+
+	request, ok := h.request(w, r)
+	if !ok {
+		return
+	}
+
+	if request.RequesterID != admin.ID {
+		http.Error(w, "Отменить запрос может только его автор", http.StatusForbidden)
+		return
+	}
+
+	if request.Status != models.AccessRequestPending {
+		http.Error(w, "Запрос уже рассмотрен", http.StatusConflict)
+		return
+	}
+
+	if err := models.CancelAccessRequest(h.DB, request.ID, admin.ID); err != nil {
+		http.Error(w, "Ошибка при отмене запроса доступа: "+err.Error(), http.StatusConflict)
+		return
+	}
+
+	h.respond(w, r, http.StatusOK, request.ID, models.AuditEvent{Action: models.AuditRequestCancel, Before: auditState(request)})
+}
+
+// canDecide проверяет, что запрос ожидает решения, а оператор может его одобрить или отклонить.
+// Собственные запросы и запросы для связанного с оператором пользователя рассматривают другие операторы
+func (h *AccessRequestHandler) canDecide(w http.ResponseWriter, admin *models.Admin, request *models.AccessRequest) bool {
+	if request.Status != models.AccessRequestPending {
+		http.Error(w, "Запрос уже рассмотрен", http.StatusConflict)
+		return false
+	}
+
+	if request.RequesterID == admin.ID || (admin.UserID != 0 && request.UserID == admin.UserID) {
+		http.Error(w, "Нельзя рассматривать собственный запрос доступа", http.StatusForbidden)
+		return false
+	}
+
+	allowed, err := h.canApprove(admin, request.ServerID)
+	if err != nil {
+		log.Printf("Ошибка при проверке правил одобрения: %v", err)
+		http.Error(w, "Ошибка при проверке прав доступа", http.StatusInternalServerError)
+		return false
+	}
+	if !allowed {
+		http.Error(w, "Недостаточно прав: вы не можете одобрять запросы доступа к этому серверу", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// canApprove проверяет, входит ли оператор в число одобряющих для сервера
+func (h *AccessRequestHandler) canApprove(admin *models.Admin, serverID int64) (bool, error) {
+	policy, err := auth.LoadApprovalPolicy(h.DB, serverID)
+	if err != nil {
+		return false, err
+	}
+	return policy.CanApprove(h.DB, admin)
+}
+
+// canView проверяет, может ли оператор видеть запрос: с разрешением access:read - любой,
+// иначе свой запрос или ожидающий запрос, который он может одобрить
+func (h *AccessRequestHandler) canView(admin *models.Admin, request *models.AccessRequest) (bool, error) {
+	if admin.HasPermission(auth.PermAccessRead) || request.RequesterID == admin.ID {
+		return true, nil
+	}
+	if request.Status != models.AccessRequestPending {
+		return false, nil
+	}
+	return h.canApprove(admin, request.ServerID)
+}
+
+// request получает запрос доступа по ID из URL и отвечает ошибкой, если его нет
+func (h *AccessRequestHandler) request(w http.ResponseWriter, r *http.Request) (*models.AccessRequest, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	request, err := models.GetAccessRequestByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Запрос доступа не найден: "+err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+
+	return request, true
+}
+
+// respond записывает изменение запроса доступа в журнал аудита и отправляет его актуальное состояние
+func (h *AccessRequestHandler) respond(w http.ResponseWriter, r *http.Request, status int, id int64, event models.AuditEvent) {
+	request, err := models.GetAccessRequestByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Ошибка при получении запроса доступа: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	event.UserID = request.UserID
+	event.ServerID = request.ServerID
+	event.Target = accessRequestTarget(id)
+	event.After = auditState(request)
+	audit(h.DB, r, event, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(request)
+}
+
+// decodeDecision читает необязательный комментарий к решению по запросу доступа
+func decodeDecision(w http.ResponseWriter, r *http.Request, input *decisionInput) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	if err := json.NewDecoder(r.Body).Decode(input); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// accessRequestTarget описывает запрос доступа как объект действия в журнале аудита
+func accessRequestTarget(id int64) string {
+	return "access_request:" + strconv.FormatInt(id, 10)
+}
@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"ssh-gate/auth"
+	"ssh-gate/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// AdminHandler содержит обработчики для API операторов
+type AdminHandler struct {
+	DB *sql.DB
+}
+
+// NewAdminHandler создает новый экземпляр AdminHandler
+func NewAdminHandler(db *sql.DB) *AdminHandler {
+	return &AdminHandler{DB: db}
+}
+
+// adminRequest описывает данные для создания оператора, смены пароля или роли.
+// UserID связывает оператора с пользователем SSH, для которого он может запрашивать доступ
+type adminRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+	UserID   int64  `json:"user_id"`
+}
+
+// minPasswordLength минимальная длина пароля оператора
+const minPasswordLength = 12
+
+// CreateAdmin обрабатывает запрос на создание оператора
+func (h *AdminHandler) CreateAdmin(w http.ResponseWriter, r *http.Request) {
+	var request adminRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Username == "" {
+		http.Error(w, "Имя оператора обязательно", http.StatusBadRequest)
+		return
+	}
+
+	if len(request.Password) < minPasswordLength {
+		http.Error(w, "Пароль должен быть не короче "+strconv.Itoa(minPasswordLength)+" символов", http.StatusBadRequest)
+		return
+	}
+
+	// По умолчанию новый оператор получает роль с минимальными правами
+	if request.Role == "" {
+		request.Role = auth.RoleAuditor
+	}
+	if !h.roleExists(w, request.Role) {
+		return
+	}
+
+	if request.UserID != 0 {
+		if _, err := models.GetUserByID(h.DB, request.UserID); err != nil {
+			http.Error(w, "Пользователь не найден: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	hash, err := auth.HashPassword(request.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	id, err := models.AddAdmin(h.DB, models.Admin{Username: request.Username, PasswordHash: hash, Role: request.Role, UserID: request.UserID})
+	if err != nil {
+		audit(h.DB, r, models.AuditEvent{Action: models.AuditAdminCreate, Target: "admin:" + request.Username}, err)
+		http.Error(w, "Ошибка при добавлении оператора: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	admin, err := models.GetAdminByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Ошибка при получении оператора: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.DB, r, models.AuditEvent{Action: models.AuditAdminCreate, UserID: admin.UserID, Target: adminTarget(id), After: auditState(admin)}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(admin)
+}
+
+// GetAllAdmins обрабатывает запрос на получение всех операторов
+func (h *AdminHandler) GetAllAdmins(w http.ResponseWriter, r *http.Request) {
+	admins, err := models.GetAllAdmins(h.DB)
+	if err != nil {
+		http.Error(w, "Ошибка при получении операторов: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(admins)
+}
+
+// UpdateAdminPassword обрабатывает запрос на смену пароля оператора
+func (h *AdminHandler) UpdateAdminPassword(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return
+	}
+
+	var request adminRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(request.Password) < minPasswordLength {
+		http.Error(w, "Пароль должен быть не короче "+strconv.Itoa(minPasswordLength)+" символов", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := auth.HashPassword(request.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := models.UpdateAdminPassword(h.DB, id, hash); err != nil {
+		http.Error(w, "Ошибка при смене пароля: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	audit(h.DB, r, models.AuditEvent{Action: models.AuditAdminPassword, Target: adminTarget(id)}, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateAdminRole обрабатывает запрос на назначение роли оператору
+func (h *AdminHandler) UpdateAdminRole(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return
+	}
+
+	var request adminRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Role == "" {
+		http.Error(w, "Роль обязательна", http.StatusBadRequest)
+		return
+	}
+	if !h.roleExists(w, request.Role) {
+		return
+	}
+
+	// Оператор не может понизить сам себя, чтобы не остаться без управления ролями
+	if current := auth.AdminFromContext(r.Context()); current != nil && current.ID == id {
+		http.Error(w, "Нельзя изменить роль собственной учетной записи", http.StatusBadRequest)
+		return
+	}
+
+	before, err := models.GetAdminByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Ошибка при назначении роли: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := models.SetAdminRole(h.DB, id, request.Role); err != nil {
+		http.Error(w, "Ошибка при назначении роли: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	admin, err := models.GetAdminByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Ошибка при получении оператора: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.DB, r, models.AuditEvent{
+		Action: models.AuditAdminRole,
+		Target: adminTarget(id),
+		Before: auditState(before),
+		After:  auditState(admin),
+	}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(admin)
+}
+
+// GetAllRoles обрабатывает запрос на получение всех ролей и их разрешений
+func (h *AdminHandler) GetAllRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := models.GetAllRoles(h.DB)
+	if err != nil {
+		http.Error(w, "Ошибка при получении ролей: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(roles)
+}
+
+// roleExists проверяет существование роли и отвечает ошибкой, если ее нет
+func (h *AdminHandler) roleExists(w http.ResponseWriter, role string) bool {
+	exists, err := models.RoleExists(h.DB, role)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !exists {
+		http.Error(w, "Роль "+role+" не найдена", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// DeleteAdmin обрабатывает запрос на удаление оператора
+func (h *AdminHandler) DeleteAdmin(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return
+	}
+
+	// Оператор не может удалить сам себя, чтобы не остаться без доступа к шлюзу
+	if current := auth.AdminFromContext(r.Context()); current != nil && current.ID == id {
+		http.Error(w, "Нельзя удалить собственную учетную запись", http.StatusBadRequest)
+		return
+	}
+
+	before, err := models.GetAdminByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Ошибка при удалении оператора: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := models.DeleteAdmin(h.DB, id); err != nil {
+		http.Error(w, "Ошибка при удалении оператора: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	audit(h.DB, r, models.AuditEvent{Action: models.AuditAdminDelete, Target: adminTarget(id), Before: auditState(before)}, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminTarget описывает оператора как объект действия в журнале аудита
+func adminTarget(id int64) string {
+	return "admin:" + strconv.FormatInt(id, 10)
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ssh-gate/auth"
+	"ssh-gate/models"
+	"ssh-gate/reconcile"
+)
+
+// Размер страницы журнала аудита
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 500
+)
+
+// AuditHandler содержит обработчики для просмотра, выгрузки и проверки журнала аудита.
+// Key - ключ подписи журнала (nil, если подпись не настроена)
+type AuditHandler struct {
+	DB  *sql.DB
+	Key []byte
+}
+
+// NewAuditHandler создает новый экземпляр AuditHandler
+func NewAuditHandler(db *sql.DB, key []byte) *AuditHandler {
+	return &AuditHandler{DB: db, Key: key}
+}
+
+// auditPage описывает страницу журнала аудита
+type auditPage struct {
+	Events []models.AuditEvent `json:"events"`
+	Total  int                 `json:"total"`
+	Limit  int                 `json:"limit"`
+	Offset int                 `json:"offset"`
+}
+
+// GetAuditEvents обрабатывает запрос на получение страницы журнала аудита
+func (h *AuditHandler) GetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	filter, ok := parseAuditFilter(w, r)
+	if !ok {
+		return
+	}
+
+	filter.Limit = defaultAuditLimit
+	query := r.URL.Query()
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > maxAuditLimit {
+			http.Error(w, "Параметр limit должен быть от 1 до "+strconv.Itoa(maxAuditLimit), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = limit
+	}
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			http.Error(w, "Неверный формат параметра offset", http.StatusBadRequest)
+			return
+		}
+		filter.Offset = offset
+	}
+
+	events, total, err := models.GetAuditEvents(h.DB, filter)
+	if err != nil {
+		http.Error(w, "Ошибка при получении журнала аудита: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(auditPage{Events: events, Total: total, Limit: filter.Limit, Offset: filter.Offset})
+}
+
+// ExportAuditEvents обрабатывает запрос на выгрузку журнала аудита в CSV или JSON.
+// Выгружаются все записи, подходящие под фильтр, без разбиения на страницы
+func (h *AuditHandler) ExportAuditEvents(w http.ResponseWriter, r *http.Request) {
+	filter, ok := parseAuditFilter(w, r)
+	if !ok {
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		http.Error(w, "Формат выгрузки должен быть json или csv", http.StatusBadRequest)
+		return
+	}
+
+	events, _, err := models.GetAuditEvents(h.DB, filter)
+	if err != nil {
+		http.Error(w, "Ошибка при получении журнала аудита: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filename := "audit-" + time.Now().UTC().Format("20060102-150405") + "." + format
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	writer := csv.NewWriter(w)
+	writer.Write([]string{
+		"id", "created_at", "actor_id", "actor", "token_id", "action", "user_id", "server_id",
+		"target", "result", "error", "client_ip", "before", "after", "prev_hash", "hash", "signature",
+	})
+	for _, event := range events {
+		writer.Write([]string{
+			strconv.FormatInt(event.ID, 10),
+			event.CreatedAt.UTC().Format(time.RFC3339Nano),
+			strconv.FormatInt(event.ActorID, 10),
+			event.Actor,
+			strconv.FormatInt(event.TokenID, 10),
+			event.Action,
+			strconv.FormatInt(event.UserID, 10),
+			strconv.FormatInt(event.ServerID, 10),
+			event.Target,
+			event.Result,
+			event.Error,
+			event.ClientIP,
+			string(event.Before),
+			string(event.After),
+			event.PrevHash,
+			event.Hash,
+			event.Signature,
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Ошибка выгрузки журнала аудита: %v", err)
+	}
+}
+
+// VerifyAuditChain обрабатывает запрос на проверку цепочки журнала аудита. В теле запроса
+// можно передать ранее выгруженную контрольную точку, чтобы проверить, что журнал не усечен
+func (h *AuditHandler) VerifyAuditChain(w http.ResponseWriter, r *http.Request) {
+	var checkpoint *models.AuditCheckpoint
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&checkpoint); err != nil {
+			http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := models.VerifyAuditChain(h.DB, h.Key, checkpoint)
+	if err != nil {
+		http.Error(w, "Ошибка при проверке журнала аудита: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// GetAuditCheckpoint обрабатывает запрос на выгрузку контрольной точки журнала аудита.
+// Контрольная точка подписывается, если задан ключ подписи журнала
+func (h *AuditHandler) GetAuditCheckpoint(w http.ResponseWriter, r *http.Request) {
+	checkpoint, err := models.NewAuditCheckpoint(h.DB, h.Key)
+	if err != nil {
+		http.Error(w, "Ошибка при создании контрольной точки: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(checkpoint)
+}
+
+// parseAuditFilter читает условия выборки журнала аудита из параметров запроса
+// и отвечает ошибкой, если они заданы неверно
+func parseAuditFilter(w http.ResponseWriter, r *http.Request) (models.AuditFilter, bool) {
+	query := r.URL.Query()
+	filter := models.AuditFilter{Action: query.Get("action"), Result: query.Get("result")}
+
+	ids := map[string]*int64{"actor_id": &filter.ActorID, "user_id": &filter.UserID, "server_id": &filter.ServerID}
+	for name, target := range ids {
+		if value := query.Get(name); value != "" {
+			id, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				http.Error(w, "Неверный формат параметра "+name, http.StatusBadRequest)
+				return filter, false
+			}
+			*target = id
+		}
+	}
+
+	times := map[string]**time.Time{"from": &filter.From, "to": &filter.To}
+	for name, target := range times {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "Параметр "+name+" должен быть в формате RFC 3339", http.StatusBadRequest)
+				return filter, false
+			}
+			*target = &t
+		}
+	}
+
+	return filter, true
+}
+
+// audit записывает действие оператора в журнал аудита. Исполнитель и API-токен берутся
+// из контекста запроса, если они не указаны в событии явно. Если err не nil, действие
+// записывается как невыполненное. Выполненное действие может содержать в Error ошибки
+// серверов, синхронизация которых будет повторена при сверке.
+// Ошибка записи в журнал не прерывает обработку запроса
+func audit(db *sql.DB, r *http.Request, event models.AuditEvent, err error) {
+	event = withActor(r, event)
+
+	event.Result = models.AuditSuccess
+	if err != nil {
+		event.Result = models.AuditFailure
+		event.Error = err.Error()
+	}
+
+	if _, err := models.AddAuditEvent(db, event); err != nil {
+		log.Printf("Ошибка записи в журнал аудита (%s): %v", event.Action, err)
+	}
+}
+
+// withActor дополняет событие журнала аудита исполнителем, API-токеном и адресом клиента из запроса
+func withActor(r *http.Request, event models.AuditEvent) models.AuditEvent {
+	if event.Actor == "" {
+		if admin := auth.AdminFromContext(r.Context()); admin != nil {
+			event.ActorID = admin.ID
+			event.Actor = admin.Username
+		}
+	}
+	if token := auth.TokenFromContext(r.Context()); token != nil && event.TokenID == 0 {
+		event.TokenID = token.ID
+	}
+	event.ClientIP = clientIP(r)
+	return event
+}
+
+// auditState возвращает состояние объекта для журнала аудита в JSON
+func auditState(value any) json.RawMessage {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// driftErrors объединяет ошибки синхронизации серверов для журнала аудита
+func driftErrors(drifts ...*reconcile.Drift) string {
+	var messages []string
+	for _, drift := range drifts {
+		if drift != nil && drift.Error != "" {
+			messages = append(messages, drift.Server+": "+drift.Error)
+		}
+	}
+	return strings.Join(messages, "; ")
+}
+
+// driftError возвращает ошибку синхронизации сервера или nil, если сервер синхронизирован
+func driftError(drift *reconcile.Drift) error {
+	if drift == nil {
+		return nil
+	}
+	return drift.Err()
+}
+
+// clientIP возвращает адрес клиента без порта
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"ssh-gate/auth"
+	"ssh-gate/models"
+)
+
+// dummyPasswordHash используется для сравнения, когда оператор не найден,
+// чтобы время ответа не выдавало существование учетной записи
+var dummyPasswordHash, _ = auth.HashPassword("ssh-gate")
+
+// errInvalidCredentials записывается в журнал аудита при неудачной попытке входа
+var errInvalidCredentials = errors.New("неверное имя пользователя или пароль")
+
+// AuthHandler содержит обработчики входа и выхода операторов
+type AuthHandler struct {
+	DB          *sql.DB
+	OIDCEnabled bool
+}
+
+// NewAuthHandler создает новый экземпляр AuthHandler
+func NewAuthHandler(db *sql.DB, oidcEnabled bool) *AuthHandler {
+	return &AuthHandler{DB: db, OIDCEnabled: oidcEnabled}
+}
+
+// Methods обрабатывает запрос на получение доступных способов входа
+func (h *AuthHandler) Methods(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{
+		"password": true,
+		"oidc":     h.OIDCEnabled,
+	})
+}
+
+// loginRequest описывает учетные данные для входа
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Login обрабатывает запрос на вход оператора и открывает сессию
+func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	var request loginRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Username == "" || request.Password == "" {
+		http.Error(w, "Имя пользователя и пароль обязательны", http.StatusBadRequest)
+		return
+	}
+
+	admin, err := models.GetAdminByUsername(h.DB, request.Username)
+	if err != nil {
+		auth.CheckPassword(dummyPasswordHash, request.Password)
+		audit(h.DB, r, models.AuditEvent{Action: models.AuditLogin, Actor: request.Username}, errInvalidCredentials)
+		http.Error(w, "Неверное имя пользователя или пароль", http.StatusUnauthorized)
+		return
+	}
+
+	if !auth.CheckPassword(admin.PasswordHash, request.Password) {
+		audit(h.DB, r, models.AuditEvent{Action: models.AuditLogin, ActorID: admin.ID, Actor: admin.Username}, errInvalidCredentials)
+		http.Error(w, "Неверное имя пользователя или пароль", http.StatusUnauthorized)
+		return
+	}
+
+	// Попутно очищаем истекшие сессии
+	if err := models.DeleteExpiredSessions(h.DB); err != nil {
+		log.Printf("Ошибка при удалении истекших сессий: %v", err)
+	}
+
+	if err := auth.StartSession(w, h.DB, admin.ID); err != nil {
+		http.Error(w, "Ошибка при создании сессии: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.DB, r, models.AuditEvent{Action: models.AuditLogin, ActorID: admin.ID, Actor: admin.Username}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(admin)
+}
+
+// Logout обрабатывает запрос на выход оператора и закрывает сессию
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	if err := auth.EndSession(w, r, h.DB); err != nil {
+		http.Error(w, "Ошибка при завершении сессии: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.DB, r, models.AuditEvent{Action: models.AuditLogout}, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Me обрабатывает запрос на получение текущего оператора
+func (h *AuthHandler) Me(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(auth.AdminFromContext(r.Context()))
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+
+	"ssh-gate/jobs"
+	"ssh-gate/models"
+	"ssh-gate/reconcile"
+)
+
+// GateKeyHandler содержит обработчики для собственных ключей шлюза
+type GateKeyHandler struct {
+	DB         *sql.DB
+	Reconciler *reconcile.Engine
+	Queue      *jobs.Queue
+}
+
+// NewGateKeyHandler создает новый экземпляр GateKeyHandler
+func NewGateKeyHandler(db *sql.DB, reconciler *reconcile.Engine, queue *jobs.Queue) *GateKeyHandler {
+	return &GateKeyHandler{DB: db, Reconciler: reconciler, Queue: queue}
+}
+
+// GetGateKeys обрабатывает запрос на получение ключей шлюза: активного, заменяемых
+// и выведенных из обращения, с числом серверов, на которых установлен каждый ключ
+func (h *GateKeyHandler) GetGateKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := models.GetGateKeys(h.DB)
+	if err != nil {
+		http.Error(w, "Ошибка при получении ключей шлюза: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// RotateGateKey обрабатывает запрос на ротацию ключа шлюза. Новый ключ сразу становится
+// активным, а серверы переводятся на него по одному в фоновой задаче
+func (h *GateKeyHandler) RotateGateKey(w http.ResponseWriter, r *http.Request) {
+	previous, err := models.GetActiveGateKey(h.DB)
+	if err != nil {
+		http.Error(w, "Ошибка при получении ключа шлюза: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	key, err := h.Reconciler.NewGateKey()
+	if err != nil {
+		http.Error(w, "Ошибка при создании ключа шлюза: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	event := models.AuditEvent{Action: models.AuditGateKeyRotate, Before: auditState(previous), After: auditState(key)}
+	enqueueJob(w, r, h.Queue, reconcile.JobRotateGateKey, reconcile.GateKeyJobTarget, reconcile.RotateGateKeyJob{GateKeyID: key.ID}, event)
+}
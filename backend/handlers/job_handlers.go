@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ssh-gate/auth"
+	"ssh-gate/jobs"
+	"ssh-gate/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Размер списка задач
+const (
+	defaultJobLimit = 50
+	maxJobLimit     = 500
+)
+
+// jobStreamInterval период проверки хода выполнения задачи при потоковой передаче
+const jobStreamInterval = 500 * time.Millisecond
+
+// JobHandler содержит обработчики для просмотра и отмены задач очереди
+type JobHandler struct {
+	DB    *sql.DB
+	Queue *jobs.Queue
+}
+
+// NewJobHandler создает новый экземпляр JobHandler
+func NewJobHandler(db *sql.DB, queue *jobs.Queue) *JobHandler {
+	return &JobHandler{DB: db, Queue: queue}
+}
+
+// jobResponse описывает задачу вместе с журналом ее выполнения
+type jobResponse struct {
+	models.Job
+	Logs []models.JobLog `json:"logs"`
+}
+
+// GetJobs обрабатывает запрос на получение последних задач. Параметр status
+// оставляет только задачи в указанном состоянии
+func (h *JobHandler) GetJobs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := defaultJobLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > maxJobLimit {
+			http.Error(w, "Параметр limit должен быть от 1 до "+strconv.Itoa(maxJobLimit), http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	list, err := models.GetJobs(h.DB, query.Get("status"), limit)
+	if err != nil {
+		http.Error(w, "Ошибка при получении задач: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// GetJob обрабатывает запрос на получение задачи вместе с журналом выполнения
+func (h *JobHandler) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.job(w, r)
+	if !ok {
+		return
+	}
+
+	logs, err := models.GetJobLogs(h.DB, job.ID, 0)
+	if err != nil {
+		http.Error(w, "Ошибка при получении журнала задачи: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobResponse{Job: *job, Logs: logs})
+}
+
+// StreamJob передает ход выполнения задачи в формате Server-Sent Events: события log
+// с новыми записями журнала и status при изменении состояния. Поток закрывается
+// после завершения задачи
+func (h *JobHandler) StreamJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.job(w, r)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Потоковая передача не поддерживается", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	ticker := time.NewTicker(jobStreamInterval)
+	defer ticker.Stop()
+
+	var lastLogID int64
+	lastState := ""
+	for {
+		logs, err := models.GetJobLogs(h.DB, job.ID, lastLogID)
+		if err != nil {
+			writeEvent(w, "error", err.Error())
+			flusher.Flush()
+			return
+		}
+		for _, entry := range logs {
+			writeEvent(w, "log", entry)
+			lastLogID = entry.ID
+		}
+
+		if job, err = models.GetJobByID(h.DB, job.ID); err != nil {
+			writeEvent(w, "error", err.Error())
+			flusher.Flush()
+			return
+		}
+		if state := job.Status + ":" + strconv.Itoa(job.Attempts); state != lastState {
+			writeEvent(w, "status", job)
+			lastState = state
+		}
+		flusher.Flush()
+
+		if job.Finished() {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CancelJob обрабатывает запрос на отмену задачи. Ожидающая задача больше не выполняется,
+// выполняемая прерывается при первой возможности
+func (h *JobHandler) CancelJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.job(w, r)
+	if !ok {
+		return
+	}
+
+	admin := auth.AdminFromContext(r.Context())
+	if job.ActorID != admin.ID && !admin.HasPermission(auth.PermAccessWrite) {
+		auth.Forbidden(w, auth.PermAccessWrite)
+		return
+	}
+
+	cancelled, err := h.Queue.Cancel(job.ID)
+	if err != nil {
+		http.Error(w, "Ошибка при отмене задачи: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !cancelled {
+		http.Error(w, "Задача уже завершена", http.StatusConflict)
+		return
+	}
+
+	job, err = models.GetJobByID(h.DB, job.ID)
+	if err != nil {
+		http.Error(w, "Ошибка при получении задачи: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// job получает задачу по ID из URL и проверяет, что оператор может ее просматривать:
+// свои задачи доступны всегда, чужие - с разрешением access:read
+func (h *JobHandler) job(w http.ResponseWriter, r *http.Request) (*models.Job, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	job, err := models.GetJobByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Задача не найдена: "+err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+
+	admin := auth.AdminFromContext(r.Context())
+	if admin == nil || (job.ActorID != admin.ID && !admin.HasPermission(auth.PermAccessRead)) {
+		auth.Forbidden(w, auth.PermAccessRead)
+		return nil, false
+	}
+
+	return job, true
+}
+
+// writeEvent записывает событие Server-Sent Events с данными в JSON
+func writeEvent(w http.ResponseWriter, name string, value any) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+}
+
+// async проверяет, запрошено ли выполнение операции в фоне через очередь задач
+func async(r *http.Request) bool {
+	value, _ := strconv.ParseBool(r.URL.Query().Get("async"))
+	return value
+}
+
+// enqueueJob ставит операцию в очередь задач и отвечает 202 с созданной задачей.
+// Событие аудита записывается от имени оператора после завершения задачи
+func enqueueJob(w http.ResponseWriter, r *http.Request, queue *jobs.Queue, kind, target string, payload any, event models.AuditEvent) {
+	job, err := queue.Enqueue(kind, target, payload, withActor(r, event))
+	if err != nil {
+		http.Error(w, "Ошибка при постановке задачи в очередь: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/jobs/"+strconv.FormatInt(job.ID, 10))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"ssh-gate/ssh"
+)
+
+// jumpHostKeysFile файл authorized_keys на jump-сервере
+const jumpHostKeysFile = "authorized_keys"
+
+// addJumpHostKeys добавляет ключи в authorized_keys jump-сервера
+func addJumpHostKeys(lines ...string) error {
+	return editJumpHostKeys(func(file *ssh.AuthorizedKeysFile) {
+		for _, line := range lines {
+			if key, err := ssh.ParseAuthorizedKey(line); err == nil {
+				file.Add(key)
+			}
+		}
+	})
+}
+
+// removeJumpHostKeys удаляет ключи из authorized_keys jump-сервера, остальные строки сохраняются как есть
+func removeJumpHostKeys(lines ...string) error {
+	return editJumpHostKeys(func(file *ssh.AuthorizedKeysFile) {
+		for _, line := range lines {
+			if key, err := ssh.ParseAuthorizedKey(line); err == nil {
+				file.Remove(key.Key)
+			}
+		}
+	})
+}
+
+// jumpHostKeysMu защищает authorized_keys jump-сервера от одновременных изменений:
+// без нее два запроса прочитают файл одновременно и последняя запись потеряет изменения первой
+var jumpHostKeysMu sync.Mutex
+
+// editJumpHostKeys читает authorized_keys jump-сервера, применяет к нему edit и записывает результат
+func editJumpHostKeys(edit func(file *ssh.AuthorizedKeysFile)) error {
+	jumpHostKeysMu.Lock()
+	defer jumpHostKeysMu.Unlock()
+
+	data, err := os.ReadFile(jumpHostKeysFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("ошибка чтения файла authorized_keys: %w", err)
+	}
+
+	file := ssh.ParseAuthorizedKeysFile(data)
+	edit(file)
+
+	return writeJumpHostKeys(file.Bytes())
+}
+
+// writeJumpHostKeys атомарно записывает authorized_keys jump-сервера: содержимое пишется
+// во временный файл в том же каталоге, получает права исходного файла и переименовывается поверх
+func writeJumpHostKeys(content []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(jumpHostKeysFile); err == nil {
+		mode = info.Mode().Perm()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("ошибка получения сведений о файле authorized_keys: %w", err)
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(jumpHostKeysFile), filepath.Base(jumpHostKeysFile)+".ssh-gate-*")
+	if err != nil {
+		return fmt.Errorf("ошибка создания временного файла: %w", err)
+	}
+
+	if err := writeJumpHostTempFile(temp, content, mode); err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+
+	if err := os.Rename(temp.Name(), jumpHostKeysFile); err != nil {
+		os.Remove(temp.Name())
+		return fmt.Errorf("ошибка замены файла authorized_keys: %w", err)
+	}
+
+	return nil
+}
+
+// writeJumpHostTempFile записывает содержимое во временный файл, сбрасывает его на диск
+// и выставляет ему права
+func writeJumpHostTempFile(file *os.File, content []byte, mode os.FileMode) error {
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return fmt.Errorf("ошибка записи временного файла: %w", err)
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("ошибка записи временного файла: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("ошибка записи временного файла: %w", err)
+	}
+
+	if err := os.Chmod(file.Name(), mode); err != nil {
+		return fmt.Errorf("ошибка установки прав на временный файл: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"ssh-gate/ssh"
+
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func TestJumpHostKeysConcurrentEdits(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	lines := make([]string, 20)
+	for i := range lines {
+		public, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := gossh.NewPublicKey(public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines[i] = strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key)))
+	}
+
+	var wg sync.WaitGroup
+	for _, line := range lines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := addJumpHostKeys(line); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	data, err := os.ReadFile(jumpHostKeysFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := ssh.ParseAuthorizedKeysFile(data)
+	if got := len(file.Keys()); got != len(lines) {
+		t.Fatalf("в authorized_keys %d ключей, ожидалось %d", got, len(lines))
+	}
+
+	// Временные файлы не остаются рядом с authorized_keys
+	entries, err := os.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != filepath.Base(jumpHostKeysFile) {
+		t.Fatalf("в каталоге остались файлы: %v", entries)
+	}
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"ssh-gate/auth"
+	"ssh-gate/models"
+	"ssh-gate/sso"
+
+	"golang.org/x/oauth2"
+)
+
+// oidcStateCookie хранит state, nonce и PKCE-верификатор на время входа через провайдера.
+// oidcUsernameAttempts ограничивает подбор свободного имени при первом входе
+const (
+	oidcStateCookie      = "ssh_gate_oidc"
+	oidcStateTTL         = 10 * time.Minute
+	oidcUsernameAttempts = 100
+)
+
+// OIDCHandler содержит обработчики входа через OpenID Connect
+type OIDCHandler struct {
+	DB       *sql.DB
+	Provider *sso.Provider
+}
+
+// NewOIDCHandler создает новый экземпляр OIDCHandler
+func NewOIDCHandler(db *sql.DB, provider *sso.Provider) *OIDCHandler {
+	return &OIDCHandler{DB: db, Provider: provider}
+}
+
+// Login перенаправляет оператора на страницу входа OIDC-провайдера
+func (h *OIDCHandler) Login(w http.ResponseWriter, r *http.Request) {
+	state, err := auth.NewToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	nonce, err := auth.NewToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	verifier := oauth2.GenerateVerifier()
+
+	// Cookie должна пережить возврат с сайта провайдера, поэтому SameSite=Lax
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    strings.Join([]string{state, nonce, verifier}, "."),
+		Path:     "/api/auth/oidc",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   auth.CookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, h.Provider.AuthCodeURL(state, nonce, verifier), http.StatusFound)
+}
+
+// Callback завершает вход через OIDC-провайдера: проверяет ID-токен, назначает роль
+// по группам провайдера, при первом входе создает оператора и пользователя SSH и открывает сессию
+func (h *OIDCHandler) Callback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil {
+		http.Error(w, "Сессия входа не найдена или истекла", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/auth/oidc", MaxAge: -1})
+
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 || r.URL.Query().Get("state") != parts[0] {
+		http.Error(w, "Неверный параметр state", http.StatusBadRequest)
+		return
+	}
+	nonce, verifier := parts[1], parts[2]
+
+	if errorCode := r.URL.Query().Get("error"); errorCode != "" {
+		http.Error(w, "Провайдер отклонил вход: "+errorCode, http.StatusUnauthorized)
+		return
+	}
+
+	identity, err := h.Provider.Exchange(r.Context(), r.URL.Query().Get("code"), nonce, verifier)
+	if err != nil {
+		audit(h.DB, r, models.AuditEvent{Action: models.AuditLoginOIDC}, err)
+		http.Error(w, "Ошибка входа через OIDC: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	role, ok := h.Provider.Role(identity.Groups)
+	if !ok {
+		audit(h.DB, r, models.AuditEvent{Action: models.AuditLoginOIDC, Actor: identity.Username},
+			errors.New("ни одна из групп пользователя не сопоставлена роли шлюза"))
+		http.Error(w, "Ни одна из групп пользователя не сопоставлена роли шлюза", http.StatusForbidden)
+		return
+	}
+
+	admin, err := h.findOrCreateAdmin(identity, role)
+	if err != nil {
+		http.Error(w, "Ошибка при создании оператора: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := auth.StartSession(w, h.DB, admin.ID); err != nil {
+		http.Error(w, "Ошибка при создании сессии: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.DB, r, models.AuditEvent{
+		Action:  models.AuditLoginOIDC,
+		ActorID: admin.ID,
+		Actor:   admin.Username,
+		UserID:  admin.UserID,
+		After:   auditState(admin),
+	}, nil)
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// findOrCreateAdmin находит оператора по субъекту провайдера или создает нового оператора вместе
+// с новым пользователем SSH. Роль существующего оператора обновляется, так как источником истины
+// для групп служит провайдер
+func (h *OIDCHandler) findOrCreateAdmin(identity *sso.Identity, role string) (*models.Admin, error) {
+	admin, err := models.GetAdminByOIDCSubject(h.DB, identity.Subject)
+	if err == nil {
+		if admin.Role != role {
+			if err := models.SetAdminRole(h.DB, admin.ID, role); err != nil {
+				return nil, err
+			}
+			admin.Role = role
+		}
+		return admin, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// С существующими учетными записями оператор связывается только по субъекту: имя пользователь
+	// может сменить у провайдера сам. Если имя уже занято, новой учетной записи назначается свободное
+	username, err := h.freeUsername(identity.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	// Пользователь SSH создается без ключа: ключ добавляется отдельно
+	userID, err := models.AddUser(h.DB, models.User{Username: username})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Создан пользователь %s при первом входе через OIDC (субъект %s)", username, identity.Subject)
+
+	id, err := models.AddOIDCAdmin(h.DB, models.Admin{Username: username, Role: role, UserID: userID}, identity.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	return models.GetAdminByID(h.DB, id)
+}
+
+// freeUsername возвращает имя, не занятое ни оператором, ни пользователем SSH:
+// само имя или имя с номером, например alice-2
+func (h *OIDCHandler) freeUsername(name string) (string, error) {
+	for n := 1; n <= oidcUsernameAttempts; n++ {
+		candidate := name
+		if n > 1 {
+			candidate = fmt.Sprintf("%s-%d", name, n)
+		}
+
+		taken, err := models.UsernameTaken(h.DB, candidate)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("не удалось подобрать свободное имя для %s", name)
+}
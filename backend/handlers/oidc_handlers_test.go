@@ -0,0 +1,453 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"ssh-gate/auth"
+	"ssh-gate/db"
+	"ssh-gate/models"
+	"ssh-gate/secrets"
+	"ssh-gate/sso"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+const (
+	testClientID    = "ssh-gate"
+	testRedirectURL = "http://gate.test/api/auth/oidc/callback"
+	testCode        = "test-code"
+)
+
+// mockProvider - локальный OIDC-провайдер: отдает discovery, JWKS и выдает
+// ID-токены на token-эндпоинте, проверяя код авторизации и PKCE
+type mockProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu        sync.Mutex
+	challenge string         // code_challenge из запроса авторизации
+	nonce     string         // nonce из запроса авторизации
+	claims    map[string]any // Дополнительные claims следующего ID-токена
+	signWith  *rsa.PrivateKey
+	override  func(claims map[string]any)
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("ошибка генерации ключа провайдера: %v", err)
+	}
+
+	p := &mockProvider{t: t, key: key, claims: map[string]any{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/token", p.token)
+	p.server = httptest.NewServer(mux)
+	t.Cleanup(p.server.Close)
+
+	return p
+}
+
+func (p *mockProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := p.server.URL
+	json.NewEncoder(w).Encode(map[string]any{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"jwks_uri":                              issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (p *mockProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key:       &p.key.PublicKey,
+		KeyID:     "test",
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}}})
+}
+
+func (p *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if r.PostForm.Get("code") != testCode || base64.RawURLEncoding.EncodeToString(sum[:]) != p.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	claims := map[string]any{
+		"iss":   p.server.URL,
+		"aud":   testClientID,
+		"sub":   "subject-1",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": p.nonce,
+	}
+	for name, value := range p.claims {
+		claims[name] = value
+	}
+	if p.override != nil {
+		p.override(claims)
+	}
+
+	signWith := p.key
+	if p.signWith != nil {
+		signWith = p.signWith
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: signWith, KeyID: "test"}}, nil)
+	if err != nil {
+		p.t.Errorf("ошибка создания подписи: %v", err)
+		return
+	}
+	payload, _ := json.Marshal(claims)
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		p.t.Errorf("ошибка подписи ID-токена: %v", err)
+		return
+	}
+	idToken, _ := signed.CompactSerialize()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// newOIDCTest создает базу данных, провайдера и обработчик входа через OIDC
+func newOIDCTest(t *testing.T, roleMap map[string]string, defaultRole string) (*OIDCHandler, *mockProvider) {
+	t.Helper()
+
+	masterKey, err := secrets.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keeper, err := secrets.NewKeeper(masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database, err := db.InitDB(filepath.Join(t.TempDir(), "users.db"), keeper)
+	if err != nil {
+		t.Fatalf("ошибка инициализации базы данных: %v", err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	roles, err := auth.RoleNames(database)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock := newMockProvider(t)
+	provider, err := sso.New(context.Background(), sso.Config{
+		Issuer:      mock.server.URL,
+		ClientID:    testClientID,
+		RedirectURL: testRedirectURL,
+		GroupsClaim: "groups",
+		RoleMap:     roleMap,
+		DefaultRole: defaultRole,
+		Roles:       roles,
+	})
+	if err != nil {
+		t.Fatalf("ошибка подключения к провайдеру: %v", err)
+	}
+
+	return NewOIDCHandler(database, provider), mock
+}
+
+// startLogin выполняет перенаправление на провайдера и возвращает cookie входа и state
+func startLogin(t *testing.T, h *OIDCHandler, mock *mockProvider) (*http.Cookie, string) {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	h.Login(recorder, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil))
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("Login: код %d, ожидался %d", recorder.Code, http.StatusFound)
+	}
+
+	location, err := url.Parse(recorder.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := location.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("Login: PKCE не используется: %s", location)
+	}
+
+	mock.mu.Lock()
+	mock.challenge = query.Get("code_challenge")
+	mock.nonce = query.Get("nonce")
+	mock.mu.Unlock()
+
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcStateCookie {
+		t.Fatalf("Login: не установлена cookie входа: %v", cookies)
+	}
+
+	return cookies[0], query.Get("state")
+}
+
+// callback возвращает пользователя с провайдера с указанными state и cookie входа
+func callback(h *OIDCHandler, cookie *http.Cookie, state string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, "/api/auth/oidc/callback?"+url.Values{"code": {testCode}, "state": {state}}.Encode(), nil)
+	if cookie != nil {
+		request.AddCookie(cookie)
+	}
+
+	recorder := httptest.NewRecorder()
+	h.Callback(recorder, request)
+	return recorder
+}
+
+func TestOIDCCallbackCreatesAdminWithMappedRole(t *testing.T) {
+	h, mock := newOIDCTest(t, map[string]string{"ops": auth.RoleLead, "sre": auth.RoleAdmin}, "")
+	mock.claims = map[string]any{"preferred_username": "alice", "groups": []string{"ops", "sre"}}
+
+	cookie, state := startLogin(t, h, mock)
+	recorder := callback(h, cookie, state)
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("Callback: код %d, ожидался %d: %s", recorder.Code, http.StatusFound, recorder.Body)
+	}
+
+	var session bool
+	for _, c := range recorder.Result().Cookies() {
+		if c.Name == auth.SessionCookie && c.Value != "" {
+			session = true
+		}
+	}
+	if !session {
+		t.Fatal("Callback: сессия не открыта")
+	}
+
+	admin, err := models.GetAdminByOIDCSubject(h.DB, "subject-1")
+	if err != nil {
+		t.Fatalf("оператор не создан: %v", err)
+	}
+	// Из нескольких подходящих групп выбирается роль с большими правами
+	if admin.Username != "alice" || admin.Role != auth.RoleAdmin {
+		t.Fatalf("оператор %s с ролью %s, ожидался alice с ролью %s", admin.Username, admin.Role, auth.RoleAdmin)
+	}
+	if _, err := models.GetUserByUsername(h.DB, "alice"); err != nil {
+		t.Fatalf("пользователь SSH не создан: %v", err)
+	}
+
+	// При повторном входе роль обновляется по группам провайдера
+	mock.claims["groups"] = []string{"ops"}
+	cookie, state = startLogin(t, h, mock)
+	if recorder := callback(h, cookie, state); recorder.Code != http.StatusFound {
+		t.Fatalf("повторный Callback: код %d: %s", recorder.Code, recorder.Body)
+	}
+	admin, err = models.GetAdminByOIDCSubject(h.DB, "subject-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin.Role != auth.RoleLead {
+		t.Fatalf("роль %s после повторного входа, ожидалась %s", admin.Role, auth.RoleLead)
+	}
+}
+
+func TestOIDCCallbackDoesNotLinkByUsername(t *testing.T) {
+	h, mock := newOIDCTest(t, map[string]string{"ops": auth.RoleAdmin}, "")
+
+	// Локальный оператор и пользователь SSH с тем же именем, что у пользователя провайдера
+	userID, err := models.AddUser(h.DB, models.User{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	localID, err := models.AddAdmin(h.DB, models.Admin{Username: "alice", PasswordHash: "hash", Role: auth.RoleAuditor, UserID: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.claims = map[string]any{"preferred_username": "alice", "groups": []string{"ops"}}
+	cookie, state := startLogin(t, h, mock)
+	recorder := callback(h, cookie, state)
+	if recorder.Code != http.StatusFound {
+		t.Fatalf("Callback: код %d, ожидался %d: %s", recorder.Code, http.StatusFound, recorder.Body)
+	}
+
+	admin, err := models.GetAdminByOIDCSubject(h.DB, "subject-1")
+	if err != nil {
+		t.Fatalf("оператор не создан: %v", err)
+	}
+	if admin.ID == localID || admin.UserID == userID {
+		t.Fatal("вход через OIDC связан с локальной учетной записью по имени")
+	}
+	if admin.Username != "alice-2" || admin.Role != auth.RoleAdmin {
+		t.Fatalf("оператор %s с ролью %s, ожидался alice-2 с ролью %s", admin.Username, admin.Role, auth.RoleAdmin)
+	}
+	if user, err := models.GetUserByID(h.DB, admin.UserID); err != nil || user.Username != "alice-2" {
+		t.Fatalf("пользователь SSH оператора: %v, %v", user, err)
+	}
+
+	local, err := models.GetAdminByID(h.DB, localID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local.Role != auth.RoleAuditor || local.UserID != userID {
+		t.Fatalf("локальный оператор изменен: %+v", local)
+	}
+
+	// Другой субъект с тем же именем получает отдельную учетную запись
+	mock.override = func(claims map[string]any) { claims["sub"] = "subject-2" }
+	cookie, state = startLogin(t, h, mock)
+	if recorder := callback(h, cookie, state); recorder.Code != http.StatusFound {
+		t.Fatalf("Callback второго субъекта: код %d: %s", recorder.Code, recorder.Body)
+	}
+	other, err := models.GetAdminByOIDCSubject(h.DB, "subject-2")
+	if err != nil {
+		t.Fatalf("оператор второго субъекта не создан: %v", err)
+	}
+	if other.ID == admin.ID || other.Username != "alice-3" {
+		t.Fatalf("оператор второго субъекта %s (ID %d)", other.Username, other.ID)
+	}
+}
+
+func TestOIDCCallbackRoleMapping(t *testing.T) {
+	tests := []struct {
+		name        string
+		defaultRole string
+		groups      []string
+		code        int
+		role        string
+	}{
+		{name: "без подходящих групп", groups: []string{"guests"}, code: http.StatusForbidden},
+		{name: "без групп", code: http.StatusForbidden},
+		{name: "роль по умолчанию", defaultRole: auth.RoleAuditor, groups: []string{"guests"}, code: http.StatusFound, role: auth.RoleAuditor},
+		{name: "группа важнее роли по умолчанию", defaultRole: auth.RoleAuditor, groups: []string{"ops"}, code: http.StatusFound, role: auth.RoleLead},
+		{name: "несколько групп", groups: []string{"audit", "ops", "admins"}, code: http.StatusFound, role: auth.RoleAdmin},
+		{name: "несколько групп без admin", groups: []string{"audit", "ops"}, code: http.StatusFound, role: auth.RoleLead},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := newOIDCTest(t, map[string]string{"ops": auth.RoleLead, "admins": auth.RoleAdmin, "audit": auth.RoleAuditor}, tt.defaultRole)
+			mock.claims = map[string]any{"preferred_username": "bob"}
+			if tt.groups != nil {
+				mock.claims["groups"] = tt.groups
+			}
+
+			cookie, state := startLogin(t, h, mock)
+			recorder := callback(h, cookie, state)
+			if recorder.Code != tt.code {
+				t.Fatalf("Callback: код %d, ожидался %d: %s", recorder.Code, tt.code, recorder.Body)
+			}
+
+			admin, err := models.GetAdminByOIDCSubject(h.DB, "subject-1")
+			if tt.role == "" {
+				if err == nil {
+					t.Fatalf("создан оператор %s без разрешенной роли", admin.Username)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("оператор не создан: %v", err)
+			}
+			if admin.Role != tt.role {
+				t.Fatalf("роль %s, ожидалась %s", admin.Role, tt.role)
+			}
+		})
+	}
+}
+
+func TestOIDCCallbackRejectsInvalidLogin(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		prepare func(mock *mockProvider, cookie **http.Cookie, state *string)
+		code    int
+	}{
+		{
+			name:    "неверный state",
+			prepare: func(mock *mockProvider, cookie **http.Cookie, state *string) { *state = "forged" },
+			code:    http.StatusBadRequest,
+		},
+		{
+			name:    "нет cookie входа",
+			prepare: func(mock *mockProvider, cookie **http.Cookie, state *string) { *cookie = nil },
+			code:    http.StatusBadRequest,
+		},
+		{
+			name: "неверный nonce",
+			prepare: func(mock *mockProvider, cookie **http.Cookie, state *string) {
+				mock.override = func(claims map[string]any) { claims["nonce"] = "replayed" }
+			},
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "подпись чужим ключом",
+			prepare: func(mock *mockProvider, cookie **http.Cookie, state *string) {
+				mock.signWith = otherKey
+			},
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "токен для другого клиента",
+			prepare: func(mock *mockProvider, cookie **http.Cookie, state *string) {
+				mock.override = func(claims map[string]any) { claims["aud"] = "other-client" }
+			},
+			code: http.StatusUnauthorized,
+		},
+		{
+			name: "истекший токен",
+			prepare: func(mock *mockProvider, cookie **http.Cookie, state *string) {
+				mock.override = func(claims map[string]any) { claims["exp"] = time.Now().Add(-time.Hour).Unix() }
+			},
+			code: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := newOIDCTest(t, map[string]string{"ops": auth.RoleAdmin}, "")
+			mock.claims = map[string]any{"preferred_username": "mallory", "groups": []string{"ops"}}
+
+			cookie, state := startLogin(t, h, mock)
+			tt.prepare(mock, &cookie, &state)
+
+			recorder := callback(h, cookie, state)
+			if recorder.Code != tt.code {
+				t.Fatalf("Callback: код %d, ожидался %d: %s", recorder.Code, tt.code, recorder.Body)
+			}
+			for _, c := range recorder.Result().Cookies() {
+				if c.Name == auth.SessionCookie && c.Value != "" {
+					t.Fatal("сессия открыта после отклоненного входа")
+				}
+			}
+			if _, err := models.GetAdminByOIDCSubject(h.DB, "subject-1"); err == nil {
+				t.Fatal("оператор создан после отклоненного входа")
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ssh-gate/auth"
+	"ssh-gate/models"
+	"ssh-gate/reconcile"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// PlanHandler содержит обработчики для планов изменений доступа
+type PlanHandler struct {
+	DB         *sql.DB
+	Reconciler *reconcile.Engine
+}
+
+// NewPlanHandler создает новый экземпляр PlanHandler
+func NewPlanHandler(db *sql.DB, reconciler *reconcile.Engine) *PlanHandler {
+	return &PlanHandler{DB: db, Reconciler: reconciler}
+}
+
+// planRequest описывает запрос на подготовку плана
+type planRequest struct {
+	Changes []models.PlanChange `json:"changes"`
+}
+
+// CreatePlan обрабатывает запрос на подготовку плана изменений доступа
+func (h *PlanHandler) CreatePlan(w http.ResponseWriter, r *http.Request) {
+	var request planRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.Reconciler.ValidateChanges(request.Changes); err != nil {
+		http.Error(w, "Неверный план: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !h.canWritePlan(w, r, request.Changes) {
+		return
+	}
+
+	createPlan(w, r, h.Reconciler, request.Changes)
+}
+
+// GetAllPlans обрабатывает запрос на получение всех планов
+func (h *PlanHandler) GetAllPlans(w http.ResponseWriter, r *http.Request) {
+	plans, err := models.GetAllPlans(h.DB)
+	if err != nil {
+		http.Error(w, "Ошибка при получении планов: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plans)
+}
+
+// GetPlan обрабатывает запрос на получение плана по ID
+func (h *PlanHandler) GetPlan(w http.ResponseWriter, r *http.Request) {
+	plan, ok := h.plan(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
+
+// ApplyPlan обрабатывает запрос на применение плана по ID
+func (h *PlanHandler) ApplyPlan(w http.ResponseWriter, r *http.Request) {
+	plan, ok := h.plan(w, r)
+	if !ok {
+		return
+	}
+
+	if plan.Status != models.PlanStatusPending {
+		http.Error(w, "План уже применен", http.StatusConflict)
+		return
+	}
+
+	if time.Since(plan.CreatedAt) > reconcile.PlanTTL {
+		http.Error(w, "План устарел, подготовьте его заново", http.StatusConflict)
+		return
+	}
+
+	// Права проверяются для оператора, который применяет план
+	if !h.canWritePlan(w, r, plan.Changes) {
+		return
+	}
+
+	applied, err := h.Reconciler.ApplyPlan(r.Context(), plan)
+	if err != nil {
+		audit(h.DB, r, models.AuditEvent{Action: models.AuditPlanApply, Target: planTarget(plan.ID), Before: auditState(plan.Changes)}, err)
+		http.Error(w, "Ошибка при применении плана: "+err.Error(), http.StatusConflict)
+		return
+	}
+	auditPlan(h.DB, r, applied)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(applied)
+}
+
+// canWritePlan проверяет, может ли оператор менять доступ ко всем серверам плана
+func (h *PlanHandler) canWritePlan(w http.ResponseWriter, r *http.Request, changes []models.PlanChange) bool {
+	admin := auth.AdminFromContext(r.Context())
+	for _, change := range changes {
+		allowed, err := auth.CanWriteAccess(h.DB, admin, change.ServerID)
+		if err != nil {
+			log.Printf("Ошибка при проверке групп оператора: %v", err)
+			http.Error(w, "Ошибка при проверке прав доступа", http.StatusInternalServerError)
+			return false
+		}
+		if !allowed {
+			auth.Forbidden(w, auth.PermAccessWrite+" (сервер "+strconv.FormatInt(change.ServerID, 10)+")")
+			return false
+		}
+	}
+	return true
+}
+
+// plan получает план по ID из URL и отвечает ошибкой, если его нет
+func (h *PlanHandler) plan(w http.ResponseWriter, r *http.Request) (*models.Plan, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	plan, err := models.GetPlanByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "План не найден: "+err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+
+	return plan, true
+}
+
+// dryRun проверяет, запрошен ли план вместо применения изменений (параметр dry_run=true)
+func dryRun(r *http.Request) bool {
+	value, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	return value
+}
+
+// createPlan подготавливает план и отправляет его в ответе
+func createPlan(w http.ResponseWriter, r *http.Request, reconciler *reconcile.Engine, changes []models.PlanChange) {
+	admin := auth.AdminFromContext(r.Context())
+
+	plan, err := reconciler.Plan(r.Context(), admin.ID, changes)
+	if err != nil {
+		http.Error(w, "Ошибка при подготовке плана: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(reconciler.DB, r, models.AuditEvent{Action: models.AuditPlanCreate, Target: planTarget(plan.ID), After: auditState(plan.Changes)}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(plan)
+}
+
+// auditPlan записывает итог применения плана в журнал аудита отдельно по каждому серверу:
+// изменения плана, относящиеся к серверу, и результат его синхронизации
+func auditPlan(db *sql.DB, r *http.Request, plan *models.Plan) {
+	var reports []*reconcile.Drift
+	if err := json.Unmarshal(plan.Result, &reports); err != nil {
+		log.Printf("Ошибка чтения итога плана %d: %v", plan.ID, err)
+	}
+
+	for _, drift := range reports {
+		var changes []models.PlanChange
+		for _, change := range plan.Changes {
+			if change.ServerID == drift.ServerID {
+				changes = append(changes, change)
+			}
+		}
+
+		event := models.AuditEvent{
+			Action:   models.AuditPlanApply,
+			ServerID: drift.ServerID,
+			Target:   planTarget(plan.ID),
+			Before:   auditState(changes),
+			After:    auditState(drift),
+		}
+		if len(changes) == 1 {
+			event.UserID = changes[0].UserID
+		}
+		audit(db, r, event, driftError(drift))
+	}
+}
+
+// planTarget описывает план как объект действия в журнале аудита
+func planTarget(id int64) string {
+	return "plan:" + strconv.FormatInt(id, 10)
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"ssh-gate/models"
+	"ssh-gate/reconcile"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ReconcileHandler содержит обработчики для сверки серверов с базой данных
+type ReconcileHandler struct {
+	DB         *sql.DB
+	Reconciler *reconcile.Engine
+}
+
+// NewReconcileHandler создает новый экземпляр ReconcileHandler
+func NewReconcileHandler(db *sql.DB, reconciler *reconcile.Engine) *ReconcileHandler {
+	return &ReconcileHandler{DB: db, Reconciler: reconciler}
+}
+
+// GetServerDrift обрабатывает запрос на получение отчета о расхождениях для сервера
+func (h *ReconcileHandler) GetServerDrift(w http.ResponseWriter, r *http.Request) {
+	server, ok := h.server(w, r)
+	if !ok {
+		return
+	}
+
+	drift, err := h.Reconciler.Check(r.Context(), server)
+	if err != nil {
+		http.Error(w, "Ошибка при сверке сервера: "+err.Error(), sshErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drift)
+}
+
+// ReconcileServer обрабатывает запрос на устранение расхождений на сервере
+func (h *ReconcileHandler) ReconcileServer(w http.ResponseWriter, r *http.Request) {
+	server, ok := h.server(w, r)
+	if !ok {
+		return
+	}
+
+	// В режиме dry_run только подготавливаем план
+	if dryRun(r) {
+		createPlan(w, r, h.Reconciler, []models.PlanChange{{Action: models.PlanActionReconcile, ServerID: server.ID}})
+		return
+	}
+
+	drift, err := h.Reconciler.Apply(r.Context(), server)
+	if err != nil {
+		audit(h.DB, r, models.AuditEvent{Action: models.AuditReconcile, ServerID: server.ID}, err)
+		http.Error(w, "Ошибка при сверке сервера: "+err.Error(), sshErrorStatus(err))
+		return
+	}
+	audit(h.DB, r, models.AuditEvent{Action: models.AuditReconcile, ServerID: server.ID, After: auditState(drift)}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drift)
+}
+
+// GetAllDrift обрабатывает запрос на получение отчетов о расхождениях для всех серверов
+func (h *ReconcileHandler) GetAllDrift(w http.ResponseWriter, r *http.Request) {
+	reports, err := h.Reconciler.CheckAll(r.Context())
+	if err != nil {
+		http.Error(w, "Ошибка при сверке серверов: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// ReconcileAll обрабатывает запрос на устранение расхождений на всех серверах
+func (h *ReconcileHandler) ReconcileAll(w http.ResponseWriter, r *http.Request) {
+	// В режиме dry_run только подготавливаем план для всех серверов
+	if dryRun(r) {
+		servers, err := models.GetAllServers(h.DB)
+		if err != nil {
+			http.Error(w, "Ошибка при получении серверов: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(servers) == 0 {
+			http.Error(w, "Нет серверов для сверки", http.StatusBadRequest)
+			return
+		}
+
+		changes := make([]models.PlanChange, 0, len(servers))
+		for _, server := range servers {
+			changes = append(changes, models.PlanChange{Action: models.PlanActionReconcile, ServerID: server.ID})
+		}
+		createPlan(w, r, h.Reconciler, changes)
+		return
+	}
+
+	reports, err := h.Reconciler.ApplyAll(r.Context())
+	if err != nil {
+		http.Error(w, "Ошибка при сверке серверов: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// В журнал попадают только серверы, на которых что-то менялось или произошла ошибка
+	for _, drift := range reports {
+		if drift.Applied || drift.Error != "" {
+			audit(h.DB, r, models.AuditEvent{Action: models.AuditReconcile, ServerID: drift.ServerID, After: auditState(drift)}, driftError(drift))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// server получает сервер по ID из URL и отвечает ошибкой, если его нет
+func (h *ReconcileHandler) server(w http.ResponseWriter, r *http.Request) (models.Server, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return models.Server{}, false
+	}
+
+	server, err := models.GetServerByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Сервер не найден: "+err.Error(), http.StatusNotFound)
+		return models.Server{}, false
+	}
+
+	return server, true
+}
@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"ssh-gate/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ServerGroupHandler содержит обработчики для API групп серверов
+type ServerGroupHandler struct {
+	DB *sql.DB
+}
+
+// NewServerGroupHandler создает новый экземпляр ServerGroupHandler
+func NewServerGroupHandler(db *sql.DB) *ServerGroupHandler {
+	return &ServerGroupHandler{DB: db}
+}
+
+// CreateServerGroup обрабатывает запрос на создание группы серверов
+func (h *ServerGroupHandler) CreateServerGroup(w http.ResponseWriter, r *http.Request) {
+	var group models.ServerGroup
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if group.Name == "" {
+		http.Error(w, "Название группы обязательно", http.StatusBadRequest)
+		return
+	}
+
+	id, err := models.AddServerGroup(h.DB, group.Name)
+	if err != nil {
+		http.Error(w, "Ошибка при добавлении группы серверов: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	group.ID = id
+	group.ServerIDs = []int64{}
+	group.AdminIDs = []int64{}
+	audit(h.DB, r, models.AuditEvent{Action: models.AuditGroupCreate, Target: groupTarget(id), After: auditState(group)}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(group)
+}
+
+// GetAllServerGroups обрабатывает запрос на получение всех групп серверов
+func (h *ServerGroupHandler) GetAllServerGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := models.GetAllServerGroups(h.DB)
+	if err != nil {
+		http.Error(w, "Ошибка при получении групп серверов: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+// DeleteServerGroup обрабатывает запрос на удаление группы серверов
+func (h *ServerGroupHandler) DeleteServerGroup(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := models.DeleteServerGroup(h.DB, id); err != nil {
+		http.Error(w, "Ошибка при удалении группы серверов: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	audit(h.DB, r, models.AuditEvent{Action: models.AuditGroupDelete, Target: groupTarget(id)}, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AddServerToGroup обрабатывает запрос на добавление сервера в группу
+func (h *ServerGroupHandler) AddServerToGroup(w http.ResponseWriter, r *http.Request) {
+	h.updateMembership(w, r, "serverId", models.AuditGroupAddServer, models.AddServerToGroup)
+}
+
+// RemoveServerFromGroup обрабатывает запрос на исключение сервера из группы
+func (h *ServerGroupHandler) RemoveServerFromGroup(w http.ResponseWriter, r *http.Request) {
+	h.updateMembership(w, r, "serverId", models.AuditGroupRemoveServer, models.RemoveServerFromGroup)
+}
+
+// AddAdminToGroup обрабатывает запрос на закрепление группы за оператором
+func (h *ServerGroupHandler) AddAdminToGroup(w http.ResponseWriter, r *http.Request) {
+	h.updateMembership(w, r, "adminId", models.AuditGroupAddAdmin, models.AddAdminToServerGroup)
+}
+
+// RemoveAdminFromGroup обрабатывает запрос на открепление группы от оператора
+func (h *ServerGroupHandler) RemoveAdminFromGroup(w http.ResponseWriter, r *http.Request) {
+	h.updateMembership(w, r, "adminId", models.AuditGroupRemoveAdmin, models.RemoveAdminFromServerGroup)
+}
+
+// updateMembership разбирает ID группы и участника из маршрута, применяет изменение состава группы
+// и записывает его в журнал аудита
+func (h *ServerGroupHandler) updateMembership(w http.ResponseWriter, r *http.Request, memberParam, action string, update func(*sql.DB, int64, int64) error) {
+	groupID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID группы", http.StatusBadRequest)
+		return
+	}
+
+	memberID, err := strconv.ParseInt(chi.URLParam(r, memberParam), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID участника группы", http.StatusBadRequest)
+		return
+	}
+
+	if err := update(h.DB, groupID, memberID); err != nil {
+		http.Error(w, "Ошибка при изменении состава группы: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	event := models.AuditEvent{Action: action, Target: groupTarget(groupID)}
+	if memberParam == "serverId" {
+		event.ServerID = memberID
+	} else {
+		event.After = auditState(map[string]int64{"admin_id": memberID})
+	}
+	audit(h.DB, r, event, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetApprovalRule обрабатывает запрос на получение правила одобрения запросов доступа к серверам группы
+func (h *ServerGroupHandler) GetApprovalRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return
+	}
+
+	rule, err := models.GetApprovalRule(h.DB, id)
+	if err != nil {
+		http.Error(w, "Правило одобрения не найдено: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// SetApprovalRule обрабатывает запрос на установку правила одобрения запросов доступа к серверам группы
+func (h *ServerGroupHandler) SetApprovalRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return
+	}
+
+	var rule models.ApprovalRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	exists, err := models.ServerGroupExists(h.DB, id)
+	if err != nil {
+		http.Error(w, "Ошибка при получении группы серверов: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Группа серверов не найдена", http.StatusNotFound)
+		return
+	}
+
+	if len(rule.ApproverIDs) == 0 && rule.ApproverRole == "" {
+		http.Error(w, "Укажите одобряющих операторов (approver_ids) или роль (approver_role)", http.StatusBadRequest)
+		return
+	}
+
+	if rule.ApproverRole != "" {
+		exists, err := models.RoleExists(h.DB, rule.ApproverRole)
+		if err != nil {
+			http.Error(w, "Ошибка при проверке роли: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			http.Error(w, "Неизвестная роль: "+rule.ApproverRole, http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, adminID := range rule.ApproverIDs {
+		if _, err := models.GetAdminByID(h.DB, adminID); err != nil {
+			http.Error(w, "Оператор не найден: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if rule.RequiredApprovals == 0 {
+		rule.RequiredApprovals = 1
+	}
+	if rule.RequiredApprovals < 0 || rule.MaxDuration < 0 {
+		http.Error(w, "Число одобрений и наибольший срок доступа не могут быть отрицательными", http.StatusBadRequest)
+		return
+	}
+
+	// Прежнее правило нужно только для журнала аудита, его может не быть
+	previous, _ := models.GetApprovalRule(h.DB, id)
+
+	rule.GroupID = id
+	if err := models.SetApprovalRule(h.DB, rule); err != nil {
+		http.Error(w, "Ошибка при сохранении правила одобрения: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.DB, r, models.AuditEvent{
+		Action: models.AuditApprovalRuleSet,
+		Target: groupTarget(id),
+		Before: auditState(previous),
+		After:  auditState(rule),
+	}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rule)
+}
+
+// DeleteApprovalRule обрабатывает запрос на удаление правила одобрения группы серверов
+func (h *ServerGroupHandler) DeleteApprovalRule(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return
+	}
+
+	previous, err := models.GetApprovalRule(h.DB, id)
+	if err != nil {
+		http.Error(w, "Ошибка при удалении правила одобрения: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := models.DeleteApprovalRule(h.DB, id); err != nil {
+		http.Error(w, "Ошибка при удалении правила одобрения: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	audit(h.DB, r, models.AuditEvent{Action: models.AuditApprovalRuleDel, Target: groupTarget(id), Before: auditState(previous)}, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// groupTarget описывает группу серверов как объект действия в журнале аудита
+func groupTarget(id int64) string {
+	return "group:" + strconv.FormatInt(id, 10)
+}
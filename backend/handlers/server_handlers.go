@@ -1,12 +1,20 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"strconv"
+	"time"
 
+	"ssh-gate/auth"
+	"ssh-gate/jobs"
 	"ssh-gate/models"
+	"ssh-gate/reconcile"
+	"ssh-gate/secrets"
 	"ssh-gate/ssh"
 
 	"github.com/go-chi/chi/v5"
@@ -14,12 +22,15 @@ import (
 
 // ServerHandler содержит обработчики для API серверов
 type ServerHandler struct {
-	DB *sql.DB
+	DB         *sql.DB
+	Secrets    *secrets.Keeper
+	Reconciler *reconcile.Engine
+	Queue      *jobs.Queue
 }
 
 // NewServerHandler создает новый экземпляр ServerHandler
-func NewServerHandler(db *sql.DB) *ServerHandler {
-	return &ServerHandler{DB: db}
+func NewServerHandler(db *sql.DB, keeper *secrets.Keeper, reconciler *reconcile.Engine, queue *jobs.Queue) *ServerHandler {
+	return &ServerHandler{DB: db, Secrets: keeper, Reconciler: reconciler, Queue: queue}
 }
 
 // CreateServer обрабатывает запрос на создание нового сервера
@@ -30,8 +41,8 @@ func (h *ServerHandler) CreateServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if server.IP == "" || server.Login == "" || server.Password == "" {
-		http.Error(w, "IP, логин и пароль обязательны", http.StatusBadRequest)
+	if server.IP == "" || server.Login == "" {
+		http.Error(w, "IP и логин обязательны", http.StatusBadRequest)
 		return
 	}
 
@@ -39,6 +50,38 @@ func (h *ServerHandler) CreateServer(w http.ResponseWriter, r *http.Request) {
 		server.Port = 22
 	}
 
+	if err := models.ValidateLabels(server.Labels); err != nil {
+		http.Error(w, "Неверные метки сервера: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if server.Labels == nil {
+		server.Labels = map[string]string{}
+	} else if len(server.Labels) > 0 && !canLabel(r) {
+		auth.Forbidden(w, auth.PermAccessWrite)
+		return
+	}
+
+	// Ключ хоста можно закрепить заранее, не дожидаясь первого подключения
+	if server.HostKey != "" {
+		key, err := ssh.ParseHostKey(server.HostKey)
+		if err != nil {
+			http.Error(w, "Неверный формат ключа хоста: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		server.HostKey = ssh.FormatHostKey(key)
+	}
+
+	if !h.credentials(w, &server, nil) {
+		return
+	}
+
+	// Пароль нужен только для установки ключа шлюза и после нее не сохраняется
+	if err := h.enroll(r.Context(), &server); err != nil {
+		audit(h.DB, r, models.AuditEvent{Action: models.AuditServerCreate, After: auditState(server)}, err)
+		http.Error(w, "Ошибка при установке ключа шлюза на сервер: "+err.Error(), sshErrorStatus(err))
+		return
+	}
+
 	id, err := models.AddServer(h.DB, server)
 	if err != nil {
 		http.Error(w, "Ошибка при добавлении сервера: "+err.Error(), http.StatusInternalServerError)
@@ -46,6 +89,15 @@ func (h *ServerHandler) CreateServer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	server.ID = id
+	event := models.AuditEvent{Action: models.AuditServerCreate, ServerID: id, After: auditState(server)}
+	// Сервер с метками может сразу подойти под политики доступа групп
+	if len(server.Labels) > 0 {
+		if users, err := models.GetServerUsers(h.DB, id); err == nil && len(users) > 0 {
+			event.Error = h.syncLabels(r.Context(), server)
+		}
+	}
+	audit(h.DB, r, event, nil)
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(server)
@@ -70,14 +122,31 @@ func (h *ServerHandler) GetServer(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(server)
 }
 
-// GetAllServers обрабатывает запрос на получение всех серверов
+// GetAllServers обрабатывает запрос на получение всех серверов.
+// Параметр selector, например env=prod,team=billing, оставляет только серверы с этими метками
 func (h *ServerHandler) GetAllServers(w http.ResponseWriter, r *http.Request) {
+	selector, err := models.ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		http.Error(w, "Неверный селектор: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	servers, err := models.GetAllServers(h.DB)
 	if err != nil {
 		http.Error(w, "Ошибка при получении серверов: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	if len(selector) > 0 {
+		matched := []models.Server{}
+		for _, server := range servers {
+			if models.MatchLabels(server.Labels, selector) {
+				matched = append(matched, server)
+			}
+		}
+		servers = matched
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(servers)
 }
@@ -97,8 +166,8 @@ func (h *ServerHandler) UpdateServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if server.IP == "" || server.Login == "" || server.Password == "" {
-		http.Error(w, "IP, логин и пароль обязательны", http.StatusBadRequest)
+	if server.IP == "" || server.Login == "" {
+		http.Error(w, "IP и логин обязательны", http.StatusBadRequest)
 		return
 	}
 
@@ -106,17 +175,235 @@ func (h *ServerHandler) UpdateServer(w http.ResponseWriter, r *http.Request) {
 		server.Port = 22
 	}
 
+	existing, err := models.GetServerByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Сервер не найден: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if !h.credentials(w, &server, &existing) {
+		return
+	}
+
+	// Метки, не переданные в запросе, остаются прежними
+	if server.Labels == nil {
+		server.Labels = existing.Labels
+	} else if err := models.ValidateLabels(server.Labels); err != nil {
+		http.Error(w, "Неверные метки сервера: "+err.Error(), http.StatusBadRequest)
+		return
+	} else if !models.LabelsEqual(existing.Labels, server.Labels) && !canLabel(r) {
+		auth.Forbidden(w, auth.PermAccessWrite)
+		return
+	}
+
+	// Закрепленный ключ хоста меняется только через отдельный эндпоинт
 	server.ID = id
+	server.HostKey = existing.HostKey
+	if err := h.enroll(r.Context(), &server); err != nil {
+		audit(h.DB, r, models.AuditEvent{Action: models.AuditServerUpdate, ServerID: id, Before: auditState(existing)}, err)
+		http.Error(w, "Ошибка при установке ключа шлюза на сервер: "+err.Error(), sshErrorStatus(err))
+		return
+	}
 	if err := models.UpdateServer(h.DB, server); err != nil {
 		http.Error(w, "Ошибка при обновлении сервера: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	// Ключ хоста мог быть закреплен при первом подключении во время установки ключа шлюза
+	if server.HostKey != existing.HostKey {
+		if _, err := models.PinServerHostKey(h.DB, id, server.HostKey); err != nil {
+			http.Error(w, "Ошибка при закреплении ключа хоста: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	// Подключения с прежним адресом или учетными данными больше не используются
+	h.Reconciler.Pool.Invalidate(id)
+
+	event := models.AuditEvent{Action: models.AuditServerUpdate, ServerID: id, Before: auditState(existing), After: auditState(server)}
+	// Изменение меток выдает или отзывает доступ по политикам групп
+	if !models.LabelsEqual(existing.Labels, server.Labels) {
+		event.Error = h.syncLabels(r.Context(), server)
+	}
+	audit(h.DB, r, event, nil)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(server)
 }
 
-// AssignServerToUser обрабатывает запрос на привязку сервера к пользователю
+// credentials проверяет способ входа на сервер и его учетные данные и шифрует новые значения:
+// в базе данных они хранятся только в зашифрованном виде. Учетные данные не возвращаются из API,
+// поэтому непереданные значения берутся из existing (nil при создании сервера).
+// Учетные данные другого способа входа не сохраняются. Если пароль передан без способа входа,
+// шлюз входит по своему ключу: пароль остается в открытом виде до установки ключа в enroll
+func (h *ServerHandler) credentials(w http.ResponseWriter, server *models.Server, existing *models.Server) bool {
+	if server.AuthMethod == "" {
+		switch {
+		case server.PrivateKey != "":
+			server.AuthMethod = models.ServerAuthKey
+		case server.Password == "" && existing != nil:
+			server.AuthMethod = existing.AuthMethod
+		default:
+			server.AuthMethod = models.ServerAuthGate
+		}
+	}
+
+	// Ключ шлюза назначается только при его установке на сервер
+	server.GateKeyID = 0
+
+	switch server.AuthMethod {
+	case models.ServerAuthGate:
+		if server.PrivateKey != "" || server.Passphrase != "" {
+			http.Error(w, "Приватный ключ передается только при входе по ключу (auth_method: key)", http.StatusBadRequest)
+			return false
+		}
+
+		if server.Password == "" {
+			if existing == nil || existing.AuthMethod != models.ServerAuthGate {
+				http.Error(w, "Для установки ключа шлюза на сервер нужен пароль", http.StatusBadRequest)
+				return false
+			}
+			server.GateKeyID = existing.GateKeyID
+		}
+		server.PrivateKey, server.Passphrase, server.PublicKey = "", "", ""
+
+	case models.ServerAuthPassword:
+		if server.PrivateKey != "" || server.Passphrase != "" {
+			http.Error(w, "Приватный ключ передается только при входе по ключу (auth_method: key)", http.StatusBadRequest)
+			return false
+		}
+
+		if server.Password == "" && existing != nil {
+			server.Password = existing.Password
+		} else {
+			encrypted, err := h.Secrets.Encrypt(server.Password)
+			if err != nil {
+				http.Error(w, "Ошибка при шифровании пароля: "+err.Error(), http.StatusInternalServerError)
+				return false
+			}
+			server.Password = encrypted
+		}
+		if server.Password == "" {
+			http.Error(w, "Для входа по паролю нужен пароль", http.StatusBadRequest)
+			return false
+		}
+		server.PrivateKey, server.Passphrase, server.PublicKey = "", "", ""
+
+	case models.ServerAuthKey:
+		if server.Password != "" {
+			http.Error(w, "Пароль передается только при входе по паролю (auth_method: password)", http.StatusBadRequest)
+			return false
+		}
+
+		if server.PrivateKey == "" {
+			if server.Passphrase != "" {
+				http.Error(w, "Парольная фраза передается вместе с приватным ключом", http.StatusBadRequest)
+				return false
+			}
+			if existing == nil || existing.PrivateKey == "" {
+				http.Error(w, "Для входа по ключу нужен приватный ключ", http.StatusBadRequest)
+				return false
+			}
+			server.PrivateKey, server.Passphrase, server.PublicKey = existing.PrivateKey, existing.Passphrase, existing.PublicKey
+			return true
+		}
+
+		publicKey, err := ssh.ValidatePrivateKey(server.PrivateKey, server.Passphrase)
+		if err != nil {
+			http.Error(w, "Неверный приватный ключ: "+err.Error(), http.StatusBadRequest)
+			return false
+		}
+		privateKey, err := h.Secrets.Encrypt(server.PrivateKey)
+		if err != nil {
+			http.Error(w, "Ошибка при шифровании приватного ключа: "+err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		passphrase, err := h.Secrets.Encrypt(server.Passphrase)
+		if err != nil {
+			http.Error(w, "Ошибка при шифровании парольной фразы: "+err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		server.PrivateKey, server.Passphrase, server.PublicKey = privateKey, passphrase, publicKey
+
+	default:
+		http.Error(w, "Неизвестный способ входа: "+server.AuthMethod+" (допустимы gate, password и key)", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// enroll устанавливает на сервер ключ шлюза, если для входа по нему передан пароль.
+// После установки и проверки ключа пароль удаляется из server
+func (h *ServerHandler) enroll(ctx context.Context, server *models.Server) error {
+	if server.AuthMethod != models.ServerAuthGate || server.Password == "" {
+		return nil
+	}
+
+	return h.Reconciler.Enroll(ctx, server, server.Password)
+}
+
+// EnrollServer обрабатывает запрос на перевод сервера на вход по ключу шлюза. Шлюз входит
+// с сохраненными учетными данными сервера, устанавливает свой ключ, проверяет вход по нему
+// и удаляет сохраненные пароль или приватный ключ
+func (h *ServerHandler) EnrollServer(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return
+	}
+
+	server, err := models.GetServerByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Сервер не найден: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if server.AuthMethod == models.ServerAuthGate {
+		http.Error(w, "Шлюз уже входит на сервер по своему ключу", http.StatusConflict)
+		return
+	}
+
+	event := models.AuditEvent{Action: models.AuditServerEnroll, ServerID: id, Before: auditState(server)}
+	enrolled := server
+	if err := h.Reconciler.Enroll(r.Context(), &enrolled, ""); err != nil {
+		audit(h.DB, r, event, err)
+		http.Error(w, "Ошибка при установке ключа шлюза на сервер: "+err.Error(), sshErrorStatus(err))
+		return
+	}
+
+	if err := models.UpdateServer(h.DB, enrolled); err != nil {
+		http.Error(w, "Ошибка при обновлении сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.Reconciler.Pool.Invalidate(id)
+	event.After = auditState(enrolled)
+	audit(h.DB, r, event, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(enrolled)
+}
+
+// canLabel проверяет, может ли оператор менять метки сервера. Метки выдают доступ по политикам
+// групп, поэтому кроме servers:write нужно разрешение access:write
+func canLabel(r *http.Request) bool {
+	admin := auth.AdminFromContext(r.Context())
+	return admin != nil && admin.HasPermission(auth.PermAccessWrite)
+}
+
+// syncLabels приводит ключи сервера в соответствие с политиками доступа после изменения меток.
+// Если сервер недоступен, ключи будут обновлены при следующей сверке, а ошибка возвращается
+// для записи в журнал аудита
+func (h *ServerHandler) syncLabels(ctx context.Context, server models.Server) string {
+	if _, err := h.Reconciler.Apply(ctx, server); err != nil {
+		log.Printf("Ошибка обновления ключей сервера %d после изменения меток: %v", server.ID, err)
+		return err.Error()
+	}
+	return ""
+}
+
+// AssignServerToUser обрабатывает запрос на привязку сервера к пользователю.
+// В теле запроса можно передать expires_at: тогда доступ временный и будет отозван после
+// истечения срока. Повторная привязка изменяет срок уже выданного доступа
 func (h *ServerHandler) AssignServerToUser(w http.ResponseWriter, r *http.Request) {
 
 	userIDStr := chi.URLParam(r, "userId")
@@ -134,6 +421,21 @@ func (h *ServerHandler) AssignServerToUser(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	var request struct {
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if request.ExpiresAt != nil && !request.ExpiresAt.After(time.Now()) {
+		http.Error(w, "Срок действия доступа должен быть в будущем", http.StatusBadRequest)
+		return
+	}
+
 	// Получаем информацию о пользователе
 	user, err := models.GetUserByID(h.DB, userID)
 	if err != nil {
@@ -148,39 +450,65 @@ func (h *ServerHandler) AssignServerToUser(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Проверяем корректность публичного ключа
-	if err := ssh.ValidatePublicKey(user.PublicKey); err != nil {
-		http.Error(w, "Неверный формат публичного ключа: "+err.Error(), http.StatusBadRequest)
+	// Проверяем, что у пользователя есть ключи для выдачи на сервер
+	keys, err := models.GetActiveUserKeys(h.DB, user.ID)
+	if err != nil {
+		http.Error(w, "Ошибка при получении ключей пользователя: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(keys) == 0 {
+		http.Error(w, "У пользователя нет активных ключей", http.StatusBadRequest)
+		return
+	}
+
+	// В режиме dry_run только подготавливаем план
+	if dryRun(r) {
+		createPlan(w, r, h.Reconciler, []models.PlanChange{{Action: models.PlanActionGrant, UserID: userID, ServerID: serverID, ExpiresAt: request.ExpiresAt}})
 		return
 	}
 
-	// Создаем конфигурацию для SSH-подключения
-	sshConfig := ssh.SSHConfig{
-		Host:     server.IP,
-		Port:     server.Port,
-		User:     server.Login,
-		Password: server.Password,
+	previous, err := models.GetGrant(h.DB, userID, serverID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Ошибка при получении привязки сервера: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
+	event := models.AuditEvent{Action: models.AuditAccessGrant, UserID: userID, ServerID: serverID, Before: auditState(previous)}
 
-	// Добавляем публичный ключ на сервер, к которому надо получить доступ пользователю
-	if err := ssh.AddAuthorizedKey(sshConfig, user.PublicKey); err != nil {
-		http.Error(w, "Ошибка при добавлении ключа на сервер: "+err.Error(), http.StatusInternalServerError)
+	// В режиме async доступ выдается в фоне с повторными попытками
+	if async(r) {
+		enqueueJob(w, r, h.Queue, reconcile.JobGrant, reconcile.JobTarget(serverID), reconcile.GrantJob{UserID: userID, ServerID: serverID, ExpiresAt: request.ExpiresAt}, event)
 		return
 	}
 
-	// Привязываем сервер к пользователю в базе данных
-	err = models.AssignServerToUser(h.DB, userID, serverID)
+	// Привязываем сервер к пользователю или изменяем срок существующей привязки
+	// и приводим ключи на сервере в соответствие с базой данных
+	if _, err := h.Reconciler.Grant(r.Context(), server, userID, request.ExpiresAt); err != nil {
+		audit(h.DB, r, event, err)
+		http.Error(w, "Ошибка при добавлении ключа на сервер: "+err.Error(), sshErrorStatus(err))
+		return
+	}
+
+	// Перечитываем сервер: при первом подключении был закреплен ключ хоста
+	server, err = models.GetServerByID(h.DB, serverID)
 	if err != nil {
-		// Если не удалось привязать сервер к пользователю, удаляем ключ с сервера
-		_ = ssh.RemoveAuthorizedKey(sshConfig, user.PublicKey)
-		http.Error(w, "Ошибка при привязке сервера: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Сервер не найден: "+err.Error(), http.StatusNotFound)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	grant, err := models.GetGrant(h.DB, userID, serverID)
+	if err != nil {
+		http.Error(w, "Ошибка при получении привязки сервера: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	event.After = auditState(grant)
+	audit(h.DB, r, event, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.UserServer{Server: server, Grant: *grant, Direct: true})
 }
 
 // GetUserServers обрабатывает запрос на получение всех серверов пользователя
+// со сроками доступа и оставшимся временем временного доступа
 func (h *ServerHandler) GetUserServers(w http.ResponseWriter, r *http.Request) {
 	userIDStr := chi.URLParam(r, "userId")
 	userID, err := strconv.ParseInt(userIDStr, 10, 64)
@@ -189,7 +517,7 @@ func (h *ServerHandler) GetUserServers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	servers, err := models.GetUserServers(h.DB, userID)
+	servers, err := models.GetUserServerGrants(h.DB, userID)
 	if err != nil {
 		http.Error(w, "Ошибка при получении серверов пользователя: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -216,9 +544,8 @@ func (h *ServerHandler) RemoveServerFromUser(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// Получаем информацию о пользователе
-	user, err := models.GetUserByID(h.DB, userID)
-	if err != nil {
+	// Проверяем, что пользователь существует
+	if _, err := models.GetUserByID(h.DB, userID); err != nil {
 		http.Error(w, "Пользователь не найден: "+err.Error(), http.StatusNotFound)
 		return
 	}
@@ -230,27 +557,39 @@ func (h *ServerHandler) RemoveServerFromUser(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	// Создаем конфигурацию для SSH-подключения
-	sshConfig := ssh.SSHConfig{
-		Host:     server.IP,
-		Port:     server.Port,
-		User:     server.Login,
-		Password: server.Password,
+	// В режиме dry_run только подготавливаем план
+	if dryRun(r) {
+		createPlan(w, r, h.Reconciler, []models.PlanChange{{Action: models.PlanActionRevoke, UserID: userID, ServerID: serverID}})
+		return
 	}
 
-	// Удаляем публичный ключ с сервера
-	if err := ssh.RemoveAuthorizedKey(sshConfig, user.PublicKey); err != nil {
-		http.Error(w, "Ошибка при удалении ключа с сервера: "+err.Error(), http.StatusInternalServerError)
+	// Запоминаем привязку, чтобы восстановить ее вместе со сроком при ошибке
+	previous, err := models.GetGrant(h.DB, userID, serverID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Ошибка при удалении привязки сервера: "+err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Ошибка при получении привязки сервера: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Удаляем привязку сервера к пользователю в базе данных
-	err = models.RemoveServerFromUser(h.DB, userID, serverID)
-	if err != nil {
-		http.Error(w, "Ошибка при удалении привязки сервера: "+err.Error(), http.StatusInternalServerError)
+	event := models.AuditEvent{Action: models.AuditAccessRevoke, UserID: userID, ServerID: serverID, Before: auditState(previous)}
+
+	// В режиме async доступ отзывается в фоне с повторными попытками
+	if async(r) {
+		enqueueJob(w, r, h.Queue, reconcile.JobRevoke, reconcile.JobTarget(serverID), reconcile.RevokeJob{UserID: userID, ServerID: serverID}, event)
 		return
 	}
 
+	// Удаляем привязку и приводим ключи на сервере в соответствие с базой данных.
+	// Если не удалось обновить сервер, привязка восстанавливается
+	if _, err := h.Reconciler.Revoke(r.Context(), server, userID); err != nil {
+		audit(h.DB, r, event, err)
+		http.Error(w, "Ошибка при удалении ключа с сервера: "+err.Error(), sshErrorStatus(err))
+		return
+	}
+	audit(h.DB, r, event, nil)
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -270,27 +609,20 @@ func (h *ServerHandler) DeleteServer(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Получаем пользователей, имеющих доступ к серверу
-	users, err := models.GetServerUsers(h.DB, id)
-	if err != nil {
-		http.Error(w, "Ошибка при получении пользователей сервера: "+err.Error(), http.StatusInternalServerError)
+	// В режиме async сервер удаляется в фоне: ключи убираются с повторными попытками,
+	// и только после этого сервер удаляется из базы данных
+	event := models.AuditEvent{Action: models.AuditServerDelete, ServerID: id, Before: auditState(server)}
+	if async(r) {
+		enqueueJob(w, r, h.Queue, reconcile.JobDeleteServer, reconcile.JobTarget(id), reconcile.DeleteServerJob{ServerID: id}, event)
 		return
 	}
 
-	// Конфигурация для SSH-подключения к удаляемому серверу
-	sshConfig := ssh.SSHConfig{
-		Host:     server.IP,
-		Port:     server.Port,
-		User:     server.Login,
-		Password: server.Password,
-	}
-
-	// Отзываем ключи у всех пользователей
-	for _, user := range users {
-		if err := ssh.RemoveAuthorizedKey(sshConfig, user.PublicKey); err != nil {
-			http.Error(w, "Ошибка при удалении ключа с сервера: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
+	// Отзываем ключи у всех пользователей за одно подключение с ограничением времени
+	drift := h.Reconciler.ClearEach(r.Context(), []models.Server{server})[0]
+	if err := drift.Err(); err != nil {
+		audit(h.DB, r, event, err)
+		http.Error(w, "Ошибка при удалении ключа с сервера: "+err.Error(), sshErrorStatus(err))
+		return
 	}
 
 	// Удаляем записи из user_servers после успешного отзыва ключей
@@ -304,6 +636,133 @@ func (h *ServerHandler) DeleteServer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Ошибка при удалении сервера: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	h.Reconciler.Pool.Invalidate(id)
+	audit(h.DB, r, event, nil)
 
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(drift)
+}
+
+// hostKeyResponse описывает закрепленный ключ хоста сервера
+type hostKeyResponse struct {
+	ServerID    int64  `json:"server_id"`
+	Pinned      bool   `json:"pinned"`
+	HostKey     string `json:"host_key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// writeHostKey отправляет информацию о ключе хоста сервера
+func writeHostKey(w http.ResponseWriter, serverID int64, hostKey string) {
+	response := hostKeyResponse{ServerID: serverID, HostKey: hostKey}
+	if hostKey != "" {
+		fingerprint, err := ssh.HostKeyFingerprint(hostKey)
+		if err != nil {
+			http.Error(w, "Ошибка при разборе ключа хоста: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.Pinned = true
+		response.Fingerprint = fingerprint
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetHostKey обрабатывает запрос на получение закрепленного ключа хоста сервера
+func (h *ServerHandler) GetHostKey(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return
+	}
+
+	server, err := models.GetServerByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Сервер не найден: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	writeHostKey(w, server.ID, server.HostKey)
+}
+
+// PinHostKey обрабатывает запрос на повторное закрепление ключа хоста.
+// Если ключ передан в теле запроса, закрепляется он, иначе ключ запрашивается у сервера
+func (h *ServerHandler) PinHostKey(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		HostKey string `json:"host_key"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	server, err := models.GetServerByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Сервер не найден: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	event := models.AuditEvent{Action: models.AuditServerPinHostKey, ServerID: id, Before: auditState(server.HostKey)}
+	hostKey := request.HostKey
+	if hostKey == "" {
+		hostKey, err = ssh.FetchHostKey(r.Context(), server.IP, server.Port, h.Reconciler.Timeouts)
+		if err != nil {
+			audit(h.DB, r, event, err)
+			http.Error(w, "Ошибка при получении ключа хоста: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	key, err := ssh.ParseHostKey(hostKey)
+	if err != nil {
+		http.Error(w, "Неверный формат ключа хоста: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	hostKey = ssh.FormatHostKey(key)
+
+	if err := models.SetServerHostKey(h.DB, id, hostKey); err != nil {
+		http.Error(w, "Ошибка при закреплении ключа хоста: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.Reconciler.Pool.Invalidate(id)
+	event.After = auditState(hostKey)
+	audit(h.DB, r, event, nil)
+
+	writeHostKey(w, id, hostKey)
+}
+
+// ClearHostKey обрабатывает запрос на снятие закрепления ключа хоста.
+// Новый ключ будет закреплен при следующем подключении к серверу
+func (h *ServerHandler) ClearHostKey(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return
+	}
+
+	server, err := models.GetServerByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Сервер не найден: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := models.SetServerHostKey(h.DB, id, ""); err != nil {
+		http.Error(w, "Ошибка при снятии закрепления ключа хоста: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	h.Reconciler.Pool.Invalidate(id)
+	audit(h.DB, r, models.AuditEvent{Action: models.AuditServerClearKey, ServerID: id, Before: auditState(server.HostKey)}, nil)
+
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,17 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"ssh-gate/ssh"
+)
+
+// sshErrorStatus возвращает HTTP-статус для ошибки SSH-операции
+func sshErrorStatus(err error) int {
+	var mismatch *ssh.HostKeyMismatchError
+	if errors.As(err, &mismatch) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"ssh-gate/auth"
+	"ssh-gate/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// defaultTokenTTL срок действия API-токена, если он не указан явно
+const defaultTokenTTL = 90 * 24 * time.Hour
+
+// TokenHandler содержит обработчики для API-токенов
+type TokenHandler struct {
+	DB *sql.DB
+}
+
+// NewTokenHandler создает новый экземпляр TokenHandler
+func NewTokenHandler(db *sql.DB) *TokenHandler {
+	return &TokenHandler{DB: db}
+}
+
+// tokenRequest описывает параметры нового API-токена
+type tokenRequest struct {
+	Name      string   `json:"name"`
+	Kind      string   `json:"kind"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn string   `json:"expires_in"` // Например, "720h"; по умолчанию 90 дней
+}
+
+// createdTokenResponse содержит API-токен в открытом виде, он показывается только один раз
+type createdTokenResponse struct {
+	models.APIToken
+	Token string `json:"token"`
+}
+
+// CreateToken обрабатывает запрос на выпуск API-токена
+func (h *TokenHandler) CreateToken(w http.ResponseWriter, r *http.Request) {
+	admin := auth.AdminFromContext(r.Context())
+
+	var request tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Name == "" {
+		http.Error(w, "Название токена обязательно", http.StatusBadRequest)
+		return
+	}
+
+	if request.Kind == "" {
+		request.Kind = models.TokenKindPersonal
+	}
+	switch request.Kind {
+	case models.TokenKindPersonal:
+	case models.TokenKindService:
+		if !admin.HasPermission(auth.PermAdminsWrite) {
+			auth.Forbidden(w, auth.PermAdminsWrite)
+			return
+		}
+	default:
+		http.Error(w, "Неизвестный вид токена: "+request.Kind, http.StatusBadRequest)
+		return
+	}
+
+	if len(request.Scopes) == 0 {
+		http.Error(w, "Необходимо указать хотя бы одну область действия токена", http.StatusBadRequest)
+		return
+	}
+
+	// Токен не может расширить права оператора, выпустившего его
+	for _, scope := range request.Scopes {
+		if !slices.Contains(auth.AllPermissions, scope) {
+			http.Error(w, "Неизвестная область действия токена: "+scope, http.StatusBadRequest)
+			return
+		}
+		if !admin.HasPermission(scope) {
+			auth.Forbidden(w, scope)
+			return
+		}
+	}
+
+	ttl := defaultTokenTTL
+	if request.ExpiresIn != "" {
+		parsed, err := time.ParseDuration(request.ExpiresIn)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Неверный срок действия токена", http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+	expiresAt := time.Now().Add(ttl).UTC()
+
+	value, err := auth.NewAPIToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token := models.APIToken{
+		AdminID:   admin.ID,
+		Name:      request.Name,
+		Kind:      request.Kind,
+		Scopes:    request.Scopes,
+		ExpiresAt: &expiresAt,
+	}
+
+	id, err := models.AddAPIToken(h.DB, token, auth.HashToken(value))
+	if err != nil {
+		http.Error(w, "Ошибка при выпуске токена: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	created, err := models.GetAPITokenByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Ошибка при получении токена: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	audit(h.DB, r, models.AuditEvent{Action: models.AuditTokenCreate, Target: tokenTarget(id), After: auditState(created)}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(createdTokenResponse{APIToken: *created, Token: value})
+}
+
+// GetAllTokens обрабатывает запрос на получение API-токенов.
+// Операторы с правом admins:read видят все токены, остальные — только собственные
+func (h *TokenHandler) GetAllTokens(w http.ResponseWriter, r *http.Request) {
+	admin := auth.AdminFromContext(r.Context())
+
+	tokens, err := models.GetAllAPITokens(h.DB)
+	if err != nil {
+		http.Error(w, "Ошибка при получении токенов: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	visible := []models.APIToken{}
+	for _, token := range tokens {
+		if token.AdminID == admin.ID || admin.HasPermission(auth.PermAdminsRead) {
+			visible = append(visible, token)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(visible)
+}
+
+// RevokeToken обрабатывает запрос на отзыв API-токена.
+// Чужие токены может отозвать только оператор с правом admins:write
+func (h *TokenHandler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	admin := auth.AdminFromContext(r.Context())
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return
+	}
+
+	token, err := models.GetAPITokenByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Токен не найден: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if token.AdminID != admin.ID && !admin.HasPermission(auth.PermAdminsWrite) {
+		auth.Forbidden(w, auth.PermAdminsWrite)
+		return
+	}
+
+	if err := models.RevokeAPIToken(h.DB, id); err != nil {
+		http.Error(w, "Ошибка при отзыве токена: "+err.Error(), http.StatusNotFound)
+		return
+	}
+	audit(h.DB, r, models.AuditEvent{Action: models.AuditTokenRevoke, Target: tokenTarget(id), Before: auditState(token)}, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tokenTarget описывает API-токен как объект действия в журнале аудита
+func tokenTarget(id int64) string {
+	return "token:" + strconv.FormatInt(id, 10)
+}
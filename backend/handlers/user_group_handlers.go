@@ -0,0 +1,328 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"ssh-gate/auth"
+	"ssh-gate/models"
+	"ssh-gate/reconcile"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// UserGroupHandler содержит обработчики для API групп пользователей
+type UserGroupHandler struct {
+	DB         *sql.DB
+	Reconciler *reconcile.Engine
+}
+
+// NewUserGroupHandler создает новый экземпляр UserGroupHandler
+func NewUserGroupHandler(db *sql.DB, reconciler *reconcile.Engine) *UserGroupHandler {
+	return &UserGroupHandler{DB: db, Reconciler: reconciler}
+}
+
+// userGroupResponse описывает группу пользователей и результат синхронизации ее серверов
+type userGroupResponse struct {
+	models.UserGroup
+	Servers []*reconcile.Drift `json:"servers"`
+}
+
+// CreateUserGroup обрабатывает запрос на создание группы пользователей
+func (h *UserGroupHandler) CreateUserGroup(w http.ResponseWriter, r *http.Request) {
+	var group models.UserGroup
+	if err := json.NewDecoder(r.Body).Decode(&group); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if group.Name == "" {
+		http.Error(w, "Название группы обязательно", http.StatusBadRequest)
+		return
+	}
+
+	id, err := models.AddUserGroup(h.DB, group.Name)
+	if err != nil {
+		http.Error(w, "Ошибка при добавлении группы пользователей: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	group.ID = id
+	group.UserIDs = []int64{}
+	group.ServerIDs = []int64{}
+	audit(h.DB, r, models.AuditEvent{Action: models.AuditUserGroupCreate, Target: userGroupTarget(id), After: auditState(group)}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(group)
+}
+
+// GetAllUserGroups обрабатывает запрос на получение всех групп пользователей
+func (h *UserGroupHandler) GetAllUserGroups(w http.ResponseWriter, r *http.Request) {
+	groups, err := models.GetAllUserGroups(h.DB)
+	if err != nil {
+		http.Error(w, "Ошибка при получении групп пользователей: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+// GetUserGroup обрабатывает запрос на получение группы пользователей по ID
+func (h *UserGroupHandler) GetUserGroup(w http.ResponseWriter, r *http.Request) {
+	group, ok := h.group(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+// UpdateUserGroup обрабатывает запрос на переименование группы пользователей
+func (h *UserGroupHandler) UpdateUserGroup(w http.ResponseWriter, r *http.Request) {
+	existing, ok := h.group(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Name == "" {
+		http.Error(w, "Название группы обязательно", http.StatusBadRequest)
+		return
+	}
+
+	if err := models.RenameUserGroup(h.DB, existing.ID, request.Name); err != nil {
+		http.Error(w, "Ошибка при обновлении группы пользователей: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	group := *existing
+	group.Name = request.Name
+	audit(h.DB, r, models.AuditEvent{
+		Action: models.AuditUserGroupUpdate,
+		Target: userGroupTarget(group.ID),
+		Before: auditState(existing),
+		After:  auditState(group),
+	}, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
+
+// DeleteUserGroup обрабатывает запрос на удаление группы пользователей.
+// Участники группы теряют унаследованный от нее доступ, и ключи убираются с серверов группы
+func (h *UserGroupHandler) DeleteUserGroup(w http.ResponseWriter, r *http.Request) {
+	group, ok := h.group(w, r)
+	if !ok {
+		return
+	}
+
+	serverIDs, ok := h.groupServers(w, r, group)
+	if !ok {
+		return
+	}
+
+	if err := models.DeleteUserGroup(h.DB, group.ID); err != nil {
+		http.Error(w, "Ошибка при удалении группы пользователей: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Если сервер недоступен, ключи участников будут удалены при следующей сверке
+	drifts, err := h.Reconciler.ApplyServers(r.Context(), serverIDs)
+	event := models.AuditEvent{Action: models.AuditUserGroupDelete, Target: userGroupTarget(group.ID), Before: auditState(group)}
+	if err != nil {
+		audit(h.DB, r, event, err)
+		http.Error(w, "Ошибка при обновлении серверов группы: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	event.Error = driftErrors(drifts...)
+	audit(h.DB, r, event, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userGroupResponse{UserGroup: *group, Servers: drifts})
+}
+
+// AddUserToGroup обрабатывает запрос на добавление пользователя в группу.
+// Ключи пользователя выдаются на все серверы группы
+func (h *UserGroupHandler) AddUserToGroup(w http.ResponseWriter, r *http.Request) {
+	h.updateMembership(w, r, models.AuditUserGroupAddUser, models.AddUserToGroup)
+}
+
+// RemoveUserFromGroup обрабатывает запрос на исключение пользователя из группы.
+// Ключи пользователя убираются с серверов группы, если к ним нет доступа другим путем
+func (h *UserGroupHandler) RemoveUserFromGroup(w http.ResponseWriter, r *http.Request) {
+	h.updateMembership(w, r, models.AuditUserGroupRemoveUser, models.RemoveUserFromGroup)
+}
+
+// updateMembership изменяет состав группы пользователей и приводит в соответствие с ним все серверы группы.
+// Если сервер недоступен, ошибка записывается в отчет сервера, а ключи будут обновлены при следующей сверке
+func (h *UserGroupHandler) updateMembership(w http.ResponseWriter, r *http.Request, action string, update func(*sql.DB, int64, int64) error) {
+	group, ok := h.group(w, r)
+	if !ok {
+		return
+	}
+
+	userID, err := strconv.ParseInt(chi.URLParam(r, "userId"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID пользователя", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := models.GetUserByID(h.DB, userID); err != nil {
+		http.Error(w, "Пользователь не найден: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	serverIDs, ok := h.groupServers(w, r, group)
+	if !ok {
+		return
+	}
+
+	if err := update(h.DB, group.ID, userID); err != nil {
+		http.Error(w, "Ошибка при изменении состава группы: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	event := models.AuditEvent{Action: action, UserID: userID, Target: userGroupTarget(group.ID)}
+	drifts, err := h.Reconciler.ApplyServers(r.Context(), serverIDs)
+	if err != nil {
+		audit(h.DB, r, event, err)
+		http.Error(w, "Ошибка при обновлении серверов группы: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	event.Error = driftErrors(drifts...)
+	audit(h.DB, r, event, nil)
+
+	updated, err := models.GetUserGroupByID(h.DB, group.ID)
+	if err != nil {
+		http.Error(w, "Ошибка при получении группы пользователей: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userGroupResponse{UserGroup: *updated, Servers: drifts})
+}
+
+// AssignServerToGroup обрабатывает запрос на выдачу группе пользователей доступа к серверу.
+// Ключи всех участников группы выдаются на сервер. Если сервер обновить не удалось, доступ не выдается
+func (h *UserGroupHandler) AssignServerToGroup(w http.ResponseWriter, r *http.Request) {
+	h.updateServerAccess(w, r, models.AuditUserGroupGrantServer, models.AssignServerToUserGroup, models.RemoveServerFromUserGroup)
+}
+
+// RemoveServerFromGroup обрабатывает запрос на отзыв у группы пользователей доступа к серверу.
+// Ключи участников, у которых нет доступа к серверу другим путем, убираются с сервера.
+// Если сервер обновить не удалось, доступ восстанавливается
+func (h *UserGroupHandler) RemoveServerFromGroup(w http.ResponseWriter, r *http.Request) {
+	h.updateServerAccess(w, r, models.AuditUserGroupRevokeServer, models.RemoveServerFromUserGroup, models.AssignServerToUserGroup)
+}
+
+// updateServerAccess изменяет доступ группы к серверу и приводит сервер в соответствие с базой данных.
+// При ошибке синхронизации изменение отменяется функцией undo
+func (h *UserGroupHandler) updateServerAccess(w http.ResponseWriter, r *http.Request, action string, update, undo func(*sql.DB, int64, int64) error) {
+	group, ok := h.group(w, r)
+	if !ok {
+		return
+	}
+
+	serverID, err := strconv.ParseInt(chi.URLParam(r, "serverId"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID сервера", http.StatusBadRequest)
+		return
+	}
+
+	server, err := models.GetServerByID(h.DB, serverID)
+	if err != nil {
+		http.Error(w, "Сервер не найден: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := update(h.DB, group.ID, serverID); err != nil {
+		http.Error(w, "Ошибка при изменении доступа группы: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	event := models.AuditEvent{Action: action, ServerID: serverID, Target: userGroupTarget(group.ID), Before: auditState(group)}
+	drift, err := h.Reconciler.Apply(r.Context(), server)
+	if err != nil {
+		_ = undo(h.DB, group.ID, serverID)
+		audit(h.DB, r, event, err)
+		http.Error(w, "Ошибка при обновлении ключей на сервере: "+err.Error(), sshErrorStatus(err))
+		return
+	}
+
+	updated, err := models.GetUserGroupByID(h.DB, group.ID)
+	if err != nil {
+		http.Error(w, "Ошибка при получении группы пользователей: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	event.After = auditState(updated)
+	audit(h.DB, r, event, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(userGroupResponse{UserGroup: *updated, Servers: []*reconcile.Drift{drift}})
+}
+
+// groupServers получает все серверы, доступ к которым есть у участников группы, в том числе
+// по политикам доступа, и проверяет, что оператор может менять доступ к каждому из них.
+// Для группы без серверов достаточно любого разрешения на изменение доступа
+func (h *UserGroupHandler) groupServers(w http.ResponseWriter, r *http.Request, group *models.UserGroup) ([]int64, bool) {
+	admin := auth.AdminFromContext(r.Context())
+	if admin == nil || !(admin.HasPermission(auth.PermAccessWrite) || admin.HasPermission(auth.PermAccessWriteGroup)) {
+		auth.Forbidden(w, auth.PermAccessWrite)
+		return nil, false
+	}
+
+	serverIDs, err := models.GetUserGroupServerIDs(h.DB, group.ID)
+	if err != nil {
+		http.Error(w, "Ошибка при получении серверов группы: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	for _, serverID := range serverIDs {
+		allowed, err := auth.CanWriteAccess(h.DB, admin, serverID)
+		if err != nil {
+			log.Printf("Ошибка при проверке групп оператора: %v", err)
+			http.Error(w, "Ошибка при проверке прав доступа", http.StatusInternalServerError)
+			return nil, false
+		}
+		if !allowed {
+			auth.Forbidden(w, auth.PermAccessWrite+" (сервер "+strconv.FormatInt(serverID, 10)+")")
+			return nil, false
+		}
+	}
+	return serverIDs, true
+}
+
+// group получает группу пользователей по ID из URL и отвечает ошибкой, если ее нет
+func (h *UserGroupHandler) group(w http.ResponseWriter, r *http.Request) (*models.UserGroup, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	group, err := models.GetUserGroupByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Группа пользователей не найдена: "+err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+
+	return group, true
+}
+
+// userGroupTarget описывает группу пользователей как объект действия в журнале аудита
+func userGroupTarget(id int64) string {
+	return "user_group:" + strconv.FormatInt(id, 10)
+}
@@ -3,12 +3,13 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"log"
 	"net/http"
-	"os"
 	"strconv"
-	"strings"
 
+	"ssh-gate/jobs"
 	"ssh-gate/models"
+	"ssh-gate/reconcile"
 	"ssh-gate/ssh"
 
 	"github.com/go-chi/chi/v5"
@@ -16,12 +17,14 @@ import (
 
 // UserHandler содержит обработчики для API пользователей
 type UserHandler struct {
-	DB *sql.DB
+	DB         *sql.DB
+	Reconciler *reconcile.Engine
+	Queue      *jobs.Queue
 }
 
 // NewUserHandler создает новый экземпляр UserHandler
-func NewUserHandler(db *sql.DB) *UserHandler {
-	return &UserHandler{DB: db}
+func NewUserHandler(db *sql.DB, reconciler *reconcile.Engine, queue *jobs.Queue) *UserHandler {
+	return &UserHandler{DB: db, Reconciler: reconciler, Queue: queue}
 }
 
 // CreateUser обрабатывает запрос на создание нового пользователя
@@ -42,27 +45,40 @@ func (h *UserHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Проверяем ключ и опции и приводим строку к каноническому виду
+	key, err := newUserKey(user.PublicKey)
+	if err != nil {
+		http.Error(w, "Неверный формат публичного ключа: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	user.PublicKey = key.PublicKey
+
+	if !keyAvailable(w, h.DB, key.Fingerprint, 0) {
+		return
+	}
+
 	id, err := models.AddUser(h.DB, user)
 	if err != nil {
 		http.Error(w, "Ошибка при добавлении пользователя: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Добавляем публичный ключ локально на jump сервер
-	authorizedKeysFile := "authorized_keys"
-	f, err := os.OpenFile(authorizedKeysFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		http.Error(w, "Ошибка при открытии файла authorized_keys: "+err.Error(), http.StatusInternalServerError)
+	// Ключ, переданный при создании, становится первым ключом пользователя
+	key.UserID = id
+	if _, err := models.AddUserKey(h.DB, key); err != nil {
+		http.Error(w, "Ошибка при добавлении ключа пользователя: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer f.Close()
 
-	if _, err := f.WriteString(user.PublicKey + "\n"); err != nil {
+	// Добавляем публичный ключ локально на jump сервер
+	user.ID = id
+	if err := addJumpHostKeys(user.PublicKey); err != nil {
+		audit(h.DB, r, models.AuditEvent{Action: models.AuditUserCreate, UserID: id, After: auditState(user)}, err)
 		http.Error(w, "Ошибка при записи ключа в файл authorized_keys: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	audit(h.DB, r, models.AuditEvent{Action: models.AuditUserCreate, UserID: id, After: auditState(user)}, nil)
 
-	user.ID = id
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(user)
@@ -99,7 +115,15 @@ func (h *UserHandler) GetAllUsers(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(users)
 }
 
-// UpdateUser обрабатывает запрос на обновление пользователя
+// userUpdateResponse описывает обновленного пользователя и результат замены ключа на серверах
+type userUpdateResponse struct {
+	models.User
+	PreviousKey *models.UserKey    `json:"previous_key,omitempty"`
+	Servers     []*reconcile.Drift `json:"servers"`
+}
+
+// UpdateUser обрабатывает запрос на обновление пользователя. Если публичный ключ изменился,
+// старый ключ заменяется новым на всех серверах пользователя и на jump сервере
 func (h *UserHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
 	id, err := strconv.ParseInt(idStr, 10, 64)
@@ -124,17 +148,144 @@ func (h *UserHandler) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Проверяем ключ и опции и приводим строку к каноническому виду
+	key, err := newUserKey(user.PublicKey)
+	if err != nil {
+		http.Error(w, "Неверный формат публичного ключа: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	user.PublicKey = key.PublicKey
+	key.UserID = id
+
+	existing, err := models.GetUserByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Пользователь не найден: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// Ключ не должен принадлежать другому пользователю
+	if owner, err := models.GetUserKeyByFingerprint(h.DB, key.Fingerprint); err == nil && owner.UserID != id {
+		http.Error(w, "Этот ключ уже принадлежит другому пользователю", http.StatusConflict)
+		return
+	}
+
 	user.ID = id
 	if err := models.UpdateUser(h.DB, user); err != nil {
 		http.Error(w, "Ошибка при обновлении пользователя: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	response := userUpdateResponse{User: user, Servers: []*reconcile.Drift{}}
+	if existing.PublicKey != user.PublicKey {
+		previous, err := replaceUserKey(h.DB, existing, key)
+		if err != nil {
+			http.Error(w, "Ошибка при замене ключа пользователя: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Заменяем ключ на jump сервере
+		if err := removeJumpHostKeys(existing.PublicKey); err != nil {
+			http.Error(w, "Ошибка при записи файла authorized_keys: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := addJumpHostKeys(user.PublicKey); err != nil {
+			http.Error(w, "Ошибка при записи ключа в файл authorized_keys: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Заменяем ключ на серверах пользователя. Если сервер недоступен, старый ключ
+		// будет удален при следующей сверке, тогда же будет подтверждено его удаление
+		response.Servers, err = h.Reconciler.ApplyUser(r.Context(), id)
+		if err != nil {
+			audit(h.DB, r, models.AuditEvent{Action: models.AuditUserUpdate, UserID: id, Before: auditState(existing), After: auditState(user)}, err)
+			http.Error(w, "Ошибка при обновлении серверов пользователя: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if previous != nil {
+			response.PreviousKey, err = models.GetUserKeyByID(h.DB, id, previous.ID)
+			if err != nil {
+				http.Error(w, "Ошибка при получении ключа пользователя: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	audit(h.DB, r, models.AuditEvent{
+		Action: models.AuditUserUpdate,
+		UserID: id,
+		Before: auditState(existing),
+		After:  auditState(user),
+		Error:  driftErrors(response.Servers...),
+	}, nil)
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	json.NewEncoder(w).Encode(response)
+}
+
+// replaceUserKey заменяет основной ключ пользователя в таблице ключей и возвращает замененный ключ.
+// Замененный ключ выключается, но сохраняется для аудита. Если изменились только опции
+// или комментарий того же ключа, обновляется строка ключа и ничего не возвращается
+func replaceUserKey(db *sql.DB, existing *models.User, key models.UserKey) (*models.UserKey, error) {
+	keys, err := models.GetUserKeys(db, existing.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var previous, current *models.UserKey
+	if parsed, err := ssh.ParseAuthorizedKey(existing.PublicKey); err == nil {
+		previous = findUserKey(keys, parsed.Fingerprint())
+	}
+	current = findUserKey(keys, key.Fingerprint)
+
+	// Тот же ключ с другими опциями или комментарием
+	if previous != nil && previous.Fingerprint == key.Fingerprint {
+		return nil, models.SetUserKeyLine(db, previous.ID, key.PublicKey)
+	}
+
+	if current != nil {
+		current.Enabled = true
+		if err := models.UpdateUserKey(db, *current); err != nil {
+			return nil, err
+		}
+		if err := models.SetUserKeyLine(db, current.ID, key.PublicKey); err != nil {
+			return nil, err
+		}
+	} else if _, err := models.AddUserKey(db, key); err != nil {
+		return nil, err
+	}
+
+	if previous == nil {
+		return nil, nil
+	}
+
+	if err := models.RotateUserKey(db, previous.ID); err != nil {
+		return nil, err
+	}
+
+	return previous, nil
 }
 
-// DeleteUser обрабатывает запрос на удаление пользователя
+// findUserKey ищет ключ по отпечатку среди ключей пользователя
+func findUserKey(keys []models.UserKey, fingerprint string) *models.UserKey {
+	for i := range keys {
+		if keys[i].Fingerprint == fingerprint {
+			return &keys[i]
+		}
+	}
+	return nil
+}
+
+// userDeleteResponse описывает результат отзыва ключей удаленного пользователя по каждому серверу
+// и задачи повторного отзыва с серверов, которые обновить не удалось
+type userDeleteResponse struct {
+	Servers []*reconcile.Drift `json:"servers"`
+	Jobs    []*models.Job      `json:"jobs"`
+}
+
+// DeleteUser обрабатывает запрос на удаление пользователя. Ключи отзываются со всех серверов
+// параллельно, в ответе возвращается результат по каждому серверу. Для серверов, которые обновить
+// не удалось, ставится в очередь задача сверки с повторными попытками, и ответ возвращается
+// с кодом 202: ключи на этих серверах еще действуют
 func (h *UserHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
 	id, err := strconv.ParseInt(idStr, 10, 64)
@@ -157,45 +308,51 @@ func (h *UserHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Отзываем ключ с каждого сервера
-	for _, server := range servers {
-		sshConfig := ssh.SSHConfig{
-			Host:     server.IP,
-			Port:     server.Port,
-			User:     server.Login,
-			Password: server.Password,
-		}
-
-		_ = ssh.RemoveAuthorizedKey(sshConfig, user.PublicKey)
-	}
-
-	// Удаляем привязки серверов к пользователю в БД
+	// Удаляем привязки серверов к пользователю и его участие в группах в БД
 	if err := models.RemoveAllServersFromUser(h.DB, id); err != nil {
 		http.Error(w, "Ошибка при удалении привязок серверов: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	// Читаем файл authorized_keys
-	authorizedKeysFile := "authorized_keys"
-	data, err := os.ReadFile(authorizedKeysFile)
-	if err != nil {
-		http.Error(w, "Ошибка при чтении файла authorized_keys: "+err.Error(), http.StatusInternalServerError)
+	if err := models.RemoveUserFromAllGroups(h.DB, id); err != nil {
+		http.Error(w, "Ошибка при исключении пользователя из групп: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// Разделяем содержимое файла на строки и удаляем нужную строку
-	lines := strings.Split(string(data), "\n")
-	var updatedKeys []string
-	for _, line := range lines {
-		trimmedLine := strings.TrimSpace(line)
-		if trimmedLine != "" && trimmedLine != strings.TrimSpace(user.PublicKey) {
-			updatedKeys = append(updatedKeys, line)
+	// Отзываем ключи со всех серверов параллельно. Если сервер недоступен, ставим в очередь
+	// задачу сверки: она повторяется, пока ключи пользователя не будут убраны с сервера
+	drifts := h.Reconciler.ApplyEach(r.Context(), servers)
+	status := http.StatusOK
+	retries := []*models.Job{}
+	for _, drift := range drifts {
+		if drift.Error == "" {
+			continue
+		}
+		log.Printf("Ошибка при отзыве ключа пользователя %s с сервера %s: %s", user.Username, drift.Server, drift.Error)
+
+		event := withActor(r, models.AuditEvent{Action: models.AuditReconcile, UserID: id, ServerID: drift.ServerID})
+		job, err := h.Queue.Enqueue(reconcile.JobApplyServer, reconcile.JobTarget(drift.ServerID), reconcile.ApplyServerJob{ServerID: drift.ServerID}, event)
+		if err != nil {
+			log.Printf("Ошибка постановки в очередь отзыва ключа пользователя %s с сервера %s: %v", user.Username, drift.Server, err)
+			status = http.StatusBadGateway
+			continue
+		}
+		retries = append(retries, job)
+		if status == http.StatusOK {
+			status = http.StatusAccepted
 		}
 	}
 
-	// Перезаписываем файл authorized_keys
-	err = os.WriteFile(authorizedKeysFile, []byte(strings.Join(updatedKeys, "\n")), 0644)
+	// Удаляем все ключи пользователя из файла authorized_keys на jump сервере
+	keys, err := models.GetUserKeys(h.DB, id)
 	if err != nil {
+		http.Error(w, "Ошибка при получении ключей пользователя: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	lines := []string{user.PublicKey}
+	for _, key := range keys {
+		lines = append(lines, key.PublicKey)
+	}
+	if err := removeJumpHostKeys(lines...); err != nil {
 		http.Error(w, "Ошибка при записи файла authorized_keys: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -207,6 +364,14 @@ func (h *UserHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Ошибка при удалении пользователя: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	audit(h.DB, r, models.AuditEvent{
+		Action: models.AuditUserDelete,
+		UserID: id,
+		Before: auditState(user),
+		Error:  driftErrors(drifts...),
+	}, nil)
 
-	w.WriteHeader(http.StatusNoContent)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(userDeleteResponse{Servers: drifts, Jobs: retries})
 }
@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ssh-gate/models"
+	"ssh-gate/reconcile"
+	"ssh-gate/ssh"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// UserKeyHandler содержит обработчики для публичных ключей пользователей
+type UserKeyHandler struct {
+	DB         *sql.DB
+	Reconciler *reconcile.Engine
+}
+
+// NewUserKeyHandler создает новый экземпляр UserKeyHandler
+func NewUserKeyHandler(db *sql.DB, reconciler *reconcile.Engine) *UserKeyHandler {
+	return &UserKeyHandler{DB: db, Reconciler: reconciler}
+}
+
+// userKeyRequest описывает запрос на добавление или изменение ключа
+type userKeyRequest struct {
+	PublicKey string     `json:"public_key"`
+	Comment   *string    `json:"comment"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Enabled   *bool      `json:"enabled"`
+}
+
+// userKeyResponse описывает ключ и результат обновления серверов пользователя
+type userKeyResponse struct {
+	Key     *models.UserKey    `json:"key,omitempty"`
+	Servers []*reconcile.Drift `json:"servers"`
+}
+
+// GetUserKeys обрабатывает запрос на получение ключей пользователя
+func (h *UserKeyHandler) GetUserKeys(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.user(w, r)
+	if !ok {
+		return
+	}
+
+	keys, err := models.GetUserKeys(h.DB, user.ID)
+	if err != nil {
+		http.Error(w, "Ошибка при получении ключей пользователя: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// AddUserKey обрабатывает запрос на добавление ключа пользователю.
+// Ключ сразу выдается на все серверы, к которым у пользователя есть доступ
+func (h *UserKeyHandler) AddUserKey(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.user(w, r)
+	if !ok {
+		return
+	}
+
+	var request userKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.PublicKey == "" {
+		http.Error(w, "Публичный ключ обязателен", http.StatusBadRequest)
+		return
+	}
+
+	key, err := newUserKey(request.PublicKey)
+	if err != nil {
+		http.Error(w, "Неверный формат публичного ключа: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	key.UserID = user.ID
+	if request.Comment != nil {
+		key.Comment = *request.Comment
+	}
+	if request.Enabled != nil {
+		key.Enabled = *request.Enabled
+	}
+	key.ExpiresAt = request.ExpiresAt
+
+	if !keyAvailable(w, h.DB, key.Fingerprint, user.ID) {
+		return
+	}
+
+	id, err := models.AddUserKey(h.DB, key)
+	if err != nil {
+		http.Error(w, "Ошибка при добавлении ключа пользователя: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if key.Active() {
+		if err := addJumpHostKeys(key.PublicKey); err != nil {
+			http.Error(w, "Ошибка при записи ключа в файл authorized_keys: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	h.respond(w, r, http.StatusCreated, user.ID, id, models.AuditEvent{Action: models.AuditKeyAdd})
+}
+
+// UpdateUserKey обрабатывает запрос на изменение комментария, срока действия или включение ключа.
+// Изменения сразу применяются на всех серверах пользователя
+func (h *UserKeyHandler) UpdateUserKey(w http.ResponseWriter, r *http.Request) {
+	key, ok := h.key(w, r)
+	if !ok {
+		return
+	}
+
+	before := *key
+
+	var request userKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Ошибка при разборе запроса: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.PublicKey != "" {
+		http.Error(w, "Публичный ключ изменить нельзя, добавьте новый ключ", http.StatusBadRequest)
+		return
+	}
+	if request.Comment != nil {
+		key.Comment = *request.Comment
+	}
+	if request.Enabled != nil {
+		key.Enabled = *request.Enabled
+	}
+	if request.ExpiresAt != nil {
+		key.ExpiresAt = request.ExpiresAt
+	}
+
+	if err := models.UpdateUserKey(h.DB, *key); err != nil {
+		http.Error(w, "Ошибка при обновлении ключа пользователя: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// На jump сервере остаются только активные ключи
+	update := removeJumpHostKeys
+	if key.Active() {
+		update = addJumpHostKeys
+	}
+	if err := update(key.PublicKey); err != nil {
+		http.Error(w, "Ошибка при записи файла authorized_keys: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.respond(w, r, http.StatusOK, key.UserID, key.ID, models.AuditEvent{Action: models.AuditKeyUpdate, Before: auditState(before)})
+}
+
+// DeleteUserKey обрабатывает запрос на удаление ключа пользователя.
+// Ключ сразу отзывается со всех серверов пользователя
+func (h *UserKeyHandler) DeleteUserKey(w http.ResponseWriter, r *http.Request) {
+	key, ok := h.key(w, r)
+	if !ok {
+		return
+	}
+
+	if err := models.DeleteUserKey(h.DB, key.UserID, key.ID); err != nil {
+		http.Error(w, "Ошибка при удалении ключа пользователя: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := removeJumpHostKeys(key.PublicKey); err != nil {
+		http.Error(w, "Ошибка при записи файла authorized_keys: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.respond(w, r, http.StatusOK, key.UserID, 0, models.AuditEvent{Action: models.AuditKeyDelete, Before: auditState(key)})
+}
+
+// respond обновляет серверы пользователя, записывает событие в журнал аудита и отправляет ключ
+// вместе с результатом по каждому серверу. Если сервер недоступен, расхождение будет устранено
+// при следующей сверке
+func (h *UserKeyHandler) respond(w http.ResponseWriter, r *http.Request, status int, userID, keyID int64, event models.AuditEvent) {
+	event.UserID = userID
+
+	var response userKeyResponse
+
+	if keyID != 0 {
+		key, err := models.GetUserKeyByID(h.DB, userID, keyID)
+		if err != nil {
+			http.Error(w, "Ошибка при получении ключа пользователя: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.Key = key
+		event.After = auditState(key)
+	}
+
+	servers, err := h.Reconciler.ApplyUser(r.Context(), userID)
+	if err != nil {
+		audit(h.DB, r, event, err)
+		http.Error(w, "Ошибка при обновлении серверов пользователя: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.Servers = servers
+	event.Error = driftErrors(servers...)
+	audit(h.DB, r, event, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// user получает пользователя по ID из URL и отвечает ошибкой, если его нет
+func (h *UserKeyHandler) user(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	user, err := models.GetUserByID(h.DB, id)
+	if err != nil {
+		http.Error(w, "Пользователь не найден: "+err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// key получает ключ пользователя по ID из URL и отвечает ошибкой, если его нет
+func (h *UserKeyHandler) key(w http.ResponseWriter, r *http.Request) (*models.UserKey, bool) {
+	user, ok := h.user(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	keyID, err := strconv.ParseInt(chi.URLParam(r, "keyId"), 10, 64)
+	if err != nil {
+		http.Error(w, "Неверный формат ID ключа", http.StatusBadRequest)
+		return nil, false
+	}
+
+	key, err := models.GetUserKeyByID(h.DB, user.ID, keyID)
+	if err != nil {
+		http.Error(w, "Ключ не найден: "+err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+
+	return key, true
+}
+
+// newUserKey разбирает строку публичного ключа и заполняет по ней новый ключ пользователя
+func newUserKey(publicKey string) (models.UserKey, error) {
+	key, err := ssh.ParseAuthorizedKey(publicKey)
+	if err != nil {
+		return models.UserKey{}, err
+	}
+
+	return models.UserKey{
+		PublicKey:   key.String(),
+		Fingerprint: key.Fingerprint(),
+		Comment:     key.Comment,
+		Enabled:     true,
+	}, nil
+}
+
+// keyAvailable проверяет, что ключ не принадлежит другому пользователю или уже этому пользователю
+func keyAvailable(w http.ResponseWriter, db *sql.DB, fingerprint string, userID int64) bool {
+	existing, err := models.GetUserKeyByFingerprint(db, fingerprint)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true
+	}
+	if err != nil {
+		http.Error(w, "Ошибка при проверке ключа: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if existing.UserID == userID {
+		http.Error(w, "Этот ключ уже добавлен пользователю", http.StatusConflict)
+	} else {
+		http.Error(w, "Этот ключ уже принадлежит другому пользователю", http.StatusConflict)
+	}
+	return false
+}
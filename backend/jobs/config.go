@@ -0,0 +1,59 @@
+package jobs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Переменные окружения с настройками очереди задач
+const (
+	WorkersEnv    = "SSH_GATE_JOB_WORKERS"     // Число параллельных обработчиков (по умолчанию 4)
+	AttemptsEnv   = "SSH_GATE_JOB_ATTEMPTS"    // Число попыток выполнить задачу (по умолчанию 5)
+	RetryDelayEnv = "SSH_GATE_JOB_RETRY_DELAY" // Пауза перед первой повторной попыткой (по умолчанию 10s)
+)
+
+// maxRetryDelay ограничивает паузу между повторными попытками задачи
+const maxRetryDelay = 10 * time.Minute
+
+// Config содержит настройки очереди задач
+type Config struct {
+	Workers     int
+	MaxAttempts int
+	RetryDelay  time.Duration
+}
+
+// DefaultConfig настройки очереди задач по умолчанию
+var DefaultConfig = Config{Workers: 4, MaxAttempts: 5, RetryDelay: 10 * time.Second}
+
+// LoadConfig читает настройки очереди задач из окружения
+func LoadConfig() (Config, error) {
+	config := DefaultConfig
+
+	if value := os.Getenv(WorkersEnv); value != "" {
+		workers, err := strconv.Atoi(value)
+		if err != nil || workers <= 0 {
+			return Config{}, fmt.Errorf("неверное значение %s: %s", WorkersEnv, value)
+		}
+		config.Workers = workers
+	}
+
+	if value := os.Getenv(AttemptsEnv); value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts <= 0 {
+			return Config{}, fmt.Errorf("неверное значение %s: %s", AttemptsEnv, value)
+		}
+		config.MaxAttempts = attempts
+	}
+
+	if value := os.Getenv(RetryDelayEnv); value != "" {
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay <= 0 {
+			return Config{}, fmt.Errorf("неверное значение %s: %s", RetryDelayEnv, value)
+		}
+		config.RetryDelay = delay
+	}
+
+	return config, nil
+}
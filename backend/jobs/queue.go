@@ -0,0 +1,300 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"ssh-gate/models"
+)
+
+// errCancelled ошибка задачи, отмененной оператором
+var errCancelled = errors.New("задача отменена")
+
+// pollInterval период проверки очереди на задачи, время повторной попытки которых наступило
+const pollInterval = time.Second
+
+// Handler выполняет задачу определенного вида. Ход выполнения записывается в журнал задачи
+// через logf, результат сохраняется в задаче. Если ctx отменен, обработчик должен прервать работу
+type Handler func(ctx context.Context, job *models.Job, logf func(format string, args ...any)) (any, error)
+
+// Queue - очередь задач, сохраняемая в базе данных и выполняемая фоновыми обработчиками.
+// Задачи, завершившиеся ошибкой, повторяются с удваивающейся паузой
+type Queue struct {
+	DB     *sql.DB
+	Config Config
+
+	handlers map[string]Handler
+	wake     chan struct{}
+
+	mu      sync.Mutex
+	running map[int64]context.CancelFunc
+}
+
+// New создает очередь задач
+func New(db *sql.DB, config Config) *Queue {
+	return &Queue{
+		DB:       db,
+		Config:   config,
+		handlers: make(map[string]Handler),
+		wake:     make(chan struct{}, 1),
+		running:  make(map[int64]context.CancelFunc),
+	}
+}
+
+// Register задает обработчик задач вида kind. Вызывается до запуска очереди
+func (q *Queue) Register(kind string, handler Handler) {
+	q.handlers[kind] = handler
+}
+
+// Enqueue ставит задачу в очередь и сразу возвращает ее. Задачи с одинаковым target
+// выполняются в порядке постановки в очередь. Событие event записывается в журнал аудита
+// от имени его исполнителя после завершения задачи
+func (q *Queue) Enqueue(kind, target string, payload any, event models.AuditEvent) (*models.Job, error) {
+	if _, ok := q.handlers[kind]; !ok {
+		return nil, fmt.Errorf("неизвестный вид задачи: %s", kind)
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка сериализации параметров задачи: %w", err)
+	}
+
+	id, err := models.AddJob(q.DB, models.Job{
+		Kind:        kind,
+		Target:      target,
+		Payload:     data,
+		MaxAttempts: q.Config.MaxAttempts,
+		ActorID:     event.ActorID,
+		Actor:       event.Actor,
+		Audit:       &event,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Будим свободный обработчик, не дожидаясь следующей проверки очереди
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return models.GetJobByID(q.DB, id)
+}
+
+// Cancel отменяет задачу: ожидающая задача больше не выполняется, у выполняемой
+// отменяется контекст. Возвращает false, если задача уже завершена
+func (q *Queue) Cancel(id int64) (bool, error) {
+	cancelled, err := models.CancelQueuedJob(q.DB, id)
+	if err != nil {
+		return false, err
+	}
+	if cancelled {
+		job, err := models.GetJobByID(q.DB, id)
+		if err != nil {
+			return true, err
+		}
+		q.logf(job.ID, "Задача отменена")
+		q.audit(job, errCancelled)
+		return true, nil
+	}
+
+	q.mu.Lock()
+	cancel, ok := q.running[id]
+	q.mu.Unlock()
+	if ok {
+		cancel()
+	}
+	return ok, nil
+}
+
+// Run запускает обработчики очереди и работает, пока не будет отменен контекст.
+// Задачи, выполнение которых прервал перезапуск шлюза, возвращаются в очередь
+func (q *Queue) Run(ctx context.Context) {
+	requeued, err := models.RequeueRunningJobs(q.DB)
+	if err != nil {
+		log.Printf("Ошибка возврата прерванных задач в очередь: %v", err)
+	} else if requeued > 0 {
+		log.Printf("Возвращены в очередь прерванные задачи: %d", requeued)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < q.Config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// work выполняет задачи по одной, пока не будет отменен контекст
+func (q *Queue) work(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		job, err := models.ClaimJob(q.DB, time.Now().UTC())
+		if err != nil {
+			log.Printf("Ошибка выбора задачи из очереди: %v", err)
+		}
+		if job != nil {
+			q.execute(ctx, job)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// execute выполняет одну попытку задачи и сохраняет ее итог
+func (q *Queue) execute(ctx context.Context, job *models.Job) {
+	logf := func(format string, args ...any) {
+		q.logf(job.ID, format, args...)
+	}
+
+	handler, ok := q.handlers[job.Kind]
+	if !ok {
+		q.finish(job, models.JobStatusFailed, nil, fmt.Errorf("неизвестный вид задачи: %s", job.Kind), logf)
+		return
+	}
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	q.mu.Lock()
+	q.running[job.ID] = cancel
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.running, job.ID)
+		q.mu.Unlock()
+		cancel()
+	}()
+
+	logf("Попытка %d из %d", job.Attempts, job.MaxAttempts)
+	result, err := handler(jobCtx, job, logf)
+
+	switch {
+	case err == nil:
+		q.finish(job, models.JobStatusSucceeded, result, nil, logf)
+	case ctx.Err() != nil:
+		// Шлюз останавливается: задача будет выполнена заново после перезапуска
+		logf("Выполнение прервано остановкой шлюза")
+		if err := models.RetryJob(q.DB, job.ID, time.Now().UTC(), err.Error()); err != nil {
+			log.Printf("Ошибка возврата задачи %d в очередь: %v", job.ID, err)
+		}
+	case jobCtx.Err() != nil:
+		q.finish(job, models.JobStatusCancelled, result, errCancelled, logf)
+	case isPermanent(err) || job.Attempts >= job.MaxAttempts:
+		q.finish(job, models.JobStatusFailed, result, err, logf)
+	default:
+		delay := retryDelay(q.Config.RetryDelay, job.Attempts-1)
+		logf("Ошибка: %v. Повтор через %s", err, delay)
+		if err := models.RetryJob(q.DB, job.ID, time.Now().UTC().Add(delay), err.Error()); err != nil {
+			log.Printf("Ошибка возврата задачи %d в очередь: %v", job.ID, err)
+		}
+	}
+}
+
+// finish сохраняет итог задачи и записывает ее событие в журнал аудита
+func (q *Queue) finish(job *models.Job, status string, result any, jobErr error, logf func(string, ...any)) {
+	var data json.RawMessage
+	if result != nil {
+		if encoded, err := json.Marshal(result); err == nil {
+			data = encoded
+		}
+	}
+
+	message := ""
+	if jobErr != nil {
+		message = jobErr.Error()
+		logf("Ошибка: %s", message)
+	}
+	switch status {
+	case models.JobStatusSucceeded:
+		logf("Задача выполнена")
+	case models.JobStatusFailed:
+		logf("Задача не выполнена")
+	case models.JobStatusCancelled:
+		logf("Задача отменена")
+	}
+
+	if err := models.FinishJob(q.DB, job.ID, status, data, message); err != nil {
+		log.Printf("Ошибка сохранения итога задачи %d: %v", job.ID, err)
+	}
+
+	q.audit(job, jobErr)
+}
+
+// logf добавляет запись в журнал выполнения задачи
+func (q *Queue) logf(jobID int64, format string, args ...any) {
+	if err := models.AddJobLog(q.DB, jobID, fmt.Sprintf(format, args...)); err != nil {
+		log.Printf("Ошибка записи в журнал задачи %d: %v", jobID, err)
+	}
+}
+
+// audit записывает в журнал аудита событие завершенной задачи. Если err не nil,
+// действие записывается как невыполненное
+func (q *Queue) audit(job *models.Job, err error) {
+	if job.Audit == nil {
+		return
+	}
+
+	event := *job.Audit
+	event.Result = models.AuditSuccess
+	if err != nil {
+		event.Result = models.AuditFailure
+		event.Error = err.Error()
+	}
+	if _, err := models.AddAuditEvent(q.DB, event); err != nil {
+		log.Printf("Ошибка записи в журнал аудита (%s): %v", event.Action, err)
+	}
+}
+
+// retryDelay возвращает паузу перед повторной попыткой: она удваивается
+// после каждой неудачи, но не превышает maxRetryDelay
+func retryDelay(base time.Duration, failures int) time.Duration {
+	delay := base
+	for i := 0; i < failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// permanentError ошибка, при которой повторять задачу бессмысленно
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent помечает ошибку задачи как окончательную: задача завершается без повторных попыток,
+// например если сервер или пользователь уже удалены
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// isPermanent проверяет, помечена ли ошибка как окончательная
+func isPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
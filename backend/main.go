@@ -1,63 +1,337 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/rs/cors"
+	"ssh-gate/auth"
 	"ssh-gate/db"
 	"ssh-gate/handlers"
+	"ssh-gate/jobs"
+	"ssh-gate/models"
+	"ssh-gate/reconcile"
+	"ssh-gate/secrets"
+	"ssh-gate/ssh"
+	"ssh-gate/sso"
 )
 
 func main() {
-	// Инициализируем базу данных
+	// Служебные команды запускаются вместо веб-сервера
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// Загружаем мастер-ключ для шифрования учетных данных серверов
+	keeper, err := loadKeeper()
+	if err != nil {
+		log.Fatal("Ошибка загрузки мастер-ключа:", err)
+	}
 
-	database, err := db.InitDB("users.db")
+	// Загружаем ключ подписи журнала аудита, если он задан
+	auditKey, err := secrets.LoadAuditKey()
+	if err != nil {
+		log.Fatal("Ошибка загрузки ключа подписи журнала аудита:", err)
+	}
+	models.SetAuditSigningKey(auditKey)
+
+	// Инициализируем базу данных
+	database, err := db.InitDB(databasePath, keeper)
 	if err != nil {
 		log.Fatal("Ошибка инициализации базы данных:", err)
 	}
 	defer database.Close()
 
+	// Создаем первого оператора, если база данных пуста
+	if err := auth.EnsureBootstrapAdmin(database); err != nil {
+		log.Fatal("Ошибка создания оператора:", err)
+	}
+
+	// Возвращаем в ожидание запросы доступа, выдачу доступа по которым прервал перезапуск
+	released, err := models.ReleaseStaleAccessRequests(database)
+	if err != nil {
+		log.Fatal("Ошибка возврата запросов доступа в ожидание:", err)
+	}
+	if released > 0 {
+		log.Printf("Возвращены в ожидание запросы доступа, одобрение которых прервал перезапуск: %d", released)
+	}
+
+	// Подключаемся к OIDC-провайдеру, если вход через него настроен
+	roles, err := auth.RoleNames(database)
+	if err != nil {
+		log.Fatal("Ошибка получения ролей:", err)
+	}
+	oidcConfig, oidcEnabled, err := sso.LoadConfig(roles)
+	if err != nil {
+		log.Fatal("Ошибка настройки OIDC:", err)
+	}
+	var oidcHandler *handlers.OIDCHandler
+	if oidcEnabled {
+		provider, err := sso.New(context.Background(), oidcConfig)
+		if err != nil {
+			log.Fatal("Ошибка настройки OIDC:", err)
+		}
+		oidcHandler = handlers.NewOIDCHandler(database, provider)
+		log.Printf("Вход через OIDC включен: %s", oidcConfig.Issuer)
+	}
+
+	// Запускаем фоновую сверку серверов с базой данных, если она настроена
+	reconciler := reconcile.New(database, keeper)
+	reconciler.FanOut, err = reconcile.LoadFanOutConfig()
+	if err != nil {
+		log.Fatal("Ошибка настройки параллельной работы с серверами:", err)
+	}
+	reconciler.Timeouts, err = ssh.LoadTimeouts()
+	if err != nil {
+		log.Fatal("Ошибка настройки SSH-подключений:", err)
+	}
+	poolConfig, err := ssh.LoadPoolConfig()
+	if err != nil {
+		log.Fatal("Ошибка настройки пула SSH-подключений:", err)
+	}
+	reconciler.Pool = ssh.NewPool(poolConfig)
+	go reconciler.Pool.Run(context.Background())
+
+	interval, err := reconcile.LoadInterval()
+	if err != nil {
+		log.Fatal("Ошибка настройки сверки:", err)
+	}
+	if interval > 0 {
+		go reconciler.Run(context.Background(), interval)
+		log.Printf("Фоновая сверка серверов включена: каждые %s", interval)
+	}
+
+	// Создаем собственный ключ шлюза при первом запуске
+	gateKey, err := reconciler.EnsureGateKey()
+	if err != nil {
+		log.Fatal("Ошибка создания ключа шлюза:", err)
+	}
+	log.Printf("Ключ шлюза: %s", gateKey.Fingerprint)
+
+	// Запускаем фоновый отзыв временных доступов с истекшим сроком
+	expiryInterval, err := reconcile.LoadExpiryInterval()
+	if err != nil {
+		log.Fatal("Ошибка настройки отзыва доступов:", err)
+	}
+	go reconciler.RunExpiry(context.Background(), expiryInterval)
+
+	// Запускаем очередь фоновых задач
+	jobConfig, err := jobs.LoadConfig()
+	if err != nil {
+		log.Fatal("Ошибка настройки очереди задач:", err)
+	}
+	queue := jobs.New(database, jobConfig)
+	reconciler.RegisterJobs(queue)
+	go queue.Run(context.Background())
+
+	// Запускаем периодическую выгрузку контрольных точек журнала аудита, если она настроена
+	checkpointDir, checkpointInterval, err := loadAuditCheckpointConfig()
+	if err != nil {
+		log.Fatal("Ошибка настройки контрольных точек журнала аудита:", err)
+	}
+	if checkpointDir != "" {
+		go runAuditCheckpoints(context.Background(), database, auditKey, checkpointDir, checkpointInterval)
+		log.Printf("Выгрузка контрольных точек журнала аудита включена: %s, каждые %s", checkpointDir, checkpointInterval)
+	}
+
 	// Создаем обработчики
-	userHandler := handlers.NewUserHandler(database)
-	serverHandler := handlers.NewServerHandler(database)
+	authHandler := handlers.NewAuthHandler(database, oidcEnabled)
+	adminHandler := handlers.NewAdminHandler(database)
+	tokenHandler := handlers.NewTokenHandler(database)
+	userHandler := handlers.NewUserHandler(database, reconciler, queue)
+	userKeyHandler := handlers.NewUserKeyHandler(database, reconciler)
+	serverHandler := handlers.NewServerHandler(database, keeper, reconciler, queue)
+	reconcileHandler := handlers.NewReconcileHandler(database, reconciler)
+	planHandler := handlers.NewPlanHandler(database, reconciler)
+	serverGroupHandler := handlers.NewServerGroupHandler(database)
+	userGroupHandler := handlers.NewUserGroupHandler(database, reconciler)
+	accessPolicyHandler := handlers.NewAccessPolicyHandler(database, reconciler)
+	accessRequestHandler := handlers.NewAccessRequestHandler(database, reconciler)
+	auditHandler := handlers.NewAuditHandler(database, auditKey)
+	jobHandler := handlers.NewJobHandler(database, queue)
+	gateKeyHandler := handlers.NewGateKeyHandler(database, reconciler, queue)
 
 	// Создаем роутер
 	r := chi.NewRouter()
 
-	// Добавляем middleware
+	// Добавляем middleware. Адрес клиента для журнала аудита берется из заголовков
+	// X-Forwarded-For и X-Real-IP, только если шлюз работает за доверенным прокси
+	if trustProxy() {
+		r.Use(middleware.RealIP)
+	}
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
-	r.Use(cors.AllowAll().Handler)
+	r.Use(corsHandler())
+
 	// Определяем маршруты
 	r.Route("/api", func(r chi.Router) {
-		// Маршруты для пользователей
-		r.Route("/users", func(r chi.Router) {
-			r.Post("/", userHandler.CreateUser)
-			r.Get("/", userHandler.GetAllUsers)
-			r.Get("/{id}", userHandler.GetUser)
-			r.Put("/{id}", userHandler.UpdateUser)
-			r.Delete("/{id}", userHandler.DeleteUser)
-		})
+		// Вход доступен без сессии
+		r.Get("/auth/methods", authHandler.Methods)
+		r.Post("/auth/login", authHandler.Login)
+		if oidcHandler != nil {
+			r.Get("/auth/oidc/login", oidcHandler.Login)
+			r.Get("/auth/oidc/callback", oidcHandler.Callback)
+		}
 
-		// Маршруты для серверов
-		r.Route("/servers", func(r chi.Router) {
-			r.Post("/", serverHandler.CreateServer)
-			r.Get("/", serverHandler.GetAllServers)
-			r.Get("/{id}", serverHandler.GetServer)
-			r.Put("/{id}", serverHandler.UpdateServer)
-			r.Delete("/{id}", serverHandler.DeleteServer)
-		})
+		// Все остальные маршруты требуют авторизации
+		r.Group(func(r chi.Router) {
+			r.Use(auth.Middleware(database))
+
+			r.Post("/auth/logout", authHandler.Logout)
+			r.Get("/auth/me", authHandler.Me)
+
+			// Маршруты для операторов и ролей
+			r.Route("/admins", func(r chi.Router) {
+				r.With(auth.Require(auth.PermAdminsWrite)).Post("/", adminHandler.CreateAdmin)
+				r.With(auth.Require(auth.PermAdminsRead)).Get("/", adminHandler.GetAllAdmins)
+				r.With(auth.Require(auth.PermAdminsWrite)).Put("/{id}/password", adminHandler.UpdateAdminPassword)
+				r.With(auth.Require(auth.PermAdminsWrite)).Put("/{id}/role", adminHandler.UpdateAdminRole)
+				r.With(auth.Require(auth.PermAdminsWrite)).Delete("/{id}", adminHandler.DeleteAdmin)
+			})
+			r.With(auth.Require(auth.PermAdminsRead)).Get("/roles", adminHandler.GetAllRoles)
+
+			// Маршруты для API-токенов
+			r.Route("/tokens", func(r chi.Router) {
+				r.Post("/", tokenHandler.CreateToken)
+				r.Get("/", tokenHandler.GetAllTokens)
+				r.Delete("/{id}", tokenHandler.RevokeToken)
+			})
+
+			// Маршруты для пользователей
+			r.Route("/users", func(r chi.Router) {
+				r.With(auth.Require(auth.PermUsersWrite)).Post("/", userHandler.CreateUser)
+				r.With(auth.Require(auth.PermUsersRead)).Get("/", userHandler.GetAllUsers)
+				r.With(auth.Require(auth.PermUsersRead)).Get("/{id}", userHandler.GetUser)
+				r.With(auth.Require(auth.PermUsersWrite)).Put("/{id}", userHandler.UpdateUser)
+				r.With(auth.Require(auth.PermUsersWrite)).Delete("/{id}", userHandler.DeleteUser)
+
+				// Публичные ключи пользователя
+				r.With(auth.Require(auth.PermUsersRead)).Get("/{id}/keys", userKeyHandler.GetUserKeys)
+				r.With(auth.Require(auth.PermUsersWrite)).Post("/{id}/keys", userKeyHandler.AddUserKey)
+				r.With(auth.Require(auth.PermUsersWrite)).Put("/{id}/keys/{keyId}", userKeyHandler.UpdateUserKey)
+				r.With(auth.Require(auth.PermUsersWrite)).Delete("/{id}/keys/{keyId}", userKeyHandler.DeleteUserKey)
+			})
+
+			// Маршруты для серверов
+			r.Route("/servers", func(r chi.Router) {
+				r.With(auth.Require(auth.PermServersWrite)).Post("/", serverHandler.CreateServer)
+				r.With(auth.Require(auth.PermServersRead)).Get("/", serverHandler.GetAllServers)
+				r.With(auth.Require(auth.PermServersRead)).Get("/{id}", serverHandler.GetServer)
+				r.With(auth.Require(auth.PermServersWrite)).Put("/{id}", serverHandler.UpdateServer)
+				r.With(auth.Require(auth.PermServersWrite)).Delete("/{id}", serverHandler.DeleteServer)
+
+				// Закрепленный ключ хоста сервера
+				r.With(auth.Require(auth.PermServersRead)).Get("/{id}/host-key", serverHandler.GetHostKey)
+				r.With(auth.Require(auth.PermServersWrite)).Put("/{id}/host-key", serverHandler.PinHostKey)
+				r.With(auth.Require(auth.PermServersWrite)).Delete("/{id}/host-key", serverHandler.ClearHostKey)
+
+				// Перевод сервера на вход по ключу шлюза
+				r.With(auth.Require(auth.PermServersWrite)).Post("/{id}/enroll", serverHandler.EnrollServer)
+
+				// Сверка ключей на сервере с базой данных
+				r.With(auth.Require(auth.PermAccessRead)).Get("/{id}/drift", reconcileHandler.GetServerDrift)
+				r.With(auth.RequireAccessWrite(database, "id")).Post("/{id}/reconcile", reconcileHandler.ReconcileServer)
+			})
+
+			// Собственные ключи шлюза и их ротация на всех серверах
+			r.Route("/gate-keys", func(r chi.Router) {
+				r.With(auth.Require(auth.PermServersRead)).Get("/", gateKeyHandler.GetGateKeys)
+				r.With(auth.Require(auth.PermServersWrite)).Post("/rotate", gateKeyHandler.RotateGateKey)
+			})
+
+			// Сверка всех серверов
+			r.With(auth.Require(auth.PermAccessRead)).Get("/drift", reconcileHandler.GetAllDrift)
+			r.With(auth.Require(auth.PermAccessWrite)).Post("/reconcile", reconcileHandler.ReconcileAll)
 
-		// Маршруты для управления доступом пользователей к серверам
-		r.Route("/users/{userId}/servers", func(r chi.Router) {
-			r.Get("/", serverHandler.GetUserServers)
-			r.Post("/{serverId}", serverHandler.AssignServerToUser)
-			r.Delete("/{serverId}", serverHandler.RemoveServerFromUser)
+			// Планы изменений доступа. Права на серверы плана проверяются в обработчиках
+			r.Route("/plans", func(r chi.Router) {
+				r.Post("/", planHandler.CreatePlan)
+				r.With(auth.Require(auth.PermAccessRead)).Get("/", planHandler.GetAllPlans)
+				r.With(auth.Require(auth.PermAccessRead)).Get("/{id}", planHandler.GetPlan)
+				r.Post("/{id}/apply", planHandler.ApplyPlan)
+			})
+
+			// Маршруты для групп серверов
+			r.Route("/server-groups", func(r chi.Router) {
+				r.With(auth.Require(auth.PermServersWrite)).Post("/", serverGroupHandler.CreateServerGroup)
+				r.With(auth.Require(auth.PermServersRead)).Get("/", serverGroupHandler.GetAllServerGroups)
+				r.With(auth.Require(auth.PermServersWrite)).Delete("/{id}", serverGroupHandler.DeleteServerGroup)
+				r.With(auth.Require(auth.PermServersWrite)).Put("/{id}/servers/{serverId}", serverGroupHandler.AddServerToGroup)
+				r.With(auth.Require(auth.PermServersWrite)).Delete("/{id}/servers/{serverId}", serverGroupHandler.RemoveServerFromGroup)
+				r.With(auth.Require(auth.PermAdminsWrite)).Put("/{id}/admins/{adminId}", serverGroupHandler.AddAdminToGroup)
+				r.With(auth.Require(auth.PermAdminsWrite)).Delete("/{id}/admins/{adminId}", serverGroupHandler.RemoveAdminFromGroup)
+
+				// Правила одобрения запросов доступа к серверам группы
+				r.With(auth.Require(auth.PermServersRead)).Get("/{id}/approval-rule", serverGroupHandler.GetApprovalRule)
+				r.With(auth.Require(auth.PermAdminsWrite)).Put("/{id}/approval-rule", serverGroupHandler.SetApprovalRule)
+				r.With(auth.Require(auth.PermAdminsWrite)).Delete("/{id}/approval-rule", serverGroupHandler.DeleteApprovalRule)
+			})
+
+			// Маршруты для групп пользователей. Изменение участников и удаление группы меняют
+			// доступ ко всем серверам группы, права на них проверяются в обработчиках
+			r.Route("/user-groups", func(r chi.Router) {
+				r.With(auth.Require(auth.PermUsersWrite)).Post("/", userGroupHandler.CreateUserGroup)
+				r.With(auth.Require(auth.PermUsersRead)).Get("/", userGroupHandler.GetAllUserGroups)
+				r.With(auth.Require(auth.PermUsersRead)).Get("/{id}", userGroupHandler.GetUserGroup)
+				r.With(auth.Require(auth.PermUsersWrite)).Put("/{id}", userGroupHandler.UpdateUserGroup)
+				r.With(auth.Require(auth.PermUsersWrite)).Delete("/{id}", userGroupHandler.DeleteUserGroup)
+				r.Put("/{id}/users/{userId}", userGroupHandler.AddUserToGroup)
+				r.Delete("/{id}/users/{userId}", userGroupHandler.RemoveUserFromGroup)
+				r.With(auth.RequireAccessWrite(database, "serverId")).Put("/{id}/servers/{serverId}", userGroupHandler.AssignServerToGroup)
+				r.With(auth.RequireAccessWrite(database, "serverId")).Delete("/{id}/servers/{serverId}", userGroupHandler.RemoveServerFromGroup)
+			})
+
+			// Политики доступа групп пользователей к серверам по меткам
+			r.Route("/access-policies", func(r chi.Router) {
+				r.With(auth.Require(auth.PermAccessWrite)).Post("/", accessPolicyHandler.CreateAccessPolicy)
+				r.With(auth.Require(auth.PermAccessRead)).Get("/", accessPolicyHandler.GetAllAccessPolicies)
+				r.With(auth.Require(auth.PermAccessRead)).Get("/{id}", accessPolicyHandler.GetAccessPolicy)
+				r.With(auth.Require(auth.PermAccessWrite)).Put("/{id}", accessPolicyHandler.UpdateAccessPolicy)
+				r.With(auth.Require(auth.PermAccessWrite)).Delete("/{id}", accessPolicyHandler.DeleteAccessPolicy)
+			})
+
+			// Запросы временного доступа. Права автора и одобряющих проверяются в обработчиках
+			r.Route("/access-requests", func(r chi.Router) {
+				r.Post("/", accessRequestHandler.CreateAccessRequest)
+				r.Get("/", accessRequestHandler.GetAccessRequests)
+				r.Get("/{id}", accessRequestHandler.GetAccessRequest)
+				r.Post("/{id}/approve", accessRequestHandler.ApproveAccessRequest)
+				r.Post("/{id}/deny", accessRequestHandler.DenyAccessRequest)
+				r.Post("/{id}/cancel", accessRequestHandler.CancelAccessRequest)
+			})
+
+			// Журнал аудита
+			r.Route("/audit", func(r chi.Router) {
+				r.With(auth.Require(auth.PermAuditRead)).Get("/", auditHandler.GetAuditEvents)
+				r.With(auth.Require(auth.PermAuditRead)).Get("/export", auditHandler.ExportAuditEvents)
+				r.With(auth.Require(auth.PermAuditRead)).Get("/checkpoint", auditHandler.GetAuditCheckpoint)
+				r.With(auth.Require(auth.PermAuditRead)).Post("/verify", auditHandler.VerifyAuditChain)
+			})
+
+			// Задачи очереди. Свои задачи оператор видит без разрешения access:read
+			r.Route("/jobs", func(r chi.Router) {
+				r.With(auth.Require(auth.PermAccessRead)).Get("/", jobHandler.GetJobs)
+				r.Get("/{id}", jobHandler.GetJob)
+				r.Get("/{id}/events", jobHandler.StreamJob)
+				r.Post("/{id}/cancel", jobHandler.CancelJob)
+			})
+
+			// Маршруты для управления доступом пользователей к серверам
+			r.Route("/users/{userId}/servers", func(r chi.Router) {
+				r.With(auth.Require(auth.PermAccessRead)).Get("/", serverHandler.GetUserServers)
+				r.With(auth.RequireAccessWrite(database, "serverId")).Post("/{serverId}", serverHandler.AssignServerToUser)
+				r.With(auth.RequireAccessWrite(database, "serverId")).Delete("/{serverId}", serverHandler.RemoveServerFromUser)
+			})
 		})
 	})
 
@@ -71,6 +345,44 @@ func main() {
 	}
 }
 
+// corsOriginsEnv задает через запятую источники, которым разрешены запросы к API
+const corsOriginsEnv = "SSH_GATE_CORS_ORIGINS"
+
+// corsHandler разрешает кросс-доменные запросы с cookie только для явно указанных источников
+func corsHandler() func(http.Handler) http.Handler {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv(corsOriginsEnv), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+
+	return cors.New(cors.Options{
+		AllowedOrigins:   origins,
+		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowCredentials: true,
+	}).Handler
+}
+
+// trustProxyEnv включает чтение адреса клиента из заголовков прокси (true/false)
+const trustProxyEnv = "SSH_GATE_TRUST_PROXY"
+
+// trustProxy проверяет, работает ли шлюз за доверенным обратным прокси
+func trustProxy() bool {
+	value, _ := strconv.ParseBool(os.Getenv(trustProxyEnv))
+	return value
+}
+
+// loadKeeper загружает мастер-ключ и создает на его основе Keeper
+func loadKeeper() (*secrets.Keeper, error) {
+	masterKey, err := secrets.LoadMasterKey()
+	if err != nil {
+		return nil, err
+	}
+	return secrets.NewKeeper(masterKey)
+}
+
 // Функция для удобного обслуживания фронтенда и SPA-роутинга (todo временно)
 func fileServer(r chi.Router, path string, root http.FileSystem) {
 	if path != "/" && path[len(path)-1] != '/' {
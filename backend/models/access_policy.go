@@ -0,0 +1,244 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// AccessPolicy представляет политику доступа: группа пользователей получает доступ ко всем
+// серверам, у которых есть все метки селектора. Новые серверы с подходящими метками получают
+// ключи участников группы автоматически, а при снятии метки доступ отзывается.
+// ServerIDs - серверы, подходящие под селектор на момент запроса
+type AccessPolicy struct {
+	ID        int64             `json:"id"`
+	Name      string            `json:"name"`
+	GroupID   int64             `json:"group_id"`
+	Selector  map[string]string `json:"selector"`
+	ServerIDs []int64           `json:"server_ids"`
+}
+
+// CreateAccessPolicyTable создает таблицы политик доступа и их селекторов
+func CreateAccessPolicyTable(db *sql.DB) error {
+	policyQuery := `
+	CREATE TABLE IF NOT EXISTS access_policies (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL DEFAULT '',
+		group_id INTEGER NOT NULL,
+		FOREIGN KEY (group_id) REFERENCES user_groups(id) ON DELETE CASCADE
+	);
+	`
+
+	selectorQuery := `
+	CREATE TABLE IF NOT EXISTS access_policy_selectors (
+		policy_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (policy_id, name),
+		FOREIGN KEY (policy_id) REFERENCES access_policies(id) ON DELETE CASCADE
+	);
+	`
+
+	if _, err := db.Exec(policyQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы политик доступа: %w", err)
+	}
+
+	if _, err := db.Exec(selectorQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы селекторов политик доступа: %w", err)
+	}
+
+	return nil
+}
+
+// policyMatches возвращает условие SQL: политика policy применяется к серверу server,
+// то есть у сервера есть все метки селектора политики
+func policyMatches(policy, server string) string {
+	return `NOT EXISTS (
+		SELECT 1
+		FROM access_policy_selectors ps
+		WHERE ps.policy_id = ` + policy + ` AND NOT EXISTS (
+			SELECT 1
+			FROM server_labels sl
+			WHERE sl.server_id = ` + server + ` AND sl.name = ps.name AND sl.value = ps.value
+		)
+	)`
+}
+
+// AddAccessPolicy добавляет политику доступа вместе с ее селектором
+func AddAccessPolicy(db *sql.DB, policy AccessPolicy) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`INSERT INTO access_policies (name, group_id) VALUES (?, ?);`, policy.Name, policy.GroupID)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка добавления политики доступа: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения ID: %w", err)
+	}
+
+	if err := setPolicySelector(tx, id, policy.Selector); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("ошибка сохранения политики доступа: %w", err)
+	}
+
+	return id, nil
+}
+
+// UpdateAccessPolicy изменяет название, группу и селектор политики доступа
+func UpdateAccessPolicy(db *sql.DB, policy AccessPolicy) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE access_policies SET name = ?, group_id = ? WHERE id = ?;`, policy.Name, policy.GroupID, policy.ID)
+	if err != nil {
+		return fmt.Errorf("ошибка обновления политики доступа: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("политика доступа с ID %d не найдена", policy.ID)
+	}
+
+	if err := setPolicySelector(tx, policy.ID, policy.Selector); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ошибка сохранения политики доступа: %w", err)
+	}
+
+	return nil
+}
+
+// setPolicySelector заменяет селектор политики доступа
+func setPolicySelector(tx *sql.Tx, policyID int64, selector map[string]string) error {
+	if _, err := tx.Exec(`DELETE FROM access_policy_selectors WHERE policy_id = ?;`, policyID); err != nil {
+		return fmt.Errorf("ошибка удаления селектора политики доступа: %w", err)
+	}
+
+	for name, value := range selector {
+		query := `INSERT INTO access_policy_selectors (policy_id, name, value) VALUES (?, ?, ?);`
+		if _, err := tx.Exec(query, policyID, name, value); err != nil {
+			return fmt.Errorf("ошибка сохранения селектора политики доступа: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// accessPolicySelect выбирает политики доступа вместе с селекторами и подходящими серверами
+var accessPolicySelect = `
+	SELECT p.id, p.name, p.group_id,
+		COALESCE((SELECT GROUP_CONCAT(name || '=' || value) FROM access_policy_selectors WHERE policy_id = p.id), ''),
+		COALESCE((SELECT GROUP_CONCAT(s.id) FROM servers s WHERE ` + policyMatches("p.id", "s.id") + `), '')
+	FROM access_policies p
+	`
+
+// GetAllAccessPolicies получает все политики доступа
+func GetAllAccessPolicies(db *sql.DB) ([]AccessPolicy, error) {
+	rows, err := db.Query(accessPolicySelect + "ORDER BY p.id;")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения политик доступа: %w", err)
+	}
+	defer rows.Close()
+
+	var policies []AccessPolicy
+	for rows.Next() {
+		policy, err := scanAccessPolicy(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения данных политики доступа: %w", err)
+		}
+		policies = append(policies, *policy)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return policies, nil
+}
+
+// GetAccessPolicyByID получает политику доступа по ID
+func GetAccessPolicyByID(db *sql.DB, id int64) (*AccessPolicy, error) {
+	policy, err := scanAccessPolicy(db.QueryRow(accessPolicySelect+"WHERE p.id = ?;", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("политика доступа с ID %d не найдена", id)
+		}
+		return nil, fmt.Errorf("ошибка получения политики доступа: %w", err)
+	}
+
+	return policy, nil
+}
+
+// scanAccessPolicy читает политику доступа из строки результата
+func scanAccessPolicy(row rowScanner) (*AccessPolicy, error) {
+	var (
+		policy    AccessPolicy
+		selector  string
+		serverIDs string
+		err       error
+	)
+
+	if err := row.Scan(&policy.ID, &policy.Name, &policy.GroupID, &selector, &serverIDs); err != nil {
+		return nil, err
+	}
+	policy.Selector = parseLabels(selector)
+	if policy.ServerIDs, err = parseIDList(serverIDs); err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+// DeleteAccessPolicy удаляет политику доступа
+func DeleteAccessPolicy(db *sql.DB, id int64) error {
+	if _, err := db.Exec(`DELETE FROM access_policy_selectors WHERE policy_id = ?;`, id); err != nil {
+		return fmt.Errorf("ошибка удаления селектора политики доступа: %w", err)
+	}
+
+	result, err := db.Exec(`DELETE FROM access_policies WHERE id = ?;`, id)
+	if err != nil {
+		return fmt.Errorf("ошибка удаления политики доступа: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("политика доступа с ID %d не найдена", id)
+	}
+
+	return nil
+}
+
+// deleteGroupAccessPolicies удаляет политики доступа группы пользователей
+func deleteGroupAccessPolicies(db *sql.DB, groupID int64) error {
+	query := `DELETE FROM access_policy_selectors WHERE policy_id IN (SELECT id FROM access_policies WHERE group_id = ?);`
+	if _, err := db.Exec(query, groupID); err != nil {
+		return fmt.Errorf("ошибка удаления селекторов политик группы: %w", err)
+	}
+
+	if _, err := db.Exec(`DELETE FROM access_policies WHERE group_id = ?;`, groupID); err != nil {
+		return fmt.Errorf("ошибка удаления политик доступа группы: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,507 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Состояния запроса доступа
+const (
+	AccessRequestPending   = "pending"   // Запрос ожидает одобрения
+	AccessRequestApproving = "approving" // Запрос одобрен, доступ выдается
+	AccessRequestApproved  = "approved"  // Запрос одобрен, доступ выдан
+	AccessRequestDenied    = "denied"    // Запрос отклонен
+	AccessRequestCancelled = "cancelled" // Запрос отменен автором
+	AccessRequestExpired   = "expired"   // Срок выданного по запросу доступа истек
+)
+
+// Duration длительность, которая в JSON записывается строкой в формате Go (например, "8h")
+type Duration time.Duration
+
+// MarshalJSON записывает длительность строкой
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON читает длительность из строки
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("длительность должна быть строкой, например \"8h\"")
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("неверный формат длительности: %s", value)
+	}
+
+	*d = Duration(duration)
+	return nil
+}
+
+// AccessApproval представляет одобрение запроса доступа одним из операторов
+type AccessApproval struct {
+	AdminID   int64     `json:"admin_id"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AccessRequest представляет запрос временного доступа пользователя к серверу.
+// RequesterID - оператор, создавший запрос, RequiredApprovals - число одобрений,
+// необходимое по правилам групп сервера на момент создания запроса.
+// ExpiresAt - срок доступа, выданного после одобрения
+type AccessRequest struct {
+	ID                int64            `json:"id"`
+	RequesterID       int64            `json:"requester_id"`
+	UserID            int64            `json:"user_id"`
+	ServerID          int64            `json:"server_id"`
+	Reason            string           `json:"reason"`
+	Duration          Duration         `json:"duration"`
+	Status            string           `json:"status"`
+	RequiredApprovals int              `json:"required_approvals"`
+	Approvals         []AccessApproval `json:"approvals"`
+	DecidedBy         int64            `json:"decided_by,omitempty"`
+	DecisionComment   string           `json:"decision_comment,omitempty"`
+	CreatedAt         time.Time        `json:"created_at"`
+	DecidedAt         *time.Time       `json:"decided_at"`
+	ExpiresAt         *time.Time       `json:"expires_at"`
+}
+
+// AccessRequestFilter задает условия выборки запросов доступа. Нулевые поля не учитываются
+type AccessRequestFilter struct {
+	Status      string
+	RequesterID int64
+	UserID      int64
+	ServerID    int64
+}
+
+// CreateAccessRequestTable создает таблицы запросов доступа и их одобрений
+func CreateAccessRequestTable(db *sql.DB) error {
+	requestQuery := `
+	CREATE TABLE IF NOT EXISTS access_requests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		requester_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		server_id INTEGER NOT NULL,
+		reason TEXT NOT NULL,
+		duration INTEGER NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		required_approvals INTEGER NOT NULL DEFAULT 1,
+		decided_by INTEGER,
+		decision_comment TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		decided_at DATETIME,
+		expires_at DATETIME,
+		FOREIGN KEY (requester_id) REFERENCES admins(id),
+		FOREIGN KEY (user_id) REFERENCES users(id),
+		FOREIGN KEY (server_id) REFERENCES servers(id)
+	);
+	`
+
+	approvalQuery := `
+	CREATE TABLE IF NOT EXISTS access_request_approvals (
+		request_id INTEGER NOT NULL,
+		admin_id INTEGER NOT NULL,
+		comment TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (request_id, admin_id),
+		FOREIGN KEY (request_id) REFERENCES access_requests(id) ON DELETE CASCADE,
+		FOREIGN KEY (admin_id) REFERENCES admins(id)
+	);
+	`
+
+	if _, err := db.Exec(requestQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы запросов доступа: %w", err)
+	}
+
+	if _, err := db.Exec(approvalQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы одобрений запросов доступа: %w", err)
+	}
+
+	return nil
+}
+
+// AddAccessRequest сохраняет новый запрос доступа в состоянии pending
+func AddAccessRequest(db *sql.DB, request AccessRequest) (int64, error) {
+	query := `
+	INSERT INTO access_requests (requester_id, user_id, server_id, reason, duration, status, required_approvals, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?);
+	`
+
+	seconds := int64(time.Duration(request.Duration).Seconds())
+	result, err := db.Exec(query, request.RequesterID, request.UserID, request.ServerID, request.Reason, seconds,
+		AccessRequestPending, request.RequiredApprovals, time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("ошибка добавления запроса доступа: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения ID: %w", err)
+	}
+
+	return id, nil
+}
+
+// GetAccessRequestByID получает запрос доступа по ID вместе с одобрениями
+func GetAccessRequestByID(db *sql.DB, id int64) (*AccessRequest, error) {
+	query := `
+	SELECT id, requester_id, user_id, server_id, reason, duration, status, required_approvals,
+		COALESCE(decided_by, 0), decision_comment, created_at, decided_at, expires_at
+	FROM access_requests
+	WHERE id = ?;
+	`
+
+	request, err := scanAccessRequest(db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("запрос доступа с ID %d не найден", id)
+		}
+		return nil, fmt.Errorf("ошибка получения запроса доступа: %w", err)
+	}
+
+	if request.Approvals, err = getAccessApprovals(db, request.ID); err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// GetAccessRequests получает запросы доступа, подходящие под фильтр, начиная с новых
+func GetAccessRequests(db *sql.DB, filter AccessRequestFilter) ([]AccessRequest, error) {
+	var (
+		conditions []string
+		args       []any
+	)
+	if filter.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.RequesterID != 0 {
+		conditions = append(conditions, "requester_id = ?")
+		args = append(args, filter.RequesterID)
+	}
+	if filter.UserID != 0 {
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, filter.UserID)
+	}
+	if filter.ServerID != 0 {
+		conditions = append(conditions, "server_id = ?")
+		args = append(args, filter.ServerID)
+	}
+
+	query := `
+	SELECT id, requester_id, user_id, server_id, reason, duration, status, required_approvals,
+		COALESCE(decided_by, 0), decision_comment, created_at, decided_at, expires_at
+	FROM access_requests
+	`
+	if len(conditions) > 0 {
+		query += "WHERE " + strings.Join(conditions, " AND ") + "\n"
+	}
+	query += "ORDER BY id DESC;"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения запросов доступа: %w", err)
+	}
+	defer rows.Close()
+
+	requests := []AccessRequest{}
+	for rows.Next() {
+		request, err := scanAccessRequest(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения данных запроса доступа: %w", err)
+		}
+		requests = append(requests, *request)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+	rows.Close()
+
+	for i := range requests {
+		if requests[i].Approvals, err = getAccessApprovals(db, requests[i].ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return requests, nil
+}
+
+// HasPendingAccessRequest проверяет, есть ли у пользователя ожидающий запрос доступа к серверу,
+// в том числе одобренный запрос, по которому доступ еще выдается
+func HasPendingAccessRequest(db *sql.DB, userID, serverID int64) (bool, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM access_requests
+	WHERE user_id = ? AND server_id = ? AND status IN (?, ?);
+	`
+
+	var count int
+	if err := db.QueryRow(query, userID, serverID, AccessRequestPending, AccessRequestApproving).Scan(&count); err != nil {
+		return false, fmt.Errorf("ошибка проверки запросов доступа: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// ClaimAccessRequest сохраняет одобрение ожидающего запроса оператором и, если набрано необходимое
+// число одобрений, переводит запрос в состояние approving. Подсчет одобрений и смена состояния
+// выполняются в одной транзакции: из одновременных одобрений запрос закрепляет ровно одно, а
+// одновременные отклонение или отмена запроса либо не пройдут, либо не дадут его одобрить.
+// Возвращает true, если запрос закреплен за оператором: доступ выдается только после этого
+func ClaimAccessRequest(db *sql.DB, id, adminID int64, comment string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Транзакция начинается с записи, поэтому одновременные одобрения выполняются по очереди
+	// и каждое следующее видит одобрения, сохраненные предыдущими
+	approvalQuery := `
+	INSERT INTO access_request_approvals (request_id, admin_id, comment, created_at)
+	SELECT id, ?, ?, ? FROM access_requests
+	WHERE id = ? AND status = ?;
+	`
+	now := time.Now().UTC()
+	result, err := tx.Exec(approvalQuery, adminID, comment, now, id, AccessRequestPending)
+	if err != nil {
+		return false, fmt.Errorf("ошибка сохранения одобрения запроса доступа: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+	if rowsAffected == 0 {
+		return false, fmt.Errorf("ожидающий запрос доступа с ID %d не найден", id)
+	}
+
+	claimQuery := `
+	UPDATE access_requests
+	SET status = ?, decided_by = ?, decision_comment = ?, decided_at = ?
+	WHERE id = ? AND status = ?
+		AND (SELECT COUNT(*) FROM access_request_approvals WHERE request_id = access_requests.id) >= required_approvals;
+	`
+	result, err = tx.Exec(claimQuery, AccessRequestApproving, adminID, comment, now, id, AccessRequestPending)
+	if err != nil {
+		return false, fmt.Errorf("ошибка изменения состояния запроса доступа: %w", err)
+	}
+	rowsAffected, err = result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("ошибка сохранения одобрения запроса доступа: %w", err)
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// ReleaseAccessRequest возвращает запрос в состояние pending, если доступ по нему выдать
+// не удалось, и удаляет последнее одобрение, сохраненное ClaimAccessRequest
+func ReleaseAccessRequest(db *sql.DB, id, adminID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE access_requests
+	SET status = ?, decided_by = NULL, decision_comment = '', decided_at = NULL
+	WHERE id = ? AND status = ?;
+	`
+	if _, err := tx.Exec(query, AccessRequestPending, id, AccessRequestApproving); err != nil {
+		return fmt.Errorf("ошибка изменения состояния запроса доступа: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM access_request_approvals WHERE request_id = ? AND admin_id = ?;`, id, adminID); err != nil {
+		return fmt.Errorf("ошибка удаления одобрения запроса доступа: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ошибка изменения состояния запроса доступа: %w", err)
+	}
+
+	return nil
+}
+
+// ReleaseStaleAccessRequests возвращает в состояние pending запросы, выдачу доступа по которым
+// прервал перезапуск шлюза, и удаляет одобрения, которыми они были закреплены
+func ReleaseStaleAccessRequests(db *sql.DB) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	approvalQuery := `
+	DELETE FROM access_request_approvals
+	WHERE (request_id, admin_id) IN (SELECT id, decided_by FROM access_requests WHERE status = ?);
+	`
+	if _, err := tx.Exec(approvalQuery, AccessRequestApproving); err != nil {
+		return 0, fmt.Errorf("ошибка удаления одобрения запроса доступа: %w", err)
+	}
+
+	requestQuery := `
+	UPDATE access_requests
+	SET status = ?, decided_by = NULL, decision_comment = '', decided_at = NULL
+	WHERE status = ?;
+	`
+	result, err := tx.Exec(requestQuery, AccessRequestPending, AccessRequestApproving)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка изменения состояния запроса доступа: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("ошибка изменения состояния запроса доступа: %w", err)
+	}
+
+	return rowsAffected, nil
+}
+
+// ApproveAccessRequest завершает одобрение запроса в состоянии approving после выдачи доступа
+// и сохраняет срок выданного доступа
+func ApproveAccessRequest(db *sql.DB, id int64, expiresAt *time.Time) error {
+	query := `
+	UPDATE access_requests
+	SET status = ?, expires_at = ?
+	WHERE id = ? AND status = ?;
+	`
+
+	result, err := db.Exec(query, AccessRequestApproved, nullTime(expiresAt), id, AccessRequestApproving)
+	if err != nil {
+		return fmt.Errorf("ошибка изменения состояния запроса доступа: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("одобряемый запрос доступа с ID %d не найден", id)
+	}
+
+	return nil
+}
+
+// DenyAccessRequest отклоняет ожидающий запрос доступа
+func DenyAccessRequest(db *sql.DB, id, adminID int64, comment string) error {
+	return decideAccessRequest(db, id, AccessRequestDenied, adminID, comment)
+}
+
+// CancelAccessRequest отменяет ожидающий запрос доступа по решению его автора
+func CancelAccessRequest(db *sql.DB, id, adminID int64) error {
+	return decideAccessRequest(db, id, AccessRequestCancelled, adminID, "")
+}
+
+// decideAccessRequest завершает рассмотрение запроса. Изменяется только ожидающий запрос,
+// поэтому одновременные решения по одному запросу не перезаписывают друг друга
+func decideAccessRequest(db execQuerier, id int64, status string, adminID int64, comment string) error {
+	query := `
+	UPDATE access_requests
+	SET status = ?, decided_by = ?, decision_comment = ?, decided_at = ?
+	WHERE id = ? AND status = ?;
+	`
+
+	result, err := db.Exec(query, status, adminID, comment, time.Now().UTC(), id, AccessRequestPending)
+	if err != nil {
+		return fmt.Errorf("ошибка изменения состояния запроса доступа: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("ожидающий запрос доступа с ID %d не найден", id)
+	}
+
+	return nil
+}
+
+// ExpireAccessRequests отмечает одобренные запросы, срок доступа по которым истек к моменту now
+func ExpireAccessRequests(db *sql.DB, now time.Time) (int64, error) {
+	query := `
+	UPDATE access_requests
+	SET status = ?
+	WHERE status = ? AND expires_at <= ?;
+	`
+
+	result, err := db.Exec(query, AccessRequestExpired, AccessRequestApproved, now.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("ошибка обновления истекших запросов доступа: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	return rowsAffected, nil
+}
+
+// getAccessApprovals получает одобрения запроса доступа в порядке их получения
+func getAccessApprovals(db *sql.DB, requestID int64) ([]AccessApproval, error) {
+	query := `
+	SELECT admin_id, comment, created_at
+	FROM access_request_approvals
+	WHERE request_id = ?
+	ORDER BY created_at;
+	`
+
+	rows, err := db.Query(query, requestID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения одобрений запроса доступа: %w", err)
+	}
+	defer rows.Close()
+
+	approvals := []AccessApproval{}
+	for rows.Next() {
+		var approval AccessApproval
+		if err := rows.Scan(&approval.AdminID, &approval.Comment, &approval.CreatedAt); err != nil {
+			return nil, fmt.Errorf("ошибка чтения данных одобрения: %w", err)
+		}
+		approvals = append(approvals, approval)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return approvals, nil
+}
+
+// scanAccessRequest читает запрос доступа из строки результата
+func scanAccessRequest(row rowScanner) (*AccessRequest, error) {
+	var (
+		request   AccessRequest
+		seconds   int64
+		decidedAt sql.NullTime
+		expiresAt sql.NullTime
+	)
+
+	if err := row.Scan(&request.ID, &request.RequesterID, &request.UserID, &request.ServerID, &request.Reason, &seconds,
+		&request.Status, &request.RequiredApprovals, &request.DecidedBy, &request.DecisionComment,
+		&request.CreatedAt, &decidedAt, &expiresAt); err != nil {
+		return nil, err
+	}
+
+	request.Duration = Duration(time.Duration(seconds) * time.Second)
+	request.DecidedAt = timePtr(decidedAt)
+	request.ExpiresAt = timePtr(expiresAt)
+
+	return &request, nil
+}
@@ -0,0 +1,202 @@
+package models
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newAccessRequestTestDB создает базу данных с ожидающим запросом доступа, которому нужно одно одобрение
+func newAccessRequestTestDB(t *testing.T) (*sql.DB, int64) {
+	return newAccessRequestTestDBWithApprovals(t, 1)
+}
+
+// newAccessRequestTestDBWithApprovals создает базу данных с ожидающим запросом доступа,
+// которому нужно required одобрений
+func newAccessRequestTestDBWithApprovals(t *testing.T, required int) (*sql.DB, int64) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "requests.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := CreateAccessRequestTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := AddAccessRequest(db, AccessRequest{
+		RequesterID:       1,
+		UserID:            1,
+		ServerID:          1,
+		Reason:            "дежурство",
+		Duration:          Duration(time.Hour),
+		RequiredApprovals: required,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db, id
+}
+
+func TestClaimAccessRequestBlocksConcurrentDecisions(t *testing.T) {
+	db, id := newAccessRequestTestDB(t)
+
+	if claimed, err := ClaimAccessRequest(db, id, 2, "ок"); err != nil || !claimed {
+		t.Fatalf("запрос не закреплен: %v", err)
+	}
+	if err := DenyAccessRequest(db, id, 3, "нет"); err == nil {
+		t.Fatal("отклонен запрос, по которому выдается доступ")
+	}
+	if err := CancelAccessRequest(db, id, 1); err == nil {
+		t.Fatal("отменен запрос, по которому выдается доступ")
+	}
+	if _, err := ClaimAccessRequest(db, id, 3, ""); err == nil {
+		t.Fatal("запрос закреплен повторно")
+	}
+
+	expiresAt := time.Now().Add(time.Hour).UTC()
+	if err := ApproveAccessRequest(db, id, &expiresAt); err != nil {
+		t.Fatalf("одобрение не завершено: %v", err)
+	}
+
+	request, err := GetAccessRequestByID(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Status != AccessRequestApproved || request.DecidedBy != 2 || request.ExpiresAt == nil || len(request.Approvals) != 1 {
+		t.Fatalf("запрос после одобрения: %+v", request)
+	}
+}
+
+func TestClaimAccessRequestAfterDenial(t *testing.T) {
+	db, id := newAccessRequestTestDB(t)
+
+	if err := DenyAccessRequest(db, id, 3, "нет"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClaimAccessRequest(db, id, 2, ""); err == nil {
+		t.Fatal("закреплен отклоненный запрос")
+	}
+
+	request, err := GetAccessRequestByID(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Status != AccessRequestDenied || len(request.Approvals) != 0 {
+		t.Fatalf("запрос после отклонения: %+v", request)
+	}
+}
+
+func TestReleaseAccessRequest(t *testing.T) {
+	db, id := newAccessRequestTestDB(t)
+
+	if _, err := ClaimAccessRequest(db, id, 2, "ок"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReleaseAccessRequest(db, id, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := GetAccessRequestByID(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Status != AccessRequestPending || request.DecidedBy != 0 || len(request.Approvals) != 0 {
+		t.Fatalf("запрос после возврата в ожидание: %+v", request)
+	}
+
+	expiresAt := time.Now().Add(time.Hour).UTC()
+	if err := ApproveAccessRequest(db, id, &expiresAt); err == nil {
+		t.Fatal("одобрен запрос, который не закреплен за оператором")
+	}
+	if err := DenyAccessRequest(db, id, 3, "нет"); err != nil {
+		t.Fatalf("возвращенный в ожидание запрос не отклоняется: %v", err)
+	}
+}
+
+func TestClaimAccessRequestCountsApprovals(t *testing.T) {
+	db, id := newAccessRequestTestDBWithApprovals(t, 3)
+
+	// Одновременные одобрения: запрос закрепляет только то, которое набрало необходимое число
+	var wg sync.WaitGroup
+	results := make(chan bool, 3)
+	for adminID := int64(2); adminID <= 4; adminID++ {
+		wg.Add(1)
+		go func(adminID int64) {
+			defer wg.Done()
+			for {
+				claimed, err := ClaimAccessRequest(db, id, adminID, "")
+				if err != nil && strings.Contains(err.Error(), "locked") {
+					continue
+				}
+				if err != nil {
+					t.Errorf("одобрение оператора %d: %v", adminID, err)
+				}
+				results <- claimed
+				return
+			}
+		}(adminID)
+	}
+	wg.Wait()
+	close(results)
+
+	claims := 0
+	for claimed := range results {
+		if claimed {
+			claims++
+		}
+	}
+	if claims != 1 {
+		t.Fatalf("запрос закреплен %d раз, ожидалось 1", claims)
+	}
+
+	request, err := GetAccessRequestByID(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Status != AccessRequestApproving || len(request.Approvals) != 3 {
+		t.Fatalf("запрос после одобрений: %+v", request)
+	}
+
+	if _, err := ClaimAccessRequest(db, id, 5, ""); err == nil {
+		t.Fatal("сохранено одобрение закрепленного запроса")
+	}
+}
+
+func TestReleaseStaleAccessRequests(t *testing.T) {
+	db, id := newAccessRequestTestDBWithApprovals(t, 2)
+
+	if _, err := ClaimAccessRequest(db, id, 2, "ок"); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := ClaimAccessRequest(db, id, 3, "ок"); err != nil || !claimed {
+		t.Fatalf("запрос не закреплен: %v", err)
+	}
+
+	// Шлюз перезапустился до выдачи доступа
+	released, err := ReleaseStaleAccessRequests(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released != 1 {
+		t.Fatalf("возвращено в ожидание %d запросов, ожидался 1", released)
+	}
+
+	request, err := GetAccessRequestByID(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.Status != AccessRequestPending || request.DecidedBy != 0 || len(request.Approvals) != 1 || request.Approvals[0].AdminID != 2 {
+		t.Fatalf("запрос после перезапуска: %+v", request)
+	}
+
+	if claimed, err := ClaimAccessRequest(db, id, 3, ""); err != nil || !claimed {
+		t.Fatalf("запрос не закрепляется повторно: %v", err)
+	}
+}
@@ -0,0 +1,338 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Admin представляет учетную запись оператора, управляющего шлюзом
+type Admin struct {
+	ID           int64     `json:"id"`
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	Role         string    `json:"role"`
+	UserID       int64     `json:"user_id,omitempty"`     // Связанный пользователь SSH, если есть
+	Permissions  []string  `json:"permissions,omitempty"` // Заполняется при авторизации запроса
+}
+
+// HasPermission проверяет, есть ли у оператора разрешение
+func (a *Admin) HasPermission(permission string) bool {
+	for _, p := range a.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAdminTable создает таблицы операторов и их сессий
+func CreateAdminTable(db *sql.DB) error {
+	adminQuery := `
+	CREATE TABLE IF NOT EXISTS admins (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+
+	sessionQuery := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		token_hash TEXT PRIMARY KEY,
+		admin_id INTEGER NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL,
+		FOREIGN KEY (admin_id) REFERENCES admins(id) ON DELETE CASCADE
+	);
+	`
+
+	if _, err := db.Exec(adminQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы операторов: %w", err)
+	}
+
+	if _, err := db.Exec(sessionQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы сессий: %w", err)
+	}
+
+	// Учетные записи, созданные при входе через OIDC, связаны с субъектом провайдера
+	if err := addColumnIfMissing(db, "admins", "oidc_subject", "TEXT"); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_admins_oidc_subject ON admins(oidc_subject);`); err != nil {
+		return fmt.Errorf("ошибка создания индекса операторов: %w", err)
+	}
+
+	if err := addColumnIfMissing(db, "admins", "user_id", "INTEGER REFERENCES users(id) ON DELETE SET NULL"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddAdmin добавляет нового оператора
+func AddAdmin(db *sql.DB, admin Admin) (int64, error) {
+	query := `
+	INSERT INTO admins (username, password_hash, role_id, user_id)
+	VALUES (?, ?, (SELECT id FROM roles WHERE name = ?), NULLIF(?, 0));
+	`
+
+	result, err := db.Exec(query, admin.Username, admin.PasswordHash, admin.Role, admin.UserID)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка добавления оператора: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения ID: %w", err)
+	}
+
+	return id, nil
+}
+
+// GetAdminByID получает оператора по ID
+func GetAdminByID(db *sql.DB, id int64) (*Admin, error) {
+	admin := &Admin{}
+	query := `
+	SELECT a.id, a.username, a.password_hash, a.created_at, COALESCE(r.name, ''), COALESCE(a.user_id, 0)
+	FROM admins a
+	LEFT JOIN roles r ON r.id = a.role_id
+	WHERE a.id = ?;
+	`
+
+	err := db.QueryRow(query, id).Scan(&admin.ID, &admin.Username, &admin.PasswordHash, &admin.CreatedAt, &admin.Role, &admin.UserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("оператор с ID %d не найден", id)
+		}
+		return nil, fmt.Errorf("ошибка получения оператора: %w", err)
+	}
+
+	return admin, nil
+}
+
+// GetAdminByUsername получает оператора по имени
+func GetAdminByUsername(db *sql.DB, username string) (*Admin, error) {
+	admin := &Admin{}
+	query := `
+	SELECT a.id, a.username, a.password_hash, a.created_at, COALESCE(r.name, ''), COALESCE(a.user_id, 0)
+	FROM admins a
+	LEFT JOIN roles r ON r.id = a.role_id
+	WHERE a.username = ?;
+	`
+
+	err := db.QueryRow(query, username).Scan(&admin.ID, &admin.Username, &admin.PasswordHash, &admin.CreatedAt, &admin.Role, &admin.UserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("оператор %s не найден", username)
+		}
+		return nil, fmt.Errorf("ошибка получения оператора: %w", err)
+	}
+
+	return admin, nil
+}
+
+// GetAdminByOIDCSubject получает оператора по субъекту OIDC-провайдера
+func GetAdminByOIDCSubject(db *sql.DB, subject string) (*Admin, error) {
+	admin := &Admin{}
+	query := `
+	SELECT a.id, a.username, a.password_hash, a.created_at, COALESCE(r.name, ''), COALESCE(a.user_id, 0)
+	FROM admins a
+	LEFT JOIN roles r ON r.id = a.role_id
+	WHERE a.oidc_subject = ?;
+	`
+
+	err := db.QueryRow(query, subject).Scan(&admin.ID, &admin.Username, &admin.PasswordHash, &admin.CreatedAt, &admin.Role, &admin.UserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("оператор с субъектом %s не найден: %w", subject, err)
+		}
+		return nil, fmt.Errorf("ошибка получения оператора: %w", err)
+	}
+
+	return admin, nil
+}
+
+// UsernameTaken проверяет, занято ли имя оператором или пользователем SSH
+func UsernameTaken(db *sql.DB, username string) (bool, error) {
+	query := `
+	SELECT EXISTS (SELECT 1 FROM admins WHERE username = ?) OR EXISTS (SELECT 1 FROM users WHERE username = ?);
+	`
+
+	var taken bool
+	if err := db.QueryRow(query, username, username).Scan(&taken); err != nil {
+		return false, fmt.Errorf("ошибка проверки имени %s: %w", username, err)
+	}
+
+	return taken, nil
+}
+
+// AddOIDCAdmin добавляет оператора, входящего через OIDC. Такой оператор не имеет пароля
+func AddOIDCAdmin(db *sql.DB, admin Admin, subject string) (int64, error) {
+	query := `
+	INSERT INTO admins (username, password_hash, role_id, oidc_subject, user_id)
+	VALUES (?, '', (SELECT id FROM roles WHERE name = ?), ?, NULLIF(?, 0));
+	`
+
+	result, err := db.Exec(query, admin.Username, admin.Role, subject, admin.UserID)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка добавления оператора: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения ID: %w", err)
+	}
+
+	return id, nil
+}
+
+// GetAllAdmins получает всех операторов
+func GetAllAdmins(db *sql.DB) ([]Admin, error) {
+	query := `
+	SELECT a.id, a.username, a.password_hash, a.created_at, COALESCE(r.name, ''), COALESCE(a.user_id, 0)
+	FROM admins a
+	LEFT JOIN roles r ON r.id = a.role_id;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения операторов: %w", err)
+	}
+	defer rows.Close()
+
+	var admins []Admin
+	for rows.Next() {
+		var admin Admin
+		if err := rows.Scan(&admin.ID, &admin.Username, &admin.PasswordHash, &admin.CreatedAt, &admin.Role, &admin.UserID); err != nil {
+			return nil, fmt.Errorf("ошибка чтения данных оператора: %w", err)
+		}
+		admins = append(admins, admin)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return admins, nil
+}
+
+// CountAdmins возвращает количество операторов
+func CountAdmins(db *sql.DB) (int, error) {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM admins;`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("ошибка подсчета операторов: %w", err)
+	}
+	return count, nil
+}
+
+// UpdateAdminPassword обновляет хеш пароля оператора
+func UpdateAdminPassword(db *sql.DB, id int64, passwordHash string) error {
+	query := `
+	UPDATE admins
+	SET password_hash = ?
+	WHERE id = ?;
+	`
+
+	result, err := db.Exec(query, passwordHash, id)
+	if err != nil {
+		return fmt.Errorf("ошибка обновления пароля оператора: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("оператор с ID %d не найден", id)
+	}
+
+	return nil
+}
+
+// DeleteAdmin удаляет оператора вместе с его сессиями, API-токенами и группами
+func DeleteAdmin(db *sql.DB, id int64) error {
+	if _, err := db.Exec(`DELETE FROM sessions WHERE admin_id = ?;`, id); err != nil {
+		return fmt.Errorf("ошибка удаления сессий оператора: %w", err)
+	}
+
+	// Внешние ключи в SQLite не включены, поэтому API-токены оператора удаляются явно
+	if _, err := db.Exec(`DELETE FROM api_tokens WHERE admin_id = ?;`, id); err != nil {
+		return fmt.Errorf("ошибка удаления API-токенов оператора: %w", err)
+	}
+
+	if _, err := db.Exec(`DELETE FROM server_group_admins WHERE admin_id = ?;`, id); err != nil {
+		return fmt.Errorf("ошибка удаления групп оператора: %w", err)
+	}
+
+	result, err := db.Exec(`DELETE FROM admins WHERE id = ?;`, id)
+	if err != nil {
+		return fmt.Errorf("ошибка удаления оператора: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("оператор с ID %d не найден", id)
+	}
+
+	return nil
+}
+
+// CreateSession сохраняет сессию оператора. Сам токен не хранится, только его хеш
+func CreateSession(db *sql.DB, tokenHash string, adminID int64, expiresAt time.Time) error {
+	query := `
+	INSERT INTO sessions (token_hash, admin_id, expires_at)
+	VALUES (?, ?, ?);
+	`
+
+	if _, err := db.Exec(query, tokenHash, adminID, expiresAt.UTC()); err != nil {
+		return fmt.Errorf("ошибка создания сессии: %w", err)
+	}
+
+	return nil
+}
+
+// GetSessionAdmin возвращает оператора по хешу токена действующей сессии
+func GetSessionAdmin(db *sql.DB, tokenHash string) (*Admin, error) {
+	admin := &Admin{}
+	query := `
+	SELECT a.id, a.username, a.password_hash, a.created_at, COALESCE(r.name, ''), COALESCE(a.user_id, 0)
+	FROM sessions s
+	JOIN admins a ON a.id = s.admin_id
+	LEFT JOIN roles r ON r.id = a.role_id
+	WHERE s.token_hash = ? AND s.expires_at > ?;
+	`
+
+	err := db.QueryRow(query, tokenHash, time.Now().UTC()).Scan(&admin.ID, &admin.Username, &admin.PasswordHash, &admin.CreatedAt, &admin.Role, &admin.UserID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("сессия не найдена или истекла")
+		}
+		return nil, fmt.Errorf("ошибка получения сессии: %w", err)
+	}
+
+	return admin, nil
+}
+
+// DeleteSession удаляет сессию по хешу токена
+func DeleteSession(db *sql.DB, tokenHash string) error {
+	if _, err := db.Exec(`DELETE FROM sessions WHERE token_hash = ?;`, tokenHash); err != nil {
+		return fmt.Errorf("ошибка удаления сессии: %w", err)
+	}
+	return nil
+}
+
+// DeleteExpiredSessions удаляет истекшие сессии
+func DeleteExpiredSessions(db *sql.DB) error {
+	if _, err := db.Exec(`DELETE FROM sessions WHERE expires_at <= ?;`, time.Now().UTC()); err != nil {
+		return fmt.Errorf("ошибка удаления истекших сессий: %w", err)
+	}
+	return nil
+}
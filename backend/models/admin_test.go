@@ -0,0 +1,51 @@
+package models
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeleteAdminRemovesAPITokens(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "admins.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := CreateAdminTable(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateRoleTable(db, []Role{{Name: "admin", Permissions: []string{"users:read"}}}, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateServerGroupTable(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateAPITokenTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	adminID, err := AddAdmin(db, Admin{Username: "ci-owner", PasswordHash: "hash", Role: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddAPIToken(db, APIToken{AdminID: adminID, Name: "ci", Kind: TokenKindService, Scopes: []string{"users:read"}}, "token-hash"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteAdmin(db, adminID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetActiveAPIToken(db, "token-hash"); err == nil {
+		t.Fatal("API-токен удаленного оператора остался действующим")
+	}
+	tokens, err := GetAllAPITokens(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Fatalf("осталось API-токенов %d, ожидалось 0", len(tokens))
+	}
+}
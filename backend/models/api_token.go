@@ -0,0 +1,216 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Виды API-токенов
+const (
+	TokenKindPersonal = "personal" // Токен оператора для его собственных скриптов
+	TokenKindService  = "service"  // Токен для CI и систем автоматизации
+)
+
+// APIToken представляет API-токен для автоматизации. Сам токен не хранится, только его хеш
+type APIToken struct {
+	ID         int64      `json:"id"`
+	AdminID    int64      `json:"admin_id"`
+	Name       string     `json:"name"`
+	Kind       string     `json:"kind"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+// CreateAPITokenTable создает таблицу API-токенов
+func CreateAPITokenTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		admin_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		kind TEXT NOT NULL DEFAULT 'personal',
+		token_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME,
+		last_used_at DATETIME,
+		revoked_at DATETIME,
+		FOREIGN KEY (admin_id) REFERENCES admins(id) ON DELETE CASCADE
+	);
+	`
+
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("ошибка создания таблицы API-токенов: %w", err)
+	}
+
+	return nil
+}
+
+// AddAPIToken сохраняет новый API-токен по его хешу
+func AddAPIToken(db *sql.DB, token APIToken, tokenHash string) (int64, error) {
+	query := `
+	INSERT INTO api_tokens (admin_id, name, kind, token_hash, scopes, expires_at)
+	VALUES (?, ?, ?, ?, ?, ?);
+	`
+
+	result, err := db.Exec(query, token.AdminID, token.Name, token.Kind, tokenHash, strings.Join(token.Scopes, ","), nullTime(token.ExpiresAt))
+	if err != nil {
+		return 0, fmt.Errorf("ошибка добавления API-токена: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения ID: %w", err)
+	}
+
+	return id, nil
+}
+
+// GetAPITokenByID получает API-токен по ID
+func GetAPITokenByID(db *sql.DB, id int64) (*APIToken, error) {
+	query := `
+	SELECT id, admin_id, name, kind, scopes, created_at, expires_at, last_used_at, revoked_at
+	FROM api_tokens
+	WHERE id = ?;
+	`
+
+	token, err := scanAPIToken(db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("API-токен с ID %d не найден", id)
+		}
+		return nil, fmt.Errorf("ошибка получения API-токена: %w", err)
+	}
+
+	return token, nil
+}
+
+// GetActiveAPIToken получает действующий (не отозванный и не истекший) API-токен по хешу
+func GetActiveAPIToken(db *sql.DB, tokenHash string) (*APIToken, error) {
+	query := `
+	SELECT id, admin_id, name, kind, scopes, created_at, expires_at, last_used_at, revoked_at
+	FROM api_tokens
+	WHERE token_hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?);
+	`
+
+	token, err := scanAPIToken(db.QueryRow(query, tokenHash, time.Now().UTC()))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("API-токен не найден, отозван или истек")
+		}
+		return nil, fmt.Errorf("ошибка получения API-токена: %w", err)
+	}
+
+	return token, nil
+}
+
+// GetAllAPITokens получает все API-токены
+func GetAllAPITokens(db *sql.DB) ([]APIToken, error) {
+	query := `
+	SELECT id, admin_id, name, kind, scopes, created_at, expires_at, last_used_at, revoked_at
+	FROM api_tokens
+	ORDER BY id;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения API-токенов: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения данных API-токена: %w", err)
+		}
+		tokens = append(tokens, *token)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// TouchAPIToken отмечает время последнего использования API-токена
+func TouchAPIToken(db *sql.DB, id int64) error {
+	if _, err := db.Exec(`UPDATE api_tokens SET last_used_at = ? WHERE id = ?;`, time.Now().UTC(), id); err != nil {
+		return fmt.Errorf("ошибка обновления времени использования API-токена: %w", err)
+	}
+	return nil
+}
+
+// RevokeAPIToken отзывает API-токен. Запись сохраняется для истории
+func RevokeAPIToken(db *sql.DB, id int64) error {
+	query := `
+	UPDATE api_tokens
+	SET revoked_at = ?
+	WHERE id = ? AND revoked_at IS NULL;
+	`
+
+	result, err := db.Exec(query, time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("ошибка отзыва API-токена: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("действующий API-токен с ID %d не найден", id)
+	}
+
+	return nil
+}
+
+// rowScanner объединяет *sql.Row и *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanAPIToken читает API-токен из строки результата
+func scanAPIToken(row rowScanner) (*APIToken, error) {
+	var (
+		token      APIToken
+		scopes     string
+		expiresAt  sql.NullTime
+		lastUsedAt sql.NullTime
+		revokedAt  sql.NullTime
+	)
+
+	if err := row.Scan(&token.ID, &token.AdminID, &token.Name, &token.Kind, &scopes, &token.CreatedAt, &expiresAt, &lastUsedAt, &revokedAt); err != nil {
+		return nil, err
+	}
+
+	token.Scopes = splitList(scopes)
+	token.ExpiresAt = timePtr(expiresAt)
+	token.LastUsedAt = timePtr(lastUsedAt)
+	token.RevokedAt = timePtr(revokedAt)
+
+	return &token, nil
+}
+
+// nullTime преобразует необязательное время в значение для записи в базу данных
+func nullTime(t *time.Time) sql.NullTime {
+	if t == nil {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}
+}
+
+// timePtr преобразует прочитанное из базы данных необязательное время
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
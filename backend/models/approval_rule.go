@@ -0,0 +1,157 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ApprovalRule задает, кто и как одобряет запросы доступа к серверам группы.
+// Одобрять могут операторы из ApproverIDs и операторы с ролью ApproverRole.
+// RequiredApprovals - число разных одобряющих, MaxDuration - наибольший срок доступа (0 - без ограничения)
+type ApprovalRule struct {
+	GroupID           int64    `json:"group_id"`
+	ApproverIDs       []int64  `json:"approver_ids"`
+	ApproverRole      string   `json:"approver_role"`
+	RequiredApprovals int      `json:"required_approvals"`
+	MaxDuration       Duration `json:"max_duration"`
+}
+
+// CreateApprovalRuleTable создает таблицу правил одобрения запросов доступа
+func CreateApprovalRuleTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS approval_rules (
+		group_id INTEGER PRIMARY KEY,
+		approver_ids TEXT NOT NULL DEFAULT '',
+		approver_role TEXT NOT NULL DEFAULT '',
+		required_approvals INTEGER NOT NULL DEFAULT 1,
+		max_duration INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY (group_id) REFERENCES server_groups(id) ON DELETE CASCADE
+	);
+	`
+
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("ошибка создания таблицы правил одобрения: %w", err)
+	}
+
+	return nil
+}
+
+// SetApprovalRule сохраняет правило одобрения группы серверов, заменяя прежнее
+func SetApprovalRule(db *sql.DB, rule ApprovalRule) error {
+	query := `
+	INSERT INTO approval_rules (group_id, approver_ids, approver_role, required_approvals, max_duration)
+	VALUES (?, ?, ?, ?, ?)
+	ON CONFLICT (group_id) DO UPDATE SET
+		approver_ids = excluded.approver_ids,
+		approver_role = excluded.approver_role,
+		required_approvals = excluded.required_approvals,
+		max_duration = excluded.max_duration;
+	`
+
+	ids := make([]string, 0, len(rule.ApproverIDs))
+	for _, id := range rule.ApproverIDs {
+		ids = append(ids, strconv.FormatInt(id, 10))
+	}
+
+	seconds := int64(time.Duration(rule.MaxDuration).Seconds())
+	if _, err := db.Exec(query, rule.GroupID, strings.Join(ids, ","), rule.ApproverRole, rule.RequiredApprovals, seconds); err != nil {
+		return fmt.Errorf("ошибка сохранения правила одобрения: %w", err)
+	}
+
+	return nil
+}
+
+// GetApprovalRule получает правило одобрения группы серверов
+func GetApprovalRule(db *sql.DB, groupID int64) (*ApprovalRule, error) {
+	query := `
+	SELECT group_id, approver_ids, approver_role, required_approvals, max_duration
+	FROM approval_rules
+	WHERE group_id = ?;
+	`
+
+	rule, err := scanApprovalRule(db.QueryRow(query, groupID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("правило одобрения группы с ID %d не найдено", groupID)
+		}
+		return nil, fmt.Errorf("ошибка получения правила одобрения: %w", err)
+	}
+
+	return rule, nil
+}
+
+// GetServerApprovalRules получает правила одобрения всех групп, в которые входит сервер
+func GetServerApprovalRules(db *sql.DB, serverID int64) ([]ApprovalRule, error) {
+	query := `
+	SELECT r.group_id, r.approver_ids, r.approver_role, r.required_approvals, r.max_duration
+	FROM approval_rules r
+	JOIN server_group_servers gs ON gs.group_id = r.group_id
+	WHERE gs.server_id = ?
+	ORDER BY r.group_id;
+	`
+
+	rows, err := db.Query(query, serverID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения правил одобрения: %w", err)
+	}
+	defer rows.Close()
+
+	var rules []ApprovalRule
+	for rows.Next() {
+		rule, err := scanApprovalRule(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения данных правила одобрения: %w", err)
+		}
+		rules = append(rules, *rule)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return rules, nil
+}
+
+// DeleteApprovalRule удаляет правило одобрения группы серверов
+func DeleteApprovalRule(db *sql.DB, groupID int64) error {
+	result, err := db.Exec(`DELETE FROM approval_rules WHERE group_id = ?;`, groupID)
+	if err != nil {
+		return fmt.Errorf("ошибка удаления правила одобрения: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("правило одобрения группы с ID %d не найдено", groupID)
+	}
+
+	return nil
+}
+
+// scanApprovalRule читает правило одобрения из строки результата
+func scanApprovalRule(row rowScanner) (*ApprovalRule, error) {
+	var (
+		rule        ApprovalRule
+		approverIDs string
+		seconds     int64
+	)
+
+	if err := row.Scan(&rule.GroupID, &approverIDs, &rule.ApproverRole, &rule.RequiredApprovals, &seconds); err != nil {
+		return nil, err
+	}
+
+	ids, err := parseIDList(approverIDs)
+	if err != nil {
+		return nil, err
+	}
+	rule.ApproverIDs = ids
+	rule.MaxDuration = Duration(time.Duration(seconds) * time.Second)
+
+	return &rule, nil
+}
@@ -0,0 +1,365 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Результаты действий в журнале аудита
+const (
+	AuditSuccess = "success" // Действие выполнено
+	AuditFailure = "failure" // Действие не выполнено или откачено
+)
+
+// AuditSystemActor имя исполнителя фоновых действий шлюза (отзыв истекших доступов, сверка)
+const AuditSystemActor = "system"
+
+// Действия, которые записываются в журнал аудита
+const (
+	AuditLogin     = "auth.login"
+	AuditLoginOIDC = "auth.login_oidc"
+	AuditLogout    = "auth.logout"
+
+	AuditAdminCreate   = "admin.create"
+	AuditAdminPassword = "admin.password"
+	AuditAdminRole     = "admin.role"
+	AuditAdminDelete   = "admin.delete"
+
+	AuditTokenCreate = "token.create"
+	AuditTokenRevoke = "token.revoke"
+
+	AuditUserCreate = "user.create"
+	AuditUserUpdate = "user.update"
+	AuditUserDelete = "user.delete"
+
+	AuditKeyAdd    = "key.add"
+	AuditKeyUpdate = "key.update"
+	AuditKeyDelete = "key.delete"
+
+	AuditServerCreate     = "server.create"
+	AuditServerUpdate     = "server.update"
+	AuditServerDelete     = "server.delete"
+	AuditServerPinHostKey = "server.host_key.pin"
+	AuditServerClearKey   = "server.host_key.clear"
+	AuditServerEnroll     = "server.enroll"
+
+	AuditGateKeyRotate = "gate_key.rotate"
+
+	AuditAccessGrant  = "access.grant"
+	AuditAccessRevoke = "access.revoke"
+	AuditAccessExpire = "access.expire"
+
+	AuditReconcile = "reconcile.apply"
+
+	AuditPlanCreate = "plan.create"
+	AuditPlanApply  = "plan.apply"
+
+	AuditGroupCreate       = "group.create"
+	AuditGroupDelete       = "group.delete"
+	AuditGroupAddServer    = "group.server.add"
+	AuditGroupRemoveServer = "group.server.remove"
+	AuditGroupAddAdmin     = "group.admin.add"
+	AuditGroupRemoveAdmin  = "group.admin.remove"
+	AuditApprovalRuleSet   = "group.approval_rule.set"
+	AuditApprovalRuleDel   = "group.approval_rule.delete"
+
+	AuditUserGroupCreate       = "user_group.create"
+	AuditUserGroupUpdate       = "user_group.update"
+	AuditUserGroupDelete       = "user_group.delete"
+	AuditUserGroupAddUser      = "user_group.user.add"
+	AuditUserGroupRemoveUser   = "user_group.user.remove"
+	AuditUserGroupGrantServer  = "user_group.server.grant"
+	AuditUserGroupRevokeServer = "user_group.server.revoke"
+
+	AuditPolicyCreate = "access_policy.create"
+	AuditPolicyUpdate = "access_policy.update"
+	AuditPolicyDelete = "access_policy.delete"
+
+	AuditRequestCreate  = "access_request.create"
+	AuditRequestApprove = "access_request.approve"
+	AuditRequestDeny    = "access_request.deny"
+	AuditRequestCancel  = "access_request.cancel"
+)
+
+// AuditEvent представляет запись журнала аудита. ActorID - оператор, выполнивший действие
+// (0 для фоновых действий шлюза), TokenID - API-токен, через который выполнен запрос.
+// UserID и ServerID - затронутые пользователь и сервер, Target - другой объект действия
+// (например, "admin:3"). Before и After - состояние объекта до и после действия в JSON,
+// Error - текст ошибки, в том числе ошибки SSH. Hash - SHA-256 записи вместе с хешем
+// предыдущей записи PrevHash, Signature - HMAC-SHA256 хеша, если задан ключ подписи журнала
+type AuditEvent struct {
+	ID        int64           `json:"id"`
+	CreatedAt time.Time       `json:"created_at"`
+	ActorID   int64           `json:"actor_id"`
+	Actor     string          `json:"actor"`
+	TokenID   int64           `json:"token_id,omitempty"`
+	Action    string          `json:"action"`
+	UserID    int64           `json:"user_id,omitempty"`
+	ServerID  int64           `json:"server_id,omitempty"`
+	Target    string          `json:"target,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	Result    string          `json:"result"`
+	Error     string          `json:"error,omitempty"`
+	ClientIP  string          `json:"client_ip,omitempty"`
+	PrevHash  string          `json:"prev_hash"`
+	Hash      string          `json:"hash"`
+	Signature string          `json:"signature,omitempty"`
+}
+
+// auditSelect выбирает все поля записей журнала аудита
+const auditSelect = `
+	SELECT id, created_at, actor_id, actor, token_id, action, user_id, server_id, target,
+		before_state, after_state, result, error, client_ip, prev_hash, hash, signature
+	FROM audit_events
+	`
+
+// AuditFilter задает условия выборки записей журнала аудита. Нулевые поля не учитываются.
+// Action выбирает действие целиком или все действия с этим префиксом (например, "access").
+// Limit и Offset задают страницу выборки, Limit = 0 - без ограничения
+type AuditFilter struct {
+	ActorID  int64
+	Action   string
+	UserID   int64
+	ServerID int64
+	Result   string
+	From     *time.Time
+	To       *time.Time
+	Limit    int
+	Offset   int
+}
+
+// CreateAuditTable создает таблицу журнала аудита. Журнал только дополняется:
+// изменение и удаление записей, а также добавление записей вне цепочки хешей запрещено
+// триггерами. Записи, сохраненные до появления цепочки, включаются в нее при миграции
+func CreateAuditTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS audit_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at DATETIME NOT NULL,
+		actor_id INTEGER NOT NULL DEFAULT 0,
+		actor TEXT NOT NULL DEFAULT '',
+		token_id INTEGER NOT NULL DEFAULT 0,
+		action TEXT NOT NULL,
+		user_id INTEGER NOT NULL DEFAULT 0,
+		server_id INTEGER NOT NULL DEFAULT 0,
+		target TEXT NOT NULL DEFAULT '',
+		before_state TEXT,
+		after_state TEXT,
+		result TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		client_ip TEXT NOT NULL DEFAULT '',
+		prev_hash TEXT NOT NULL DEFAULT '',
+		hash TEXT NOT NULL DEFAULT '',
+		signature TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS audit_events_created_at ON audit_events (created_at);
+	CREATE INDEX IF NOT EXISTS audit_events_user_id ON audit_events (user_id);
+	CREATE INDEX IF NOT EXISTS audit_events_server_id ON audit_events (server_id);
+	`
+
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("ошибка создания таблицы журнала аудита: %w", err)
+	}
+
+	// Цепочка хешей появилась позже журнала: записи, сохраненные до нее, включаются
+	// в цепочку один раз, вместе с добавлением столбцов
+	chained, err := hasColumn(db, "audit_events", "hash")
+	if err != nil {
+		return err
+	}
+	if !chained {
+		if err := chainAuditEvents(db); err != nil {
+			return err
+		}
+	}
+
+	// Новая запись должна иметь хеш и ссылаться на последнюю запись цепочки
+	triggers := `
+	CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+	BEGIN
+		SELECT RAISE(ABORT, 'журнал аудита нельзя изменять');
+	END;
+	CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+	BEGIN
+		SELECT RAISE(ABORT, 'записи журнала аудита нельзя удалять');
+	END;
+	CREATE TRIGGER IF NOT EXISTS audit_events_chained BEFORE INSERT ON audit_events
+	WHEN NEW.hash = ''
+		OR NEW.prev_hash <> COALESCE((SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1), '')
+	BEGIN
+		SELECT RAISE(ABORT, 'запись журнала аудита не включена в цепочку');
+	END;
+	`
+
+	if _, err := db.Exec(triggers); err != nil {
+		return fmt.Errorf("ошибка создания триггеров журнала аудита: %w", err)
+	}
+
+	return nil
+}
+
+// AddAuditEvent добавляет запись в конец цепочки журнала аудита
+func AddAuditEvent(db *sql.DB, event AuditEvent) (int64, error) {
+	query := `
+	INSERT INTO audit_events (id, created_at, actor_id, actor, token_id, action, user_id, server_id, target,
+		before_state, after_state, result, error, client_ip, prev_hash, hash, signature)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`
+
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	event.CreatedAt = event.CreatedAt.UTC()
+	event.Before = nullJSON(event.Before)
+	event.After = nullJSON(event.After)
+
+	// Записи добавляются по одной, чтобы каждая ссылалась на последнюю запись цепочки
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	event.ID, event.PrevHash = 0, ""
+	err = tx.QueryRow(`SELECT id, hash FROM audit_events ORDER BY id DESC LIMIT 1;`).Scan(&event.ID, &event.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("ошибка получения последней записи журнала аудита: %w", err)
+	}
+	event.ID++
+	event.Hash = auditHash(event)
+	event.Signature = auditSignature(auditKey, event.Hash)
+
+	_, err = tx.Exec(query, event.ID, event.CreatedAt, event.ActorID, event.Actor, event.TokenID, event.Action,
+		event.UserID, event.ServerID, event.Target, nullString(event.Before), nullString(event.After),
+		event.Result, event.Error, event.ClientIP, event.PrevHash, event.Hash, event.Signature)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка записи в журнал аудита: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("ошибка записи в журнал аудита: %w", err)
+	}
+
+	return event.ID, nil
+}
+
+// GetAuditEvents получает записи журнала аудита по фильтру, начиная с новых,
+// и общее число записей, подходящих под фильтр без учета страницы
+func GetAuditEvents(db *sql.DB, filter AuditFilter) ([]AuditEvent, int, error) {
+	var (
+		conditions []string
+		args       []any
+	)
+	if filter.ActorID != 0 {
+		conditions = append(conditions, "actor_id = ?")
+		args = append(args, filter.ActorID)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "(action = ? OR action LIKE ?)")
+		args = append(args, filter.Action, filter.Action+".%")
+	}
+	if filter.UserID != 0 {
+		conditions = append(conditions, "user_id = ?")
+		args = append(args, filter.UserID)
+	}
+	if filter.ServerID != 0 {
+		conditions = append(conditions, "server_id = ?")
+		args = append(args, filter.ServerID)
+	}
+	if filter.Result != "" {
+		conditions = append(conditions, "result = ?")
+		args = append(args, filter.Result)
+	}
+	if filter.From != nil {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.From.UTC())
+	}
+	if filter.To != nil {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filter.To.UTC())
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "WHERE " + strings.Join(conditions, " AND ") + "\n"
+	}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM audit_events\n"+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("ошибка подсчета записей журнала аудита: %w", err)
+	}
+
+	query := auditSelect + where + "ORDER BY id DESC\n"
+	if filter.Limit > 0 {
+		query += "LIMIT ? OFFSET ?"
+		args = append(args, filter.Limit, filter.Offset)
+	}
+
+	rows, err := db.Query(query+";", args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("ошибка получения журнала аудита: %w", err)
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("ошибка чтения записи журнала аудита: %w", err)
+		}
+		events = append(events, *event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return events, total, nil
+}
+
+// scanAuditEvent читает запись журнала аудита из строки результата
+func scanAuditEvent(row rowScanner) (*AuditEvent, error) {
+	var (
+		event         AuditEvent
+		before, after sql.NullString
+	)
+
+	err := row.Scan(&event.ID, &event.CreatedAt, &event.ActorID, &event.Actor, &event.TokenID, &event.Action,
+		&event.UserID, &event.ServerID, &event.Target, &before, &after, &event.Result, &event.Error, &event.ClientIP,
+		&event.PrevHash, &event.Hash, &event.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	if before.Valid {
+		event.Before = json.RawMessage(before.String)
+	}
+	if after.Valid {
+		event.After = json.RawMessage(after.String)
+	}
+
+	return &event, nil
+}
+
+// nullJSON приводит отсутствующее состояние объекта (null) к пустому значению
+func nullJSON(value json.RawMessage) json.RawMessage {
+	if len(value) == 0 || string(value) == "null" {
+		return nil
+	}
+	return value
+}
+
+// nullString возвращает NULL для пустого состояния объекта
+func nullString(value json.RawMessage) sql.NullString {
+	if len(value) == 0 {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: string(value), Valid: true}
+}
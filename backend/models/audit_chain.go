@@ -0,0 +1,261 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// auditMu упорядочивает добавление записей в цепочку журнала аудита
+	auditMu sync.Mutex
+	// auditKey ключ подписи новых записей журнала аудита (nil - записи не подписываются)
+	auditKey []byte
+)
+
+// SetAuditSigningKey задает ключ, которым подписываются новые записи журнала аудита
+func SetAuditSigningKey(key []byte) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	auditKey = key
+}
+
+// AuditCheckpoint фиксирует состояние цепочки журнала аудита: последнюю запись, ее хеш
+// и число записей. Контрольные точки хранятся вне шлюза и позволяют обнаружить
+// удаление последних записей или пересчет всей цепочки
+type AuditCheckpoint struct {
+	EventID   int64     `json:"event_id"`
+	Hash      string    `json:"hash"`
+	Events    int64     `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+	Signature string    `json:"signature,omitempty"`
+}
+
+// AuditVerification описывает результат проверки цепочки журнала аудита.
+// BrokenID - первая запись, на которой цепочка нарушена, Reason - причина
+type AuditVerification struct {
+	Valid      bool             `json:"valid"`
+	Checked    int64            `json:"checked"`
+	LastID     int64            `json:"last_id"`
+	LastHash   string           `json:"last_hash"`
+	Signed     bool             `json:"signatures_checked"`
+	BrokenID   int64            `json:"broken_id,omitempty"`
+	Reason     string           `json:"reason,omitempty"`
+	Checkpoint *AuditCheckpoint `json:"checkpoint,omitempty"`
+}
+
+// NewAuditCheckpoint создает контрольную точку для последней записи журнала аудита
+// и подписывает ее ключом key, если он задан
+func NewAuditCheckpoint(db *sql.DB, key []byte) (*AuditCheckpoint, error) {
+	checkpoint := AuditCheckpoint{CreatedAt: time.Now().UTC()}
+
+	err := db.QueryRow(`SELECT id, hash FROM audit_events ORDER BY id DESC LIMIT 1;`).Scan(&checkpoint.EventID, &checkpoint.Hash)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("ошибка получения последней записи журнала аудита: %w", err)
+	}
+
+	if err := db.QueryRow(`SELECT COUNT(*) FROM audit_events;`).Scan(&checkpoint.Events); err != nil {
+		return nil, fmt.Errorf("ошибка подсчета записей журнала аудита: %w", err)
+	}
+
+	checkpoint.Signature = checkpoint.sign(key)
+	return &checkpoint, nil
+}
+
+// sign возвращает подпись контрольной точки или пустую строку, если ключ не задан
+func (c *AuditCheckpoint) sign(key []byte) string {
+	if key == nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, key)
+	writeField(mac, strconv.FormatInt(c.EventID, 10))
+	writeField(mac, c.Hash)
+	writeField(mac, strconv.FormatInt(c.Events, 10))
+	writeField(mac, c.CreatedAt.UTC().Format(time.RFC3339Nano))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyAuditChain проверяет цепочку журнала аудита от первой записи до последней: связь
+// каждой записи с предыдущей и ее хеш. Если задан ключ key, проверяются и подписи: каждая
+// подписанная запись должна иметь верную подпись, а после последней подписанной записи
+// не должно быть неподписанных (подпись записи подтверждает через цепочку все предыдущие).
+// Если передана контрольная точка, проверяется, что ее запись есть в цепочке с тем же хешем
+func VerifyAuditChain(db *sql.DB, key []byte, checkpoint *AuditCheckpoint) (*AuditVerification, error) {
+	rows, err := db.Query(auditSelect + "ORDER BY id;")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения журнала аудита: %w", err)
+	}
+	defer rows.Close()
+
+	result := &AuditVerification{Signed: key != nil, Checkpoint: checkpoint}
+	var (
+		unsignedFrom   int64 // Первая неподписанная запись после последней подписанной
+		checkpointSeen bool
+	)
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения записи журнала аудита: %w", err)
+		}
+
+		switch {
+		case event.Hash == "":
+			result.BrokenID, result.Reason = event.ID, "запись не включена в цепочку: запись вставлена"
+		case event.PrevHash != result.LastHash:
+			result.BrokenID, result.Reason = event.ID, "запись не связана с предыдущей: запись удалена или вставлена"
+		case auditHash(*event) != event.Hash:
+			result.BrokenID, result.Reason = event.ID, "хеш не совпадает: запись изменена"
+		case key != nil && event.Signature != "" && !hmac.Equal([]byte(event.Signature), []byte(auditSignature(key, event.Hash))):
+			result.BrokenID, result.Reason = event.ID, "подпись не совпадает"
+		}
+		if result.BrokenID != 0 {
+			return result, nil
+		}
+
+		if event.Signature != "" {
+			unsignedFrom = 0
+		} else if unsignedFrom == 0 {
+			unsignedFrom = event.ID
+		}
+
+		if checkpoint != nil && event.ID == checkpoint.EventID {
+			checkpointSeen = true
+			if event.Hash != checkpoint.Hash {
+				result.BrokenID, result.Reason = event.ID, "хеш записи не совпадает с контрольной точкой"
+				return result, nil
+			}
+		}
+
+		result.Checked++
+		result.LastID = event.ID
+		result.LastHash = event.Hash
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	if key != nil && unsignedFrom != 0 {
+		result.BrokenID, result.Reason = unsignedFrom, "записи не подписаны"
+		return result, nil
+	}
+
+	if checkpoint != nil {
+		switch {
+		case key != nil && checkpoint.Signature != "" && !hmac.Equal([]byte(checkpoint.Signature), []byte(checkpoint.sign(key))):
+			result.Reason = "подпись контрольной точки не совпадает"
+			return result, nil
+		case checkpoint.EventID != 0 && !checkpointSeen:
+			result.BrokenID, result.Reason = checkpoint.EventID, "запись контрольной точки отсутствует: журнал усечен"
+			return result, nil
+		case result.Checked < checkpoint.Events:
+			result.Reason = "записей меньше, чем в контрольной точке"
+			return result, nil
+		}
+	}
+
+	result.Valid = true
+	return result, nil
+}
+
+// chainAuditEvents добавляет в журнал аудита столбцы цепочки хешей и включает в цепочку
+// все сохраненные ранее записи. Выполняется один раз, в одной транзакции с добавлением
+// столбцов: после миграции запись без хеша считается нарушением цепочки. Запрет изменения
+// журнала на время переноса снимается и затем создается заново
+func chainAuditEvents(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, column := range []string{"prev_hash", "hash", "signature"} {
+		if err := addColumnIfMissing(tx, "audit_events", column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DROP TRIGGER IF EXISTS audit_events_no_update;`); err != nil {
+		return fmt.Errorf("ошибка снятия запрета изменения журнала аудита: %w", err)
+	}
+
+	rows, err := tx.Query(auditSelect + "ORDER BY id;")
+	if err != nil {
+		return fmt.Errorf("ошибка получения журнала аудита: %w", err)
+	}
+	var events []AuditEvent
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("ошибка чтения записи журнала аудита: %w", err)
+		}
+		events = append(events, *event)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	prev := ""
+	for _, event := range events {
+		event.PrevHash = prev
+		event.Hash = auditHash(event)
+		event.Signature = auditSignature(auditKey, event.Hash)
+		_, err := tx.Exec(`UPDATE audit_events SET prev_hash = ?, hash = ?, signature = ? WHERE id = ?;`,
+			event.PrevHash, event.Hash, event.Signature, event.ID)
+		if err != nil {
+			return fmt.Errorf("ошибка записи хеша журнала аудита: %w", err)
+		}
+		prev = event.Hash
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ошибка сохранения цепочки журнала аудита: %w", err)
+	}
+
+	return nil
+}
+
+// auditHash вычисляет SHA-256 записи журнала аудита вместе с хешем предыдущей записи.
+// Каждое поле записывается с длиной, чтобы границы полей нельзя было сдвинуть
+func auditHash(event AuditEvent) string {
+	h := sha256.New()
+	writeField(h, strconv.FormatInt(event.ID, 10))
+	writeField(h, event.CreatedAt.UTC().Format(time.RFC3339Nano))
+	writeField(h, strconv.FormatInt(event.ActorID, 10))
+	writeField(h, event.Actor)
+	writeField(h, strconv.FormatInt(event.TokenID, 10))
+	writeField(h, event.Action)
+	writeField(h, strconv.FormatInt(event.UserID, 10))
+	writeField(h, strconv.FormatInt(event.ServerID, 10))
+	writeField(h, event.Target)
+	writeField(h, string(event.Before))
+	writeField(h, string(event.After))
+	writeField(h, event.Result)
+	writeField(h, event.Error)
+	writeField(h, event.ClientIP)
+	writeField(h, event.PrevHash)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// auditSignature возвращает HMAC-SHA256 хеша записи или пустую строку, если ключ не задан
+func auditSignature(key []byte, digest string) string {
+	if key == nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(digest))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// writeField записывает поле в хеш вместе с его длиной
+func writeField(h hash.Hash, value string) {
+	fmt.Fprintf(h, "%d:%s;", len(value), value)
+}
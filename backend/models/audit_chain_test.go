@@ -0,0 +1,296 @@
+package models
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var testAuditKey = []byte("audit-signing-key")
+
+// newAuditTestDB создает базу данных с журналом аудита и задает ключ подписи записей
+func newAuditTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "audit.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	SetAuditSigningKey(testAuditKey)
+	t.Cleanup(func() { SetAuditSigningKey(nil) })
+
+	if err := CreateAuditTable(db); err != nil {
+		t.Fatalf("ошибка создания журнала аудита: %v", err)
+	}
+
+	return db
+}
+
+// addTestEvents добавляет в журнал n записей
+func addTestEvents(t *testing.T, db *sql.DB, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		_, err := AddAuditEvent(db, AuditEvent{Actor: "admin", ActorID: 1, Action: AuditUserCreate, UserID: int64(i + 1), Result: AuditSuccess})
+		if err != nil {
+			t.Fatalf("ошибка записи в журнал аудита: %v", err)
+		}
+	}
+}
+
+// execUnguarded выполняет запрос к журналу в обход триггеров, как злоумышленник с доступом к базе
+func execUnguarded(t *testing.T, db *sql.DB, query string, args ...any) {
+	t.Helper()
+
+	for _, trigger := range []string{"audit_events_no_update", "audit_events_no_delete", "audit_events_chained"} {
+		if _, err := db.Exec("DROP TRIGGER IF EXISTS " + trigger + ";"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddAuditEventBuildsChain(t *testing.T) {
+	db := newAuditTestDB(t)
+	addTestEvents(t, db, 3)
+
+	events, total, err := GetAuditEvents(db, AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 {
+		t.Fatalf("записей %d, ожидалось 3", total)
+	}
+
+	// Записи возвращаются начиная с новых
+	prev := ""
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		if event.PrevHash != prev {
+			t.Fatalf("запись %d ссылается на %q, ожидалось %q", event.ID, event.PrevHash, prev)
+		}
+		if event.Hash != auditHash(event) {
+			t.Fatalf("запись %d: неверный хеш", event.ID)
+		}
+		if event.Signature != auditSignature(testAuditKey, event.Hash) {
+			t.Fatalf("запись %d: неверная подпись", event.ID)
+		}
+		prev = event.Hash
+	}
+
+	result, err := VerifyAuditChain(db, testAuditKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || result.Checked != 3 || result.LastHash != prev {
+		t.Fatalf("проверка цепочки: %+v", result)
+	}
+}
+
+func TestVerifyAuditChainWithCheckpoint(t *testing.T) {
+	db := newAuditTestDB(t)
+	addTestEvents(t, db, 2)
+
+	checkpoint, err := NewAuditCheckpoint(db, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestEvents(t, db, 1)
+
+	result, err := VerifyAuditChain(db, testAuditKey, checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || result.Checked != 3 {
+		t.Fatalf("проверка с контрольной точкой: %+v", result)
+	}
+
+	// Контрольная точка, подписанная другим ключом, не принимается
+	forged := *checkpoint
+	forged.Signature = forged.sign([]byte("other-key"))
+	result, err = VerifyAuditChain(db, testAuditKey, &forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Valid {
+		t.Fatal("принята контрольная точка с чужой подписью")
+	}
+}
+
+func TestVerifyAuditChainDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name     string
+		tamper   func(t *testing.T, db *sql.DB)
+		brokenID int64
+	}{
+		{
+			name: "изменена запись",
+			tamper: func(t *testing.T, db *sql.DB) {
+				execUnguarded(t, db, `UPDATE audit_events SET action = ? WHERE id = 2;`, AuditUserDelete)
+			},
+			brokenID: 2,
+		},
+		{
+			name: "удалена запись",
+			tamper: func(t *testing.T, db *sql.DB) {
+				execUnguarded(t, db, `DELETE FROM audit_events WHERE id = 2;`)
+			},
+			brokenID: 3,
+		},
+		{
+			name: "вставлена запись без хеша",
+			tamper: func(t *testing.T, db *sql.DB) {
+				execUnguarded(t, db, `INSERT INTO audit_events (created_at, action, result) VALUES (?, ?, ?);`,
+					time.Now().UTC(), AuditAccessGrant, AuditSuccess)
+			},
+			brokenID: 4,
+		},
+		{
+			name: "вставлена запись с пересчитанным хешем без подписи",
+			tamper: func(t *testing.T, db *sql.DB) {
+				var last string
+				if err := db.QueryRow(`SELECT hash FROM audit_events WHERE id = 3;`).Scan(&last); err != nil {
+					t.Fatal(err)
+				}
+				event := AuditEvent{ID: 4, CreatedAt: time.Now().UTC(), Action: AuditAccessGrant, Result: AuditSuccess, PrevHash: last}
+				event.Hash = auditHash(event)
+				execUnguarded(t, db, `INSERT INTO audit_events (id, created_at, action, result, prev_hash, hash) VALUES (?, ?, ?, ?, ?, ?);`,
+					event.ID, event.CreatedAt, event.Action, event.Result, event.PrevHash, event.Hash)
+			},
+			brokenID: 4,
+		},
+		{
+			name: "подпись чужим ключом",
+			tamper: func(t *testing.T, db *sql.DB) {
+				var digest string
+				if err := db.QueryRow(`SELECT hash FROM audit_events WHERE id = 1;`).Scan(&digest); err != nil {
+					t.Fatal(err)
+				}
+				execUnguarded(t, db, `UPDATE audit_events SET signature = ? WHERE id = 1;`, auditSignature([]byte("other-key"), digest))
+			},
+			brokenID: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newAuditTestDB(t)
+			addTestEvents(t, db, 3)
+			tt.tamper(t, db)
+
+			result, err := VerifyAuditChain(db, testAuditKey, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Valid || result.BrokenID != tt.brokenID {
+				t.Fatalf("проверка цепочки: %+v, ожидалось нарушение на записи %d", result, tt.brokenID)
+			}
+		})
+	}
+}
+
+func TestCreateAuditTableDoesNotChainForgedRows(t *testing.T) {
+	db := newAuditTestDB(t)
+	addTestEvents(t, db, 3)
+
+	execUnguarded(t, db, `INSERT INTO audit_events (created_at, action, result) VALUES (?, ?, ?);`,
+		time.Now().UTC(), AuditAccessGrant, AuditSuccess)
+
+	// Перезапуск шлюза не включает вставленную запись в цепочку
+	if err := CreateAuditTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := VerifyAuditChain(db, testAuditKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Valid || result.BrokenID != 4 {
+		t.Fatalf("проверка цепочки после перезапуска: %+v, ожидалось нарушение на записи 4", result)
+	}
+}
+
+func TestAuditTableRejectsUnchainedInsert(t *testing.T) {
+	db := newAuditTestDB(t)
+	addTestEvents(t, db, 1)
+
+	_, err := db.Exec(`INSERT INTO audit_events (created_at, action, result) VALUES (?, ?, ?);`,
+		time.Now().UTC(), AuditAccessGrant, AuditSuccess)
+	if err == nil {
+		t.Fatal("вставлена запись без хеша")
+	}
+
+	_, err = db.Exec(`INSERT INTO audit_events (created_at, action, result, prev_hash, hash) VALUES (?, ?, ?, ?, ?);`,
+		time.Now().UTC(), AuditAccessGrant, AuditSuccess, "", "forged")
+	if err == nil {
+		t.Fatal("вставлена запись, не связанная с последней записью цепочки")
+	}
+}
+
+func TestCreateAuditTableChainsLegacyEvents(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "audit.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	SetAuditSigningKey(testAuditKey)
+	t.Cleanup(func() { SetAuditSigningKey(nil) })
+
+	// Журнал в том виде, в каком он был до появления цепочки хешей
+	legacy := `
+	CREATE TABLE audit_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at DATETIME NOT NULL,
+		actor_id INTEGER NOT NULL DEFAULT 0,
+		actor TEXT NOT NULL DEFAULT '',
+		token_id INTEGER NOT NULL DEFAULT 0,
+		action TEXT NOT NULL,
+		user_id INTEGER NOT NULL DEFAULT 0,
+		server_id INTEGER NOT NULL DEFAULT 0,
+		target TEXT NOT NULL DEFAULT '',
+		before_state TEXT,
+		after_state TEXT,
+		result TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		client_ip TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TRIGGER audit_events_no_update BEFORE UPDATE ON audit_events
+	BEGIN
+		SELECT RAISE(ABORT, 'журнал аудита нельзя изменять');
+	END;
+	`
+	if _, err := db.Exec(legacy); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err := db.Exec(`INSERT INTO audit_events (created_at, action, result) VALUES (?, ?, ?);`,
+			time.Now().UTC(), AuditUserCreate, AuditSuccess)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := CreateAuditTable(db); err != nil {
+		t.Fatalf("ошибка миграции журнала аудита: %v", err)
+	}
+	addTestEvents(t, db, 1)
+
+	result, err := VerifyAuditChain(db, testAuditKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Valid || result.Checked != 3 {
+		t.Fatalf("проверка цепочки после миграции: %+v", result)
+	}
+
+	if _, err := db.Exec(`UPDATE audit_events SET action = ? WHERE id = 1;`, AuditUserDelete); err == nil {
+		t.Fatal("после миграции снят запрет изменения журнала")
+	}
+}
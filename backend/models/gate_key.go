@@ -0,0 +1,179 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Состояния ключа шлюза
+const (
+	GateKeyActive   = "active"   // Устанавливается на новые серверы
+	GateKeyRetiring = "retiring" // Заменен новым, но еще установлен на части серверов
+	GateKeyRetired  = "retired"  // Не установлен ни на одном сервере, приватная часть удалена
+)
+
+// GateKey представляет собственный ключ шлюза, по которому он входит на серверы.
+// Активный ключ всегда один; после ротации прежний ключ используется, пока его
+// не заменят на всех серверах
+type GateKey struct {
+	ID          int64      `json:"id"`
+	PublicKey   string     `json:"public_key"`
+	Fingerprint string     `json:"fingerprint"`
+	PrivateKey  string     `json:"-"` // Хранится в зашифрованном виде, наружу не отдается
+	Status      string     `json:"status"`
+	Servers     int        `json:"servers"` // Число серверов, на которых установлен ключ
+	CreatedAt   time.Time  `json:"created_at"`
+	RetiredAt   *time.Time `json:"retired_at,omitempty"`
+}
+
+// CreateGateKeyTable создает таблицу ключей шлюза
+func CreateGateKeyTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS gate_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		public_key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		private_key TEXT NOT NULL,
+		status TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		retired_at DATETIME
+	);
+	`
+
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("ошибка создания таблицы ключей шлюза: %w", err)
+	}
+
+	return nil
+}
+
+// AddGateKey добавляет новый активный ключ шлюза. Прежний активный ключ
+// переходит в состояние retiring
+func AddGateKey(db *sql.DB, key GateKey) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE gate_keys SET status = ? WHERE status = ?;`, GateKeyRetiring, GateKeyActive); err != nil {
+		return 0, fmt.Errorf("ошибка замены активного ключа шлюза: %w", err)
+	}
+
+	query := `
+	INSERT INTO gate_keys (public_key, fingerprint, private_key, status, created_at)
+	VALUES (?, ?, ?, ?, ?);
+	`
+	result, err := tx.Exec(query, key.PublicKey, key.Fingerprint, key.PrivateKey, GateKeyActive, time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("ошибка добавления ключа шлюза: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения ID: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("ошибка сохранения ключа шлюза: %w", err)
+	}
+
+	return id, nil
+}
+
+// gateKeySelect выбирает ключи шлюза вместе с числом серверов, на которых они установлены
+const gateKeySelect = `
+	SELECT g.id, g.public_key, g.fingerprint, g.private_key, g.status, g.created_at, g.retired_at,
+		(SELECT COUNT(*) FROM servers s WHERE s.auth_method = 'gate' AND s.gate_key_id = g.id)
+	FROM gate_keys g
+	`
+
+// scanGateKey читает ключ шлюза из строки результата
+func scanGateKey(row rowScanner) (*GateKey, error) {
+	var (
+		key       GateKey
+		retiredAt sql.NullTime
+	)
+
+	if err := row.Scan(&key.ID, &key.PublicKey, &key.Fingerprint, &key.PrivateKey, &key.Status, &key.CreatedAt, &retiredAt, &key.Servers); err != nil {
+		return nil, err
+	}
+	key.RetiredAt = timePtr(retiredAt)
+
+	return &key, nil
+}
+
+// GetGateKeyByID получает ключ шлюза по ID
+func GetGateKeyByID(db *sql.DB, id int64) (*GateKey, error) {
+	key, err := scanGateKey(db.QueryRow(gateKeySelect+"WHERE g.id = ?;", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("ключ шлюза с ID %d не найден", id)
+		}
+		return nil, fmt.Errorf("ошибка получения ключа шлюза: %w", err)
+	}
+
+	return key, nil
+}
+
+// GetActiveGateKey получает активный ключ шлюза. Возвращает sql.ErrNoRows, если ключ еще не создан
+func GetActiveGateKey(db *sql.DB) (*GateKey, error) {
+	key, err := scanGateKey(db.QueryRow(gateKeySelect+"WHERE g.status = ?;", GateKeyActive))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("ошибка получения активного ключа шлюза: %w", err)
+	}
+
+	return key, nil
+}
+
+// GetGateKeys получает все ключи шлюза, начиная с последнего
+func GetGateKeys(db *sql.DB) ([]GateKey, error) {
+	rows, err := db.Query(gateKeySelect + "ORDER BY g.id DESC;")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения ключей шлюза: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []GateKey{}
+	for rows.Next() {
+		key, err := scanGateKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения ключа шлюза: %w", err)
+		}
+		keys = append(keys, *key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return keys, nil
+}
+
+// RetireUnusedGateKeys выводит из обращения замененные ключи шлюза, которые больше
+// не установлены ни на одном сервере: их приватная часть удаляется. Возвращает число ключей
+func RetireUnusedGateKeys(db *sql.DB) (int, error) {
+	query := `
+	UPDATE gate_keys
+	SET status = ?, private_key = '', retired_at = ?
+	WHERE status = ? AND NOT EXISTS (
+		SELECT 1 FROM servers s WHERE s.auth_method = 'gate' AND s.gate_key_id = gate_keys.id
+	);
+	`
+
+	result, err := db.Exec(query, GateKeyRetired, time.Now().UTC(), GateKeyRetiring)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка вывода ключей шлюза из обращения: %w", err)
+	}
+
+	retired, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	return int(retired), nil
+}
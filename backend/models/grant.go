@@ -0,0 +1,271 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Grant представляет доступ пользователя к серверу (запись таблицы user_servers).
+// Истекший доступ сразу перестает выдаваться на сервер, а запись удаляется после того,
+// как ключи пользователя убраны с сервера. Если отозвать доступ не удалось,
+// RevokeAttempts и RevokeError описывают неудачные попытки, NextRevokeAt - время следующей
+type Grant struct {
+	UserID         int64      `json:"user_id"`
+	ServerID       int64      `json:"server_id"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	RevokeAttempts int        `json:"revoke_attempts"`
+	RevokeError    string     `json:"revoke_error,omitempty"`
+	NextRevokeAt   *time.Time `json:"next_revoke_at,omitempty"`
+}
+
+// Expired проверяет, истек ли срок доступа к моменту now
+func (g Grant) Expired(now time.Time) bool {
+	return g.ExpiresAt != nil && !g.ExpiresAt.After(now)
+}
+
+// GetGrant получает доступ пользователя к серверу
+func GetGrant(db *sql.DB, userID, serverID int64) (*Grant, error) {
+	query := `
+	SELECT user_id, server_id, expires_at, revoke_attempts, revoke_error, next_revoke_at
+	FROM user_servers
+	WHERE user_id = ? AND server_id = ?;
+	`
+
+	grant, err := scanGrant(db.QueryRow(query, userID, serverID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("привязка сервера к пользователю не найдена: %w", err)
+		}
+		return nil, fmt.Errorf("ошибка получения привязки сервера: %w", err)
+	}
+
+	return grant, nil
+}
+
+// GetUserGrants получает все доступы пользователя к серверам
+func GetUserGrants(db *sql.DB, userID int64) ([]Grant, error) {
+	query := `
+	SELECT user_id, server_id, expires_at, revoke_attempts, revoke_error, next_revoke_at
+	FROM user_servers
+	WHERE user_id = ?
+	ORDER BY server_id;
+	`
+
+	return queryGrants(db, query, userID)
+}
+
+// GetDueExpiredGrants получает истекшие доступы, которые пора отозвать:
+// отзыв еще не выполнялся или наступило время повторной попытки
+func GetDueExpiredGrants(db *sql.DB, now time.Time) ([]Grant, error) {
+	query := `
+	SELECT user_id, server_id, expires_at, revoke_attempts, revoke_error, next_revoke_at
+	FROM user_servers
+	WHERE expires_at <= ? AND (next_revoke_at IS NULL OR next_revoke_at <= ?)
+	ORDER BY server_id, user_id;
+	`
+
+	now = now.UTC()
+	return queryGrants(db, query, now, now)
+}
+
+// SetGrantExpiry изменяет срок действия доступа. Пустой срок делает доступ бессрочным.
+// Состояние отзыва сбрасывается, так как доступ выдан заново
+func SetGrantExpiry(db *sql.DB, userID, serverID int64, expiresAt *time.Time) error {
+	query := `
+	UPDATE user_servers
+	SET expires_at = ?, revoke_attempts = 0, revoke_error = '', next_revoke_at = NULL
+	WHERE user_id = ? AND server_id = ?;
+	`
+
+	result, err := db.Exec(query, nullTime(expiresAt), userID, serverID)
+	if err != nil {
+		return fmt.Errorf("ошибка изменения срока доступа: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("привязка сервера к пользователю не найдена")
+	}
+
+	return nil
+}
+
+// RemoveExpiredGrants удаляет доступы к серверу, истекшие к моменту now,
+// и возвращает количество удаленных записей
+func RemoveExpiredGrants(db *sql.DB, serverID int64, now time.Time) (int64, error) {
+	query := `
+	DELETE FROM user_servers
+	WHERE server_id = ? AND expires_at <= ?;
+	`
+
+	result, err := db.Exec(query, serverID, now.UTC())
+	if err != nil {
+		return 0, fmt.Errorf("ошибка удаления истекших доступов: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	return rowsAffected, nil
+}
+
+// PostponeGrantRevocation отмечает неудачную попытку отзыва истекших к моменту now доступов
+// к серверу и назначает время следующей попытки
+func PostponeGrantRevocation(db *sql.DB, serverID int64, now, next time.Time, message string) error {
+	query := `
+	UPDATE user_servers
+	SET revoke_attempts = revoke_attempts + 1, revoke_error = ?, next_revoke_at = ?
+	WHERE server_id = ? AND expires_at <= ?;
+	`
+
+	if _, err := db.Exec(query, message, next.UTC(), serverID, now.UTC()); err != nil {
+		return fmt.Errorf("ошибка сохранения попытки отзыва доступа: %w", err)
+	}
+
+	return nil
+}
+
+// queryGrants выполняет запрос и читает доступы из результата
+func queryGrants(db *sql.DB, query string, args ...any) ([]Grant, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения привязок серверов: %w", err)
+	}
+	defer rows.Close()
+
+	var grants []Grant
+	for rows.Next() {
+		grant, err := scanGrant(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения данных привязки: %w", err)
+		}
+		grants = append(grants, *grant)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return grants, nil
+}
+
+// scanGrant читает доступ из строки результата
+func scanGrant(row rowScanner) (*Grant, error) {
+	var (
+		grant        Grant
+		expiresAt    sql.NullTime
+		nextRevokeAt sql.NullTime
+	)
+
+	if err := row.Scan(&grant.UserID, &grant.ServerID, &expiresAt, &grant.RevokeAttempts, &grant.RevokeError, &nextRevokeAt); err != nil {
+		return nil, err
+	}
+
+	grant.ExpiresAt = timePtr(expiresAt)
+	grant.NextRevokeAt = timePtr(nextRevokeAt)
+
+	return &grant, nil
+}
+
+// Источники доступа пользователя к серверу
+const (
+	UserAccessDirect    = "direct"    // Доступ выдан пользователю напрямую
+	UserAccessInherited = "inherited" // Доступ унаследован от групп пользователя
+)
+
+// UserServer описывает сервер пользователя и доступ к нему. Direct означает, что доступ
+// выдан пользователю напрямую (Grant), Groups - группы, от которых доступ унаследован
+type UserServer struct {
+	Server Server
+	Grant  Grant
+	Direct bool
+	Groups []UserGroupRef
+}
+
+// GetUserServerGrants получает серверы пользователя вместе со сроками прямого доступа к ним
+// и группами, через которые доступ унаследован
+func GetUserServerGrants(db *sql.DB, userID int64) ([]UserServer, error) {
+	servers, err := GetUserServers(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	grants, err := GetUserGrants(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	groups, err := GetUserGroupAccess(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	byServer := make(map[int64]Grant, len(grants))
+	for _, grant := range grants {
+		byServer[grant.ServerID] = grant
+	}
+
+	result := make([]UserServer, 0, len(servers))
+	for _, server := range servers {
+		grant, direct := byServer[server.ID]
+		result = append(result, UserServer{Server: server, Grant: grant, Direct: direct, Groups: groups[server.ID]})
+	}
+
+	return result, nil
+}
+
+// MarshalJSON сериализует сервер пользователя без учетных данных сервера. Источник доступа
+// указывается в access: direct - выдан напрямую, inherited - только через группы.
+// Для временного доступа добавляется оставшееся время, а для истекшего - состояние его отзыва
+func (s UserServer) MarshalJSON() ([]byte, error) {
+	access := UserAccessDirect
+	if !s.Direct {
+		access = UserAccessInherited
+	}
+	groups := s.Groups
+	if groups == nil {
+		groups = []UserGroupRef{}
+	}
+
+	var remainingSeconds *int64
+	var remaining string
+	now := time.Now()
+	if s.Grant.ExpiresAt != nil && !s.Grant.Expired(now) {
+		left := s.Grant.ExpiresAt.Sub(now).Round(time.Second)
+		seconds := int64(left.Seconds())
+		remainingSeconds = &seconds
+		remaining = left.String()
+	}
+
+	return json.Marshal(struct {
+		publicServer
+		Access           string         `json:"access"`
+		Groups           []UserGroupRef `json:"groups"`
+		ExpiresAt        *time.Time     `json:"expires_at"`
+		RemainingSeconds *int64         `json:"remaining_seconds,omitempty"`
+		Remaining        string         `json:"remaining,omitempty"`
+		Expired          bool           `json:"expired"`
+		RevokeAttempts   int            `json:"revoke_attempts,omitempty"`
+		RevokeError      string         `json:"revoke_error,omitempty"`
+		NextRevokeAt     *time.Time     `json:"next_revoke_at,omitempty"`
+	}{
+		publicServer:     s.Server.public(),
+		Access:           access,
+		Groups:           groups,
+		ExpiresAt:        s.Grant.ExpiresAt,
+		RemainingSeconds: remainingSeconds,
+		Remaining:        remaining,
+		Expired:          s.Grant.Expired(now),
+		RevokeAttempts:   s.Grant.RevokeAttempts,
+		RevokeError:      s.Grant.RevokeError,
+		NextRevokeAt:     s.Grant.NextRevokeAt,
+	})
+}
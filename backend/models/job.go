@@ -0,0 +1,370 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Состояния задачи очереди
+const (
+	JobStatusQueued    = "queued"    // Задача ожидает выполнения, в том числе повторной попытки
+	JobStatusRunning   = "running"   // Задача выполняется
+	JobStatusSucceeded = "succeeded" // Задача выполнена
+	JobStatusFailed    = "failed"    // Все попытки выполнить задачу завершились ошибкой
+	JobStatusCancelled = "cancelled" // Задача отменена оператором
+)
+
+// Job представляет задачу очереди, выполняемую в фоне: SSH-операцию, которая может занять
+// много времени или потребовать повторных попыток. Задачи с одинаковым Target (например,
+// задачи одного сервера) выполняются строго по очереди. Payload содержит параметры задачи,
+// Result - итог последней успешной попытки. Audit - событие журнала аудита,
+// которое записывается после завершения задачи
+type Job struct {
+	ID          int64           `json:"id"`
+	Kind        string          `json:"kind"`
+	Target      string          `json:"target,omitempty"`
+	Status      string          `json:"status"`
+	Payload     json.RawMessage `json:"payload"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	ActorID     int64           `json:"actor_id,omitempty"`
+	Actor       string          `json:"actor,omitempty"`
+	Audit       *AuditEvent     `json:"-"`
+	CreatedAt   time.Time       `json:"created_at"`
+	NextRunAt   time.Time       `json:"next_run_at"`
+	StartedAt   *time.Time      `json:"started_at"`
+	FinishedAt  *time.Time      `json:"finished_at"`
+}
+
+// Finished проверяет, завершена ли задача окончательно
+func (j Job) Finished() bool {
+	return j.Status == JobStatusSucceeded || j.Status == JobStatusFailed || j.Status == JobStatusCancelled
+}
+
+// JobLog представляет запись журнала выполнения задачи
+type JobLog struct {
+	ID        int64     `json:"id"`
+	JobID     int64     `json:"job_id"`
+	CreatedAt time.Time `json:"created_at"`
+	Message   string    `json:"message"`
+}
+
+// CreateJobTable создает таблицы задач очереди и их журналов
+func CreateJobTable(db *sql.DB) error {
+	jobQuery := `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		kind TEXT NOT NULL,
+		target TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT 'queued',
+		payload TEXT NOT NULL,
+		result TEXT,
+		error TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		max_attempts INTEGER NOT NULL,
+		actor_id INTEGER NOT NULL DEFAULT 0,
+		actor TEXT NOT NULL DEFAULT '',
+		audit TEXT,
+		created_at DATETIME NOT NULL,
+		next_run_at DATETIME NOT NULL,
+		started_at DATETIME,
+		finished_at DATETIME
+	);
+	`
+
+	logQuery := `
+	CREATE TABLE IF NOT EXISTS job_logs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		job_id INTEGER NOT NULL,
+		created_at DATETIME NOT NULL,
+		message TEXT NOT NULL,
+		FOREIGN KEY (job_id) REFERENCES jobs(id) ON DELETE CASCADE
+	);
+	`
+
+	if _, err := db.Exec(jobQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы задач: %w", err)
+	}
+
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS jobs_status_next_run ON jobs (status, next_run_at);`); err != nil {
+		return fmt.Errorf("ошибка создания индекса задач: %w", err)
+	}
+
+	if _, err := db.Exec(logQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы журналов задач: %w", err)
+	}
+
+	return nil
+}
+
+// AddJob ставит задачу в очередь
+func AddJob(db *sql.DB, job Job) (int64, error) {
+	var audit sql.NullString
+	if job.Audit != nil {
+		data, err := json.Marshal(job.Audit)
+		if err != nil {
+			return 0, fmt.Errorf("ошибка сериализации события аудита задачи: %w", err)
+		}
+		audit = sql.NullString{String: string(data), Valid: true}
+	}
+
+	query := `
+	INSERT INTO jobs (kind, target, status, payload, max_attempts, actor_id, actor, audit, created_at, next_run_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
+	`
+
+	now := time.Now().UTC()
+	result, err := db.Exec(query, job.Kind, job.Target, JobStatusQueued, string(job.Payload), job.MaxAttempts, job.ActorID, job.Actor, audit, now, now)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка добавления задачи: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения ID: %w", err)
+	}
+
+	return id, nil
+}
+
+// jobSelect выбирает задачи очереди
+const jobSelect = `
+	SELECT id, kind, target, status, payload, result, error, attempts, max_attempts, actor_id, actor, audit,
+		created_at, next_run_at, started_at, finished_at
+	FROM jobs
+	`
+
+// GetJobByID получает задачу по ID
+func GetJobByID(db *sql.DB, id int64) (*Job, error) {
+	job, err := scanJob(db.QueryRow(jobSelect+"WHERE id = ?;", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("задача с ID %d не найдена", id)
+		}
+		return nil, fmt.Errorf("ошибка получения задачи: %w", err)
+	}
+
+	return job, nil
+}
+
+// GetJobs получает задачи, начиная с последних. Пустой status означает задачи в любом состоянии
+func GetJobs(db *sql.DB, status string, limit int) ([]Job, error) {
+	query := jobSelect + "WHERE (? = '' OR status = ?) ORDER BY id DESC LIMIT ?;"
+
+	rows, err := db.Query(query, status, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения задач: %w", err)
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения данных задачи: %w", err)
+		}
+		jobs = append(jobs, *job)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return jobs, nil
+}
+
+// ClaimJob выбирает задачу, время выполнения которой наступило, и переводит ее в выполнение.
+// Задача не выбирается, пока не завершены более ранние задачи с тем же Target.
+// Возвращает nil, если таких задач нет
+func ClaimJob(db *sql.DB, now time.Time) (*Job, error) {
+	for {
+		var id int64
+		query := `
+		SELECT id
+		FROM jobs j
+		WHERE status = ? AND next_run_at <= ? AND NOT EXISTS (
+			SELECT 1
+			FROM jobs earlier
+			WHERE j.target != '' AND earlier.target = j.target AND earlier.id < j.id AND earlier.status IN (?, ?)
+		)
+		ORDER BY next_run_at, id
+		LIMIT 1;
+		`
+		if err := db.QueryRow(query, JobStatusQueued, now, JobStatusQueued, JobStatusRunning).Scan(&id); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("ошибка выбора задачи: %w", err)
+		}
+
+		// Задачу мог забрать другой обработчик, тогда выбираем следующую
+		query = `
+		UPDATE jobs
+		SET status = ?, attempts = attempts + 1, started_at = ?, error = ''
+		WHERE id = ? AND status = ?;
+		`
+		result, err := db.Exec(query, JobStatusRunning, now, id, JobStatusQueued)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка обновления задачи: %w", err)
+		}
+
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+		}
+
+		if rowsAffected > 0 {
+			return GetJobByID(db, id)
+		}
+	}
+}
+
+// RetryJob возвращает выполнявшуюся задачу в очередь для повторной попытки в момент next
+func RetryJob(db *sql.DB, id int64, next time.Time, message string) error {
+	query := `
+	UPDATE jobs
+	SET status = ?, next_run_at = ?, error = ?
+	WHERE id = ? AND status = ?;
+	`
+
+	if _, err := db.Exec(query, JobStatusQueued, next, message, id, JobStatusRunning); err != nil {
+		return fmt.Errorf("ошибка обновления задачи: %w", err)
+	}
+
+	return nil
+}
+
+// FinishJob сохраняет итог выполнения задачи
+func FinishJob(db *sql.DB, id int64, status string, result json.RawMessage, message string) error {
+	var value sql.NullString
+	if result != nil {
+		value = sql.NullString{String: string(result), Valid: true}
+	}
+
+	query := `
+	UPDATE jobs
+	SET status = ?, result = ?, error = ?, finished_at = ?
+	WHERE id = ?;
+	`
+
+	if _, err := db.Exec(query, status, value, message, time.Now().UTC(), id); err != nil {
+		return fmt.Errorf("ошибка сохранения итога задачи: %w", err)
+	}
+
+	return nil
+}
+
+// CancelQueuedJob отменяет задачу, ожидающую выполнения. Возвращает false,
+// если задача уже выполняется или завершена
+func CancelQueuedJob(db *sql.DB, id int64) (bool, error) {
+	query := `
+	UPDATE jobs
+	SET status = ?, finished_at = ?
+	WHERE id = ? AND status = ?;
+	`
+
+	result, err := db.Exec(query, JobStatusCancelled, time.Now().UTC(), id, JobStatusQueued)
+	if err != nil {
+		return false, fmt.Errorf("ошибка отмены задачи: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	return rowsAffected > 0, nil
+}
+
+// RequeueRunningJobs возвращает в очередь задачи, выполнение которых прервал перезапуск шлюза
+func RequeueRunningJobs(db *sql.DB) (int64, error) {
+	result, err := db.Exec(`UPDATE jobs SET status = ?, next_run_at = ? WHERE status = ?;`, JobStatusQueued, time.Now().UTC(), JobStatusRunning)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка возврата задач в очередь: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	return rowsAffected, nil
+}
+
+// scanJob читает задачу из строки результата
+func scanJob(row rowScanner) (*Job, error) {
+	var (
+		job        Job
+		payload    string
+		result     sql.NullString
+		audit      sql.NullString
+		startedAt  sql.NullTime
+		finishedAt sql.NullTime
+	)
+
+	err := row.Scan(&job.ID, &job.Kind, &job.Target, &job.Status, &payload, &result, &job.Error, &job.Attempts, &job.MaxAttempts,
+		&job.ActorID, &job.Actor, &audit, &job.CreatedAt, &job.NextRunAt, &startedAt, &finishedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	job.Payload = json.RawMessage(payload)
+	if result.Valid {
+		job.Result = json.RawMessage(result.String)
+	}
+	if audit.Valid {
+		job.Audit = &AuditEvent{}
+		if err := json.Unmarshal([]byte(audit.String), job.Audit); err != nil {
+			return nil, fmt.Errorf("ошибка разбора события аудита задачи: %w", err)
+		}
+	}
+	job.StartedAt = timePtr(startedAt)
+	job.FinishedAt = timePtr(finishedAt)
+
+	return &job, nil
+}
+
+// AddJobLog добавляет запись в журнал выполнения задачи
+func AddJobLog(db *sql.DB, jobID int64, message string) error {
+	query := `INSERT INTO job_logs (job_id, created_at, message) VALUES (?, ?, ?);`
+	if _, err := db.Exec(query, jobID, time.Now().UTC(), message); err != nil {
+		return fmt.Errorf("ошибка записи в журнал задачи: %w", err)
+	}
+
+	return nil
+}
+
+// GetJobLogs получает записи журнала задачи с ID больше afterID в порядке добавления
+func GetJobLogs(db *sql.DB, jobID, afterID int64) ([]JobLog, error) {
+	query := `
+	SELECT id, job_id, created_at, message
+	FROM job_logs
+	WHERE job_id = ? AND id > ?
+	ORDER BY id;
+	`
+
+	rows, err := db.Query(query, jobID, afterID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения журнала задачи: %w", err)
+	}
+	defer rows.Close()
+
+	logs := []JobLog{}
+	for rows.Next() {
+		var entry JobLog
+		if err := rows.Scan(&entry.ID, &entry.JobID, &entry.CreatedAt, &entry.Message); err != nil {
+			return nil, fmt.Errorf("ошибка чтения журнала задачи: %w", err)
+		}
+		logs = append(logs, entry)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return logs, nil
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// execQuerier объединяет *sql.DB и *sql.Tx, чтобы миграции можно было выполнять в транзакции
+type execQuerier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// hasColumn проверяет, есть ли столбец в таблице
+func hasColumn(db execQuerier, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		return false, fmt.Errorf("ошибка получения структуры таблицы %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &pk); err != nil {
+			return false, fmt.Errorf("ошибка чтения структуры таблицы %s: %w", table, err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return false, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return false, nil
+}
+
+// addColumnIfMissing добавляет столбец в существующую таблицу, если его еще нет
+func addColumnIfMissing(db execQuerier, table, column, definition string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	query := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition)
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("ошибка добавления столбца %s в таблицу %s: %w", column, table, err)
+	}
+
+	return nil
+}
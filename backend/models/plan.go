@@ -0,0 +1,208 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Действия, из которых состоит план изменений доступа
+const (
+	PlanActionGrant     = "grant"     // Выдать пользователю доступ к серверу
+	PlanActionRevoke    = "revoke"    // Отозвать доступ пользователя к серверу
+	PlanActionReconcile = "reconcile" // Устранить расхождения на сервере
+)
+
+// Состояния плана
+const (
+	PlanStatusPending  = "pending"  // План подготовлен и ожидает применения
+	PlanStatusApplying = "applying" // План применяется
+	PlanStatusApplied  = "applied"  // План применен на всех серверах
+	PlanStatusFailed   = "failed"   // План применен не на всех серверах
+)
+
+// PlanChange описывает одно изменение доступа в плане. ExpiresAt задает срок временного доступа
+type PlanChange struct {
+	Action    string     `json:"action"`
+	UserID    int64      `json:"user_id,omitempty"`
+	ServerID  int64      `json:"server_id"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Plan представляет подготовленный без изменения серверов план изменений доступа.
+// Servers содержит ожидаемые изменения authorized_keys по серверам, Result - итог применения
+type Plan struct {
+	ID        int64           `json:"id"`
+	AdminID   int64           `json:"admin_id"`
+	Status    string          `json:"status"`
+	Changes   []PlanChange    `json:"changes"`
+	Servers   json.RawMessage `json:"servers"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	AppliedAt *time.Time      `json:"applied_at"`
+}
+
+// CreatePlanTable создает таблицу планов изменений доступа
+func CreatePlanTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS plans (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		admin_id INTEGER NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		changes TEXT NOT NULL,
+		servers TEXT NOT NULL,
+		result TEXT,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		applied_at DATETIME,
+		FOREIGN KEY (admin_id) REFERENCES admins(id) ON DELETE CASCADE
+	);
+	`
+
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("ошибка создания таблицы планов: %w", err)
+	}
+
+	return nil
+}
+
+// AddPlan сохраняет новый план
+func AddPlan(db *sql.DB, plan Plan) (int64, error) {
+	changes, err := json.Marshal(plan.Changes)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка сериализации изменений плана: %w", err)
+	}
+
+	query := `
+	INSERT INTO plans (admin_id, status, changes, servers, created_at)
+	VALUES (?, ?, ?, ?, ?);
+	`
+
+	result, err := db.Exec(query, plan.AdminID, PlanStatusPending, string(changes), string(plan.Servers), time.Now().UTC())
+	if err != nil {
+		return 0, fmt.Errorf("ошибка добавления плана: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения ID: %w", err)
+	}
+
+	return id, nil
+}
+
+// GetPlanByID получает план по ID
+func GetPlanByID(db *sql.DB, id int64) (*Plan, error) {
+	query := `
+	SELECT id, admin_id, status, changes, servers, result, created_at, applied_at
+	FROM plans
+	WHERE id = ?;
+	`
+
+	plan, err := scanPlan(db.QueryRow(query, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("план с ID %d не найден", id)
+		}
+		return nil, fmt.Errorf("ошибка получения плана: %w", err)
+	}
+
+	return plan, nil
+}
+
+// GetAllPlans получает все планы, начиная с последних
+func GetAllPlans(db *sql.DB) ([]Plan, error) {
+	query := `
+	SELECT id, admin_id, status, changes, servers, result, created_at, applied_at
+	FROM plans
+	ORDER BY id DESC;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения планов: %w", err)
+	}
+	defer rows.Close()
+
+	var plans []Plan
+	for rows.Next() {
+		plan, err := scanPlan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения данных плана: %w", err)
+		}
+		plans = append(plans, *plan)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return plans, nil
+}
+
+// StartPlan переводит план из ожидания в применение. Возвращает ошибку, если план уже применялся,
+// поэтому один план не может быть применен дважды, в том числе параллельными запросами
+func StartPlan(db *sql.DB, id int64) error {
+	query := `
+	UPDATE plans
+	SET status = ?, applied_at = ?
+	WHERE id = ? AND status = ?;
+	`
+
+	result, err := db.Exec(query, PlanStatusApplying, time.Now().UTC(), id, PlanStatusPending)
+	if err != nil {
+		return fmt.Errorf("ошибка обновления плана: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("план с ID %d уже применен", id)
+	}
+
+	return nil
+}
+
+// FinishPlan сохраняет итог применения плана
+func FinishPlan(db *sql.DB, id int64, status string, result json.RawMessage) error {
+	query := `
+	UPDATE plans
+	SET status = ?, result = ?
+	WHERE id = ?;
+	`
+
+	if _, err := db.Exec(query, status, string(result), id); err != nil {
+		return fmt.Errorf("ошибка сохранения итога плана: %w", err)
+	}
+
+	return nil
+}
+
+// scanPlan читает план из строки результата
+func scanPlan(row rowScanner) (*Plan, error) {
+	var (
+		plan      Plan
+		changes   string
+		servers   string
+		result    sql.NullString
+		appliedAt sql.NullTime
+	)
+
+	if err := row.Scan(&plan.ID, &plan.AdminID, &plan.Status, &changes, &servers, &result, &plan.CreatedAt, &appliedAt); err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(changes), &plan.Changes); err != nil {
+		return nil, fmt.Errorf("ошибка разбора изменений плана: %w", err)
+	}
+	plan.Servers = json.RawMessage(servers)
+	if result.Valid {
+		plan.Result = json.RawMessage(result.String)
+	}
+	plan.AppliedAt = timePtr(appliedAt)
+
+	return &plan, nil
+}
@@ -0,0 +1,184 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Role представляет роль оператора и набор ее разрешений
+type Role struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+// CreateRoleTable создает таблицы ролей и разрешений, заполняет встроенные роли
+// и назначает роль операторам, созданным до появления ролей
+func CreateRoleTable(db *sql.DB, builtin []Role, defaultRole string) error {
+	roleQuery := `
+	CREATE TABLE IF NOT EXISTS roles (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		description TEXT NOT NULL DEFAULT ''
+	);
+	`
+
+	permissionQuery := `
+	CREATE TABLE IF NOT EXISTS role_permissions (
+		role_id INTEGER NOT NULL,
+		permission TEXT NOT NULL,
+		PRIMARY KEY (role_id, permission),
+		FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE
+	);
+	`
+
+	if _, err := db.Exec(roleQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы ролей: %w", err)
+	}
+
+	if _, err := db.Exec(permissionQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы разрешений: %w", err)
+	}
+
+	// Встроенные роли дополняются новыми разрешениями при каждом запуске
+	for _, role := range builtin {
+		if _, err := db.Exec(`INSERT OR IGNORE INTO roles (name, description) VALUES (?, ?);`, role.Name, role.Description); err != nil {
+			return fmt.Errorf("ошибка создания роли %s: %w", role.Name, err)
+		}
+		for _, permission := range role.Permissions {
+			query := `
+			INSERT OR IGNORE INTO role_permissions (role_id, permission)
+			SELECT id, ? FROM roles WHERE name = ?;
+			`
+			if _, err := db.Exec(query, permission, role.Name); err != nil {
+				return fmt.Errorf("ошибка добавления разрешения %s роли %s: %w", permission, role.Name, err)
+			}
+		}
+	}
+
+	if err := addColumnIfMissing(db, "admins", "role_id", "INTEGER REFERENCES roles(id)"); err != nil {
+		return err
+	}
+
+	query := `
+	UPDATE admins
+	SET role_id = (SELECT id FROM roles WHERE name = ?)
+	WHERE role_id IS NULL;
+	`
+	if _, err := db.Exec(query, defaultRole); err != nil {
+		return fmt.Errorf("ошибка назначения роли операторам: %w", err)
+	}
+
+	return nil
+}
+
+// GetAllRoles получает все роли с их разрешениями
+func GetAllRoles(db *sql.DB) ([]Role, error) {
+	query := `
+	SELECT r.id, r.name, r.description, COALESCE(GROUP_CONCAT(p.permission), '')
+	FROM roles r
+	LEFT JOIN role_permissions p ON p.role_id = r.id
+	GROUP BY r.id
+	ORDER BY r.id;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения ролей: %w", err)
+	}
+	defer rows.Close()
+
+	var roles []Role
+	for rows.Next() {
+		var (
+			role        Role
+			permissions string
+		)
+		if err := rows.Scan(&role.ID, &role.Name, &role.Description, &permissions); err != nil {
+			return nil, fmt.Errorf("ошибка чтения данных роли: %w", err)
+		}
+		role.Permissions = splitList(permissions)
+		roles = append(roles, role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return roles, nil
+}
+
+// RoleExists проверяет, существует ли роль с указанным именем
+func RoleExists(db *sql.DB, name string) (bool, error) {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM roles WHERE name = ?;`, name).Scan(&count); err != nil {
+		return false, fmt.Errorf("ошибка проверки роли: %w", err)
+	}
+	return count > 0, nil
+}
+
+// GetRolePermissions получает разрешения роли по ее имени
+func GetRolePermissions(db *sql.DB, name string) ([]string, error) {
+	query := `
+	SELECT p.permission
+	FROM role_permissions p
+	JOIN roles r ON r.id = p.role_id
+	WHERE r.name = ?;
+	`
+
+	rows, err := db.Query(query, name)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения разрешений роли: %w", err)
+	}
+	defer rows.Close()
+
+	var permissions []string
+	for rows.Next() {
+		var permission string
+		if err := rows.Scan(&permission); err != nil {
+			return nil, fmt.Errorf("ошибка чтения разрешения: %w", err)
+		}
+		permissions = append(permissions, permission)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return permissions, nil
+}
+
+// SetAdminRole назначает оператору роль
+func SetAdminRole(db *sql.DB, adminID int64, role string) error {
+	query := `
+	UPDATE admins
+	SET role_id = (SELECT id FROM roles WHERE name = ?)
+	WHERE id = ?;
+	`
+
+	result, err := db.Exec(query, role, adminID)
+	if err != nil {
+		return fmt.Errorf("ошибка назначения роли: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("оператор с ID %d не найден", adminID)
+	}
+
+	return nil
+}
+
+// splitList разбирает список, сохраненный через запятую
+func splitList(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return strings.Split(value, ",")
+}
@@ -2,16 +2,64 @@ package models
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"time"
+)
+
+// Способы входа шлюза на сервер
+const (
+	ServerAuthPassword = "password" // По паролю
+	ServerAuthKey      = "key"      // По приватному ключу
+	ServerAuthGate     = "gate"     // По собственному ключу шлюза, установленному на сервер
 )
 
 // Server представляет модель сервера
 type Server struct {
-	ID       int64  `json:"id"`
-	IP       string `json:"ip"`
-	Port     int    `json:"port"`
-	Login    string `json:"login"`
-	Password string `json:"password"`
+	ID         int64  `json:"id"`
+	IP         string `json:"ip"`
+	Port       int    `json:"port"`
+	Login      string `json:"login"`
+	AuthMethod string `json:"auth_method"`           // Способ входа: password, key или gate
+	Password   string `json:"password"`              // Хранится в зашифрованном виде, наружу не отдается
+	PrivateKey string `json:"private_key"`           // Хранится в зашифрованном виде, наружу не отдается
+	Passphrase string `json:"passphrase"`            // Парольная фраза приватного ключа, хранится в зашифрованном виде
+	PublicKey  string `json:"public_key"`            // Публичная часть приватного ключа в формате authorized_keys
+	HostKey    string `json:"host_key"`              // Закрепленный ключ хоста в формате authorized_keys
+	GateKeyID  int64  `json:"gate_key_id,omitempty"` // Ключ шлюза, установленный на сервер (для способа gate)
+	// Произвольные метки сервера, например env=prod или team=billing. По ним политики
+	// доступа выбирают серверы для групп пользователей
+	Labels map[string]string `json:"labels"`
+}
+
+// publicServer представление сервера в API без учетных данных
+type publicServer struct {
+	serverFields
+	Password      string `json:"password,omitempty"`
+	PrivateKey    string `json:"private_key,omitempty"`
+	Passphrase    string `json:"passphrase,omitempty"`
+	PublicKey     string `json:"public_key,omitempty"`
+	HasPassword   bool   `json:"has_password"`
+	HasPrivateKey bool   `json:"has_private_key"`
+}
+
+// serverFields позволяет сериализовать поля Server без его метода MarshalJSON
+type serverFields Server
+
+// public возвращает представление сервера для API
+func (s Server) public() publicServer {
+	return publicServer{
+		serverFields:  serverFields(s),
+		PublicKey:     s.PublicKey,
+		HasPassword:   s.Password != "",
+		HasPrivateKey: s.PrivateKey != "",
+	}
+}
+
+// MarshalJSON сериализует сервер без учетных данных: пароль и приватный ключ принимаются
+// при создании и обновлении, но никогда не возвращается из API
+func (s Server) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.public())
 }
 
 // CreateServerTable создает таблицу серверов и связующую таблицу
@@ -43,22 +91,67 @@ func CreateServerTable(db *sql.DB) error {
 		return fmt.Errorf("ошибка создания таблицы серверов: %w", err)
 	}
 
+	// Добавляем столбец с закрепленным ключом хоста в ранее созданные таблицы
+	if err := addColumnIfMissing(db, "servers", "host_key", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	// Способ входа и приватный ключ сервера. Ранее добавленные серверы входят по паролю
+	if err := addColumnIfMissing(db, "servers", "auth_method", "TEXT NOT NULL DEFAULT 'password'"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "servers", "private_key", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "servers", "passphrase", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "servers", "public_key", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	// Ключ шлюза, по которому он входит на сервер
+	if err := addColumnIfMissing(db, "servers", "gate_key_id", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
 	// Создаем связующую таблицу
 	if _, err := db.Exec(userServerQuery); err != nil {
 		return fmt.Errorf("ошибка создания связующей таблицы: %w", err)
 	}
 
+	// Срок действия доступа и состояние его отзыва после истечения
+	if err := addColumnIfMissing(db, "user_servers", "expires_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "user_servers", "revoke_attempts", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "user_servers", "revoke_error", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "user_servers", "next_revoke_at", "DATETIME"); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-// AddServer добавляет новый сервер в базу данных
+// AddServer добавляет новый сервер в базу данных вместе с его метками
 func AddServer(db *sql.DB, server Server) (int64, error) {
 	query := `
-        INSERT INTO servers (ip, port, login, password)
-        VALUES (?, ?, ?, ?);
+        INSERT INTO servers (ip, port, login, auth_method, password, private_key, passphrase, public_key, host_key, gate_key_id)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?);
         `
 
-	result, err := db.Exec(query, server.IP, server.Port, server.Login, server.Password)
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, server.IP, server.Port, server.Login, server.AuthMethod,
+		server.Password, server.PrivateKey, server.Passphrase, server.PublicKey, server.HostKey, server.GateKeyID)
 	if err != nil {
 		return 0, fmt.Errorf("ошибка добавления сервера: %w", err)
 	}
@@ -68,37 +161,43 @@ func AddServer(db *sql.DB, server Server) (int64, error) {
 		return 0, fmt.Errorf("ошибка получения ID: %w", err)
 	}
 
+	if err := setServerLabels(tx, id, server.Labels); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("ошибка сохранения сервера: %w", err)
+	}
+
 	return id, nil
 }
 
-// GetServerByID получает сервер по ID
-func GetServerByID(db *sql.DB, id int64) (Server, error) {
-	query := `
-        SELECT id, ip, port, login, password
-        FROM servers
-        WHERE id = ?;
+// serverSelect выбирает серверы вместе с их метками
+const serverSelect = `
+        SELECT s.id, s.ip, s.port, s.login, s.auth_method, s.password, s.private_key, s.passphrase, s.public_key, s.host_key, s.gate_key_id,
+                COALESCE((SELECT GROUP_CONCAT(name || '=' || value) FROM server_labels WHERE server_id = s.id), '')
+        FROM servers s
         `
 
-	var server Server
-	err := db.QueryRow(query, id).Scan(&server.ID, &server.IP, &server.Port, &server.Login, &server.Password)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return Server{}, fmt.Errorf("сервер с ID %d не найден", id)
-		}
-		return Server{}, fmt.Errorf("ошибка получения сервера: %w", err)
+// scanServer читает сервер из строки результата
+func scanServer(row rowScanner) (Server, error) {
+	var (
+		server Server
+		labels string
+	)
+
+	if err := row.Scan(&server.ID, &server.IP, &server.Port, &server.Login, &server.AuthMethod,
+		&server.Password, &server.PrivateKey, &server.Passphrase, &server.PublicKey, &server.HostKey, &server.GateKeyID, &labels); err != nil {
+		return Server{}, err
 	}
+	server.Labels = parseLabels(labels)
 
 	return server, nil
 }
 
-// GetAllServers получает все серверы
-func GetAllServers(db *sql.DB) ([]Server, error) {
-	query := `
-        SELECT id, ip, port, login, password
-        FROM servers;
-        `
-
-	rows, err := db.Query(query)
+// queryServers выполняет запрос и читает серверы из результата
+func queryServers(db *sql.DB, query string, args ...any) ([]Server, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("ошибка получения серверов: %w", err)
 	}
@@ -106,8 +205,8 @@ func GetAllServers(db *sql.DB) ([]Server, error) {
 
 	var servers []Server
 	for rows.Next() {
-		var server Server
-		if err := rows.Scan(&server.ID, &server.IP, &server.Port, &server.Login, &server.Password); err != nil {
+		server, err := scanServer(rows)
+		if err != nil {
 			return nil, fmt.Errorf("ошибка чтения данных сервера: %w", err)
 		}
 		servers = append(servers, server)
@@ -120,15 +219,40 @@ func GetAllServers(db *sql.DB) ([]Server, error) {
 	return servers, nil
 }
 
-// UpdateServer обновляет данные сервера
+// GetServerByID получает сервер по ID
+func GetServerByID(db *sql.DB, id int64) (Server, error) {
+	server, err := scanServer(db.QueryRow(serverSelect+"WHERE s.id = ?;", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Server{}, fmt.Errorf("сервер с ID %d не найден", id)
+		}
+		return Server{}, fmt.Errorf("ошибка получения сервера: %w", err)
+	}
+
+	return server, nil
+}
+
+// GetAllServers получает все серверы
+func GetAllServers(db *sql.DB) ([]Server, error) {
+	return queryServers(db, serverSelect+"ORDER BY s.id;")
+}
+
+// UpdateServer обновляет данные и метки сервера
 func UpdateServer(db *sql.DB, server Server) error {
 	query := `
         UPDATE servers
-        SET ip = ?, port = ?, login = ?, password = ?
+        SET ip = ?, port = ?, login = ?, auth_method = ?, password = ?, private_key = ?, passphrase = ?, public_key = ?, gate_key_id = ?
         WHERE id = ?;
         `
 
-	result, err := db.Exec(query, server.IP, server.Port, server.Login, server.Password, server.ID)
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, server.IP, server.Port, server.Login, server.AuthMethod,
+		server.Password, server.PrivateKey, server.Passphrase, server.PublicKey, server.GateKeyID, server.ID)
 	if err != nil {
 		return fmt.Errorf("ошибка обновления сервера: %w", err)
 	}
@@ -142,65 +266,164 @@ func UpdateServer(db *sql.DB, server Server) error {
 		return fmt.Errorf("сервер с ID %d не найден", server.ID)
 	}
 
+	if err := setServerLabels(tx, server.ID, server.Labels); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ошибка сохранения сервера: %w", err)
+	}
+
 	return nil
 }
 
-// AssignServerToUser привязывает сервер к пользователю
-func AssignServerToUser(db *sql.DB, userID, serverID int64) error {
+// SetServerHostKey закрепляет ключ хоста за сервером (пустая строка снимает закрепление)
+func SetServerHostKey(db *sql.DB, id int64, hostKey string) error {
 	query := `
-	INSERT INTO user_servers (user_id, server_id)
-	VALUES (?, ?);
+	UPDATE servers
+	SET host_key = ?
+	WHERE id = ?;
 	`
 
-	_, err := db.Exec(query, userID, serverID)
+	result, err := db.Exec(query, hostKey, id)
 	if err != nil {
-		return fmt.Errorf("ошибка привязки сервера к пользователю: %w", err)
+		return fmt.Errorf("ошибка сохранения ключа хоста: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("сервер с ID %d не найден", id)
 	}
 
 	return nil
 }
 
-// GetUserServers получает все серверы пользователя
-func GetUserServers(db *sql.DB, userID int64) ([]Server, error) {
+// SetServerGateKey отмечает, что на сервер установлен ключ шлюза keyID
+func SetServerGateKey(db *sql.DB, id, keyID int64) error {
 	query := `
-        SELECT s.id, s.ip, s.port, s.login, s.password
-	FROM servers s
-	JOIN user_servers us ON s.id = us.server_id
-	WHERE us.user_id = ?;
+	UPDATE servers
+	SET gate_key_id = ?
+	WHERE id = ? AND auth_method = ?;
 	`
 
-	rows, err := db.Query(query, userID)
+	result, err := db.Exec(query, keyID, id, ServerAuthGate)
 	if err != nil {
-		return nil, fmt.Errorf("ошибка получения серверов пользователя: %w", err)
+		return fmt.Errorf("ошибка сохранения ключа шлюза сервера: %w", err)
 	}
-	defer rows.Close()
 
-	var servers []Server
-	for rows.Next() {
-		var server Server
-		if err := rows.Scan(&server.ID, &server.IP, &server.Port, &server.Login, &server.Password); err != nil {
-			return nil, fmt.Errorf("ошибка чтения данных сервера: %w", err)
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("сервер с ID %d не найден или входит не по ключу шлюза", id)
+	}
+
+	return nil
+}
+
+// GetGateServers получает серверы, на которые шлюз входит по своему ключу
+func GetGateServers(db *sql.DB) ([]Server, error) {
+	return queryServers(db, serverSelect+"WHERE s.auth_method = ? ORDER BY s.id;", ServerAuthGate)
+}
+
+// PinServerHostKey закрепляет ключ хоста, если он еще не закреплен,
+// и возвращает ключ, закрепленный за сервером в итоге
+func PinServerHostKey(db *sql.DB, id int64, hostKey string) (string, error) {
+	query := `
+	UPDATE servers
+	SET host_key = ?
+	WHERE id = ? AND host_key = '';
+	`
+
+	if _, err := db.Exec(query, hostKey, id); err != nil {
+		return "", fmt.Errorf("ошибка сохранения ключа хоста: %w", err)
+	}
+
+	var pinned string
+	err := db.QueryRow(`SELECT host_key FROM servers WHERE id = ?;`, id).Scan(&pinned)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("сервер с ID %d не найден", id)
 		}
-		servers = append(servers, server)
+		return "", fmt.Errorf("ошибка получения ключа хоста: %w", err)
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	return pinned, nil
+}
+
+// AssignServerToUser привязывает сервер к пользователю. Если expiresAt задан,
+// доступ временный и будет отозван после истечения срока
+func AssignServerToUser(db *sql.DB, userID, serverID int64, expiresAt *time.Time) error {
+	query := `
+	INSERT INTO user_servers (user_id, server_id, expires_at)
+	VALUES (?, ?, ?);
+	`
+
+	_, err := db.Exec(query, userID, serverID, nullTime(expiresAt))
+	if err != nil {
+		return fmt.Errorf("ошибка привязки сервера к пользователю: %w", err)
 	}
 
-	return servers, nil
+	return nil
+}
+
+// GetUserServers получает все серверы пользователя: выданные ему напрямую, включая серверы
+// с истекшим, но еще не отозванным доступом, и унаследованные от его групп, в том числе
+// по политикам доступа
+func GetUserServers(db *sql.DB, userID int64) ([]Server, error) {
+	query := serverSelect + `
+	WHERE s.id IN (SELECT server_id FROM user_servers WHERE user_id = ?)
+		OR s.id IN (
+			SELECT gs.server_id
+			FROM user_group_servers gs
+			JOIN user_group_members gm ON gm.group_id = gs.group_id
+			WHERE gm.user_id = ?
+		)
+		OR EXISTS (
+			SELECT 1
+			FROM access_policies p
+			JOIN user_group_members gm ON gm.group_id = p.group_id
+			WHERE gm.user_id = ? AND ` + policyMatches("p.id", "s.id") + `
+		)
+	ORDER BY s.id;
+	`
+
+	return queryServers(db, query, userID, userID, userID)
 }
 
-// GetServerUsers получает всех пользователей, имеющих доступ к серверу
+// GetServerUsers получает всех пользователей, имеющих доступ к серверу напрямую или через
+// группы, в том числе по политикам доступа. Пользователи с истекшим сроком прямого доступа
+// не возвращаются, даже если доступ еще не отозван, если только у них нет доступа через группу
 func GetServerUsers(db *sql.DB, serverID int64) ([]User, error) {
 	query := `
         SELECT u.id, u.username, u.public_key
         FROM users u
-        JOIN user_servers us ON u.id = us.user_id
-        WHERE us.server_id = ?;
+        WHERE u.id IN (
+                SELECT user_id FROM user_servers
+                WHERE server_id = ? AND (expires_at IS NULL OR expires_at > ?)
+        )
+                OR u.id IN (
+                SELECT gm.user_id
+                FROM user_group_members gm
+                JOIN user_group_servers gs ON gs.group_id = gm.group_id
+                WHERE gs.server_id = ?
+        )
+                OR u.id IN (
+                SELECT gm.user_id
+                FROM user_group_members gm
+                JOIN access_policies p ON p.group_id = gm.group_id
+                WHERE ` + policyMatches("p.id", "?") + `
+        )
+        ORDER BY u.id;
         `
 
-	rows, err := db.Query(query, serverID)
+	rows, err := db.Query(query, serverID, time.Now().UTC(), serverID, serverID)
 	if err != nil {
 		return nil, fmt.Errorf("ошибка получения пользователей сервера: %w", err)
 	}
@@ -250,6 +473,22 @@ func RemoveAllServersFromUser(db *sql.DB, userID int64) error {
 	return nil
 }
 
+// IsServerAssigned проверяет, привязан ли сервер к пользователю
+func IsServerAssigned(db *sql.DB, userID, serverID int64) (bool, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM user_servers
+	WHERE user_id = ? AND server_id = ?;
+	`
+
+	var count int
+	if err := db.QueryRow(query, userID, serverID).Scan(&count); err != nil {
+		return false, fmt.Errorf("ошибка проверки привязки сервера: %w", err)
+	}
+
+	return count > 0, nil
+}
+
 // RemoveServerFromUser удаляет привязку сервера к пользователю
 func RemoveServerFromUser(db *sql.DB, userID, serverID int64) error {
 	query := `
@@ -276,6 +515,18 @@ func RemoveServerFromUser(db *sql.DB, userID, serverID int64) error {
 
 // DeleteServer удаляет сервер по ID
 func DeleteServer(db *sql.DB, id int64) error {
+	if _, err := db.Exec(`DELETE FROM server_group_servers WHERE server_id = ?;`, id); err != nil {
+		return fmt.Errorf("ошибка исключения сервера из групп: %w", err)
+	}
+
+	if _, err := db.Exec(`DELETE FROM user_group_servers WHERE server_id = ?;`, id); err != nil {
+		return fmt.Errorf("ошибка удаления доступов групп пользователей к серверу: %w", err)
+	}
+
+	if _, err := db.Exec(`DELETE FROM server_labels WHERE server_id = ?;`, id); err != nil {
+		return fmt.Errorf("ошибка удаления меток сервера: %w", err)
+	}
+
 	query := `
 	DELETE FROM servers
 	WHERE id = ?;
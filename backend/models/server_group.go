@@ -0,0 +1,218 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+)
+
+// ServerGroup представляет группу серверов, закрепленную за операторами
+type ServerGroup struct {
+	ID        int64   `json:"id"`
+	Name      string  `json:"name"`
+	ServerIDs []int64 `json:"server_ids"`
+	AdminIDs  []int64 `json:"admin_ids"`
+}
+
+// CreateServerGroupTable создает таблицы групп серверов и их связей с серверами и операторами
+func CreateServerGroupTable(db *sql.DB) error {
+	groupQuery := `
+	CREATE TABLE IF NOT EXISTS server_groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE
+	);
+	`
+
+	groupServerQuery := `
+	CREATE TABLE IF NOT EXISTS server_group_servers (
+		group_id INTEGER NOT NULL,
+		server_id INTEGER NOT NULL,
+		PRIMARY KEY (group_id, server_id),
+		FOREIGN KEY (group_id) REFERENCES server_groups(id) ON DELETE CASCADE,
+		FOREIGN KEY (server_id) REFERENCES servers(id) ON DELETE CASCADE
+	);
+	`
+
+	groupAdminQuery := `
+	CREATE TABLE IF NOT EXISTS server_group_admins (
+		group_id INTEGER NOT NULL,
+		admin_id INTEGER NOT NULL,
+		PRIMARY KEY (group_id, admin_id),
+		FOREIGN KEY (group_id) REFERENCES server_groups(id) ON DELETE CASCADE,
+		FOREIGN KEY (admin_id) REFERENCES admins(id) ON DELETE CASCADE
+	);
+	`
+
+	if _, err := db.Exec(groupQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы групп серверов: %w", err)
+	}
+
+	if _, err := db.Exec(groupServerQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы серверов группы: %w", err)
+	}
+
+	if _, err := db.Exec(groupAdminQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы операторов группы: %w", err)
+	}
+
+	return nil
+}
+
+// AddServerGroup добавляет новую группу серверов
+func AddServerGroup(db *sql.DB, name string) (int64, error) {
+	result, err := db.Exec(`INSERT INTO server_groups (name) VALUES (?);`, name)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка добавления группы серверов: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения ID: %w", err)
+	}
+
+	return id, nil
+}
+
+// GetAllServerGroups получает все группы серверов вместе с их серверами и операторами
+func GetAllServerGroups(db *sql.DB) ([]ServerGroup, error) {
+	query := `
+	SELECT g.id, g.name,
+		COALESCE((SELECT GROUP_CONCAT(server_id) FROM server_group_servers WHERE group_id = g.id), ''),
+		COALESCE((SELECT GROUP_CONCAT(admin_id) FROM server_group_admins WHERE group_id = g.id), '')
+	FROM server_groups g
+	ORDER BY g.id;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения групп серверов: %w", err)
+	}
+	defer rows.Close()
+
+	var groups []ServerGroup
+	for rows.Next() {
+		var (
+			group     ServerGroup
+			serverIDs string
+			adminIDs  string
+		)
+		if err := rows.Scan(&group.ID, &group.Name, &serverIDs, &adminIDs); err != nil {
+			return nil, fmt.Errorf("ошибка чтения данных группы серверов: %w", err)
+		}
+		if group.ServerIDs, err = parseIDList(serverIDs); err != nil {
+			return nil, err
+		}
+		if group.AdminIDs, err = parseIDList(adminIDs); err != nil {
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return groups, nil
+}
+
+// ServerGroupExists проверяет, существует ли группа серверов
+func ServerGroupExists(db *sql.DB, id int64) (bool, error) {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM server_groups WHERE id = ?;`, id).Scan(&count); err != nil {
+		return false, fmt.Errorf("ошибка проверки группы серверов: %w", err)
+	}
+	return count > 0, nil
+}
+
+// DeleteServerGroup удаляет группу серверов вместе с ее связями
+func DeleteServerGroup(db *sql.DB, id int64) error {
+	if _, err := db.Exec(`DELETE FROM server_group_servers WHERE group_id = ?;`, id); err != nil {
+		return fmt.Errorf("ошибка удаления серверов группы: %w", err)
+	}
+
+	if _, err := db.Exec(`DELETE FROM server_group_admins WHERE group_id = ?;`, id); err != nil {
+		return fmt.Errorf("ошибка удаления операторов группы: %w", err)
+	}
+
+	if _, err := db.Exec(`DELETE FROM approval_rules WHERE group_id = ?;`, id); err != nil {
+		return fmt.Errorf("ошибка удаления правила одобрения группы: %w", err)
+	}
+
+	result, err := db.Exec(`DELETE FROM server_groups WHERE id = ?;`, id)
+	if err != nil {
+		return fmt.Errorf("ошибка удаления группы серверов: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("группа серверов с ID %d не найдена", id)
+	}
+
+	return nil
+}
+
+// AddServerToGroup добавляет сервер в группу
+func AddServerToGroup(db *sql.DB, groupID, serverID int64) error {
+	if _, err := db.Exec(`INSERT OR IGNORE INTO server_group_servers (group_id, server_id) VALUES (?, ?);`, groupID, serverID); err != nil {
+		return fmt.Errorf("ошибка добавления сервера в группу: %w", err)
+	}
+	return nil
+}
+
+// RemoveServerFromGroup исключает сервер из группы
+func RemoveServerFromGroup(db *sql.DB, groupID, serverID int64) error {
+	if _, err := db.Exec(`DELETE FROM server_group_servers WHERE group_id = ? AND server_id = ?;`, groupID, serverID); err != nil {
+		return fmt.Errorf("ошибка исключения сервера из группы: %w", err)
+	}
+	return nil
+}
+
+// AddAdminToServerGroup закрепляет группу серверов за оператором
+func AddAdminToServerGroup(db *sql.DB, groupID, adminID int64) error {
+	if _, err := db.Exec(`INSERT OR IGNORE INTO server_group_admins (group_id, admin_id) VALUES (?, ?);`, groupID, adminID); err != nil {
+		return fmt.Errorf("ошибка добавления оператора в группу: %w", err)
+	}
+	return nil
+}
+
+// RemoveAdminFromServerGroup открепляет группу серверов от оператора
+func RemoveAdminFromServerGroup(db *sql.DB, groupID, adminID int64) error {
+	if _, err := db.Exec(`DELETE FROM server_group_admins WHERE group_id = ? AND admin_id = ?;`, groupID, adminID); err != nil {
+		return fmt.Errorf("ошибка исключения оператора из группы: %w", err)
+	}
+	return nil
+}
+
+// IsServerInAdminGroups проверяет, входит ли сервер в одну из групп оператора
+func IsServerInAdminGroups(db *sql.DB, adminID, serverID int64) (bool, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM server_group_servers gs
+	JOIN server_group_admins ga ON ga.group_id = gs.group_id
+	WHERE ga.admin_id = ? AND gs.server_id = ?;
+	`
+
+	var count int
+	if err := db.QueryRow(query, adminID, serverID).Scan(&count); err != nil {
+		return false, fmt.Errorf("ошибка проверки групп оператора: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// parseIDList разбирает список ID, сохраненный через запятую
+func parseIDList(value string) ([]int64, error) {
+	ids := []int64{}
+	for _, item := range splitList(value) {
+		id, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("неверный формат ID в списке: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,117 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// labelNamePattern допустимое имя метки, например env или example.com/team
+	labelNamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]{0,62}[A-Za-z0-9])?$`)
+	// labelValuePattern допустимое значение метки, в том числе пустое
+	labelValuePattern = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9._-]{0,62}[A-Za-z0-9])?)?$`)
+)
+
+// CreateServerLabelTable создает таблицу меток серверов
+func CreateServerLabelTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS server_labels (
+		server_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (server_id, name),
+		FOREIGN KEY (server_id) REFERENCES servers(id) ON DELETE CASCADE
+	);
+	`
+
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("ошибка создания таблицы меток серверов: %w", err)
+	}
+
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS server_labels_name_value ON server_labels (name, value);`); err != nil {
+		return fmt.Errorf("ошибка создания индекса меток серверов: %w", err)
+	}
+
+	return nil
+}
+
+// ValidateLabels проверяет имена и значения меток. Имя состоит из латинских букв, цифр
+// и символов . _ / -, значение - из латинских букв, цифр и символов . _ -
+func ValidateLabels(labels map[string]string) error {
+	for name, value := range labels {
+		if !labelNamePattern.MatchString(name) {
+			return fmt.Errorf("неверное имя метки %q", name)
+		}
+		if !labelValuePattern.MatchString(value) {
+			return fmt.Errorf("неверное значение метки %s=%q", name, value)
+		}
+	}
+	return nil
+}
+
+// LabelsEqual проверяет, совпадают ли наборы меток
+func LabelsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		if other, ok := b[name]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchLabels проверяет, есть ли среди меток все метки селектора
+func MatchLabels(labels, selector map[string]string) bool {
+	for name, value := range selector {
+		if other, ok := labels[name]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseSelector разбирает селектор, записанный строкой вида env=prod,team=billing
+func ParseSelector(value string) (map[string]string, error) {
+	selector := make(map[string]string)
+	for _, item := range splitList(value) {
+		name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return nil, fmt.Errorf("ожидается имя=значение, получено %q", item)
+		}
+		selector[name] = value
+	}
+	if err := ValidateLabels(selector); err != nil {
+		return nil, err
+	}
+	return selector, nil
+}
+
+// setServerLabels заменяет метки сервера
+func setServerLabels(tx *sql.Tx, serverID int64, labels map[string]string) error {
+	if _, err := tx.Exec(`DELETE FROM server_labels WHERE server_id = ?;`, serverID); err != nil {
+		return fmt.Errorf("ошибка удаления меток сервера: %w", err)
+	}
+
+	for name, value := range labels {
+		if _, err := tx.Exec(`INSERT INTO server_labels (server_id, name, value) VALUES (?, ?, ?);`, serverID, name, value); err != nil {
+			return fmt.Errorf("ошибка сохранения метки сервера: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// parseLabels разбирает метки, сохраненные через запятую в виде имя=значение.
+// Имена и значения меток не содержат запятых и знака равенства
+func parseLabels(value string) map[string]string {
+	labels := make(map[string]string)
+	for _, item := range splitList(value) {
+		name, value, _ := strings.Cut(item, "=")
+		labels[name] = value
+	}
+	return labels
+}
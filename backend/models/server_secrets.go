@@ -0,0 +1,138 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+
+	"ssh-gate/secrets"
+)
+
+// EncryptServerSecrets шифрует учетные данные серверов и приватные ключи шлюза, сохраненные в открытом виде.
+// Возвращает количество обновленных записей
+func EncryptServerSecrets(db *sql.DB, keeper *secrets.Keeper) (int, error) {
+	return updateServerSecrets(db, func(value string) (string, error) {
+		if value == "" || secrets.IsEncrypted(value) {
+			return value, nil
+		}
+		return keeper.Encrypt(value)
+	})
+}
+
+// RewrapServerSecrets перешифровывает ключи данных учетных данных серверов и приватных ключей шлюза
+// новым мастер-ключом.
+// Возвращает количество обновленных записей
+func RewrapServerSecrets(db *sql.DB, current, next *secrets.Keeper) (int, error) {
+	return updateServerSecrets(db, func(value string) (string, error) {
+		return current.Rewrap(value, next)
+	})
+}
+
+// serverSecretColumns столбцы таблицы серверов, хранящиеся в зашифрованном виде
+var serverSecretColumns = []string{"password", "private_key", "passphrase"}
+
+// updateServerSecrets применяет преобразование к учетным данным всех серверов и приватным ключам
+// шлюза в одной транзакции
+func updateServerSecrets(db *sql.DB, transform func(string) (string, error)) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка начала транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id, password, private_key, passphrase FROM servers;`)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения серверов: %w", err)
+	}
+
+	updates := map[int64][]string{}
+	for rows.Next() {
+		var id int64
+		values := make([]string, len(serverSecretColumns))
+		if err := rows.Scan(&id, &values[0], &values[1], &values[2]); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("ошибка чтения данных сервера: %w", err)
+		}
+
+		changed := false
+		for i, value := range values {
+			transformed, err := transform(value)
+			if err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("ошибка обработки учетных данных сервера с ID %d (%s): %w", id, serverSecretColumns[i], err)
+			}
+			if transformed != value {
+				values[i] = transformed
+				changed = true
+			}
+		}
+		if changed {
+			updates[id] = values
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+	rows.Close()
+
+	for id, values := range updates {
+		query := `UPDATE servers SET password = ?, private_key = ?, passphrase = ? WHERE id = ?;`
+		if _, err := tx.Exec(query, values[0], values[1], values[2], id); err != nil {
+			return 0, fmt.Errorf("ошибка обновления учетных данных сервера с ID %d: %w", id, err)
+		}
+	}
+
+	gateKeys, err := updateGateKeySecrets(tx, transform)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("ошибка фиксации транзакции: %w", err)
+	}
+
+	return len(updates) + gateKeys, nil
+}
+
+// updateGateKeySecrets применяет преобразование к приватным ключам шлюза. Ключи, выведенные
+// из обращения, не хранят приватную часть и пропускаются
+func updateGateKeySecrets(tx *sql.Tx, transform func(string) (string, error)) (int, error) {
+	rows, err := tx.Query(`SELECT id, private_key FROM gate_keys WHERE private_key != '';`)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения ключей шлюза: %w", err)
+	}
+
+	updates := map[int64]string{}
+	for rows.Next() {
+		var (
+			id    int64
+			value string
+		)
+		if err := rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("ошибка чтения ключа шлюза: %w", err)
+		}
+
+		transformed, err := transform(value)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("ошибка обработки ключа шлюза с ID %d: %w", id, err)
+		}
+		if transformed != value {
+			updates[id] = transformed
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+	rows.Close()
+
+	for id, value := range updates {
+		if _, err := tx.Exec(`UPDATE gate_keys SET private_key = ? WHERE id = ?;`, value, id); err != nil {
+			return 0, fmt.Errorf("ошибка обновления ключа шлюза с ID %d: %w", id, err)
+		}
+	}
+
+	return len(updates), nil
+}
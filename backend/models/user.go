@@ -70,6 +70,26 @@ func GetUserByID(db *sql.DB, id int64) (*User, error) {
 	return user, nil
 }
 
+// GetUserByUsername получает пользователя по имени
+func GetUserByUsername(db *sql.DB, username string) (*User, error) {
+	user := &User{}
+	query := `
+	SELECT id, username, public_key
+	FROM users
+	WHERE username = ?;
+	`
+
+	err := db.QueryRow(query, username).Scan(&user.ID, &user.Username, &user.PublicKey)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("пользователь %s не найден: %w", username, err)
+		}
+		return nil, fmt.Errorf("ошибка получения пользователя: %w", err)
+	}
+
+	return user, nil
+}
+
 // GetAllUsers получает всех пользователей
 func GetAllUsers(db *sql.DB) ([]User, error) {
 	query := `
@@ -126,6 +146,10 @@ func UpdateUser(db *sql.DB, user User) error {
 
 // DeleteUser удаление пользователя
 func DeleteUser(db *sql.DB, id int64) error {
+	if _, err := db.Exec(`DELETE FROM user_keys WHERE user_id = ?;`, id); err != nil {
+		return fmt.Errorf("ошибка удаления ключей пользователя: %w", err)
+	}
+
 	query := `
 	DELETE FROM users
 	WHERE id = ?;
@@ -0,0 +1,343 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// UserGroup представляет группу пользователей. Участники группы получают доступ
+// ко всем серверам, выданным группе
+type UserGroup struct {
+	ID        int64   `json:"id"`
+	Name      string  `json:"name"`
+	UserIDs   []int64 `json:"user_ids"`
+	ServerIDs []int64 `json:"server_ids"`
+}
+
+// UserGroupRef описывает группу, через которую пользователь получил доступ к серверу
+type UserGroupRef struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// CreateUserGroupTable создает таблицы групп пользователей, их участников и доступов групп к серверам
+func CreateUserGroupTable(db *sql.DB) error {
+	groupQuery := `
+	CREATE TABLE IF NOT EXISTS user_groups (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE
+	);
+	`
+
+	memberQuery := `
+	CREATE TABLE IF NOT EXISTS user_group_members (
+		group_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		PRIMARY KEY (group_id, user_id),
+		FOREIGN KEY (group_id) REFERENCES user_groups(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	`
+
+	groupServerQuery := `
+	CREATE TABLE IF NOT EXISTS user_group_servers (
+		group_id INTEGER NOT NULL,
+		server_id INTEGER NOT NULL,
+		PRIMARY KEY (group_id, server_id),
+		FOREIGN KEY (group_id) REFERENCES user_groups(id) ON DELETE CASCADE,
+		FOREIGN KEY (server_id) REFERENCES servers(id) ON DELETE CASCADE
+	);
+	`
+
+	if _, err := db.Exec(groupQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы групп пользователей: %w", err)
+	}
+
+	if _, err := db.Exec(memberQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы участников групп пользователей: %w", err)
+	}
+
+	if _, err := db.Exec(groupServerQuery); err != nil {
+		return fmt.Errorf("ошибка создания таблицы серверов групп пользователей: %w", err)
+	}
+
+	return nil
+}
+
+// AddUserGroup добавляет новую группу пользователей
+func AddUserGroup(db *sql.DB, name string) (int64, error) {
+	result, err := db.Exec(`INSERT INTO user_groups (name) VALUES (?);`, name)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка добавления группы пользователей: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения ID: %w", err)
+	}
+
+	return id, nil
+}
+
+// userGroupSelect выбирает группы пользователей вместе с участниками и серверами
+const userGroupSelect = `
+	SELECT g.id, g.name,
+		COALESCE((SELECT GROUP_CONCAT(user_id) FROM user_group_members WHERE group_id = g.id), ''),
+		COALESCE((SELECT GROUP_CONCAT(server_id) FROM user_group_servers WHERE group_id = g.id), '')
+	FROM user_groups g
+	`
+
+// GetAllUserGroups получает все группы пользователей вместе с участниками и серверами
+func GetAllUserGroups(db *sql.DB) ([]UserGroup, error) {
+	rows, err := db.Query(userGroupSelect + "ORDER BY g.id;")
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения групп пользователей: %w", err)
+	}
+	defer rows.Close()
+
+	var groups []UserGroup
+	for rows.Next() {
+		group, err := scanUserGroup(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения данных группы пользователей: %w", err)
+		}
+		groups = append(groups, *group)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return groups, nil
+}
+
+// GetUserGroupByID получает группу пользователей по ID
+func GetUserGroupByID(db *sql.DB, id int64) (*UserGroup, error) {
+	group, err := scanUserGroup(db.QueryRow(userGroupSelect+"WHERE g.id = ?;", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("группа пользователей с ID %d не найдена", id)
+		}
+		return nil, fmt.Errorf("ошибка получения группы пользователей: %w", err)
+	}
+
+	return group, nil
+}
+
+// scanUserGroup читает группу пользователей из строки результата
+func scanUserGroup(row rowScanner) (*UserGroup, error) {
+	var (
+		group     UserGroup
+		userIDs   string
+		serverIDs string
+		err       error
+	)
+
+	if err := row.Scan(&group.ID, &group.Name, &userIDs, &serverIDs); err != nil {
+		return nil, err
+	}
+	if group.UserIDs, err = parseIDList(userIDs); err != nil {
+		return nil, err
+	}
+	if group.ServerIDs, err = parseIDList(serverIDs); err != nil {
+		return nil, err
+	}
+
+	return &group, nil
+}
+
+// RenameUserGroup изменяет название группы пользователей
+func RenameUserGroup(db *sql.DB, id int64, name string) error {
+	result, err := db.Exec(`UPDATE user_groups SET name = ? WHERE id = ?;`, name, id)
+	if err != nil {
+		return fmt.Errorf("ошибка обновления группы пользователей: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("группа пользователей с ID %d не найдена", id)
+	}
+
+	return nil
+}
+
+// DeleteUserGroup удаляет группу пользователей вместе с участниками, доступами к серверам
+// и политиками доступа
+func DeleteUserGroup(db *sql.DB, id int64) error {
+	if err := deleteGroupAccessPolicies(db, id); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`DELETE FROM user_group_members WHERE group_id = ?;`, id); err != nil {
+		return fmt.Errorf("ошибка удаления участников группы: %w", err)
+	}
+
+	if _, err := db.Exec(`DELETE FROM user_group_servers WHERE group_id = ?;`, id); err != nil {
+		return fmt.Errorf("ошибка удаления доступов группы к серверам: %w", err)
+	}
+
+	result, err := db.Exec(`DELETE FROM user_groups WHERE id = ?;`, id)
+	if err != nil {
+		return fmt.Errorf("ошибка удаления группы пользователей: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("группа пользователей с ID %d не найдена", id)
+	}
+
+	return nil
+}
+
+// AddUserToGroup добавляет пользователя в группу
+func AddUserToGroup(db *sql.DB, groupID, userID int64) error {
+	if _, err := db.Exec(`INSERT OR IGNORE INTO user_group_members (group_id, user_id) VALUES (?, ?);`, groupID, userID); err != nil {
+		return fmt.Errorf("ошибка добавления пользователя в группу: %w", err)
+	}
+	return nil
+}
+
+// RemoveUserFromGroup исключает пользователя из группы
+func RemoveUserFromGroup(db *sql.DB, groupID, userID int64) error {
+	if _, err := db.Exec(`DELETE FROM user_group_members WHERE group_id = ? AND user_id = ?;`, groupID, userID); err != nil {
+		return fmt.Errorf("ошибка исключения пользователя из группы: %w", err)
+	}
+	return nil
+}
+
+// RemoveUserFromAllGroups исключает пользователя из всех групп
+func RemoveUserFromAllGroups(db *sql.DB, userID int64) error {
+	if _, err := db.Exec(`DELETE FROM user_group_members WHERE user_id = ?;`, userID); err != nil {
+		return fmt.Errorf("ошибка исключения пользователя из групп: %w", err)
+	}
+	return nil
+}
+
+// AssignServerToUserGroup выдает группе пользователей доступ к серверу
+func AssignServerToUserGroup(db *sql.DB, groupID, serverID int64) error {
+	if _, err := db.Exec(`INSERT OR IGNORE INTO user_group_servers (group_id, server_id) VALUES (?, ?);`, groupID, serverID); err != nil {
+		return fmt.Errorf("ошибка выдачи группе доступа к серверу: %w", err)
+	}
+	return nil
+}
+
+// RemoveServerFromUserGroup отзывает у группы пользователей доступ к серверу
+func RemoveServerFromUserGroup(db *sql.DB, groupID, serverID int64) error {
+	if _, err := db.Exec(`DELETE FROM user_group_servers WHERE group_id = ? AND server_id = ?;`, groupID, serverID); err != nil {
+		return fmt.Errorf("ошибка отзыва у группы доступа к серверу: %w", err)
+	}
+	return nil
+}
+
+// HasGroupAccess проверяет, есть ли у пользователя доступ к серверу через одну из его групп,
+// в том числе по политике доступа
+func HasGroupAccess(db *sql.DB, userID, serverID int64) (bool, error) {
+	query := `
+	SELECT
+		(SELECT COUNT(*)
+		FROM user_group_members gm
+		JOIN user_group_servers gs ON gs.group_id = gm.group_id
+		WHERE gm.user_id = ? AND gs.server_id = ?)
+		+
+		(SELECT COUNT(*)
+		FROM user_group_members gm
+		JOIN access_policies p ON p.group_id = gm.group_id
+		WHERE gm.user_id = ? AND ` + policyMatches("p.id", "?") + `);
+	`
+
+	var count int
+	if err := db.QueryRow(query, userID, serverID, userID, serverID).Scan(&count); err != nil {
+		return false, fmt.Errorf("ошибка проверки доступа через группы: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// GetUserGroupAccess получает серверы, доступ к которым пользователь получил через группы,
+// в том числе по политикам доступа, и группы, через которые выдан доступ к каждому из них
+func GetUserGroupAccess(db *sql.DB, userID int64) (map[int64][]UserGroupRef, error) {
+	query := `
+	SELECT gs.server_id, g.id, g.name
+	FROM user_group_members gm
+	JOIN user_group_servers gs ON gs.group_id = gm.group_id
+	JOIN user_groups g ON g.id = gm.group_id
+	WHERE gm.user_id = ?
+	UNION
+	SELECT s.id, g.id, g.name
+	FROM user_group_members gm
+	JOIN access_policies p ON p.group_id = gm.group_id
+	JOIN user_groups g ON g.id = gm.group_id
+	JOIN servers s
+	WHERE gm.user_id = ? AND ` + policyMatches("p.id", "s.id") + `
+	ORDER BY 1, 2;
+	`
+
+	rows, err := db.Query(query, userID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения доступов через группы: %w", err)
+	}
+	defer rows.Close()
+
+	access := make(map[int64][]UserGroupRef)
+	for rows.Next() {
+		var (
+			serverID int64
+			group    UserGroupRef
+		)
+		if err := rows.Scan(&serverID, &group.ID, &group.Name); err != nil {
+			return nil, fmt.Errorf("ошибка чтения доступа через группу: %w", err)
+		}
+		access[serverID] = append(access[serverID], group)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return access, nil
+}
+
+// GetUserGroupServerIDs получает все серверы, доступ к которым есть у участников группы:
+// выданные группе напрямую и подходящие под ее политики доступа
+func GetUserGroupServerIDs(db *sql.DB, groupID int64) ([]int64, error) {
+	query := `
+	SELECT s.id
+	FROM servers s
+	WHERE s.id IN (SELECT server_id FROM user_group_servers WHERE group_id = ?)
+		OR EXISTS (
+			SELECT 1
+			FROM access_policies p
+			WHERE p.group_id = ? AND ` + policyMatches("p.id", "s.id") + `
+		)
+	ORDER BY s.id;
+	`
+
+	rows, err := db.Query(query, groupID, groupID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения серверов группы: %w", err)
+	}
+	defer rows.Close()
+
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("ошибка чтения ID сервера: %w", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,308 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// UserKey представляет один из публичных ключей пользователя.
+// На серверы выдаются все включенные ключи с неистекшим сроком действия.
+// Ключ, замененный при ротации, выключается и хранится для аудита: RotatedAt - время замены,
+// RemovedAt - время, когда удаление ключа со всех серверов было подтверждено
+type UserKey struct {
+	ID          int64      `json:"id"`
+	UserID      int64      `json:"user_id"`
+	PublicKey   string     `json:"public_key"`
+	Fingerprint string     `json:"fingerprint"`
+	Comment     string     `json:"comment"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	Enabled     bool       `json:"enabled"`
+	RotatedAt   *time.Time `json:"rotated_at,omitempty"`
+	RemovedAt   *time.Time `json:"removed_at,omitempty"`
+}
+
+// Active проверяет, выдается ли ключ на серверы
+func (k UserKey) Active() bool {
+	return k.Enabled && (k.ExpiresAt == nil || k.ExpiresAt.After(time.Now()))
+}
+
+// CreateUserKeyTable создает таблицу публичных ключей пользователей
+func CreateUserKeyTable(db *sql.DB) error {
+	query := `
+	CREATE TABLE IF NOT EXISTS user_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		public_key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		comment TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME,
+		enabled INTEGER NOT NULL DEFAULT 1,
+		UNIQUE (user_id, fingerprint),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	`
+
+	if _, err := db.Exec(query); err != nil {
+		return fmt.Errorf("ошибка создания таблицы ключей пользователей: %w", err)
+	}
+
+	// Время ротации и подтверждения удаления ключа
+	if err := addColumnIfMissing(db, "user_keys", "rotated_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "user_keys", "removed_at", "DATETIME"); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddUserKey добавляет публичный ключ пользователю
+func AddUserKey(db *sql.DB, key UserKey) (int64, error) {
+	query := `
+	INSERT INTO user_keys (user_id, public_key, fingerprint, comment, created_at, expires_at, enabled)
+	VALUES (?, ?, ?, ?, ?, ?, ?);
+	`
+
+	result, err := db.Exec(query, key.UserID, key.PublicKey, key.Fingerprint, key.Comment, time.Now().UTC(), nullTime(key.ExpiresAt), key.Enabled)
+	if err != nil {
+		return 0, fmt.Errorf("ошибка добавления ключа пользователя: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("ошибка получения ID: %w", err)
+	}
+
+	return id, nil
+}
+
+// GetUserKeyByID получает ключ пользователя по ID
+func GetUserKeyByID(db *sql.DB, userID, keyID int64) (*UserKey, error) {
+	query := `
+	SELECT id, user_id, public_key, fingerprint, comment, created_at, expires_at, enabled, rotated_at, removed_at
+	FROM user_keys
+	WHERE id = ? AND user_id = ?;
+	`
+
+	key, err := scanUserKey(db.QueryRow(query, keyID, userID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("ключ с ID %d не найден", keyID)
+		}
+		return nil, fmt.Errorf("ошибка получения ключа пользователя: %w", err)
+	}
+
+	return key, nil
+}
+
+// GetUserKeyByFingerprint получает ключ по отпечатку среди ключей всех пользователей
+func GetUserKeyByFingerprint(db *sql.DB, fingerprint string) (*UserKey, error) {
+	query := `
+	SELECT id, user_id, public_key, fingerprint, comment, created_at, expires_at, enabled, rotated_at, removed_at
+	FROM user_keys
+	WHERE fingerprint = ?
+	ORDER BY id
+	LIMIT 1;
+	`
+
+	key, err := scanUserKey(db.QueryRow(query, fingerprint))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("ключ с отпечатком %s не найден: %w", fingerprint, err)
+		}
+		return nil, fmt.Errorf("ошибка получения ключа пользователя: %w", err)
+	}
+
+	return key, nil
+}
+
+// GetUserKeys получает все ключи пользователя
+func GetUserKeys(db *sql.DB, userID int64) ([]UserKey, error) {
+	query := `
+	SELECT id, user_id, public_key, fingerprint, comment, created_at, expires_at, enabled, rotated_at, removed_at
+	FROM user_keys
+	WHERE user_id = ?
+	ORDER BY id;
+	`
+
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения ключей пользователя: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []UserKey
+	for rows.Next() {
+		key, err := scanUserKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения данных ключа: %w", err)
+		}
+		keys = append(keys, *key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return keys, nil
+}
+
+// GetActiveUserKeys получает ключи пользователя, которые выдаются на серверы
+func GetActiveUserKeys(db *sql.DB, userID int64) ([]UserKey, error) {
+	keys, err := GetUserKeys(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var active []UserKey
+	for _, key := range keys {
+		if key.Active() {
+			active = append(active, key)
+		}
+	}
+
+	return active, nil
+}
+
+// UpdateUserKey обновляет комментарий, срок действия и признак включения ключа.
+// Включенный ключ перестает считаться замененным
+func UpdateUserKey(db *sql.DB, key UserKey) error {
+	query := `
+	UPDATE user_keys
+	SET comment = ?, expires_at = ?, enabled = ?,
+		rotated_at = CASE WHEN ? THEN NULL ELSE rotated_at END,
+		removed_at = CASE WHEN ? THEN NULL ELSE removed_at END
+	WHERE id = ? AND user_id = ?;
+	`
+
+	result, err := db.Exec(query, key.Comment, nullTime(key.ExpiresAt), key.Enabled, key.Enabled, key.Enabled, key.ID, key.UserID)
+	if err != nil {
+		return fmt.Errorf("ошибка обновления ключа пользователя: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("ключ с ID %d не найден", key.ID)
+	}
+
+	return nil
+}
+
+// SetUserKeyLine заменяет строку ключа, например при изменении опций или комментария того же ключа
+func SetUserKeyLine(db *sql.DB, keyID int64, publicKey string) error {
+	if _, err := db.Exec(`UPDATE user_keys SET public_key = ? WHERE id = ?;`, publicKey, keyID); err != nil {
+		return fmt.Errorf("ошибка обновления ключа пользователя: %w", err)
+	}
+	return nil
+}
+
+// RotateUserKey выключает ключ, замененный при ротации, и отмечает время замены
+func RotateUserKey(db *sql.DB, keyID int64) error {
+	query := `
+	UPDATE user_keys
+	SET enabled = 0, rotated_at = ?, removed_at = NULL
+	WHERE id = ?;
+	`
+
+	if _, err := db.Exec(query, time.Now().UTC(), keyID); err != nil {
+		return fmt.Errorf("ошибка ротации ключа пользователя: %w", err)
+	}
+
+	return nil
+}
+
+// ConfirmRotatedKeysRemoved отмечает, что замененные ключи пользователя удалены со всех серверов
+func ConfirmRotatedKeysRemoved(db *sql.DB, userID int64) error {
+	query := `
+	UPDATE user_keys
+	SET removed_at = ?
+	WHERE user_id = ? AND enabled = 0 AND rotated_at IS NOT NULL AND removed_at IS NULL;
+	`
+
+	if _, err := db.Exec(query, time.Now().UTC(), userID); err != nil {
+		return fmt.Errorf("ошибка подтверждения удаления ключей: %w", err)
+	}
+
+	return nil
+}
+
+// GetUsersWithPendingRotation возвращает ID пользователей, у которых удаление замененных ключей не подтверждено
+func GetUsersWithPendingRotation(db *sql.DB) ([]int64, error) {
+	query := `
+	SELECT DISTINCT user_id
+	FROM user_keys
+	WHERE enabled = 0 AND rotated_at IS NOT NULL AND removed_at IS NULL;
+	`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения незавершенных ротаций: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("ошибка чтения ID пользователя: %w", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ошибка при переборе строк: %w", err)
+	}
+
+	return ids, nil
+}
+
+// DeleteUserKey удаляет ключ пользователя
+func DeleteUserKey(db *sql.DB, userID, keyID int64) error {
+	query := `
+	DELETE FROM user_keys
+	WHERE id = ? AND user_id = ?;
+	`
+
+	result, err := db.Exec(query, keyID, userID)
+	if err != nil {
+		return fmt.Errorf("ошибка удаления ключа пользователя: %w", err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ошибка получения количества затронутых строк: %w", err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("ключ с ID %d не найден", keyID)
+	}
+
+	return nil
+}
+
+// scanUserKey читает ключ пользователя из строки результата
+func scanUserKey(row rowScanner) (*UserKey, error) {
+	var (
+		key       UserKey
+		expiresAt sql.NullTime
+		rotatedAt sql.NullTime
+		removedAt sql.NullTime
+	)
+
+	if err := row.Scan(&key.ID, &key.UserID, &key.PublicKey, &key.Fingerprint, &key.Comment, &key.CreatedAt, &expiresAt, &key.Enabled, &rotatedAt, &removedAt); err != nil {
+		return nil, err
+	}
+
+	key.ExpiresAt = timePtr(expiresAt)
+	key.RotatedAt = timePtr(rotatedAt)
+	key.RemovedAt = timePtr(removedAt)
+	return &key, nil
+}
@@ -0,0 +1,32 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"log"
+
+	"ssh-gate/models"
+)
+
+// audit записывает в журнал аудита действие, выполненное шлюзом без участия оператора.
+// Если err не nil, действие записывается как невыполненное
+func (e *Engine) audit(event models.AuditEvent, err error) {
+	event.Actor = models.AuditSystemActor
+	event.Result = models.AuditSuccess
+	if err != nil {
+		event.Result = models.AuditFailure
+		event.Error = err.Error()
+	}
+
+	if _, err := models.AddAuditEvent(e.DB, event); err != nil {
+		log.Printf("Ошибка записи в журнал аудита (%s): %v", event.Action, err)
+	}
+}
+
+// auditState возвращает состояние объекта для журнала аудита в JSON
+func auditState(value any) json.RawMessage {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return data
+}
@@ -0,0 +1,63 @@
+package reconcile
+
+import (
+	"database/sql"
+	"fmt"
+
+	"ssh-gate/models"
+	"ssh-gate/secrets"
+	"ssh-gate/ssh"
+)
+
+// SSHConfig создает конфигурацию SSH-подключения к серверу, расшифровывая учетные данные
+// выбранного для сервера способа входа. Ключ хоста, полученный при первом подключении,
+// сохраняется в базе данных
+func SSHConfig(db *sql.DB, keeper *secrets.Keeper, server models.Server) (ssh.SSHConfig, error) {
+	config := ssh.SSHConfig{
+		Host:    server.IP,
+		Port:    server.Port,
+		User:    server.Login,
+		HostKey: server.HostKey,
+		OnHostKeyPinned: func(hostKey string) error {
+			// Ключ мог быть закреплен параллельным подключением, поэтому сверяемся с базой
+			pinned, err := models.PinServerHostKey(db, server.ID, hostKey)
+			if err != nil {
+				return err
+			}
+			if pinned != hostKey {
+				expected, _ := ssh.HostKeyFingerprint(pinned)
+				actual, _ := ssh.HostKeyFingerprint(hostKey)
+				return &ssh.HostKeyMismatchError{Host: server.IP, Expected: expected, Actual: actual}
+			}
+			return nil
+		},
+	}
+
+	var err error
+	switch server.AuthMethod {
+	case models.ServerAuthKey:
+		if config.PrivateKey, err = keeper.Decrypt(server.PrivateKey); err != nil {
+			return ssh.SSHConfig{}, fmt.Errorf("ошибка расшифровки приватного ключа сервера: %w", err)
+		}
+		if config.Passphrase, err = keeper.Decrypt(server.Passphrase); err != nil {
+			return ssh.SSHConfig{}, fmt.Errorf("ошибка расшифровки парольной фразы сервера: %w", err)
+		}
+	case models.ServerAuthGate:
+		key, err := models.GetGateKeyByID(db, server.GateKeyID)
+		if err != nil {
+			return ssh.SSHConfig{}, err
+		}
+		if key.PrivateKey == "" {
+			return ssh.SSHConfig{}, fmt.Errorf("ключ шлюза с ID %d выведен из обращения", key.ID)
+		}
+		if config.PrivateKey, err = keeper.Decrypt(key.PrivateKey); err != nil {
+			return ssh.SSHConfig{}, fmt.Errorf("ошибка расшифровки ключа шлюза: %w", err)
+		}
+	default:
+		if config.Password, err = keeper.Decrypt(server.Password); err != nil {
+			return ssh.SSHConfig{}, fmt.Errorf("ошибка расшифровки пароля сервера: %w", err)
+		}
+	}
+
+	return config, nil
+}
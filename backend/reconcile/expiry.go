@@ -0,0 +1,146 @@
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"ssh-gate/models"
+)
+
+// ExpiryIntervalEnv переменная окружения с интервалом проверки истекших доступов (по умолчанию 1m)
+const ExpiryIntervalEnv = "SSH_GATE_EXPIRY_INTERVAL"
+
+// DefaultExpiryInterval интервал проверки истекших доступов по умолчанию
+const DefaultExpiryInterval = time.Minute
+
+// maxRevokeRetryDelay ограничивает паузу между повторными попытками отзыва доступа
+const maxRevokeRetryDelay = time.Hour
+
+// LoadExpiryInterval читает интервал проверки истекших доступов из окружения
+func LoadExpiryInterval() (time.Duration, error) {
+	value := os.Getenv(ExpiryIntervalEnv)
+	if value == "" {
+		return DefaultExpiryInterval, nil
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("неверное значение %s: %s", ExpiryIntervalEnv, value)
+	}
+
+	return interval, nil
+}
+
+// ExpireGrants отзывает истекшие доступы: убирает ключи пользователей с сервера и удаляет
+// записи из базы данных. Если сервер недоступен, записи сохраняются, а попытка повторяется
+// с растущей паузой. Одобренные запросы доступа с истекшим сроком отмечаются как expired.
+// Возвращает отчеты по серверам, на которых выполнялся отзыв
+func (e *Engine) ExpireGrants(ctx context.Context, retryDelay time.Duration) ([]*Drift, error) {
+	now := time.Now().UTC()
+	if _, err := models.ExpireAccessRequests(e.DB, now); err != nil {
+		return nil, err
+	}
+
+	grants, err := models.GetDueExpiredGrants(e.DB, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ключи истекших доступов убираются одной синхронизацией сервера
+	attempts := make(map[int64]int)
+	var serverIDs []int64
+	for _, grant := range grants {
+		if _, ok := attempts[grant.ServerID]; !ok {
+			serverIDs = append(serverIDs, grant.ServerID)
+		}
+		attempts[grant.ServerID] = max(attempts[grant.ServerID], grant.RevokeAttempts)
+	}
+
+	reports := make([]*Drift, 0, len(serverIDs))
+	for _, serverID := range serverIDs {
+		drift, err := e.expireServer(ctx, serverID, now)
+		if err != nil {
+			drift = &Drift{ServerID: serverID, Error: err.Error()}
+			if server, err := models.GetServerByID(e.DB, serverID); err == nil {
+				drift.Server = address(server)
+			}
+
+			next := now.Add(revokeRetryDelay(retryDelay, attempts[serverID]))
+			if err := models.PostponeGrantRevocation(e.DB, serverID, now, next, drift.Error); err != nil {
+				return nil, err
+			}
+		}
+		reports = append(reports, drift)
+
+		// Каждый отозванный или неотозванный доступ записывается в журнал аудита
+		for _, grant := range grants {
+			if grant.ServerID == serverID {
+				event := models.AuditEvent{Action: models.AuditAccessExpire, UserID: grant.UserID, ServerID: serverID, Before: auditState(grant)}
+				e.audit(event, err)
+			}
+		}
+	}
+
+	return reports, nil
+}
+
+// expireServer убирает с сервера ключи пользователей, доступ которых истек к моменту now,
+// и после этого удаляет их записи из базы данных
+func (e *Engine) expireServer(ctx context.Context, serverID int64, now time.Time) (*Drift, error) {
+	server, err := models.GetServerByID(e.DB, serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	drift, err := e.Apply(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := models.RemoveExpiredGrants(e.DB, serverID, now); err != nil {
+		return nil, err
+	}
+
+	return drift, nil
+}
+
+// revokeRetryDelay возвращает паузу перед следующей попыткой отзыва:
+// она удваивается после каждой неудачи, но не превышает maxRevokeRetryDelay
+func revokeRetryDelay(base time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 0; i < attempts && delay < maxRevokeRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRevokeRetryDelay)
+}
+
+// RunExpiry периодически отзывает истекшие доступы, пока не будет отменен контекст
+func (e *Engine) RunExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reports, err := e.ExpireGrants(ctx, interval)
+		if err != nil {
+			log.Printf("Ошибка отзыва истекших доступов: %v", err)
+			continue
+		}
+
+		for _, drift := range reports {
+			if drift.Error != "" {
+				log.Printf("Отзыв истекших доступов к серверу %s не выполнен, попытка будет повторена: %s", drift.Server, drift.Error)
+			} else {
+				log.Printf("Отзыв истекших доступов к серверу %s: удалено %d ключей", drift.Server, len(drift.Extra))
+			}
+		}
+	}
+}
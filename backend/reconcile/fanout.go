@@ -0,0 +1,110 @@
+package reconcile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"ssh-gate/models"
+)
+
+// Переменные окружения с настройками параллельной работы с серверами
+const (
+	WorkersEnv = "SSH_GATE_SSH_WORKERS" // Число серверов, обновляемых одновременно (по умолчанию 8)
+	TimeoutEnv = "SSH_GATE_SSH_TIMEOUT" // Предельное время операции на одном сервере (по умолчанию 2m)
+)
+
+// FanOutConfig задает, сколько серверов обновляется одновременно
+// и сколько времени отводится на операцию с одним сервером
+type FanOutConfig struct {
+	Workers int
+	Timeout time.Duration
+}
+
+// DefaultFanOut настройки параллельной работы с серверами по умолчанию
+var DefaultFanOut = FanOutConfig{Workers: 8, Timeout: 2 * time.Minute}
+
+// LoadFanOutConfig читает настройки параллельной работы с серверами из окружения
+func LoadFanOutConfig() (FanOutConfig, error) {
+	config := DefaultFanOut
+
+	if value := os.Getenv(WorkersEnv); value != "" {
+		workers, err := strconv.Atoi(value)
+		if err != nil || workers <= 0 {
+			return FanOutConfig{}, fmt.Errorf("неверное значение %s: %s", WorkersEnv, value)
+		}
+		config.Workers = workers
+	}
+
+	if value := os.Getenv(TimeoutEnv); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return FanOutConfig{}, fmt.Errorf("неверное значение %s: %s", TimeoutEnv, value)
+		}
+		config.Timeout = timeout
+	}
+
+	return config, nil
+}
+
+// ApplyEach приводит в соответствие с базой данных указанные серверы параллельно.
+// Ошибка на одном сервере не прерывает обновление остальных и записывается в его отчет
+func (e *Engine) ApplyEach(ctx context.Context, servers []models.Server) []*Drift {
+	return e.fanOut(ctx, servers, e.Apply)
+}
+
+// ClearEach удаляет управляемые блоки с указанных серверов параллельно.
+// Ошибка на одном сервере не прерывает обработку остальных и записывается в его отчет
+func (e *Engine) ClearEach(ctx context.Context, servers []models.Server) []*Drift {
+	return e.fanOut(ctx, servers, e.Clear)
+}
+
+// fanOut выполняет операцию для каждого сервера, одновременно не более чем для FanOut.Workers
+// серверов. Все изменения сервера вносятся за одно подключение. Отчеты возвращаются в порядке
+// серверов; если операция завершилась ошибкой или не уложилась в FanOut.Timeout,
+// ошибка записывается в отчет сервера
+func (e *Engine) fanOut(ctx context.Context, servers []models.Server, op func(context.Context, models.Server) (*Drift, error)) []*Drift {
+	reports := make([]*Drift, len(servers))
+	slots := make(chan struct{}, max(e.FanOut.Workers, 1))
+
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			reports[i] = e.runOne(ctx, server, op)
+		}()
+	}
+	wg.Wait()
+
+	return reports
+}
+
+// runOne выполняет операцию для сервера с ограничением времени. По истечении времени
+// или при отмене ctx подключение к серверу прерывается, и runOne дожидается завершения
+// операции, поэтому изменения привязок успевают откатиться до возврата отчета
+func (e *Engine) runOne(ctx context.Context, server models.Server, op func(context.Context, models.Server) (*Drift, error)) *Drift {
+	if e.FanOut.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, e.FanOut.Timeout, fmt.Errorf("превышено время ожидания сервера (%s)", e.FanOut.Timeout))
+		defer cancel()
+	}
+
+	drift, err := op(ctx, server)
+	if err != nil {
+		return failed(server, err)
+	}
+	return drift
+}
+
+// failed возвращает отчет о сервере, операция на котором завершилась ошибкой
+func failed(server models.Server, err error) *Drift {
+	return &Drift{ServerID: server.ID, Server: address(server), Error: err.Error(), err: err}
+}
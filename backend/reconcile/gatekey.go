@@ -0,0 +1,314 @@
+package reconcile
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"ssh-gate/jobs"
+	"ssh-gate/models"
+	"ssh-gate/ssh"
+)
+
+// gateKeyComment комментарий ключа шлюза в authorized_keys серверов
+const gateKeyComment = "ssh-gate"
+
+// GateKeyJobTarget ключ очереди ротации ключа шлюза: ротации выполняются по очереди
+const GateKeyJobTarget = "gate-key"
+
+// RotateGateKeyJob параметры задачи ротации ключа шлюза
+type RotateGateKeyJob struct {
+	GateKeyID int64 `json:"gate_key_id"`
+}
+
+// GateKeyRotation итог ротации ключа шлюза
+type GateKeyRotation struct {
+	GateKeyID   int64    `json:"gate_key_id"`
+	Fingerprint string   `json:"fingerprint"`
+	Rotated     []string `json:"rotated"`          // Серверы, переведенные на новый ключ
+	Failed      []string `json:"failed,omitempty"` // Серверы, на которых ключ заменить не удалось
+	Retired     int      `json:"retired"`          // Прежние ключи, выведенные из обращения
+}
+
+// EnsureGateKey возвращает активный ключ шлюза, создавая его при первом запуске
+func (e *Engine) EnsureGateKey() (*models.GateKey, error) {
+	key, err := models.GetActiveGateKey(e.DB)
+	if errors.Is(err, sql.ErrNoRows) {
+		return e.NewGateKey()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// NewGateKey создает новую пару ключей Ed25519 шлюза и делает ее активной. Приватный ключ
+// хранится в зашифрованном виде. Прежний ключ остается на серверах до завершения ротации
+func (e *Engine) NewGateKey() (*models.GateKey, error) {
+	privateKey, publicKey, err := ssh.GenerateKey(gateKeyComment)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := ssh.ParseAuthorizedKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := e.Secrets.Encrypt(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка шифрования ключа шлюза: %w", err)
+	}
+
+	id, err := models.AddGateKey(e.DB, models.GateKey{PublicKey: publicKey, Fingerprint: parsed.Fingerprint(), PrivateKey: encrypted})
+	if err != nil {
+		return nil, err
+	}
+
+	return models.GetGateKeyByID(e.DB, id)
+}
+
+// Enroll переводит сервер на вход по ключу шлюза. Шлюз подключается по паролю password
+// (или по сохраненным учетным данным сервера, если пароль пустой), устанавливает свой
+// публичный ключ, проверяет вход по нему и только после этого переводит server на способ gate,
+// забывая прежние учетные данные. Ключ хоста, закрепленный при первом подключении,
+// записывается в server.HostKey. Сохранить сервер в базе данных должен вызывающий
+func (e *Engine) Enroll(ctx context.Context, server *models.Server, password string) error {
+	key, err := models.GetActiveGateKey(e.DB)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("ключ шлюза еще не создан")
+	}
+	if err != nil {
+		return err
+	}
+
+	config := ssh.SSHConfig{
+		Host:     server.IP,
+		Port:     server.Port,
+		User:     server.Login,
+		Password: password,
+		HostKey:  server.HostKey,
+		Timeouts: e.Timeouts,
+	}
+	if password == "" {
+		if config, err = e.SSHConfig(*server); err != nil {
+			return err
+		}
+	}
+
+	return e.switchGateKey(ctx, config, nil, key, func(hostKey string) error {
+		server.AuthMethod = models.ServerAuthGate
+		server.GateKeyID = key.ID
+		server.Password, server.PrivateKey, server.Passphrase, server.PublicKey = "", "", "", ""
+		server.HostKey = hostKey
+		return nil
+	})
+}
+
+// rotateServer переводит сервер с прежнего ключа шлюза на ключ next. Пока оба ключа
+// установлены, сервер в базе данных переключается на новый ключ, и только затем
+// прежний ключ удаляется с сервера
+func (e *Engine) rotateServer(ctx context.Context, server models.Server, next *models.GateKey) error {
+	previous, err := models.GetGateKeyByID(e.DB, server.GateKeyID)
+	if err != nil {
+		return err
+	}
+
+	config, err := e.SSHConfig(server)
+	if err != nil {
+		return err
+	}
+
+	return e.switchGateKey(ctx, config, previous, next, func(string) error {
+		if err := models.SetServerGateKey(e.DB, server.ID, next.ID); err != nil {
+			return err
+		}
+		e.Pool.Invalidate(server.ID)
+		return nil
+	})
+}
+
+// switchGateKey подключается к серверу с config и устанавливает ключ шлюза next вне управляемого
+// блока authorized_keys. Затем по отдельному подключению с ключом next проверяет, что вход
+// по нему работает, и вызывает commit с ключом хоста сервера. После этого через новое подключение
+// удаляет прежний ключ шлюза previous (nil, если сервер переводится на ключ шлюза впервые).
+// Если проверка или commit не удались, установленный ключ удаляется с сервера
+func (e *Engine) switchGateKey(ctx context.Context, config ssh.SSHConfig, previous, next *models.GateKey, commit func(hostKey string) error) error {
+	nextKey, err := ssh.ParseAuthorizedKey(next.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	// Запоминаем ключ хоста, закрепленный при первом подключении: с ним проверяется новый ключ
+	hostKey := config.HostKey
+	pin := config.OnHostKeyPinned
+	config.OnHostKeyPinned = func(key string) error {
+		if pin != nil {
+			if err := pin(key); err != nil {
+				return err
+			}
+		}
+		hostKey = key
+		return nil
+	}
+
+	client, err := ssh.Dial(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	added := false
+	err = client.EditAuthorizedKeys(ctx, func(file *ssh.AuthorizedKeysFile) error {
+		added = file.Add(nextKey)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("ошибка установки ключа шлюза: %w", err)
+	}
+
+	verified, err := e.dialGateKey(ctx, config, hostKey, next)
+	if err == nil {
+		defer verified.Close()
+		err = commit(hostKey)
+	}
+	if err != nil {
+		if added {
+			rollback := client.EditAuthorizedKeys(ctx, func(file *ssh.AuthorizedKeysFile) error {
+				file.Remove(nextKey.Key)
+				return nil
+			})
+			if rollback != nil {
+				log.Printf("Ошибка удаления непроверенного ключа шлюза с сервера %s:%d: %v", config.Host, config.Port, rollback)
+			}
+		}
+		return err
+	}
+
+	if previous == nil || previous.PublicKey == next.PublicKey {
+		return nil
+	}
+
+	previousKey, err := ssh.ParseAuthorizedKey(previous.PublicKey)
+	if err != nil {
+		return err
+	}
+	err = verified.EditAuthorizedKeys(ctx, func(file *ssh.AuthorizedKeysFile) error {
+		file.Remove(previousKey.Key)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("новый ключ шлюза установлен, но прежний не удален с сервера: %w", err)
+	}
+
+	return nil
+}
+
+// dialGateKey подключается к серверу только с ключом шлюза key и читает управляемый блок,
+// проверяя, что вход по ключу и работа с authorized_keys доступны
+func (e *Engine) dialGateKey(ctx context.Context, config ssh.SSHConfig, hostKey string, key *models.GateKey) (*ssh.Client, error) {
+	privateKey, err := e.Secrets.Decrypt(key.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка расшифровки ключа шлюза: %w", err)
+	}
+
+	client, err := ssh.Dial(ctx, ssh.SSHConfig{
+		Host:       config.Host,
+		Port:       config.Port,
+		User:       config.User,
+		PrivateKey: privateKey,
+		HostKey:    hostKey,
+		Timeouts:   config.Timeouts,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("вход по ключу шлюза не удался: %w", err)
+	}
+
+	if _, _, err := client.ReadManagedKeys(ctx); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("вход по ключу шлюза не удался: %w", err)
+	}
+
+	return client, nil
+}
+
+// releaseGateKey удаляет ключ шлюза с сервера, который больше не управляется шлюзом
+func (e *Engine) releaseGateKey(ctx context.Context, client *ssh.Client, server models.Server) error {
+	if server.AuthMethod != models.ServerAuthGate {
+		return nil
+	}
+
+	key, err := models.GetGateKeyByID(e.DB, server.GateKeyID)
+	if err != nil {
+		return err
+	}
+	parsed, err := ssh.ParseAuthorizedKey(key.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	return client.EditAuthorizedKeys(ctx, func(file *ssh.AuthorizedKeysFile) error {
+		file.Remove(parsed.Key)
+		return nil
+	})
+}
+
+// runRotateGateKeyJob по очереди переводит серверы, входящие по ключу шлюза, на новый ключ.
+// Серверы, на которых ключ заменить не удалось, остаются на прежнем ключе и обрабатываются
+// при повторе задачи. Прежние ключи, больше не установленные ни на одном сервере, выводятся
+// из обращения
+func (e *Engine) runRotateGateKeyJob(ctx context.Context, job *models.Job, logf func(string, ...any)) (any, error) {
+	var params RotateGateKeyJob
+	if err := json.Unmarshal(job.Payload, &params); err != nil {
+		return nil, jobs.Permanent(fmt.Errorf("ошибка разбора параметров задачи: %w", err))
+	}
+
+	key, err := models.GetGateKeyByID(e.DB, params.GateKeyID)
+	if err != nil {
+		return nil, jobs.Permanent(err)
+	}
+	if key.Status != models.GateKeyActive {
+		return nil, jobs.Permanent(fmt.Errorf("ключ шлюза с ID %d заменен более новым, серверы переведет его ротация", key.ID))
+	}
+
+	servers, err := models.GetGateServers(e.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	rotation := &GateKeyRotation{GateKeyID: key.ID, Fingerprint: key.Fingerprint, Rotated: []string{}}
+	for _, server := range servers {
+		if server.GateKeyID == key.ID {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return rotation, err
+		}
+
+		logf("Замена ключа шлюза на сервере %s", address(server))
+		if err := e.rotateServer(ctx, server, key); err != nil {
+			logf("Сервер %s: %v", address(server), err)
+			rotation.Failed = append(rotation.Failed, address(server))
+			continue
+		}
+		rotation.Rotated = append(rotation.Rotated, address(server))
+	}
+
+	if rotation.Retired, err = models.RetireUnusedGateKeys(e.DB); err != nil {
+		return rotation, err
+	}
+	if rotation.Retired > 0 {
+		logf("Выведено из обращения прежних ключей шлюза: %d", rotation.Retired)
+	}
+
+	if len(rotation.Failed) > 0 {
+		return rotation, fmt.Errorf("не удалось заменить ключ шлюза на серверах: %s", strings.Join(rotation.Failed, ", "))
+	}
+	logf("Ключ шлюза %s установлен на всех серверах", key.Fingerprint)
+	return rotation, nil
+}
@@ -0,0 +1,63 @@
+package reconcile
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"ssh-gate/models"
+)
+
+// Grant выдает пользователю доступ к серверу или изменяет срок уже выданного доступа
+// и приводит управляемый блок сервера в соответствие с базой данных. Пустой срок означает
+// бессрочный доступ. Если сервер обновить не удалось, привязка возвращается в прежнее состояние
+func (e *Engine) Grant(ctx context.Context, server models.Server, userID int64, expiresAt *time.Time) (*Drift, error) {
+	previous, err := models.GetGrant(e.DB, userID, server.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if previous == nil {
+		err = models.AssignServerToUser(e.DB, userID, server.ID, expiresAt)
+	} else {
+		err = models.SetGrantExpiry(e.DB, userID, server.ID, expiresAt)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	drift, err := e.Apply(ctx, server)
+	if err != nil {
+		if previous == nil {
+			_ = models.RemoveServerFromUser(e.DB, userID, server.ID)
+		} else {
+			_ = models.SetGrantExpiry(e.DB, userID, server.ID, previous.ExpiresAt)
+		}
+		return nil, err
+	}
+
+	return drift, nil
+}
+
+// Revoke отзывает доступ пользователя к серверу и приводит управляемый блок сервера
+// в соответствие с базой данных. Если сервер обновить не удалось, привязка восстанавливается
+// вместе со сроком доступа
+func (e *Engine) Revoke(ctx context.Context, server models.Server, userID int64) (*Drift, error) {
+	previous, err := models.GetGrant(e.DB, userID, server.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := models.RemoveServerFromUser(e.DB, userID, server.ID); err != nil {
+		return nil, err
+	}
+
+	drift, err := e.Apply(ctx, server)
+	if err != nil {
+		_ = models.AssignServerToUser(e.DB, userID, server.ID, previous.ExpiresAt)
+		return nil, err
+	}
+
+	return drift, nil
+}
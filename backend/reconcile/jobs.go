@@ -0,0 +1,196 @@
+package reconcile
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"ssh-gate/jobs"
+	"ssh-gate/models"
+	"ssh-gate/ssh"
+)
+
+// Виды задач очереди, которые выполняет движок сверки
+const (
+	JobGrant         = "access.grant"    // Выдача доступа пользователю к серверу
+	JobRevoke        = "access.revoke"   // Отзыв доступа пользователя к серверу
+	JobApplyServer   = "server.apply"    // Приведение сервера в соответствие с базой данных
+	JobDeleteServer  = "server.delete"   // Удаление сервера с отзывом всех ключей
+	JobRotateGateKey = "gate_key.rotate" // Ротация ключа шлюза на всех серверах
+)
+
+// GrantJob параметры задачи выдачи доступа. ExpiresAt задает срок временного доступа
+type GrantJob struct {
+	UserID    int64      `json:"user_id"`
+	ServerID  int64      `json:"server_id"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// RevokeJob параметры задачи отзыва доступа
+type RevokeJob struct {
+	UserID   int64 `json:"user_id"`
+	ServerID int64 `json:"server_id"`
+}
+
+// ApplyServerJob параметры задачи сверки сервера
+type ApplyServerJob struct {
+	ServerID int64 `json:"server_id"`
+}
+
+// DeleteServerJob параметры задачи удаления сервера
+type DeleteServerJob struct {
+	ServerID int64 `json:"server_id"`
+}
+
+// JobTarget возвращает ключ очереди сервера: задачи одного сервера выполняются по очереди,
+// чтобы выдача и отзыв доступа применялись в том порядке, в котором их запросили
+func JobTarget(serverID int64) string {
+	return "server:" + strconv.FormatInt(serverID, 10)
+}
+
+// RegisterJobs регистрирует в очереди обработчики задач движка сверки
+func (e *Engine) RegisterJobs(queue *jobs.Queue) {
+	queue.Register(JobGrant, e.runGrantJob)
+	queue.Register(JobRevoke, e.runRevokeJob)
+	queue.Register(JobApplyServer, e.runApplyServerJob)
+	queue.Register(JobDeleteServer, e.runDeleteServerJob)
+	queue.Register(JobRotateGateKey, e.runRotateGateKeyJob)
+}
+
+// runGrantJob выдает доступ к серверу. Если сервер обновить не удалось,
+// привязка не сохраняется до успешной попытки
+func (e *Engine) runGrantJob(ctx context.Context, job *models.Job, logf func(string, ...any)) (any, error) {
+	var params GrantJob
+	if err := json.Unmarshal(job.Payload, &params); err != nil {
+		return nil, jobs.Permanent(fmt.Errorf("ошибка разбора параметров задачи: %w", err))
+	}
+
+	if _, err := models.GetUserByID(e.DB, params.UserID); err != nil {
+		return nil, jobs.Permanent(err)
+	}
+	server, err := models.GetServerByID(e.DB, params.ServerID)
+	if err != nil {
+		return nil, jobs.Permanent(err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	logf("Выдача доступа пользователю %d к серверу %s", params.UserID, address(server))
+	drift, err := e.Grant(ctx, server, params.UserID, params.ExpiresAt)
+	if err != nil {
+		return nil, jobError(err)
+	}
+	logDrift(logf, drift)
+	return drift, nil
+}
+
+// runRevokeJob отзывает доступ к серверу. Если сервер обновить не удалось,
+// привязка восстанавливается до успешной попытки
+func (e *Engine) runRevokeJob(ctx context.Context, job *models.Job, logf func(string, ...any)) (any, error) {
+	var params RevokeJob
+	if err := json.Unmarshal(job.Payload, &params); err != nil {
+		return nil, jobs.Permanent(fmt.Errorf("ошибка разбора параметров задачи: %w", err))
+	}
+
+	server, err := models.GetServerByID(e.DB, params.ServerID)
+	if err != nil {
+		return nil, jobs.Permanent(err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	logf("Отзыв доступа пользователя %d к серверу %s", params.UserID, address(server))
+	drift, err := e.Revoke(ctx, server, params.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, jobs.Permanent(fmt.Errorf("пользователь %d не имеет доступа к серверу %d", params.UserID, params.ServerID))
+	}
+	if err != nil {
+		return nil, jobError(err)
+	}
+	logDrift(logf, drift)
+	return drift, nil
+}
+
+// runApplyServerJob приводит управляемый блок сервера в соответствие с базой данных,
+// например убирает ключи удаленного пользователя с сервера, который был недоступен
+func (e *Engine) runApplyServerJob(ctx context.Context, job *models.Job, logf func(string, ...any)) (any, error) {
+	var params ApplyServerJob
+	if err := json.Unmarshal(job.Payload, &params); err != nil {
+		return nil, jobs.Permanent(fmt.Errorf("ошибка разбора параметров задачи: %w", err))
+	}
+
+	server, err := models.GetServerByID(e.DB, params.ServerID)
+	if err != nil {
+		return nil, jobs.Permanent(err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	logf("Сверка сервера %s", address(server))
+	drift, err := e.Apply(ctx, server)
+	if err != nil {
+		return nil, jobError(err)
+	}
+	logDrift(logf, drift)
+	return drift, nil
+}
+
+// runDeleteServerJob убирает с сервера все ключи управляемого блока и после этого удаляет
+// сервер из базы данных. Пока ключи не убраны, сервер и привязки пользователей сохраняются
+func (e *Engine) runDeleteServerJob(ctx context.Context, job *models.Job, logf func(string, ...any)) (any, error) {
+	var params DeleteServerJob
+	if err := json.Unmarshal(job.Payload, &params); err != nil {
+		return nil, jobs.Permanent(fmt.Errorf("ошибка разбора параметров задачи: %w", err))
+	}
+
+	server, err := models.GetServerByID(e.DB, params.ServerID)
+	if err != nil {
+		return nil, jobs.Permanent(err)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	logf("Удаление ключей с сервера %s", address(server))
+	drift, err := e.Clear(ctx, server)
+	if err != nil {
+		return nil, jobError(err)
+	}
+	logDrift(logf, drift)
+
+	if err := models.RemoveAllUsersFromServer(e.DB, server.ID); err != nil {
+		return nil, err
+	}
+	if err := models.DeleteServer(e.DB, server.ID); err != nil {
+		return nil, err
+	}
+	e.Pool.Invalidate(server.ID)
+	logf("Сервер %s удален", address(server))
+
+	return drift, nil
+}
+
+// jobError помечает как окончательные ошибки, которые не исправятся при повторе:
+// несовпадение ключа хоста требует проверки и закрепления ключа оператором
+func jobError(err error) error {
+	var mismatch *ssh.HostKeyMismatchError
+	if errors.As(err, &mismatch) {
+		return jobs.Permanent(err)
+	}
+	return err
+}
+
+// logDrift записывает в журнал задачи изменения, внесенные на сервер
+func logDrift(logf func(string, ...any), drift *Drift) {
+	if drift == nil {
+		return
+	}
+	logf("Сервер %s: добавлено ключей %d, удалено %d, заменено устаревших %d", drift.Server, len(drift.Missing), len(drift.Extra), len(drift.Stale))
+}
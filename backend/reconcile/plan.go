@@ -0,0 +1,359 @@
+package reconcile
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"ssh-gate/models"
+	"ssh-gate/ssh"
+)
+
+// PlanTTL время, в течение которого подготовленный план можно применить
+const PlanTTL = 24 * time.Hour
+
+// ServerPlan описывает ожидаемые изменения authorized_keys на сервере.
+// Reachable показывает, удалось ли подключиться к серверу при подготовке плана.
+// UnpinnedHostKey - отпечаток ключа хоста, который предъявил сервер без закрепленного ключа:
+// при подготовке плана ключ не закрепляется, это произойдет при применении
+type ServerPlan struct {
+	ServerID        int64       `json:"server_id"`
+	Server          string      `json:"server"`
+	Add             []KeyChange `json:"add"`
+	Remove          []KeyChange `json:"remove"`
+	Reachable       bool        `json:"reachable"`
+	UnpinnedHostKey string      `json:"unpinned_host_key,omitempty"`
+	Error           string      `json:"error,omitempty"`
+}
+
+// ValidateChanges проверяет изменения плана: действия, существование пользователей
+// и серверов, наличие активных ключей у пользователей, которым выдается доступ
+func (e *Engine) ValidateChanges(changes []models.PlanChange) error {
+	if len(changes) == 0 {
+		return fmt.Errorf("план не содержит изменений")
+	}
+
+	for _, change := range changes {
+		if _, err := models.GetServerByID(e.DB, change.ServerID); err != nil {
+			return err
+		}
+
+		if change.ExpiresAt != nil {
+			if change.Action != models.PlanActionGrant {
+				return fmt.Errorf("срок действия задается только при выдаче доступа")
+			}
+			if !change.ExpiresAt.After(time.Now()) {
+				return fmt.Errorf("срок действия доступа должен быть в будущем")
+			}
+		}
+
+		switch change.Action {
+		case models.PlanActionGrant, models.PlanActionRevoke:
+			user, err := models.GetUserByID(e.DB, change.UserID)
+			if err != nil {
+				return err
+			}
+			if change.Action == models.PlanActionGrant {
+				keys, err := models.GetActiveUserKeys(e.DB, user.ID)
+				if err != nil {
+					return err
+				}
+				if len(keys) == 0 {
+					return fmt.Errorf("у пользователя %s нет активных ключей", user.Username)
+				}
+			}
+		case models.PlanActionReconcile:
+		default:
+			return fmt.Errorf("неизвестное действие плана: %s", change.Action)
+		}
+	}
+
+	return nil
+}
+
+// Plan подготавливает и сохраняет план изменений доступа. Серверы и таблица user_servers
+// не изменяются: с каждого сервера только читается управляемый блок authorized_keys
+func (e *Engine) Plan(ctx context.Context, adminID int64, changes []models.PlanChange) (*models.Plan, error) {
+	previews := make([]*ServerPlan, 0)
+	for _, serverID := range planServers(changes) {
+		server, err := models.GetServerByID(e.DB, serverID)
+		if err != nil {
+			return nil, err
+		}
+
+		preview, err := e.preview(ctx, server, changes)
+		if err != nil {
+			return nil, err
+		}
+		previews = append(previews, preview)
+	}
+
+	servers, err := json.Marshal(previews)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка сериализации плана: %w", err)
+	}
+
+	id, err := models.AddPlan(e.DB, models.Plan{AdminID: adminID, Changes: changes, Servers: servers})
+	if err != nil {
+		return nil, err
+	}
+
+	return models.GetPlanByID(e.DB, id)
+}
+
+// preview вычисляет изменения управляемого блока сервера, которые внесет план
+func (e *Engine) preview(ctx context.Context, server models.Server, changes []models.PlanChange) (*ServerPlan, error) {
+	users, err := e.plannedUsers(server.ID, changes)
+	if err != nil {
+		return nil, err
+	}
+	desired, usernames, err := e.managedKeys(users)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &ServerPlan{
+		ServerID: server.ID,
+		Server:   address(server),
+		Add:      []KeyChange{},
+		Remove:   []KeyChange{},
+	}
+
+	var actual []ssh.ManagedKey
+	preview.UnpinnedHostKey, err = e.withReadOnlyClient(ctx, server, func(client *ssh.Client) (err error) {
+		actual, _, err = client.ReadManagedKeys(ctx)
+		return err
+	})
+	if err != nil {
+		preview.Error = err.Error()
+		return preview, nil
+	}
+	preview.Reachable = true
+
+	drift := compare(server, desired, actual, usernames)
+	e.annotate(drift)
+	preview.Add = drift.Missing
+	preview.Remove = append(drift.Extra, drift.Stale...)
+
+	return preview, nil
+}
+
+// withReadOnlyClient выполняет операцию чтения, не изменяя базу данных. Если ключ хоста сервера
+// еще не закреплен, предъявленный ключ принимается без сохранения, а его отпечаток возвращается.
+// Такое подключение не попадает в пул: его ключ хоста не закреплен
+func (e *Engine) withReadOnlyClient(ctx context.Context, server models.Server, op func(client *ssh.Client) error) (string, error) {
+	if server.HostKey != "" {
+		return "", e.withClient(ctx, server, op)
+	}
+
+	config, err := e.SSHConfig(server)
+	if err != nil {
+		return "", err
+	}
+
+	var fingerprint string
+	config.OnHostKeyPinned = func(hostKey string) (err error) {
+		fingerprint, err = ssh.HostKeyFingerprint(hostKey)
+		return err
+	}
+
+	client, err := ssh.Dial(ctx, config)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	return fingerprint, op(client)
+}
+
+// plannedUsers возвращает пользователей, которые будут иметь доступ к серверу после применения плана
+func (e *Engine) plannedUsers(serverID int64, changes []models.PlanChange) ([]models.User, error) {
+	current, err := models.GetServerUsers(e.DB, serverID)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make(map[int64]models.User, len(current))
+	order := make([]int64, 0, len(current))
+	for _, user := range current {
+		users[user.ID] = user
+		order = append(order, user.ID)
+	}
+
+	for _, change := range changes {
+		if change.ServerID != serverID {
+			continue
+		}
+
+		switch change.Action {
+		case models.PlanActionGrant:
+			if _, ok := users[change.UserID]; ok {
+				continue
+			}
+			user, err := models.GetUserByID(e.DB, change.UserID)
+			if err != nil {
+				return nil, err
+			}
+			users[user.ID] = *user
+			order = append(order, user.ID)
+		case models.PlanActionRevoke:
+			// Доступ, унаследованный от групп пользователя, отзыв прямого доступа не затрагивает
+			inherited, err := models.HasGroupAccess(e.DB, change.UserID, serverID)
+			if err != nil {
+				return nil, err
+			}
+			if !inherited {
+				delete(users, change.UserID)
+			}
+		}
+	}
+
+	result := make([]models.User, 0, len(users))
+	for _, id := range order {
+		if user, ok := users[id]; ok {
+			result = append(result, user)
+			delete(users, id)
+		}
+	}
+
+	return result, nil
+}
+
+// ApplyPlan применяет план: изменяет привязки в базе данных и приводит в соответствие с ними
+// управляемые блоки серверов. Изменения проверяются заново, так как с подготовки плана могли
+// истечь сроки доступа или измениться пользователи и серверы. Если сервер обновить не удалось,
+// изменения его привязок отменяются
+func (e *Engine) ApplyPlan(ctx context.Context, plan *models.Plan) (*models.Plan, error) {
+	if err := e.ValidateChanges(plan.Changes); err != nil {
+		return nil, fmt.Errorf("план больше не применим, подготовьте его заново: %w", err)
+	}
+
+	if err := models.StartPlan(e.DB, plan.ID); err != nil {
+		return nil, err
+	}
+
+	// Серверы обновляются параллельно, изменения привязок каждого сервера откатываются независимо
+	serverIDs := planServers(plan.Changes)
+	reports := make([]*Drift, len(serverIDs))
+	var servers []models.Server
+	var positions []int
+	for i, serverID := range serverIDs {
+		server, err := models.GetServerByID(e.DB, serverID)
+		if err != nil {
+			reports[i] = &Drift{ServerID: serverID, Error: err.Error()}
+			continue
+		}
+		servers = append(servers, server)
+		positions = append(positions, i)
+	}
+	applied := e.fanOut(ctx, servers, func(ctx context.Context, server models.Server) (*Drift, error) {
+		return e.applyServer(ctx, server, plan.Changes)
+	})
+	for i, drift := range applied {
+		reports[positions[i]] = drift
+	}
+
+	status := models.PlanStatusApplied
+	for _, drift := range reports {
+		if drift.Error != "" {
+			status = models.PlanStatusFailed
+		}
+	}
+
+	result, err := json.Marshal(reports)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка сериализации итога плана: %w", err)
+	}
+
+	if err := models.FinishPlan(e.DB, plan.ID, status, result); err != nil {
+		return nil, err
+	}
+
+	return models.GetPlanByID(e.DB, plan.ID)
+}
+
+// applyServer применяет изменения плана, относящиеся к серверу
+func (e *Engine) applyServer(ctx context.Context, server models.Server, changes []models.PlanChange) (*Drift, error) {
+	serverID := server.ID
+
+	// Изменяем только отличающиеся привязки, чтобы при ошибке откатить ровно их.
+	// Для каждой запоминается прежняя привязка (nil, если ее не было)
+	type appliedChange struct {
+		change   models.PlanChange
+		previous *models.Grant
+	}
+	var applied []appliedChange
+	rollback := func() {
+		for i := len(applied) - 1; i >= 0; i-- {
+			change, previous := applied[i].change, applied[i].previous
+			switch {
+			case previous == nil:
+				_ = models.RemoveServerFromUser(e.DB, change.UserID, change.ServerID)
+			case change.Action == models.PlanActionGrant:
+				_ = models.SetGrantExpiry(e.DB, change.UserID, change.ServerID, previous.ExpiresAt)
+			default:
+				_ = models.AssignServerToUser(e.DB, change.UserID, change.ServerID, previous.ExpiresAt)
+			}
+		}
+	}
+
+	for _, change := range changes {
+		if change.ServerID != serverID || change.Action == models.PlanActionReconcile {
+			continue
+		}
+
+		previous, err := models.GetGrant(e.DB, change.UserID, change.ServerID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			rollback()
+			return nil, err
+		}
+
+		switch {
+		case change.Action == models.PlanActionGrant && previous == nil:
+			err = models.AssignServerToUser(e.DB, change.UserID, change.ServerID, change.ExpiresAt)
+		case change.Action == models.PlanActionGrant && !sameExpiry(previous.ExpiresAt, change.ExpiresAt):
+			err = models.SetGrantExpiry(e.DB, change.UserID, change.ServerID, change.ExpiresAt)
+		case change.Action == models.PlanActionRevoke && previous != nil:
+			err = models.RemoveServerFromUser(e.DB, change.UserID, change.ServerID)
+		default:
+			continue
+		}
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		applied = append(applied, appliedChange{change: change, previous: previous})
+	}
+
+	drift, err := e.Apply(ctx, server)
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+
+	return drift, nil
+}
+
+// planServers возвращает ID серверов плана в порядке первого упоминания
+func planServers(changes []models.PlanChange) []int64 {
+	seen := make(map[int64]bool)
+	var servers []int64
+	for _, change := range changes {
+		if !seen[change.ServerID] {
+			seen[change.ServerID] = true
+			servers = append(servers, change.ServerID)
+		}
+	}
+	return servers
+}
+
+// sameExpiry сравнивает сроки действия доступа. Пустой срок означает бессрочный доступ
+func sameExpiry(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -0,0 +1,471 @@
+package reconcile
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"ssh-gate/models"
+	"ssh-gate/secrets"
+	"ssh-gate/ssh"
+)
+
+// IntervalEnv переменная окружения с интервалом фоновой сверки (например, 15m). Пустое значение отключает сверку
+const IntervalEnv = "SSH_GATE_RECONCILE_INTERVAL"
+
+// Engine сверяет управляемые блоки authorized_keys на серверах с привязками в базе данных
+type Engine struct {
+	DB       *sql.DB
+	Secrets  *secrets.Keeper
+	FanOut   FanOutConfig
+	Timeouts ssh.Timeouts
+	Pool     *ssh.Pool
+}
+
+// KeyChange описывает строку управляемого блока, которая отличается от ожидаемой
+type KeyChange struct {
+	UserID      int64  `json:"user_id"`
+	Username    string `json:"username,omitempty"`
+	Line        string `json:"line"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// Drift описывает расхождение между базой данных и сервером.
+// Missing - ключи, которых нет на сервере, Extra - ключи пользователей без доступа,
+// Stale - устаревшие ключи пользователей, у которых доступ есть. Unmanaged - ключи пользователей
+// шлюза, записанные на сервере вне блока, например добавленные вручную до появления блока:
+// шлюз эти строки не изменяет, поэтому после отзыва доступа ключ продолжит работать,
+// пока строку не удалят вручную
+type Drift struct {
+	ServerID  int64       `json:"server_id"`
+	Server    string      `json:"server"`
+	Missing   []KeyChange `json:"missing"`
+	Extra     []KeyChange `json:"extra"`
+	Stale     []KeyChange `json:"stale"`
+	Unmanaged []KeyChange `json:"unmanaged"`
+	InSync    bool        `json:"in_sync"`
+	Applied   bool        `json:"applied"`
+	Error     string      `json:"error,omitempty"`
+
+	err error
+}
+
+// Err возвращает ошибку, с которой завершилась операция на сервере, или nil
+func (d *Drift) Err() error {
+	if d.err != nil {
+		return d.err
+	}
+	if d.Error != "" {
+		return errors.New(d.Error)
+	}
+	return nil
+}
+
+// New создает движок сверки
+func New(db *sql.DB, keeper *secrets.Keeper) *Engine {
+	return &Engine{DB: db, Secrets: keeper, FanOut: DefaultFanOut, Timeouts: ssh.DefaultTimeouts, Pool: ssh.NewPool(ssh.DefaultPoolConfig)}
+}
+
+// LoadInterval читает интервал фоновой сверки из окружения. Нулевой интервал означает, что сверка отключена
+func LoadInterval() (time.Duration, error) {
+	value := os.Getenv(IntervalEnv)
+	if value == "" {
+		return 0, nil
+	}
+
+	interval, err := time.ParseDuration(value)
+	if err != nil || interval < 0 {
+		return 0, fmt.Errorf("неверное значение %s: %s", IntervalEnv, value)
+	}
+
+	return interval, nil
+}
+
+// SSHConfig создает конфигурацию SSH-подключения к серверу с ограничениями времени движка
+func (e *Engine) SSHConfig(server models.Server) (ssh.SSHConfig, error) {
+	config, err := SSHConfig(e.DB, e.Secrets, server)
+	if err != nil {
+		return ssh.SSHConfig{}, err
+	}
+
+	config.Timeouts = e.Timeouts
+	return config, nil
+}
+
+// withClient выполняет операцию с подключением к серверу из пула и возвращает подключение в пул
+func (e *Engine) withClient(ctx context.Context, server models.Server, op func(client *ssh.Client) error) error {
+	config, err := e.SSHConfig(server)
+	if err != nil {
+		return err
+	}
+
+	client, err := e.Pool.Get(ctx, server.ID, config)
+	if err != nil {
+		return err
+	}
+
+	err = op(client)
+	e.Pool.Put(server.ID, client, err)
+	return err
+}
+
+// Desired возвращает ключи, которые должны быть в управляемом блоке сервера, и имена их владельцев.
+// Пользователи без корректного ключа пропускаются
+func (e *Engine) Desired(serverID int64) ([]ssh.ManagedKey, map[int64]string, error) {
+	users, err := models.GetServerUsers(e.DB, serverID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return e.managedKeys(users)
+}
+
+// managedKeys формирует содержимое управляемого блока для пользователей с доступом к серверу:
+// все активные ключи каждого пользователя. Некорректные ключи пропускаются
+func (e *Engine) managedKeys(users []models.User) ([]ssh.ManagedKey, map[int64]string, error) {
+	var keys []ssh.ManagedKey
+	usernames := make(map[int64]string, len(users))
+	for _, user := range users {
+		usernames[user.ID] = user.Username
+
+		userKeys, err := models.GetActiveUserKeys(e.DB, user.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, userKey := range userKeys {
+			key, err := ssh.ParseAuthorizedKey(userKey.PublicKey)
+			if err != nil {
+				continue
+			}
+			keys = append(keys, ssh.ManagedKey{UserID: user.ID, Key: key})
+		}
+	}
+
+	return keys, usernames, nil
+}
+
+// ApplyUser приводит в соответствие с базой данных все серверы, к которым у пользователя есть доступ.
+// Ошибки подключения записываются в отчет сервера. Если все серверы обновлены,
+// удаление замененных ключей пользователя считается подтвержденным
+func (e *Engine) ApplyUser(ctx context.Context, userID int64) ([]*Drift, error) {
+	servers, err := models.GetUserServers(e.DB, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := e.ApplyEach(ctx, servers)
+	confirmed := true
+	for _, drift := range reports {
+		if drift.Error != "" {
+			confirmed = false
+		}
+	}
+
+	if confirmed {
+		if err := models.ConfirmRotatedKeysRemoved(e.DB, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	return reports, nil
+}
+
+// ApplyServers приводит в соответствие с базой данных указанные серверы.
+// Ошибки подключения записываются в отчет сервера
+func (e *Engine) ApplyServers(ctx context.Context, serverIDs []int64) ([]*Drift, error) {
+	servers := make([]models.Server, 0, len(serverIDs))
+	for _, serverID := range serverIDs {
+		server, err := models.GetServerByID(e.DB, serverID)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+
+	return e.ApplyEach(ctx, servers), nil
+}
+
+// Check читает управляемый блок сервера и сравнивает его с базой данных, не изменяя сервер
+func (e *Engine) Check(ctx context.Context, server models.Server) (*Drift, error) {
+	desired, usernames, err := e.Desired(server.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var actual []ssh.ManagedKey
+	var outside []*ssh.AuthorizedKey
+	err = e.withClient(ctx, server, func(client *ssh.Client) (err error) {
+		actual, outside, err = client.ReadManagedKeys(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	drift := compare(server, desired, actual, usernames)
+	e.reportUnmanaged(drift, outside, usernames)
+	e.annotate(drift)
+	return drift, nil
+}
+
+// Apply приводит управляемый блок сервера в соответствие с базой данных
+// и возвращает расхождение, которое было до изменения
+func (e *Engine) Apply(ctx context.Context, server models.Server) (*Drift, error) {
+	desired, usernames, err := e.Desired(server.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.push(ctx, server, desired, usernames)
+}
+
+// Clear удаляет с сервера все ключи управляемого блока, а с сервера, на который шлюз входит
+// по своему ключу, и ключ шлюза: после удаления сервера шлюз больше не может на него войти
+func (e *Engine) Clear(ctx context.Context, server models.Server) (*Drift, error) {
+	drift, err := e.push(ctx, server, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = e.withClient(ctx, server, func(client *ssh.Client) error {
+		return e.releaseGateKey(ctx, client, server)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ошибка удаления ключа шлюза с сервера: %w", err)
+	}
+
+	return drift, nil
+}
+
+// push записывает в управляемый блок сервера указанные ключи
+func (e *Engine) push(ctx context.Context, server models.Server, desired []ssh.ManagedKey, usernames map[int64]string) (*Drift, error) {
+	var previous []ssh.ManagedKey
+	var outside []*ssh.AuthorizedKey
+	err := e.withClient(ctx, server, func(client *ssh.Client) (err error) {
+		previous, outside, err = client.SyncManagedKeys(ctx, desired)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	drift := compare(server, desired, previous, usernames)
+	drift.Applied = !drift.InSync
+	e.reportUnmanaged(drift, outside, usernames)
+	e.annotate(drift)
+	return drift, nil
+}
+
+// reportUnmanaged добавляет в отчет ключи пользователей шлюза, записанные на сервере вне
+// управляемого блока. Владелец ключа определяется по отпечатку среди ключей всех пользователей,
+// поэтому в отчет попадают и ключи пользователей, у которых доступа к серверу уже нет
+func (e *Engine) reportUnmanaged(drift *Drift, outside []*ssh.AuthorizedKey, usernames map[int64]string) {
+	owners := make(map[string]int64, len(outside))
+	for _, key := range outside {
+		fingerprint := key.Fingerprint()
+		if _, ok := owners[fingerprint]; ok {
+			continue
+		}
+		if userKey, err := models.GetUserKeyByFingerprint(e.DB, fingerprint); err == nil {
+			owners[fingerprint] = userKey.UserID
+		}
+	}
+
+	addUnmanaged(drift, outside, owners, usernames)
+}
+
+// addUnmanaged добавляет в отчет ключи вне управляемого блока, владельцы которых найдены в owners
+// по отпечатку ключа. Содержимое блока при этом не учитывается
+func addUnmanaged(drift *Drift, outside []*ssh.AuthorizedKey, owners map[string]int64, usernames map[int64]string) {
+	for _, key := range outside {
+		userID, ok := owners[key.Fingerprint()]
+		if !ok {
+			continue
+		}
+		drift.Unmanaged = append(drift.Unmanaged, keyChange(ssh.ManagedKey{UserID: userID, Key: key}, usernames))
+	}
+}
+
+// annotate дополняет отчет именами пользователей, у которых больше нет доступа к серверу
+func (e *Engine) annotate(drift *Drift) {
+	for _, changes := range [][]KeyChange{drift.Extra, drift.Unmanaged} {
+		for i, change := range changes {
+			if change.Username != "" || change.UserID == 0 {
+				continue
+			}
+			if user, err := models.GetUserByID(e.DB, change.UserID); err == nil {
+				changes[i].Username = user.Username
+			}
+		}
+	}
+}
+
+// CheckAll проверяет расхождения на всех серверах. Ошибки подключения записываются в отчет сервера
+func (e *Engine) CheckAll(ctx context.Context) ([]*Drift, error) {
+	return e.each(ctx, e.Check)
+}
+
+// ApplyAll устраняет расхождения на всех серверах. Ошибки подключения записываются в отчет сервера.
+// После сверки подтверждается удаление замененных ключей пользователей, все серверы которых обновлены
+func (e *Engine) ApplyAll(ctx context.Context) ([]*Drift, error) {
+	reports, err := e.each(ctx, e.Apply)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.confirmRotations(reports); err != nil {
+		log.Printf("Ошибка подтверждения ротации ключей: %v", err)
+	}
+
+	return reports, nil
+}
+
+// confirmRotations подтверждает удаление замененных ключей пользователей,
+// если все серверы пользователя в отчетах сверки всех серверов обновлены без ошибок
+func (e *Engine) confirmRotations(reports []*Drift) error {
+	failed := make(map[int64]bool)
+	for _, drift := range reports {
+		if drift.Error != "" {
+			failed[drift.ServerID] = true
+		}
+	}
+
+	userIDs, err := models.GetUsersWithPendingRotation(e.DB)
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		servers, err := models.GetUserServers(e.DB, userID)
+		if err != nil {
+			return err
+		}
+
+		confirmed := true
+		for _, server := range servers {
+			if failed[server.ID] {
+				confirmed = false
+				break
+			}
+		}
+		if !confirmed {
+			continue
+		}
+
+		if err := models.ConfirmRotatedKeysRemoved(e.DB, userID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// each выполняет операцию сверки для всех серверов параллельно
+func (e *Engine) each(ctx context.Context, op func(context.Context, models.Server) (*Drift, error)) ([]*Drift, error) {
+	servers, err := models.GetAllServers(e.DB)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.fanOut(ctx, servers, op), nil
+}
+
+// Run периодически устраняет расхождения на всех серверах, пока не будет отменен контекст
+func (e *Engine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reports, err := e.ApplyAll(ctx)
+		if err != nil {
+			log.Printf("Ошибка сверки серверов: %v", err)
+			continue
+		}
+
+		for _, drift := range reports {
+			switch {
+			case drift.Error != "":
+				log.Printf("Сверка сервера %s не выполнена: %s", drift.Server, drift.Error)
+			case drift.Applied:
+				log.Printf("Сверка сервера %s: добавлено %d, удалено %d, заменено %d ключей",
+					drift.Server, len(drift.Missing), len(drift.Extra), len(drift.Stale))
+				e.audit(models.AuditEvent{Action: models.AuditReconcile, ServerID: drift.ServerID, After: auditState(drift)}, nil)
+			}
+			if len(drift.Unmanaged) > 0 {
+				log.Printf("На сервере %s вне управляемого блока записано %d ключей пользователей шлюза, шлюз их не удаляет",
+					drift.Server, len(drift.Unmanaged))
+			}
+		}
+	}
+}
+
+// compare вычисляет расхождение между ожидаемым и фактическим содержимым управляемого блока.
+// usernames содержит всех пользователей с доступом к серверу, в том числе без активных ключей
+func compare(server models.Server, desired, actual []ssh.ManagedKey, usernames map[int64]string) *Drift {
+	drift := &Drift{
+		ServerID:  server.ID,
+		Server:    address(server),
+		Missing:   []KeyChange{},
+		Extra:     []KeyChange{},
+		Stale:     []KeyChange{},
+		Unmanaged: []KeyChange{},
+	}
+
+	present := make(map[string]bool, len(actual))
+	for _, managed := range actual {
+		present[lineID(managed)] = true
+	}
+
+	expected := make(map[string]bool, len(desired))
+	for _, managed := range desired {
+		expected[lineID(managed)] = true
+		if !present[lineID(managed)] {
+			drift.Missing = append(drift.Missing, keyChange(managed, usernames))
+		}
+	}
+
+	for _, managed := range actual {
+		if expected[lineID(managed)] {
+			continue
+		}
+		if _, hasAccess := usernames[managed.UserID]; hasAccess {
+			drift.Stale = append(drift.Stale, keyChange(managed, usernames))
+		} else {
+			drift.Extra = append(drift.Extra, keyChange(managed, usernames))
+		}
+	}
+
+	drift.InSync = len(drift.Missing) == 0 && len(drift.Extra) == 0 && len(drift.Stale) == 0
+	return drift
+}
+
+// lineID возвращает идентификатор строки управляемого блока: владелец и строка ключа
+func lineID(managed ssh.ManagedKey) string {
+	return fmt.Sprintf("%d %s", managed.UserID, managed.Key.String())
+}
+
+// keyChange формирует описание строки для отчета
+func keyChange(managed ssh.ManagedKey, usernames map[int64]string) KeyChange {
+	return KeyChange{
+		UserID:      managed.UserID,
+		Username:    usernames[managed.UserID],
+		Line:        managed.Key.String(),
+		Fingerprint: managed.Key.Fingerprint(),
+	}
+}
+
+// address возвращает адрес сервера для отчетов
+func address(server models.Server) string {
+	return fmt.Sprintf("%s:%d", server.IP, server.Port)
+}
@@ -0,0 +1,75 @@
+package reconcile
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"ssh-gate/models"
+	"ssh-gate/ssh"
+
+	_ "github.com/mattn/go-sqlite3"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// newTestKey создает ключ Ed25519 для строки authorized_keys
+func newTestKey(t *testing.T, comment string) *ssh.AuthorizedKey {
+	t.Helper()
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gossh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ssh.AuthorizedKey{Key: key, Comment: comment}
+}
+
+func TestReportUnmanagedRevokedUserKeyOutsideBlock(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "reconcile.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := models.CreateUserTable(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.CreateUserKeyTable(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ключ пользователя, у которого отозван доступ, остался только вне блока:
+	// так его записывала на сервер прежняя версия шлюза
+	revoked := newTestKey(t, "alice@laptop")
+	userID, err := models.AddUser(db, models.User{Username: "alice", PublicKey: revoked.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = models.AddUserKey(db, models.UserKey{UserID: userID, PublicKey: revoked.String(), Fingerprint: revoked.Fingerprint(), Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	operator := newTestKey(t, "operator")
+
+	engine := &Engine{DB: db}
+	server := models.Server{ID: 1, IP: "10.0.0.1", Port: 22}
+
+	drift := compare(server, nil, nil, map[int64]string{})
+	engine.reportUnmanaged(drift, []*ssh.AuthorizedKey{operator, revoked}, map[int64]string{})
+	engine.annotate(drift)
+
+	if !drift.InSync {
+		t.Fatalf("управляемый блок не совпадает с базой данных: %+v", drift)
+	}
+	if len(drift.Unmanaged) != 1 {
+		t.Fatalf("ключей вне блока в отчете %d, ожидался 1: %+v", len(drift.Unmanaged), drift.Unmanaged)
+	}
+	change := drift.Unmanaged[0]
+	if change.UserID != userID || change.Username != "alice" || change.Fingerprint != revoked.Fingerprint() {
+		t.Fatalf("ключ вне блока в отчете: %+v", change)
+	}
+}
@@ -0,0 +1,48 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	// AuditKeyEnv содержит ключ подписи журнала аудита (HMAC-SHA256) в кодировке base64
+	AuditKeyEnv = "SSH_GATE_AUDIT_KEY"
+	// AuditKeyFileEnv содержит путь к файлу с ключом подписи журнала аудита
+	AuditKeyFileEnv = "SSH_GATE_AUDIT_KEY_FILE"
+
+	minAuditKeySize = 32
+)
+
+// LoadAuditKey читает ключ подписи журнала аудита из окружения или из файла.
+// Подпись необязательна: если ключ не задан, возвращается nil
+func LoadAuditKey() ([]byte, error) {
+	encoded := os.Getenv(AuditKeyEnv)
+	if encoded == "" {
+		path := os.Getenv(AuditKeyFileEnv)
+		if path == "" {
+			return nil, nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка чтения файла ключа подписи журнала аудита: %w", err)
+		}
+		encoded = string(data)
+	}
+
+	return DecodeAuditKey(encoded)
+}
+
+// DecodeAuditKey декодирует ключ подписи журнала аудита из base64 и проверяет его длину
+func DecodeAuditKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка декодирования ключа подписи журнала аудита: %w", err)
+	}
+	if len(key) < minAuditKeySize {
+		return nil, fmt.Errorf("ключ подписи журнала аудита должен быть не короче %d байт, получено %d", minAuditKeySize, len(key))
+	}
+	return key, nil
+}
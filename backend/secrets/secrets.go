@@ -0,0 +1,272 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	// MasterKeyEnv содержит мастер-ключ в кодировке base64
+	MasterKeyEnv = "SSH_GATE_MASTER_KEY"
+	// MasterKeyFileEnv содержит путь к файлу с мастер-ключом
+	MasterKeyFileEnv = "SSH_GATE_MASTER_KEY_FILE"
+	// DefaultMasterKeyFile используется, если мастер-ключ не задан через окружение
+	DefaultMasterKeyFile = "master.key"
+
+	keySize = 32
+	prefix  = "enc:v1:"
+)
+
+// Keeper выполняет конвертное шифрование секретов: каждое значение шифруется
+// собственным ключом данных (AES-256-GCM), а ключ данных — мастер-ключом
+type Keeper struct {
+	master cipher.AEAD
+}
+
+// NewKeeper создает Keeper на основе 32-байтового мастер-ключа
+func NewKeeper(masterKey []byte) (*Keeper, error) {
+	if len(masterKey) != keySize {
+		return nil, fmt.Errorf("мастер-ключ должен быть длиной %d байт, получено %d", keySize, len(masterKey))
+	}
+
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Keeper{master: aead}, nil
+}
+
+// GenerateKey создает случайный 32-байтовый ключ
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("ошибка генерации ключа: %w", err)
+	}
+	return key, nil
+}
+
+// MasterKeyFile возвращает путь к файлу мастер-ключа
+func MasterKeyFile() string {
+	if path := os.Getenv(MasterKeyFileEnv); path != "" {
+		return path
+	}
+	return DefaultMasterKeyFile
+}
+
+// ReadMasterKey читает мастер-ключ из окружения или из файла, не создавая его.
+// Если ключ не задан и файла нет, возвращается ошибка os.ErrNotExist
+func ReadMasterKey() ([]byte, error) {
+	if encoded := os.Getenv(MasterKeyEnv); encoded != "" {
+		return DecodeKey(encoded)
+	}
+
+	return ReadKeyFile(MasterKeyFile())
+}
+
+// LoadMasterKey читает мастер-ключ из окружения или из файла.
+// Если ключ нигде не задан, он генерируется и сохраняется в файл
+func LoadMasterKey() ([]byte, error) {
+	key, err := ReadMasterKey()
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	path := MasterKeyFile()
+	key, err = GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := WriteKeyFile(path, key); err != nil {
+		return nil, err
+	}
+	log.Printf("Сгенерирован новый мастер-ключ: %s", path)
+
+	return key, nil
+}
+
+// DecodeKey декодирует ключ из base64
+func DecodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка декодирования мастер-ключа: %w", err)
+	}
+	return key, nil
+}
+
+// ReadKeyFile читает ключ в кодировке base64 из файла
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения файла мастер-ключа: %w", err)
+	}
+	return DecodeKey(string(data))
+}
+
+// WriteKeyFile сохраняет ключ в кодировке base64 в файл, доступный только владельцу
+func WriteKeyFile(path string, key []byte) error {
+	data := base64.StdEncoding.EncodeToString(key) + "\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		return fmt.Errorf("ошибка записи файла мастер-ключа: %w", err)
+	}
+	return nil
+}
+
+// IsEncrypted проверяет, зашифровано ли значение
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Encrypt шифрует значение. Пустая строка остается пустой
+func (k *Keeper) Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	dataKey, err := GenerateKey()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext, err := seal(data, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := seal(k.master, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + encode(wrappedKey) + ":" + encode(ciphertext), nil
+}
+
+// Decrypt расшифровывает значение, полученное через Encrypt
+func (k *Keeper) Decrypt(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	wrappedKey, ciphertext, err := split(value)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := open(k.master, wrappedKey)
+	if err != nil {
+		return "", fmt.Errorf("ошибка расшифровки ключа данных: %w", err)
+	}
+
+	data, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(data, ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("ошибка расшифровки значения: %w", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// Rewrap перешифровывает ключ данных значения мастер-ключом target,
+// не затрагивая само зашифрованное значение
+func (k *Keeper) Rewrap(value string, target *Keeper) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	wrappedKey, ciphertext, err := split(value)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := open(k.master, wrappedKey)
+	if err != nil {
+		return "", fmt.Errorf("ошибка расшифровки ключа данных: %w", err)
+	}
+
+	rewrapped, err := seal(target.master, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + encode(rewrapped) + ":" + encode(ciphertext), nil
+}
+
+// split разбирает зашифрованное значение на обернутый ключ данных и шифртекст
+func split(value string) ([]byte, []byte, error) {
+	if !IsEncrypted(value) {
+		return nil, nil, fmt.Errorf("значение не зашифровано")
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("неверный формат зашифрованного значения")
+	}
+
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("неверный формат ключа данных: %w", err)
+	}
+
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("неверный формат шифртекста: %w", err)
+	}
+
+	return wrappedKey, ciphertext, nil
+}
+
+// newAEAD создает шифр AES-256-GCM
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания шифра: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания шифра: %w", err)
+	}
+
+	return aead, nil
+}
+
+// seal шифрует данные, добавляя случайный nonce в начало результата
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("ошибка генерации nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open расшифровывает данные, полученные через seal
+func open(aead cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("слишком короткий шифртекст")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+func encode(data []byte) string {
+	return base64.RawStdEncoding.EncodeToString(data)
+}
@@ -0,0 +1,35 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadMasterKeyDoesNotGenerateKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.key")
+	t.Setenv(MasterKeyEnv, "")
+	t.Setenv(MasterKeyFileEnv, path)
+
+	if _, err := ReadMasterKey(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ошибка %v, ожидалась os.ErrNotExist", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("при чтении создан файл мастер-ключа")
+	}
+
+	// При запуске шлюза отсутствующий ключ генерируется, и затем читается тот же ключ
+	generated, err := LoadMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(generated, read) {
+		t.Fatal("прочитан другой мастер-ключ")
+	}
+}
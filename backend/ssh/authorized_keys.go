@@ -0,0 +1,291 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthorizedKey описывает ключ из строки authorized_keys вместе с опциями и комментарием
+type AuthorizedKey struct {
+	Key     ssh.PublicKey
+	Options []string
+	Comment string
+}
+
+// AuthorizedKeysLine описывает строку файла authorized_keys.
+// Для комментариев, пустых и нераспознанных строк Key равен nil
+type AuthorizedKeysLine struct {
+	Raw string
+	Key *AuthorizedKey
+}
+
+// AuthorizedKeysFile представляет файл authorized_keys. Строки вне управляемого блока
+// записываются обратно в исходном виде, включая пустые строки в конце файла и отсутствие
+// перевода строки после последней строки, поэтому неуправляемое содержимое не теряется
+type AuthorizedKeysFile struct {
+	Lines   []AuthorizedKeysLine
+	Managed []ManagedKey
+
+	// managedAt позиция управляемого блока среди Lines, -1 если блока в файле нет
+	managedAt int
+	// noFinalNewline последняя строка файла не завершена переводом строки
+	noFinalNewline bool
+}
+
+// knownOptions перечисляет опции authorized_keys, поддерживаемые OpenSSH.
+// Значение true означает, что опция требует аргумента
+var knownOptions = map[string]bool{
+	"agent-forwarding":    false,
+	"cert-authority":      false,
+	"command":             true,
+	"environment":         true,
+	"expiry-time":         true,
+	"from":                true,
+	"no-agent-forwarding": false,
+	"no-port-forwarding":  false,
+	"no-pty":              false,
+	"no-touch-required":   false,
+	"no-user-rc":          false,
+	"no-x11-forwarding":   false,
+	"permitlisten":        true,
+	"permitopen":          true,
+	"port-forwarding":     false,
+	"principals":          true,
+	"pty":                 false,
+	"restrict":            false,
+	"tunnel":              true,
+	"user-rc":             false,
+	"verify-required":     false,
+	"x11-forwarding":      false,
+}
+
+// ParseAuthorizedKey разбирает одну строку authorized_keys с ключом любого поддерживаемого типа
+// (RSA, ECDSA, Ed25519, ключи безопасности sk-* и сертификаты), опциями и комментарием
+func ParseAuthorizedKey(line string) (*AuthorizedKey, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil, fmt.Errorf("пустой публичный ключ")
+	}
+	if strings.ContainsAny(line, "\r\n") {
+		return nil, fmt.Errorf("публичный ключ должен занимать одну строку")
+	}
+	if strings.HasPrefix(line, "#") {
+		return nil, fmt.Errorf("строка является комментарием")
+	}
+
+	key, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, fmt.Errorf("неверный формат публичного ключа: %w", err)
+	}
+	if len(bytes.TrimSpace(rest)) > 0 {
+		return nil, fmt.Errorf("лишние данные после публичного ключа")
+	}
+
+	if err := ValidateOptions(options); err != nil {
+		return nil, err
+	}
+
+	return &AuthorizedKey{Key: key, Options: options, Comment: comment}, nil
+}
+
+// ValidateOptions проверяет опции строки authorized_keys
+func ValidateOptions(options []string) error {
+	for _, option := range options {
+		name, value, hasValue := strings.Cut(option, "=")
+		requiresValue, known := knownOptions[strings.ToLower(name)]
+		if !known {
+			return fmt.Errorf("неизвестная опция authorized_keys: %s", name)
+		}
+		if requiresValue != hasValue {
+			if requiresValue {
+				return fmt.Errorf("опция %s требует значения", name)
+			}
+			return fmt.Errorf("опция %s не принимает значения", name)
+		}
+		if !hasValue {
+			continue
+		}
+
+		if len(value) < 2 || !strings.HasPrefix(value, `"`) || !strings.HasSuffix(value, `"`) {
+			return fmt.Errorf("значение опции %s должно быть в кавычках", name)
+		}
+		unquoted := value[1 : len(value)-1]
+		if unquoted == "" {
+			return fmt.Errorf("пустое значение опции %s", name)
+		}
+
+		if strings.EqualFold(name, "expiry-time") {
+			if err := validateExpiryTime(unquoted); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateExpiryTime проверяет формат YYYYMMDD[HHMM[SS]][Z] опции expiry-time
+func validateExpiryTime(value string) error {
+	trimmed := strings.TrimSuffix(value, "Z")
+	layouts := map[int]string{8: "20060102", 12: "200601021504", 14: "20060102150405"}
+	layout, ok := layouts[len(trimmed)]
+	if !ok {
+		return fmt.Errorf("неверный формат expiry-time: %s", value)
+	}
+	if _, err := time.Parse(layout, trimmed); err != nil {
+		return fmt.Errorf("неверный формат expiry-time: %s", value)
+	}
+	return nil
+}
+
+// String возвращает строку для authorized_keys
+func (k *AuthorizedKey) String() string {
+	var b strings.Builder
+	if len(k.Options) > 0 {
+		b.WriteString(strings.Join(k.Options, ","))
+		b.WriteString(" ")
+	}
+	b.WriteString(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(k.Key))))
+	if k.Comment != "" {
+		b.WriteString(" ")
+		b.WriteString(k.Comment)
+	}
+	return b.String()
+}
+
+// Fingerprint возвращает SHA256-отпечаток ключа
+func (k *AuthorizedKey) Fingerprint() string {
+	return ssh.FingerprintSHA256(k.Key)
+}
+
+// SameKey проверяет, совпадает ли ключ с другим независимо от опций и комментария
+func (k *AuthorizedKey) SameKey(other ssh.PublicKey) bool {
+	return k.Key.Type() == other.Type() && bytes.Equal(k.Key.Marshal(), other.Marshal())
+}
+
+// ParseAuthorizedKeysFile разбирает содержимое файла authorized_keys.
+// Строки, которые не удалось разобрать, сохраняются как есть
+func ParseAuthorizedKeysFile(data []byte) *AuthorizedKeysFile {
+	file := &AuthorizedKeysFile{managedAt: -1}
+	if len(data) == 0 {
+		return file
+	}
+
+	raws := strings.Split(string(data), "\n")
+	if raws[len(raws)-1] == "" {
+		raws = raws[:len(raws)-1]
+	} else {
+		file.noFinalNewline = true
+	}
+	for i := 0; i < len(raws); i++ {
+		raw := raws[i]
+
+		// Управляемый блок учитывается только при наличии закрывающего маркера
+		if file.managedAt < 0 && strings.TrimSpace(raw) == managedBlockBegin {
+			if end := findManagedBlockEnd(raws, i+1); end >= 0 {
+				file.managedAt = len(file.Lines)
+				file.Managed = parseManagedBlock(raws[i+1 : end])
+				i = end
+				continue
+			}
+		}
+
+		line := AuthorizedKeysLine{Raw: raw}
+		trimmed := strings.TrimSpace(raw)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			if key, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(trimmed)); err == nil {
+				line.Key = &AuthorizedKey{Key: key, Options: options, Comment: comment}
+			}
+		}
+		file.Lines = append(file.Lines, line)
+	}
+
+	return file
+}
+
+// Bytes сериализует файл authorized_keys. Управляемый блок записывается на прежнее место,
+// а если его не было, то в конец файла. Пустой блок не записывается
+func (f *AuthorizedKeysFile) Bytes() []byte {
+	if len(f.Lines) == 0 && len(f.Managed) == 0 {
+		return nil
+	}
+
+	managedAt := f.managedAt
+	if managedAt < 0 || managedAt > len(f.Lines) {
+		managedAt = len(f.Lines)
+	}
+
+	var b bytes.Buffer
+	for i, line := range f.Lines {
+		if i == managedAt {
+			writeManagedBlock(&b, f.Managed)
+		}
+		b.WriteString(line.Raw)
+		b.WriteString("\n")
+	}
+	if managedAt == len(f.Lines) {
+		writeManagedBlock(&b, f.Managed)
+	}
+
+	// Перевод строки не добавляется, если файл по-прежнему заканчивается исходной последней строкой
+	data := b.Bytes()
+	if f.noFinalNewline && len(f.Lines) > 0 && (managedAt < len(f.Lines) || len(f.Managed) == 0) {
+		data = data[:len(data)-1]
+	}
+	return data
+}
+
+// Keys возвращает все ключи вне управляемого блока
+func (f *AuthorizedKeysFile) Keys() []*AuthorizedKey {
+	var keys []*AuthorizedKey
+	for _, line := range f.Lines {
+		if line.Key != nil {
+			keys = append(keys, line.Key)
+		}
+	}
+	return keys
+}
+
+// Contains проверяет, есть ли указанный ключ вне управляемого блока
+func (f *AuthorizedKeysFile) Contains(key ssh.PublicKey) bool {
+	for _, line := range f.Lines {
+		if line.Key != nil && line.Key.SameKey(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add добавляет ключ в конец файла вне управляемого блока, если его там еще нет.
+// Возвращает true, если файл изменился
+func (f *AuthorizedKeysFile) Add(key *AuthorizedKey) bool {
+	if f.Contains(key.Key) {
+		return false
+	}
+	f.Lines = append(f.Lines, AuthorizedKeysLine{Raw: key.String(), Key: key})
+	f.noFinalNewline = false
+	return true
+}
+
+// Remove удаляет все строки с указанным ключом вне управляемого блока.
+// Возвращает количество удаленных строк
+func (f *AuthorizedKeysFile) Remove(key ssh.PublicKey) int {
+	kept := f.Lines[:0]
+	removed := 0
+	for i, line := range f.Lines {
+		if line.Key != nil && line.Key.SameKey(key) {
+			removed++
+			if i < f.managedAt {
+				f.managedAt--
+			}
+			continue
+		}
+		kept = append(kept, line)
+	}
+	f.Lines = kept
+	return removed
+}
@@ -0,0 +1,166 @@
+package ssh
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuthorizedKeysFileRoundTrip(t *testing.T) {
+	key := newTestKey(t, "alice@laptop").String()
+	managed := managedBlockBegin + "\n" + managedKeyTag + "1\n" + key + "\n" + managedBlockEnd
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "пустой файл", data: ""},
+		{name: "только перевод строки", data: "\n"},
+		{name: "одна строка", data: key + "\n"},
+		{name: "без перевода строки в конце", data: "# ключи\n" + key},
+		{name: "пустые строки в конце", data: key + "\n\n\n"},
+		{name: "пустые строки и пробелы", data: "\n  \n" + key + "\n\t\n"},
+		{name: "комментарии и нераспознанные строки", data: "# ключи\nне ключ\nssh-ed25519 не-base64\n" + key + "\n"},
+		{name: "опции и CRLF", data: `restrict,command="uptime" ` + key + "\r\n" + "# конец\r\n"},
+		{name: "управляемый блок в середине", data: "# до\n" + managed + "\n# после\n"},
+		{name: "управляемый блок без перевода строки в конце", data: "# до\n" + managed + "\n" + key},
+		{name: "незакрытый блок", data: managedBlockBegin + "\n" + key + "\n\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(ParseAuthorizedKeysFile([]byte(tt.data)).Bytes())
+			if got != tt.data {
+				t.Fatalf("файл изменился после разбора:\n%q\nожидалось:\n%q", got, tt.data)
+			}
+		})
+	}
+}
+
+func TestAuthorizedKeysFileEdit(t *testing.T) {
+	alice := newTestKey(t, "alice")
+	bob := newTestKey(t, "bob")
+
+	// Новая строка добавляется с переводом строки, даже если его не было в конце файла
+	file := ParseAuthorizedKeysFile([]byte("# ключи\n" + alice.String()))
+	if !file.Add(bob) {
+		t.Fatal("ключ не добавлен")
+	}
+	if file.Add(bob) {
+		t.Fatal("ключ добавлен повторно")
+	}
+	want := "# ключи\n" + alice.String() + "\n" + bob.String() + "\n"
+	if got := string(file.Bytes()); got != want {
+		t.Fatalf("после добавления:\n%q\nожидалось:\n%q", got, want)
+	}
+
+	// Управляемый блок дописывается в конец файла и завершается переводом строки
+	file = ParseAuthorizedKeysFile([]byte(alice.String() + "\n\n"))
+	file.AddManaged(2, bob)
+	want = alice.String() + "\n\n" + managedBlockBegin + "\n" + managedKeyTag + "2\n" + bob.String() + "\n" + managedBlockEnd + "\n"
+	if got := string(file.Bytes()); got != want {
+		t.Fatalf("после добавления в блок:\n%q\nожидалось:\n%q", got, want)
+	}
+
+	file = ParseAuthorizedKeysFile([]byte(alice.String() + "\n" + bob.String() + "\n\n"))
+	if removed := file.Remove(alice.Key); removed != 1 {
+		t.Fatalf("удалено %d строк, ожидалась 1", removed)
+	}
+	want = bob.String() + "\n\n"
+	if got := string(file.Bytes()); got != want {
+		t.Fatalf("после удаления:\n%q\nожидалось:\n%q", got, want)
+	}
+}
+
+func TestParseAuthorizedKey(t *testing.T) {
+	key := newTestKey(t, "").String()
+
+	tests := []struct {
+		name    string
+		line    string
+		options []string
+		comment string
+		wantErr bool
+	}{
+		{name: "ключ без опций", line: key},
+		{name: "ключ с комментарием", line: key + " alice@laptop", comment: "alice@laptop"},
+		{name: "restrict", line: "restrict " + key, options: []string{"restrict"}},
+		{name: "command", line: `command="echo hi",no-pty ` + key, options: []string{`command="echo hi"`, "no-pty"}},
+		{name: "command с запятой", line: `command="a,b" ` + key, options: []string{`command="a,b"`}},
+		{name: "from", line: `from="10.0.0.0/8,*.example.com" ` + key, options: []string{`from="10.0.0.0/8,*.example.com"`}},
+		{name: "expiry-time дата", line: `expiry-time="20301231" ` + key, options: []string{`expiry-time="20301231"`}},
+		{name: "expiry-time с временем", line: `expiry-time="203012312359Z" ` + key, options: []string{`expiry-time="203012312359Z"`}},
+		{name: "опция в верхнем регистре", line: "RESTRICT " + key, options: []string{"RESTRICT"}},
+		{name: "пробелы вокруг", line: "  " + key + "  "},
+
+		{name: "пустая строка", line: "  ", wantErr: true},
+		{name: "комментарий", line: "# " + key, wantErr: true},
+		{name: "несколько строк", line: key + "\n" + key, wantErr: true},
+		{name: "неверный ключ", line: "ssh-ed25519 AAAA", wantErr: true},
+		{name: "неизвестная опция", line: "no-such-option " + key, wantErr: true},
+		{name: "restrict со значением", line: `restrict="yes" ` + key, wantErr: true},
+		{name: "command без значения", line: "command " + key, wantErr: true},
+		{name: "command без кавычек", line: "command=uptime " + key, wantErr: true},
+		{name: "пустой command", line: `command="" ` + key, wantErr: true},
+		{name: "пустой from", line: `from="" ` + key, wantErr: true},
+		{name: "expiry-time неверной длины", line: `expiry-time="2030" ` + key, wantErr: true},
+		{name: "expiry-time неверная дата", line: `expiry-time="20301332" ` + key, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := ParseAuthorizedKey(tt.line)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("строка принята: %s", parsed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ошибка разбора: %v", err)
+			}
+
+			if strings.Join(parsed.Options, "|") != strings.Join(tt.options, "|") {
+				t.Fatalf("опции %q, ожидались %q", parsed.Options, tt.options)
+			}
+			if parsed.Comment != tt.comment {
+				t.Fatalf("комментарий %q, ожидался %q", parsed.Comment, tt.comment)
+			}
+
+			// Сериализованная строка разбирается в тот же ключ
+			again, err := ParseAuthorizedKey(parsed.String())
+			if err != nil {
+				t.Fatalf("ошибка повторного разбора %q: %v", parsed.String(), err)
+			}
+			if !again.SameKey(parsed.Key) || again.String() != parsed.String() {
+				t.Fatalf("после повторного разбора %q, ожидалось %q", again.String(), parsed.String())
+			}
+		})
+	}
+}
+
+func TestAuthorizedKeyString(t *testing.T) {
+	key := newTestKey(t, "alice@laptop")
+	base := strings.TrimSuffix(key.String(), " alice@laptop")
+
+	tests := []struct {
+		name string
+		key  AuthorizedKey
+		want string
+	}{
+		{name: "без опций и комментария", key: AuthorizedKey{Key: key.Key}, want: base},
+		{name: "с комментарием", key: AuthorizedKey{Key: key.Key, Comment: "alice@laptop"}, want: base + " alice@laptop"},
+		{
+			name: "с опциями",
+			key:  AuthorizedKey{Key: key.Key, Options: []string{"restrict", `command="uptime"`}, Comment: "ci"},
+			want: `restrict,command="uptime" ` + base + " ci",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.key.String(); got != tt.want {
+				t.Fatalf("строка %q, ожидалась %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Client - SSH-подключение к серверу. Каждая операция выполняется с контекстом: если он отменен
+// или операция не уложилась в Timeouts.Command, соединение закрывается и операция прерывается.
+// После прерывания клиент больше не используется
+type Client struct {
+	conn     *ssh.Client
+	timeouts Timeouts
+	broken   bool // Операция была прервана, соединение закрыто
+
+	// Сведения для пула подключений
+	fingerprint string
+	generation  int
+	lastUsed    time.Time
+}
+
+// Dial устанавливает SSH-соединение с сервером с проверкой ключа хоста. Установка соединения
+// и рукопожатие ограничены Timeouts.Dial и Timeouts.Handshake и прерываются при отмене ctx
+func Dial(ctx context.Context, config SSHConfig) (*Client, error) {
+	auths := []ssh.AuthMethod{}
+	if config.PrivateKey != "" {
+		key, err := parsePrivateKey(config.PrivateKey, config.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, ssh.PublicKeys(key))
+	}
+	if config.Password != "" {
+		auths = append(auths, ssh.Password(config.Password))
+	}
+
+	hostKeyCallback, err := pinnedHostKeyCallback(config)
+	if err != nil {
+		return nil, err
+	}
+
+	sshConfig := &ssh.ClientConfig{
+		User:            config.User,
+		Auth:            auths,
+		HostKeyCallback: hostKeyCallback,
+	}
+
+	conn, err := connect(ctx, fmt.Sprintf("%s:%d", config.Host, config.Port), sshConfig, config.Timeouts)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка подключения к серверу: %w", err)
+	}
+
+	return &Client{conn: conn, timeouts: config.Timeouts}, nil
+}
+
+// connect устанавливает TCP-соединение и выполняет SSH-рукопожатие. При отмене ctx или по
+// истечении времени соединение закрывается, и ошибка описывает причину прерывания
+func connect(ctx context.Context, addr string, sshConfig *ssh.ClientConfig, timeouts Timeouts) (*ssh.Client, error) {
+	dialCtx, cancel := withTimeout(ctx, timeouts.Dial, "превышено время установки соединения")
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(dialCtx, "tcp", addr)
+	if err != nil {
+		if dialCtx.Err() != nil {
+			return nil, contextError(dialCtx)
+		}
+		return nil, err
+	}
+
+	handshakeCtx, cancel := withTimeout(ctx, timeouts.Handshake, "превышено время SSH-рукопожатия")
+	defer cancel()
+
+	stop := context.AfterFunc(handshakeCtx, func() { conn.Close() })
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if !stop() {
+		if err == nil {
+			sshConn.Close()
+		}
+		return nil, contextError(handshakeCtx)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// Close закрывает соединение с сервером
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// do выполняет операцию на сервере. Если ctx отменен или операция не уложилась
+// в Timeouts.Command, соединение закрывается, что прерывает все его сессии
+func (c *Client) do(ctx context.Context, op func() error) error {
+	ctx, cancel := withTimeout(ctx, c.timeouts.Command, "превышено время выполнения операции на сервере")
+	defer cancel()
+
+	stop := context.AfterFunc(ctx, func() { c.conn.Close() })
+	err := op()
+	if !stop() {
+		c.broken = true
+		if err != nil {
+			return contextError(ctx)
+		}
+	}
+
+	return err
+}
+
+// Run выполняет команду на сервере и возвращает ее вывод вместе с выводом ошибок
+func (c *Client) Run(ctx context.Context, command string) ([]byte, error) {
+	var output []byte
+	err := c.do(ctx, func() error {
+		session, err := c.conn.NewSession()
+		if err != nil {
+			return fmt.Errorf("ошибка создания SSH-сессии: %w", err)
+		}
+		defer session.Close()
+
+		output, err = session.CombinedOutput(command)
+		if err != nil {
+			return fmt.Errorf("ошибка выполнения команды: %w", err)
+		}
+		return nil
+	})
+
+	return output, err
+}
+
+// ReadManagedKeys возвращает ключи управляемого блока authorized_keys на сервере
+// и ключи, записанные вне блока
+func (c *Client) ReadManagedKeys(ctx context.Context) ([]ManagedKey, []*AuthorizedKey, error) {
+	var keys []ManagedKey
+	var outside []*AuthorizedKey
+	err := c.do(ctx, func() error {
+		return editAuthorizedKeys(c.conn, func(file *AuthorizedKeysFile) error {
+			keys = file.Managed
+			outside = file.Keys()
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keys, outside, nil
+}
+
+// SyncManagedKeys приводит управляемый блок authorized_keys на сервере к указанному набору ключей
+// и возвращает содержимое блока до изменения и ключи, записанные вне блока.
+// Строки вне блока остаются без изменений
+func (c *Client) SyncManagedKeys(ctx context.Context, keys []ManagedKey) ([]ManagedKey, []*AuthorizedKey, error) {
+	var previous []ManagedKey
+	var outside []*AuthorizedKey
+	err := c.do(ctx, func() error {
+		return editAuthorizedKeys(c.conn, func(file *AuthorizedKeysFile) error {
+			previous = append(previous, file.Managed...)
+			outside = file.Keys()
+			file.SetManaged(keys)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return previous, outside, nil
+}
+
+// EditAuthorizedKeys применяет edit к файлу authorized_keys на сервере и записывает результат,
+// если он изменился. Используется для строк вне управляемого блока, например ключа самого шлюза
+func (c *Client) EditAuthorizedKeys(ctx context.Context, edit func(file *AuthorizedKeysFile) error) error {
+	return c.do(ctx, func() error {
+		return editAuthorizedKeys(c.conn, edit)
+	})
+}
+
+// withTimeout ограничивает контекст временем timeout. Если время истекло,
+// причиной отмены контекста становится сообщение message
+func withTimeout(ctx context.Context, timeout time.Duration, message string) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, fmt.Errorf("%s (%s)", message, timeout))
+}
+
+// contextError возвращает ошибку с причиной прерывания операции: отменой запроса
+// или задачи либо истечением отведенного времени
+func contextError(ctx context.Context) error {
+	cause := context.Cause(ctx)
+	switch {
+	case errors.Is(cause, context.Canceled):
+		return fmt.Errorf("операция на сервере отменена: %w", cause)
+	case cause == context.DeadlineExceeded:
+		return fmt.Errorf("превышено время ожидания сервера: %w", cause)
+	}
+	return cause
+}
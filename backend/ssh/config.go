@@ -0,0 +1,87 @@
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Переменные окружения с ограничениями времени SSH-подключений
+const (
+	DialTimeoutEnv      = "SSH_GATE_SSH_DIAL_TIMEOUT"      // Установка TCP-соединения (по умолчанию 10s)
+	HandshakeTimeoutEnv = "SSH_GATE_SSH_HANDSHAKE_TIMEOUT" // Рукопожатие и аутентификация (по умолчанию 15s)
+	CommandTimeoutEnv   = "SSH_GATE_SSH_COMMAND_TIMEOUT"   // Одна операция на сервере, например правка authorized_keys (по умолчанию 1m)
+)
+
+// Переменные окружения с настройками пула SSH-подключений
+const (
+	IdleTimeoutEnv = "SSH_GATE_SSH_IDLE_TIMEOUT" // Время хранения неиспользуемого подключения, 0 отключает пул (по умолчанию 5m)
+	KeepAliveEnv   = "SSH_GATE_SSH_KEEPALIVE"    // Период проверки неиспользуемых подключений (по умолчанию 30s)
+)
+
+// Timeouts задает ограничения времени SSH-подключения. Нулевое значение снимает ограничение
+type Timeouts struct {
+	Dial      time.Duration
+	Handshake time.Duration
+	Command   time.Duration
+}
+
+// DefaultTimeouts ограничения времени SSH-подключения по умолчанию
+var DefaultTimeouts = Timeouts{Dial: 10 * time.Second, Handshake: 15 * time.Second, Command: time.Minute}
+
+// LoadTimeouts читает ограничения времени SSH-подключения из окружения
+func LoadTimeouts() (Timeouts, error) {
+	timeouts := DefaultTimeouts
+
+	for env, value := range map[string]*time.Duration{
+		DialTimeoutEnv:      &timeouts.Dial,
+		HandshakeTimeoutEnv: &timeouts.Handshake,
+		CommandTimeoutEnv:   &timeouts.Command,
+	} {
+		raw := os.Getenv(env)
+		if raw == "" {
+			continue
+		}
+
+		timeout, err := time.ParseDuration(raw)
+		if err != nil || timeout <= 0 {
+			return Timeouts{}, fmt.Errorf("неверное значение %s: %s", env, raw)
+		}
+		*value = timeout
+	}
+
+	return timeouts, nil
+}
+
+// PoolConfig содержит настройки пула SSH-подключений. Нулевой IdleTimeout отключает
+// повторное использование подключений
+type PoolConfig struct {
+	IdleTimeout time.Duration
+	KeepAlive   time.Duration
+}
+
+// DefaultPoolConfig настройки пула SSH-подключений по умолчанию
+var DefaultPoolConfig = PoolConfig{IdleTimeout: 5 * time.Minute, KeepAlive: 30 * time.Second}
+
+// LoadPoolConfig читает настройки пула SSH-подключений из окружения
+func LoadPoolConfig() (PoolConfig, error) {
+	config := DefaultPoolConfig
+
+	if value := os.Getenv(IdleTimeoutEnv); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return PoolConfig{}, fmt.Errorf("неверное значение %s: %s", IdleTimeoutEnv, value)
+		}
+		config.IdleTimeout = timeout
+	}
+
+	if value := os.Getenv(KeepAliveEnv); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return PoolConfig{}, fmt.Errorf("неверное значение %s: %s", KeepAliveEnv, value)
+		}
+		config.KeepAlive = interval
+	}
+
+	return config, nil
+}
@@ -0,0 +1,105 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyMismatchError возвращается, когда ключ хоста не совпадает с закрепленным
+type HostKeyMismatchError struct {
+	Host     string
+	Expected string // Отпечаток закрепленного ключа
+	Actual   string // Отпечаток ключа, предъявленного сервером
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("ключ хоста %s не совпадает с закрепленным: ожидался %s, получен %s", e.Host, e.Expected, e.Actual)
+}
+
+// ParseHostKey разбирает ключ хоста в формате authorized_keys
+func ParseHostKey(hostKey string) (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(hostKey)))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка разбора ключа хоста: %w", err)
+	}
+
+	return key, nil
+}
+
+// FormatHostKey возвращает ключ хоста в формате authorized_keys без перевода строки
+func FormatHostKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// HostKeyFingerprint возвращает SHA256-отпечаток ключа хоста
+func HostKeyFingerprint(hostKey string) (string, error) {
+	key, err := ParseHostKey(hostKey)
+	if err != nil {
+		return "", err
+	}
+
+	return ssh.FingerprintSHA256(key), nil
+}
+
+// pinnedHostKeyCallback проверяет ключ хоста по закрепленному значению,
+// а при его отсутствии закрепляет ключ, предъявленный при первом подключении
+func pinnedHostKeyCallback(config SSHConfig) (ssh.HostKeyCallback, error) {
+	if config.HostKey == "" {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if config.OnHostKeyPinned == nil {
+				return fmt.Errorf("ключ хоста %s не закреплен", hostname)
+			}
+			if err := config.OnHostKeyPinned(FormatHostKey(key)); err != nil {
+				return fmt.Errorf("ошибка закрепления ключа хоста: %w", err)
+			}
+			return nil
+		}, nil
+	}
+
+	pinned, err := ParseHostKey(config.HostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if key.Type() != pinned.Type() || !bytes.Equal(key.Marshal(), pinned.Marshal()) {
+			return &HostKeyMismatchError{
+				Host:     hostname,
+				Expected: ssh.FingerprintSHA256(pinned),
+				Actual:   ssh.FingerprintSHA256(key),
+			}
+		}
+		return nil
+	}, nil
+}
+
+// errHostKeyCaptured прерывает рукопожатие после получения ключа хоста
+var errHostKeyCaptured = errors.New("ключ хоста получен")
+
+// FetchHostKey подключается к серверу и возвращает его ключ хоста без аутентификации
+func FetchHostKey(ctx context.Context, host string, port int, timeouts Timeouts) (string, error) {
+	var hostKey string
+	sshConfig := &ssh.ClientConfig{
+		User: "ssh-gate",
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = FormatHostKey(key)
+			return errHostKeyCaptured
+		},
+	}
+
+	client, err := connect(ctx, fmt.Sprintf("%s:%d", host, port), sshConfig, timeouts)
+	if err == nil {
+		client.Close()
+	}
+	if hostKey == "" {
+		return "", fmt.Errorf("ошибка получения ключа хоста: %w", err)
+	}
+
+	return hostKey, nil
+}
@@ -0,0 +1,129 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Маркеры блока authorized_keys, которым владеет ssh-gate. Содержимое блока
+// перезаписывается целиком при каждом изменении, строки вне его не трогаются
+const (
+	managedBlockBegin = "# BEGIN ssh-gate"
+	managedBlockEnd   = "# END ssh-gate"
+	managedKeyTag     = "# ssh-gate: user="
+)
+
+// ManagedKey описывает ключ управляемого блока и пользователя, которому он выдан.
+// UserID равен 0, если строка в блоке не помечена пользователем
+type ManagedKey struct {
+	UserID int64
+	Key    *AuthorizedKey
+}
+
+// findManagedBlockEnd возвращает индекс закрывающего маркера блока или -1
+func findManagedBlockEnd(raws []string, from int) int {
+	for i := from; i < len(raws); i++ {
+		switch strings.TrimSpace(raws[i]) {
+		case managedBlockEnd:
+			return i
+		case managedBlockBegin:
+			return -1
+		}
+	}
+	return -1
+}
+
+// parseManagedBlock разбирает строки между маркерами блока.
+// Каждому ключу предшествует строка с идентификатором пользователя
+func parseManagedBlock(raws []string) []ManagedKey {
+	var keys []ManagedKey
+	var userID int64
+
+	for _, raw := range raws {
+		trimmed := strings.TrimSpace(raw)
+		if strings.HasPrefix(trimmed, managedKeyTag) {
+			userID, _ = strconv.ParseInt(strings.TrimPrefix(trimmed, managedKeyTag), 10, 64)
+			continue
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		key, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(trimmed))
+		if err == nil {
+			keys = append(keys, ManagedKey{
+				UserID: userID,
+				Key:    &AuthorizedKey{Key: key, Options: options, Comment: comment},
+			})
+		}
+		userID = 0
+	}
+
+	return keys
+}
+
+// writeManagedBlock записывает управляемый блок
+func writeManagedBlock(b *bytes.Buffer, keys []ManagedKey) {
+	if len(keys) == 0 {
+		return
+	}
+
+	b.WriteString(managedBlockBegin + "\n")
+	for _, managed := range keys {
+		if managed.UserID != 0 {
+			fmt.Fprintf(b, "%s%d\n", managedKeyTag, managed.UserID)
+		}
+		b.WriteString(managed.Key.String())
+		b.WriteString("\n")
+	}
+	b.WriteString(managedBlockEnd + "\n")
+}
+
+// HasManagedKey проверяет, выдан ли ключ пользователю в управляемом блоке
+func (f *AuthorizedKeysFile) HasManagedKey(userID int64, key ssh.PublicKey) bool {
+	for _, managed := range f.Managed {
+		if managed.UserID == userID && managed.Key.SameKey(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddManaged добавляет ключ пользователя в управляемый блок. Строки вне блока не изменяются,
+// даже если в них записан тот же ключ. Возвращает true, если файл изменился
+func (f *AuthorizedKeysFile) AddManaged(userID int64, key *AuthorizedKey) bool {
+	if f.HasManagedKey(userID, key.Key) {
+		return false
+	}
+
+	f.Managed = append(f.Managed, ManagedKey{UserID: userID, Key: key})
+	return true
+}
+
+// RemoveManaged удаляет ключ пользователя из управляемого блока.
+// Возвращает количество удаленных строк
+func (f *AuthorizedKeysFile) RemoveManaged(userID int64, key ssh.PublicKey) int {
+	kept := f.Managed[:0]
+	removed := 0
+	for _, managed := range f.Managed {
+		if managed.UserID == userID && managed.Key.SameKey(key) {
+			removed++
+			continue
+		}
+		kept = append(kept, managed)
+	}
+	f.Managed = kept
+	return removed
+}
+
+// SetManaged заменяет содержимое управляемого блока указанными ключами
+func (f *AuthorizedKeysFile) SetManaged(keys []ManagedKey) {
+	f.Managed = nil
+	for _, managed := range keys {
+		f.AddManaged(managed.UserID, managed.Key)
+	}
+}
@@ -0,0 +1,118 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// newTestKey создает ключ Ed25519 для строки authorized_keys
+func newTestKey(t *testing.T, comment string) *AuthorizedKey {
+	t.Helper()
+
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &AuthorizedKey{Key: key, Comment: comment}
+}
+
+func TestManagedBlockRoundTrip(t *testing.T) {
+	alice := newTestKey(t, "alice@laptop")
+	bob := newTestKey(t, "bob@laptop")
+	operator := newTestKey(t, "operator")
+
+	data := strings.Join([]string{
+		"# ключи администратора",
+		operator.String(),
+		managedBlockBegin,
+		managedKeyTag + "1",
+		alice.String(),
+		managedKeyTag + "2",
+		bob.String(),
+		managedBlockEnd,
+		"",
+	}, "\n")
+
+	file := ParseAuthorizedKeysFile([]byte(data))
+	if len(file.Lines) != 2 || len(file.Managed) != 2 {
+		t.Fatalf("строк вне блока %d, ключей блока %d, ожидалось 2 и 2", len(file.Lines), len(file.Managed))
+	}
+	if !file.HasManagedKey(1, alice.Key) || !file.HasManagedKey(2, bob.Key) {
+		t.Fatal("ключи блока не привязаны к пользователям")
+	}
+	if got := string(file.Bytes()); got != data {
+		t.Fatalf("файл изменился после разбора:\n%s\nожидалось:\n%s", got, data)
+	}
+
+	if removed := file.RemoveManaged(1, alice.Key); removed != 1 {
+		t.Fatalf("удалено %d строк, ожидалась 1", removed)
+	}
+	want := strings.Join([]string{
+		"# ключи администратора",
+		operator.String(),
+		managedBlockBegin,
+		managedKeyTag + "2",
+		bob.String(),
+		managedBlockEnd,
+		"",
+	}, "\n")
+	if got := string(file.Bytes()); got != want {
+		t.Fatalf("после удаления ключа:\n%s\nожидалось:\n%s", got, want)
+	}
+}
+
+func TestManagedBlockWithoutEndMarkerIsNotManaged(t *testing.T) {
+	alice := newTestKey(t, "alice")
+	data := managedBlockBegin + "\n" + alice.String() + "\n"
+
+	file := ParseAuthorizedKeysFile([]byte(data))
+	if len(file.Managed) != 0 {
+		t.Fatal("блок без закрывающего маркера считается управляемым")
+	}
+	if !file.Contains(alice.Key) {
+		t.Fatal("ключ из незакрытого блока потерян")
+	}
+	if got := string(file.Bytes()); got != data {
+		t.Fatalf("файл изменился после разбора:\n%s\nожидалось:\n%s", got, data)
+	}
+}
+
+func TestAddManagedLeavesUnmanagedLinesUntouched(t *testing.T) {
+	operator := newTestKey(t, "operator")
+	data := "# ключ, добавленный вручную\n" + operator.String() + "\n"
+
+	file := ParseAuthorizedKeysFile([]byte(data))
+	if !file.AddManaged(7, operator) {
+		t.Fatal("ключ не добавлен в управляемый блок")
+	}
+	if !file.Contains(operator.Key) {
+		t.Fatal("строка вне блока перенесена в управляемый блок")
+	}
+
+	// Повторный разбор видит ключ и в блоке, и вне его
+	file = ParseAuthorizedKeysFile(file.Bytes())
+	if len(file.Managed) != 1 || !file.Contains(operator.Key) {
+		t.Fatalf("после записи: блок %v, строки %v", file.Managed, file.Lines)
+	}
+
+	// Отзыв доступа удаляет только строку блока
+	file.RemoveManaged(7, operator.Key)
+	if got := string(file.Bytes()); got != data {
+		t.Fatalf("после отзыва доступа:\n%s\nожидалось:\n%s", got, data)
+	}
+
+	file = ParseAuthorizedKeysFile([]byte(data))
+	file.AddManaged(7, operator)
+	file.SetManaged(nil)
+	if got := string(file.Bytes()); got != data {
+		t.Fatalf("после очистки блока:\n%s\nожидалось:\n%s", got, data)
+	}
+}
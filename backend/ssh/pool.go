@@ -0,0 +1,232 @@
+package ssh
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Параметры пула подключений
+const (
+	maxIdlePerServer   = 2               // Число простаивающих подключений к одному серверу
+	healthCheckTimeout = 5 * time.Second // Время ожидания ответа на проверку подключения
+)
+
+// Pool хранит установленные SSH-подключения к серверам для повторного использования.
+// Подключение выдается одной операции за раз, поэтому прерывание операции не затрагивает другие.
+// Перед выдачей простаивавшее подключение проверяется запросом keepalive
+type Pool struct {
+	Config PoolConfig
+
+	mu      sync.Mutex
+	servers map[int64]*poolServer
+}
+
+// poolServer простаивающие подключения к серверу. Поколение увеличивается при сбросе
+// подключений: выданные до сброса подключения не возвращаются в пул
+type poolServer struct {
+	generation int
+	idle       []*Client
+}
+
+// NewPool создает пул подключений
+func NewPool(config PoolConfig) *Pool {
+	return &Pool{Config: config, servers: make(map[int64]*poolServer)}
+}
+
+// Get возвращает подключение к серверу: простаивающее, если оно исправно и было установлено
+// с теми же учетными данными, или новое. После операции подключение возвращается через Put
+func (p *Pool) Get(ctx context.Context, serverID int64, config SSHConfig) (*Client, error) {
+	fingerprint := configFingerprint(config)
+
+	for {
+		client, generation := p.take(serverID, fingerprint)
+		if client == nil {
+			client, err := Dial(ctx, config)
+			if err != nil {
+				return nil, err
+			}
+			client.fingerprint = fingerprint
+			client.generation = generation
+			return client, nil
+		}
+
+		if client.alive() {
+			client.timeouts = config.Timeouts
+			return client, nil
+		}
+		client.Close()
+	}
+}
+
+// take забирает из пула последнее простаивающее подключение к серверу с теми же учетными данными.
+// Устаревшие подключения закрываются. Возвращает текущее поколение подключений сервера
+func (p *Pool) take(serverID int64, fingerprint string) (*Client, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	server := p.server(serverID)
+	for len(server.idle) > 0 {
+		client := server.idle[len(server.idle)-1]
+		server.idle = server.idle[:len(server.idle)-1]
+
+		if client.fingerprint != fingerprint || p.expired(client) {
+			client.Close()
+			continue
+		}
+		return client, server.generation
+	}
+
+	return nil, server.generation
+}
+
+// Put возвращает подключение в пул после операции. Подключение закрывается, если операция
+// завершилась ошибкой или была прервана, подключения к серверу сброшены или пул заполнен
+func (p *Pool) Put(serverID int64, client *Client, err error) {
+	if err != nil || client.broken || p.Config.IdleTimeout <= 0 {
+		client.Close()
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	server := p.server(serverID)
+	if client.generation != server.generation || len(server.idle) >= maxIdlePerServer {
+		client.Close()
+		return
+	}
+
+	client.lastUsed = time.Now()
+	server.idle = append(server.idle, client)
+}
+
+// Invalidate закрывает простаивающие подключения к серверу. Подключения, выданные до вызова,
+// закрываются при возврате. Вызывается при изменении адреса, учетных данных или ключа хоста сервера
+func (p *Pool) Invalidate(serverID int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	server := p.server(serverID)
+	server.generation++
+	for _, client := range server.idle {
+		client.Close()
+	}
+	server.idle = nil
+}
+
+// Run периодически проверяет простаивающие подключения запросом keepalive и закрывает
+// неисправные и простаивающие дольше IdleTimeout, пока не будет отменен контекст
+func (p *Pool) Run(ctx context.Context) {
+	if p.Config.KeepAlive <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(p.Config.KeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			p.closeAll()
+			return
+		case <-ticker.C:
+		}
+
+		p.check()
+	}
+}
+
+// check проверяет простаивающие подключения. На время проверки подключения забираются из пула
+func (p *Pool) check() {
+	p.mu.Lock()
+	checked := make(map[int64][]*Client, len(p.servers))
+	generations := make(map[int64]int, len(p.servers))
+	for serverID, server := range p.servers {
+		checked[serverID] = server.idle
+		generations[serverID] = server.generation
+		server.idle = nil
+	}
+	p.mu.Unlock()
+
+	for serverID, clients := range checked {
+		for _, client := range clients {
+			if p.expired(client) || !client.alive() {
+				client.Close()
+				continue
+			}
+
+			p.mu.Lock()
+			server := p.server(serverID)
+			if server.generation == generations[serverID] && len(server.idle) < maxIdlePerServer {
+				server.idle = append(server.idle, client)
+				client = nil
+			}
+			p.mu.Unlock()
+
+			if client != nil {
+				client.Close()
+			}
+		}
+	}
+}
+
+// closeAll закрывает все простаивающие подключения
+func (p *Pool) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, server := range p.servers {
+		for _, client := range server.idle {
+			client.Close()
+		}
+		server.idle = nil
+	}
+}
+
+// server возвращает подключения к серверу. Вызывается под p.mu
+func (p *Pool) server(serverID int64) *poolServer {
+	server, ok := p.servers[serverID]
+	if !ok {
+		server = &poolServer{}
+		p.servers[serverID] = server
+	}
+	return server
+}
+
+// expired проверяет, простаивало ли подключение дольше IdleTimeout
+func (p *Pool) expired(client *Client) bool {
+	return time.Since(client.lastUsed) > p.Config.IdleTimeout
+}
+
+// alive проверяет подключение запросом keepalive. Сервер может отклонить запрос,
+// важно лишь, что он ответил. Не ответившее вовремя подключение закрывается
+func (c *Client) alive() bool {
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := c.conn.SendRequest("keepalive@openssh.com", true, nil)
+		done <- err
+	}()
+
+	timer := time.NewTimer(healthCheckTimeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err == nil
+	case <-timer.C:
+		c.conn.Close()
+		return false
+	}
+}
+
+// configFingerprint возвращает отпечаток адреса и учетных данных подключения.
+// Подключение из пула выдается, только если отпечаток не изменился
+func configFingerprint(config SSHConfig) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%s\x00%s\x00%s\x00%s",
+		config.Host, config.Port, config.User, config.Password, config.PrivateKey, config.Passphrase)))
+	return hex.EncodeToString(sum[:])
+}
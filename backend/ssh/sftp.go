@@ -0,0 +1,142 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKeysFile путь к authorized_keys относительно домашнего каталога
+const authorizedKeysFile = ".ssh/authorized_keys"
+
+// readAuthorizedKeys читает authorized_keys по SFTP. Отсутствующий файл считается пустым
+func readAuthorizedKeys(client *sftp.Client, filePath string) ([]byte, error) {
+	file, err := client.Open(filePath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("ошибка открытия authorized_keys: %w", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения authorized_keys: %w", err)
+	}
+
+	return data, nil
+}
+
+// writeAuthorizedKeys атомарно записывает authorized_keys по SFTP: содержимое пишется
+// во временный файл рядом с исходным, получает его права и владельца и переименовывается поверх
+func writeAuthorizedKeys(client *sftp.Client, filePath string, content []byte) error {
+	dir := path.Dir(filePath)
+	if _, err := client.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		if err := client.MkdirAll(dir); err != nil {
+			return fmt.Errorf("ошибка создания каталога %s: %w", dir, err)
+		}
+		if err := client.Chmod(dir, 0700); err != nil {
+			return fmt.Errorf("ошибка установки прав на каталог %s: %w", dir, err)
+		}
+	}
+
+	// Права и владелец берутся у существующего файла
+	mode := os.FileMode(0600)
+	var owner *sftp.FileStat
+	if info, err := client.Stat(filePath); err == nil {
+		mode = info.Mode().Perm()
+		owner, _ = info.Sys().(*sftp.FileStat)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("ошибка получения сведений об authorized_keys: %w", err)
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return fmt.Errorf("ошибка генерации имени временного файла: %w", err)
+	}
+	tempPath := filePath + ".ssh-gate-" + hex.EncodeToString(suffix)
+
+	file, err := client.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return fmt.Errorf("ошибка создания временного файла: %w", err)
+	}
+
+	if err := writeTempFile(client, file, tempPath, content, mode, owner); err != nil {
+		client.Remove(tempPath)
+		return err
+	}
+
+	// posix-rename заменяет файл атомарно, обычный SFTP rename не перезаписывает существующий
+	if err := client.PosixRename(tempPath, filePath); err != nil {
+		client.Remove(tempPath)
+		return fmt.Errorf("ошибка замены authorized_keys: %w", err)
+	}
+
+	return nil
+}
+
+// writeTempFile записывает содержимое во временный файл и выставляет ему права и владельца
+func writeTempFile(client *sftp.Client, file *sftp.File, tempPath string, content []byte, mode os.FileMode, owner *sftp.FileStat) error {
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return fmt.Errorf("ошибка записи временного файла: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("ошибка записи временного файла: %w", err)
+	}
+
+	if err := client.Chmod(tempPath, mode); err != nil {
+		return fmt.Errorf("ошибка установки прав на временный файл: %w", err)
+	}
+
+	if owner != nil {
+		if err := client.Chown(tempPath, int(owner.UID), int(owner.GID)); err != nil {
+			return fmt.Errorf("ошибка установки владельца временного файла: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// editAuthorizedKeys читает authorized_keys по SFTP, применяет к нему edit
+// и записывает результат, если он изменился. Командная оболочка сервера не используется
+func editAuthorizedKeys(client *ssh.Client, edit func(file *AuthorizedKeysFile) error) error {
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return fmt.Errorf("ошибка создания SFTP-сессии: %w", err)
+	}
+	defer sftpClient.Close()
+
+	home, err := sftpClient.Getwd()
+	if err != nil {
+		return fmt.Errorf("ошибка получения домашнего каталога: %w", err)
+	}
+	filePath := path.Join(home, authorizedKeysFile)
+
+	data, err := readAuthorizedKeys(sftpClient, filePath)
+	if err != nil {
+		return err
+	}
+
+	file := ParseAuthorizedKeysFile(data)
+	if err := edit(file); err != nil {
+		return err
+	}
+
+	edited := file.Bytes()
+	if bytes.Equal(edited, ParseAuthorizedKeysFile(data).Bytes()) {
+		return nil
+	}
+
+	return writeAuthorizedKeys(sftpClient, filePath, edited)
+}
@@ -1,134 +1,96 @@
 package ssh
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
-	"strings"
 
 	"golang.org/x/crypto/ssh"
 )
 
 // SSHConfig содержит конфигурацию для SSH-подключения
 type SSHConfig struct {
-	Host     string
-	Port     int
-	User     string
-	KeyPath  string // Путь к приватному ключу для подключения (опционально)
-	Password string // Пароль для подключения (опционально)
+	Host       string
+	Port       int
+	User       string
+	Password   string // Пароль для подключения (опционально)
+	PrivateKey string // Приватный ключ для подключения в формате PEM или OpenSSH (опционально)
+	Passphrase string // Парольная фраза приватного ключа (опционально)
+	HostKey    string // Закрепленный ключ хоста в формате authorized_keys (пустой, если еще не закреплен)
+	Timeouts   Timeouts
+
+	// OnHostKeyPinned вызывается при первом подключении, когда ключ хоста еще не закреплен
+	OnHostKeyPinned func(hostKey string) error
 }
 
-// AddAuthorizedKey добавляет публичный ключ в authorized_keys на сервере
-func AddAuthorizedKey(config SSHConfig, publicKey string) error {
-	// Создаем SSH-клиент
-	auths := []ssh.AuthMethod{}
-	if config.KeyPath != "" {
-		key, err := ssh.ParsePrivateKey([]byte(config.KeyPath))
-		if err != nil {
-			return fmt.Errorf("ошибка разбора приватного ключа: %w", err)
-		}
-		auths = append(auths, ssh.PublicKeys(key))
-	}
-	if config.Password != "" {
-		auths = append(auths, ssh.Password(config.Password))
-	}
-
-	sshConfig := &ssh.ClientConfig{
-		User:            config.User,
-		Auth:            auths,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
-
-	// Подключаемся к серверу
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", config.Host, config.Port), sshConfig)
+// ValidatePublicKey проверяет корректность строки публичного ключа для authorized_keys
+// и возвращает ее в нормализованном виде
+func ValidatePublicKey(publicKey string) (string, error) {
+	key, err := ParseAuthorizedKey(publicKey)
 	if err != nil {
-		return fmt.Errorf("ошибка подключения к серверу: %w", err)
-	}
-	defer client.Close()
-
-	// Создаем сессию
-	session, err := client.NewSession()
-	if err != nil {
-		return fmt.Errorf("ошибка создания сессии: %w", err)
-	}
-	defer session.Close()
-
-	// Добавление ключа на сервер
-	cmd := fmt.Sprintf(`
-		mkdir -p ~/.ssh && chmod 700 ~/.ssh &&
-		touch ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys &&
-		echo '%s' >> ~/.ssh/authorized_keys
-	`, publicKey)
-
-	if err := session.Run(cmd); err != nil {
-		return fmt.Errorf("ошибка выполнения команды: %w", err)
+		return "", err
 	}
 
-	return nil
+	return key.String(), nil
 }
 
-// RemoveAuthorizedKey удаляет публичный ключ из authorized_keys на сервере
-func RemoveAuthorizedKey(config SSHConfig, publicKey string) error {
-	auths := []ssh.AuthMethod{}
-	if config.KeyPath != "" {
-		key, err := ssh.ParsePrivateKey([]byte(config.KeyPath))
-		if err != nil {
-			return fmt.Errorf("ошибка разбора приватного ключа: %w", err)
-		}
-		auths = append(auths, ssh.PublicKeys(key))
-	}
-	if config.Password != "" {
-		auths = append(auths, ssh.Password(config.Password))
+// ValidatePrivateKey проверяет приватный ключ и парольную фразу к нему
+// и возвращает соответствующий публичный ключ в формате authorized_keys
+func ValidatePrivateKey(privateKey, passphrase string) (string, error) {
+	signer, err := parsePrivateKey(privateKey, passphrase)
+	if err != nil {
+		return "", err
 	}
 
-	sshConfig := &ssh.ClientConfig{
-		User:            config.User,
-		Auth:            auths,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	}
+	return FormatHostKey(signer.PublicKey()), nil
+}
 
-	// Подключаемся к серверу
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", config.Host, config.Port), sshConfig)
+// GenerateKey создает пару ключей Ed25519. Возвращает приватный ключ в формате OpenSSH
+// и публичный ключ в формате authorized_keys с комментарием comment
+func GenerateKey(comment string) (privateKey, publicKey string, err error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
-		return fmt.Errorf("ошибка подключения к серверу: %w", err)
+		return "", "", fmt.Errorf("ошибка генерации ключа: %w", err)
 	}
-	defer client.Close()
 
-	// Создаем сессию
-	session, err := client.NewSession()
+	block, err := ssh.MarshalPrivateKey(private, comment)
 	if err != nil {
-		return fmt.Errorf("ошибка создания сессии: %w", err)
+		return "", "", fmt.Errorf("ошибка сериализации приватного ключа: %w", err)
 	}
-	defer session.Close()
-
-	// Создаем временный файл
-	tempFile := "/tmp/authorized_keys.tmp"
 
-	// Читаем текущий файл authorized_keys и удаляем указанный ключ
-	removeKeyCmd := fmt.Sprintf(`
-		if [ -f ~/.ssh/authorized_keys ]; then
-			grep -v "%s" ~/.ssh/authorized_keys > %s
-			mv %s ~/.ssh/authorized_keys
-			chmod 600 ~/.ssh/authorized_keys
-		fi
-	`, publicKey, tempFile, tempFile)
-
-	if err := session.Run(removeKeyCmd); err != nil {
-		return fmt.Errorf("ошибка удаления ключа: %w", err)
+	sshPublic, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return "", "", fmt.Errorf("ошибка сериализации публичного ключа: %w", err)
 	}
 
-	return nil
+	key := &AuthorizedKey{Key: sshPublic, Comment: comment}
+	return string(pem.EncodeToMemory(block)), key.String(), nil
 }
 
-// ValidatePublicKey проверяет корректность публичного ключа
-func ValidatePublicKey(publicKey string) error {
-	// Проверяем, что ключ начинается с правильного префикса
-	if !strings.HasPrefix(publicKey, "ssh-rsa ") && !strings.HasPrefix(publicKey, "ssh-ed25519 ") {
-		return fmt.Errorf("неверный формат публичного ключа")
+// parsePrivateKey разбирает приватный ключ, расшифровывая его парольной фразой, если она задана
+func parsePrivateKey(privateKey, passphrase string) (ssh.Signer, error) {
+	var (
+		signer ssh.Signer
+		err    error
+	)
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(privateKey), []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey([]byte(privateKey))
 	}
 
-	// Проверяем, что ключ не пустой
-	if len(strings.TrimSpace(publicKey)) == 0 {
-		return fmt.Errorf("пустой публичный ключ")
+	var missing *ssh.PassphraseMissingError
+	switch {
+	case errors.As(err, &missing):
+		return nil, fmt.Errorf("приватный ключ защищен парольной фразой")
+	case errors.Is(err, x509.IncorrectPasswordError):
+		return nil, fmt.Errorf("неверная парольная фраза приватного ключа")
+	case err != nil:
+		return nil, fmt.Errorf("ошибка разбора приватного ключа: %w", err)
 	}
 
-	return nil
+	return signer, nil
 }
@@ -0,0 +1,223 @@
+package sso
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Переменные окружения для настройки входа через OpenID Connect
+const (
+	IssuerEnv       = "SSH_GATE_OIDC_ISSUER"
+	ClientIDEnv     = "SSH_GATE_OIDC_CLIENT_ID"
+	ClientSecretEnv = "SSH_GATE_OIDC_CLIENT_SECRET"
+	RedirectURLEnv  = "SSH_GATE_OIDC_REDIRECT_URL"
+	GroupsClaimEnv  = "SSH_GATE_OIDC_GROUPS_CLAIM"
+	RoleMapEnv      = "SSH_GATE_OIDC_ROLE_MAP"
+	DefaultRoleEnv  = "SSH_GATE_OIDC_DEFAULT_ROLE"
+)
+
+// Config содержит настройки OIDC-провайдера
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	GroupsClaim  string            // Claim со списком групп пользователя
+	RoleMap      map[string]string // Соответствие групп провайдера ролям шлюза
+	DefaultRole  string            // Роль для пользователей без подходящих групп (пустая — вход запрещен)
+	Roles        []string          // Роли шлюза в порядке приоритета при совпадении нескольких групп
+}
+
+// LoadConfig читает настройки OIDC из окружения. roles перечисляет роли шлюза в порядке
+// приоритета: роли из соответствия групп и роль по умолчанию должны входить в этот список.
+// Второе значение false, если OIDC не настроен
+func LoadConfig(roles []string) (Config, bool, error) {
+	config := Config{
+		Issuer:       os.Getenv(IssuerEnv),
+		ClientID:     os.Getenv(ClientIDEnv),
+		ClientSecret: os.Getenv(ClientSecretEnv),
+		RedirectURL:  os.Getenv(RedirectURLEnv),
+		GroupsClaim:  os.Getenv(GroupsClaimEnv),
+		DefaultRole:  os.Getenv(DefaultRoleEnv),
+		Roles:        roles,
+	}
+
+	if config.Issuer == "" {
+		return config, false, nil
+	}
+
+	if config.ClientID == "" || config.RedirectURL == "" {
+		return config, false, fmt.Errorf("для входа через OIDC необходимо задать %s и %s", ClientIDEnv, RedirectURLEnv)
+	}
+
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+
+	roleMap, err := ParseRoleMap(os.Getenv(RoleMapEnv))
+	if err != nil {
+		return config, false, err
+	}
+	config.RoleMap = roleMap
+
+	for _, role := range roleMap {
+		if !slices.Contains(roles, role) {
+			return config, false, fmt.Errorf("неизвестная роль %s в %s", role, RoleMapEnv)
+		}
+	}
+	if config.DefaultRole != "" && !slices.Contains(roles, config.DefaultRole) {
+		return config, false, fmt.Errorf("неизвестная роль %s в %s", config.DefaultRole, DefaultRoleEnv)
+	}
+
+	return config, true, nil
+}
+
+// ParseRoleMap разбирает соответствие групп ролям в формате "группа=роль,группа=роль"
+func ParseRoleMap(value string) (map[string]string, error) {
+	roleMap := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		group, role, ok := strings.Cut(pair, "=")
+		if !ok || group == "" || role == "" {
+			return nil, fmt.Errorf("неверный формат соответствия группы и роли: %s", pair)
+		}
+		roleMap[strings.TrimSpace(group)] = strings.TrimSpace(role)
+	}
+	return roleMap, nil
+}
+
+// Identity описывает пользователя, подтвержденного OIDC-провайдером
+type Identity struct {
+	Subject  string
+	Username string
+	Email    string
+	Groups   []string
+}
+
+// Provider выполняет вход через OpenID Connect по схеме authorization code + PKCE
+type Provider struct {
+	config   Config
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// New подключается к OIDC-провайдеру и загружает его конфигурацию (discovery).
+// Для проверки на локальном mock-провайдере достаточно указать его адрес в Issuer
+func New(ctx context.Context, config Config) (*Provider, error) {
+	provider, err := oidc.NewProvider(ctx, config.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка подключения к OIDC-провайдеру: %w", err)
+	}
+
+	return &Provider{
+		config: config,
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+	}, nil
+}
+
+// AuthCodeURL возвращает адрес перенаправления на страницу входа провайдера
+func (p *Provider) AuthCodeURL(state, nonce, codeVerifier string) string {
+	return p.oauth2.AuthCodeURL(state, oauth2.S256ChallengeOption(codeVerifier), oidc.Nonce(nonce))
+}
+
+// Exchange обменивает код авторизации на ID-токен и возвращает подтвержденную личность пользователя
+func (p *Provider) Exchange(ctx context.Context, code, nonce, codeVerifier string) (*Identity, error) {
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(codeVerifier))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка обмена кода авторизации: %w", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("провайдер не вернул ID-токен")
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка проверки ID-токена: %w", err)
+	}
+
+	if idToken.Nonce != nonce {
+		return nil, fmt.Errorf("nonce ID-токена не совпадает")
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("ошибка чтения claims ID-токена: %w", err)
+	}
+
+	identity := &Identity{
+		Subject:  idToken.Subject,
+		Username: stringClaim(claims, "preferred_username"),
+		Email:    stringClaim(claims, "email"),
+		Groups:   listClaim(claims, p.config.GroupsClaim),
+	}
+	if identity.Username == "" {
+		identity.Username = identity.Email
+	}
+	if identity.Username == "" {
+		identity.Username = identity.Subject
+	}
+
+	return identity, nil
+}
+
+// Role возвращает роль шлюза для групп пользователя. Если подходит несколько групп,
+// выбирается роль, стоящая раньше в списке Roles
+func (p *Provider) Role(groups []string) (string, bool) {
+	matched := map[string]bool{}
+	for _, group := range groups {
+		if role, ok := p.config.RoleMap[group]; ok {
+			matched[role] = true
+		}
+	}
+
+	for _, role := range p.config.Roles {
+		if matched[role] {
+			return role, true
+		}
+	}
+
+	if p.config.DefaultRole != "" {
+		return p.config.DefaultRole, true
+	}
+
+	return "", false
+}
+
+func stringClaim(claims map[string]any, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+func listClaim(claims map[string]any, name string) []string {
+	switch value := claims[name].(type) {
+	case []any:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	case string:
+		return []string{value}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package sso
+
+import "testing"
+
+func TestLoadConfigRejectsUnknownRoles(t *testing.T) {
+	roles := []string{"admin", "lead", "auditor"}
+
+	tests := []struct {
+		name        string
+		roleMap     string
+		defaultRole string
+		wantErr     bool
+	}{
+		{name: "известные роли", roleMap: "ops=lead,sre=admin", defaultRole: "auditor"},
+		{name: "без соответствия групп", roleMap: ""},
+		{name: "неизвестная роль группы", roleMap: "ops=lead,sre=superuser", wantErr: true},
+		{name: "неизвестная роль по умолчанию", roleMap: "ops=lead", defaultRole: "Admin", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(IssuerEnv, "https://idp.example.com")
+			t.Setenv(ClientIDEnv, "ssh-gate")
+			t.Setenv(RedirectURLEnv, "https://gate.example.com/api/auth/oidc/callback")
+			t.Setenv(RoleMapEnv, tt.roleMap)
+			t.Setenv(DefaultRoleEnv, tt.defaultRole)
+
+			_, enabled, err := LoadConfig(roles)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("настройки с неизвестной ролью приняты")
+				}
+				return
+			}
+			if err != nil || !enabled {
+				t.Fatalf("настройки не приняты: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+import { fetchApi } from "@/shared/utils.ts";
+
+export const login = async (credentials: { username: string; password: string }) => {
+  const response = await fetchApi('/api/auth/login', {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json'
+    },
+    body: JSON.stringify(credentials)
+  })
+  if (!response.ok) {
+    throw new Error(await response.text())
+  }
+  return response.json();
+}
+
+export const logout = async () => {
+  await fetchApi('/api/auth/logout', {
+    method: 'POST'
+  })
+  return true;
+}
+
+export const authMethodsFetch = async () => {
+  const response = await fetchApi('/api/auth/methods')
+  return response.json();
+}
+
+export const oidcLoginUrl = () => {
+  const apiUrl = import.meta.env.VITE_API_URL || '';
+  return `${apiUrl}/api/auth/oidc/login`
+}
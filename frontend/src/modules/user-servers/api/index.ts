@@ -16,11 +16,12 @@ export const userServersFetch = async (userId: number) => {
 }
 
 export const assignServer = async (payload: any) => {
-  const { userId, serverId } = payload;
+  const { userId, serverId, expiresAt } = payload;
   await fetchApi(
     `/api/users/${userId}/servers/${serverId}`,
     {
-      method: 'POST'
+      method: 'POST',
+      body: expiresAt ? JSON.stringify({ expires_at: expiresAt }) : undefined
     }
   )
   return true;
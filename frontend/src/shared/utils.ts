@@ -1,5 +1,10 @@
+import router from '@/router'
 
 export const fetchApi = async (url: any, options?: any) => {
   const apiUrl = import.meta.env.VITE_API_URL || '';
-  return await fetch(`${apiUrl}${url}`, options);
+  const response = await fetch(`${apiUrl}${url}`, { credentials: 'include', ...options });
+  if (response.status === 401 && router.currentRoute.value.path !== '/login') {
+    await router.push('/login')
+  }
+  return response;
 }